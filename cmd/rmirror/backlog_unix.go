@@ -0,0 +1,31 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenBacklog calls listen(2) again on an already listening socket,
+// which updates its accept queue length. The kernel still caps it at
+// somaxconn.
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener is not a TCP listener")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+
+	"github.com/KaranocaVe/terasu-RM/internal/mirror"
+)
+
+// certHolder serves the listener certificate through GetCertificate so a
+// reload can rotate it without restarting the listeners. Connections already
+// established keep the certificate they were handshaked with.
+type certHolder struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func newCertHolder(cfg *mirror.TLSConfig) (*certHolder, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	h := &certHolder{}
+	if _, err := h.reload(cfg); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload loads the pair from disk and swaps it in only if it parses and the
+// key matches, reporting whether the served certificate changed.
+func (h *certHolder) reload(cfg *mirror.TLSConfig) (bool, error) {
+	if cfg == nil {
+		return false, errors.New("tls cannot be disabled without a restart")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, err
+		}
+	}
+	if prev := h.cert.Load(); prev != nil && bytes.Equal(prev.Certificate[0], cert.Certificate[0]) {
+		return false, nil
+	}
+	h.cert.Store(&cert)
+	return true, nil
+}
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load(), nil
+}
+
+func (h *certHolder) leaf() *x509.Certificate {
+	return h.cert.Load().Leaf
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,11 +30,19 @@ var (
 )
 
 func main() {
-	configPath := flag.String("config", "config.json", "path to config JSON")
+	configPath := flag.String("config", "config.json", "path to config JSON (or TOML/YAML with a .toml, .yaml or .yml extension)")
 	validateOnly := flag.Bool("validate", false, "validate config and exit")
 	printDefault := flag.Bool("print-default-config", false, "print a default config to stdout")
+	format := flag.String("format", "json", "format for -print-default-config (json, toml or yaml)")
 	showVersion := flag.Bool("version", false, "print version and exit")
 	checkUpstreams := flag.Bool("check-upstreams", false, "check upstreams before serving")
+	reusePort := flag.Bool("reuse-port", false, "listen with SO_REUSEPORT so a replacement process can bind the same address")
+	dumpRouteTable := flag.Bool("dump-routes", false, "print the resolved route table as JSON, in match order, and exit")
+	var probe probeRequest
+	flag.StringVar(&probe.route, "probe-route", "", "send one request to the named route through the proxy, print the result as JSON and exit")
+	flag.StringVar(&probe.method, "probe-method", http.MethodGet, "method for -probe-route")
+	flag.StringVar(&probe.path, "probe-path", "/", "path below the route's public prefix for -probe-route")
+	flag.Var(&probe.headers, "probe-header", "request header \"Name: value\" for -probe-route (repeatable)")
 	flag.Parse()
 
 	if *showVersion {
@@ -41,9 +51,7 @@ func main() {
 	}
 	if *printDefault {
 		cfg := mirror.DefaultConfig()
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		if err := enc.Encode(cfg); err != nil {
+		if err := mirror.EncodeConfig(os.Stdout, cfg, *format); err != nil {
 			fmt.Fprintf(os.Stderr, "print default config failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -60,47 +68,71 @@ func main() {
 	if err != nil {
 		logger.Fatal("invalid config", map[string]any{"error": err.Error()})
 	}
+	mirror.SetProcessIPMode(runtime.Transport.IPMode)
 	if *validateOnly {
+		for _, d := range runtime.Deprecations {
+			logger.Warn("config field deprecated", map[string]any{"field": d.Field, "replacement": d.Replacement})
+		}
 		logger.Info("config ok", nil)
 		return
 	}
+	if *dumpRouteTable {
+		if err := dumpRoutes(runtime, os.Stdout); err != nil {
+			logger.Fatal("dump routes failed", map[string]any{"error": err.Error()})
+		}
+		return
+	}
+	if probe.route != "" {
+		if err := probeRoute(runtime, mirror.NewTransport(runtime.Transport), probe, os.Stdout); err != nil {
+			logger.Fatal("probe failed", map[string]any{"error": err.Error()})
+		}
+		return
+	}
 	logger.Info("startup", map[string]any{"version": version, "commit": commit, "date": date})
+	logger.Info("ip mode", map[string]any{"configured": runtime.Transport.IPMode, "effective": mirror.EffectiveIPMode(runtime.Transport.IPMode)})
 
 	transport := mirror.NewTransport(runtime.Transport)
 	if *checkUpstreams {
+		// A signal during the checks aborts them instead of waiting on a slow upstream.
+		checkCtx, stopChecks := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		logger.Info("upstream check started", nil)
-		if err := runUpstreamChecks(runtime, transport); err != nil {
+		err := runUpstreamChecks(checkCtx, runtime, transport)
+		interrupted := checkCtx.Err() != nil
+		stopChecks()
+		if interrupted {
+			logger.Info("upstream check interrupted", nil)
+			return
+		}
+		if err != nil {
 			logger.Fatal("upstream check failed", map[string]any{"error": err.Error()})
 		}
 		logger.Info("upstream check ok", nil)
 	}
 
 	handler := newDynamicHandler()
-	proxy, err := mirror.New(runtime, transport)
+	proxy, err := mirror.NewWithMetrics(runtime, transport, nil)
 	if err != nil {
 		logger.Fatal("failed to initialize mirror", map[string]any{"error": err.Error()})
 	}
+	if runtime.Transport.WarmupConnections {
+		warmup(proxy, runtime)
+	}
+	handler.metrics.Store(proxy.Metrics())
 	handler.Store(&activeState{runtime: runtime, transport: transport, handler: proxy.Handler()})
+	proxy.Activate()
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go runWatchdog(watchdogCtx, handler, watchdogInterval, logger)
 
-	srv := &http.Server{
-		Addr:              runtime.Listen,
-		Handler:           handler,
-		ReadHeaderTimeout: runtime.Timeouts.ReadHeaderTimeout,
-		ReadTimeout:       runtime.Timeouts.ReadTimeout,
-		WriteTimeout:      runtime.Timeouts.WriteTimeout,
-		IdleTimeout:       runtime.Timeouts.IdleTimeout,
-		MaxHeaderBytes:    runtime.Timeouts.MaxHeaderBytes,
+	certs, err := newCertHolder(runtime.TLS)
+	if err != nil {
+		logger.Fatal("load certificate failed", map[string]any{"error": err.Error()})
 	}
-
-	errCh := make(chan error, 1)
-	go func() {
-		logger.Info("listening", map[string]any{"addr": runtime.Listen})
-		if runtime.TLS != nil {
-			errCh <- srv.ListenAndServeTLS(runtime.TLS.CertFile, runtime.TLS.KeyFile)
-			return
-		}
-		errCh <- srv.ListenAndServe()
-	}()
+	listeners, err := listenAll(runtime, *reusePort, logger)
+	if err != nil {
+		logger.Fatal("listen failed", map[string]any{"error": err.Error()})
+	}
+	servers, errCh := serveAll(runtime, handler, listeners, certs, logger)
 
 	stop := make(chan os.Signal, 1)
 	reload := make(chan os.Signal, 1)
@@ -111,10 +143,22 @@ func main() {
 	go func() {
 		for range reload {
 			reloadMu.Lock()
-			if err := reloadConfig(*configPath, *checkUpstreams, handler); err != nil {
-				logger.Error("reload failed", map[string]any{"error": err.Error()})
-			} else {
-				logger.Info("reload succeeded", nil)
+			active := ""
+			if state, _ := handler.current.Load().(*activeState); state != nil {
+				active = state.runtime.ConfigHash
+			}
+			applied, err := reloadConfig(*configPath, *checkUpstreams, handler)
+			switch {
+			case err != nil:
+				logger.Error("reload rejected", map[string]any{"error": err.Error(), "kept_config_hash": active})
+			case !applied:
+				logger.Info("reload skipped", map[string]any{"reason": "config unchanged", "config_hash": active})
+			default:
+				state, _ := handler.current.Load().(*activeState)
+				logger.Info("reload succeeded", map[string]any{"config_hash": state.runtime.ConfigHash, "previous_config_hash": active})
+			}
+			if certs != nil {
+				reloadCertificate(certs, handler, logger)
 			}
 			reloadMu.Unlock()
 		}
@@ -129,21 +173,224 @@ func main() {
 		}
 	}
 
+	inflight := mirror.ProcessStats().Inflight
+	handler.stopAdmitting()
 	ctx, cancel := context.WithTimeout(context.Background(), runtime.Timeouts.ShutdownTimeout)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		logger.Error("shutdown error", map[string]any{"error": err.Error()})
+	shutdownAll(ctx, servers, logger)
+	logShutdownSummary(logger, inflight)
+}
+
+// logShutdownSummary records process totals; inflight is the count when
+// shutdown began, unfinished the count still running once it returned.
+func logShutdownSummary(logger *appLogger, inflight int64) {
+	stats := mirror.ProcessStats()
+	logger.Info("shutdown summary", map[string]any{
+		"requests":       stats.Requests,
+		"request_bytes":  stats.RequestBytes,
+		"response_bytes": stats.ResponseBytes,
+		"uptime":         stats.Uptime.Seconds(),
+		"inflight":       inflight,
+		"unfinished":     stats.Inflight,
+	})
+}
+
+// listenAll binds every configured address, closing those already bound if
+// any of them fails.
+func listenAll(runtime mirror.RuntimeConfig, reusePort bool, logger *appLogger) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(runtime.ListenAddresses))
+	for _, addr := range runtime.ListenAddresses {
+		ln, err := listen(addr, runtime, reusePort, logger)
+		if err != nil {
+			for _, prev := range listeners {
+				_ = prev.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// reloadCertificate re-reads the certificate named by the active config, so a
+// rotated file is picked up on SIGHUP even when the config itself is
+// unchanged. A pair that fails to load leaves the current one in place.
+func reloadCertificate(certs *certHolder, handler *dynamicHandler, logger *appLogger) {
+	state, _ := handler.current.Load().(*activeState)
+	if state == nil {
+		return
+	}
+	changed, err := certs.reload(state.runtime.TLS)
+	if err != nil {
+		logger.Error("certificate reload rejected", map[string]any{"error": err.Error(), "not_after": certs.leaf().NotAfter})
+		return
+	}
+	if changed {
+		logger.Info("certificate reloaded", map[string]any{"cert_file": state.runtime.TLS.CertFile, "not_after": certs.leaf().NotAfter})
 	}
 }
 
+// serveAll starts one server per listener, all sharing handler. The first
+// server to stop reports on the returned channel.
+func serveAll(runtime mirror.RuntimeConfig, handler http.Handler, listeners []net.Listener, certs *certHolder, logger *appLogger) ([]*http.Server, <-chan error) {
+	servers := make([]*http.Server, 0, len(listeners))
+	errCh := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		srv := &http.Server{
+			Addr:              ln.Addr().String(),
+			Handler:           handler,
+			ReadHeaderTimeout: runtime.Timeouts.ReadHeaderTimeout,
+			ReadTimeout:       runtime.Timeouts.ReadTimeout,
+			WriteTimeout:      runtime.Timeouts.WriteTimeout,
+			IdleTimeout:       runtime.Timeouts.IdleTimeout,
+			MaxHeaderBytes:    runtime.Timeouts.MaxHeaderBytes,
+		}
+		if certs != nil {
+			srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		}
+		if runtime.DisableHTTP2Server {
+			// A non-nil empty map stops ServeTLS from enabling h2; upstream
+			// HTTP/2 is governed separately by transport.force_http2.
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		servers = append(servers, srv)
+		go func(srv *http.Server, ln net.Listener) {
+			logger.Info("listening", map[string]any{"addr": srv.Addr})
+			if certs != nil {
+				errCh <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errCh <- srv.Serve(ln)
+		}(srv, ln)
+	}
+	return servers, errCh
+}
+
+func shutdownAll(ctx context.Context, servers []*http.Server, logger *appLogger) {
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("shutdown error", map[string]any{"addr": srv.Addr, "error": err.Error()})
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+func listen(addr string, runtime mirror.RuntimeConfig, reusePort bool, logger *appLogger) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: runtime.TCPKeepAlive}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.ListenBacklog > 0 {
+		if err := setListenBacklog(ln, runtime.ListenBacklog); err != nil {
+			logger.Error("listen backlog not applied", map[string]any{"backlog": runtime.ListenBacklog, "error": err.Error()})
+		}
+	}
+	return ln, nil
+}
+
 type activeState struct {
 	runtime   mirror.RuntimeConfig
 	transport http.RoundTripper
 	handler   http.Handler
+
+	mu       sync.Mutex
+	inflight int
+	retired  bool
+	drained  chan struct{}
+}
+
+// acquire counts a request against the state. It fails once the state is
+// retired, since its drain may already be over; the caller then picks up
+// the state that replaced it.
+func (s *activeState) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retired {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+func (s *activeState) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	if s.retired && s.inflight == 0 {
+		close(s.drained)
+	}
+}
+
+// retire marks the state as replaced and returns a channel closed once the
+// requests it is still serving have finished.
+func (s *activeState) retire() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.retired {
+		s.retired = true
+		s.drained = make(chan struct{})
+		if s.inflight == 0 {
+			close(s.drained)
+		}
+	}
+	return s.drained
+}
+
+// idleSweep serializes idle-pool sweeps so a burst of reloads under load
+// does not close connections on many retired states at once.
+var idleSweep sync.Mutex
+
+// closeIdleConnections only touches pooled connections; requests still in
+// flight on the state keep theirs, which are closed once returned to the
+// pool if the sweep has already run.
+func (s *activeState) closeIdleConnections() {
+	idleSweep.Lock()
+	defer idleSweep.Unlock()
+	if closer, ok := s.handler.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	} else if closer, ok := s.transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// drainState keeps the previous state's connections open for requests that
+// were routed to it before the reload, closing them once those requests
+// finish or the drain window expires, whichever is first. Connections still
+// busy at the deadline are closed when they become idle.
+func drainState(prev *activeState, drain time.Duration) {
+	drained := prev.retire()
+	if drain > 0 {
+		timer := time.NewTimer(drain)
+		select {
+		case <-drained:
+		case <-timer.C:
+			prev.closeIdleConnections()
+		}
+		timer.Stop()
+	}
+	<-drained
+	prev.closeIdleConnections()
 }
 
 type dynamicHandler struct {
-	current atomic.Value
+	current  atomic.Value
+	lastGood atomic.Pointer[activeState]
+	// metrics is handed from each state to the next, so reloads keep
+	// counters and /metrics serves one history.
+	metrics atomic.Pointer[mirror.Metrics]
+	// live holds every state that may still have requests queued: the ones
+	// stored and not yet retired and drained.
+	liveMu sync.Mutex
+	live   map[*activeState]struct{}
 }
 
 func newDynamicHandler() *dynamicHandler {
@@ -151,74 +398,316 @@ func newDynamicHandler() *dynamicHandler {
 }
 
 func (d *dynamicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	state, ok := d.current.Load().(*activeState)
-	if !ok || state == nil || state.handler == nil {
-		http.Error(w, "handler unavailable", http.StatusServiceUnavailable)
-		return
+	for {
+		state, ok := d.current.Load().(*activeState)
+		if !ok || state == nil || state.handler == nil {
+			http.Error(w, "handler unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if state.acquire() {
+			defer state.release()
+			state.handler.ServeHTTP(w, r)
+			return
+		}
+		if next, _ := d.current.Load().(*activeState); next == state {
+			// A retired state that is current again, restored by the
+			// watchdog, serves without holding up its finished drain.
+			state.handler.ServeHTTP(w, r)
+			return
+		}
 	}
-	state.handler.ServeHTTP(w, r)
 }
 
 func (d *dynamicHandler) Store(state *activeState) {
 	d.current.Store(state)
+	if state != nil && state.handler != nil {
+		d.lastGood.Store(state)
+		d.liveMu.Lock()
+		if d.live == nil {
+			d.live = make(map[*activeState]struct{})
+		}
+		d.live[state] = struct{}{}
+		d.liveMu.Unlock()
+	}
+}
+
+// retire retires a state a reload replaced and stops tracking it once the
+// requests it is still serving have finished.
+func (d *dynamicHandler) retire(state *activeState) <-chan struct{} {
+	drained := state.retire()
+	go func() {
+		<-drained
+		d.liveMu.Lock()
+		delete(d.live, state)
+		d.liveMu.Unlock()
+	}()
+	return drained
+}
+
+// stopAdmitting makes every live state, including those still draining
+// after a reload, reject requests queued for an inflight slot, so shutdown
+// does not wait out max_inflight_wait for them.
+func (d *dynamicHandler) stopAdmitting() {
+	d.liveMu.Lock()
+	states := make([]*activeState, 0, len(d.live)+1)
+	for state := range d.live {
+		states = append(states, state)
+	}
+	d.liveMu.Unlock()
+	// The watchdog may have restored a state that had already drained.
+	if current, _ := d.current.Load().(*activeState); current != nil {
+		states = append(states, current)
+	}
+	for _, state := range states {
+		if stopper, ok := state.handler.(interface{ StopAdmitting() }); ok {
+			stopper.StopAdmitting()
+		}
+	}
+}
+
+const watchdogInterval = 5 * time.Second
+
+func runWatchdog(ctx context.Context, handler *dynamicHandler, interval time.Duration, logger *appLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var certs certChecker
+	var recycler idleRecycler
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			handler.ensureAvailable(logger)
+			certs.maybeCheck(ctx, handler)
+			recycler.maybeRecycle(handler)
+		}
+	}
+}
+
+// certChecker runs upstream certificate checks from the watchdog loop. A
+// check is due when the interval has elapsed or the active state changed.
+type certChecker struct {
+	state   *activeState
+	last    time.Time
+	running atomic.Bool
+}
+
+func (c *certChecker) maybeCheck(ctx context.Context, handler *dynamicHandler) {
+	state, ok := handler.current.Load().(*activeState)
+	if !ok || state == nil {
+		return
+	}
+	interval := state.runtime.Transport.CertCheckInterval
+	if interval <= 0 {
+		return
+	}
+	checker, ok := state.handler.(interface{ CheckCertExpiry(context.Context) })
+	if !ok {
+		return
+	}
+	if state == c.state && time.Since(c.last) < interval {
+		return
+	}
+	if !c.running.CompareAndSwap(false, true) {
+		return
+	}
+	c.state, c.last = state, time.Now()
+	timeout := state.runtime.Transport.DialTimeout + state.runtime.Transport.TLSHandshakeTimeout + state.runtime.Transport.ResponseHeaderTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	go func() {
+		defer c.running.Store(false)
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		checker.CheckCertExpiry(checkCtx)
+	}()
+}
+
+// idleRecycler closes the active state's idle upstream connections from the
+// watchdog loop every idle_conn_recycle_interval. The schedule restarts when
+// the active state changes, since a reload starts with fresh pools.
+type idleRecycler struct {
+	state *activeState
+	last  time.Time
+}
+
+func (r *idleRecycler) maybeRecycle(handler *dynamicHandler) {
+	state, ok := handler.current.Load().(*activeState)
+	if !ok || state == nil {
+		return
+	}
+	interval := state.runtime.Transport.IdleConnRecycleInterval
+	if interval <= 0 {
+		return
+	}
+	if state != r.state {
+		r.state, r.last = state, time.Now()
+		return
+	}
+	if time.Since(r.last) < interval {
+		return
+	}
+	r.last = time.Now()
+	state.closeIdleConnections()
+}
+
+func (d *dynamicHandler) ensureAvailable(logger *appLogger) bool {
+	if state, ok := d.current.Load().(*activeState); ok && state != nil && state.handler != nil {
+		return true
+	}
+	mirror.ObserveHandlerUnavailable()
+	prev := d.lastGood.Load()
+	if prev == nil {
+		logger.Error("handler unavailable", map[string]any{"recovered": false})
+		return false
+	}
+	d.current.Store(prev)
+	logger.Error("handler unavailable", map[string]any{"recovered": true})
+	return true
 }
 
-func reloadConfig(path string, checkUpstreams bool, handler *dynamicHandler) error {
+// reloadConfig re-reads path, following symlinks, and swaps in the new
+// state only once every step has passed; on error the active state is left
+// untouched. It reports false without doing anything when the config hash
+// matches the active one.
+func reloadConfig(path string, checkUpstreams bool, handler *dynamicHandler) (bool, error) {
 	cfg, err := mirror.LoadConfig(path)
 	if err != nil {
-		return err
+		return false, err
 	}
 	runtime, err := cfg.Runtime()
 	if err != nil {
-		return err
+		return false, err
+	}
+	prev, _ := handler.current.Load().(*activeState)
+	if prev != nil && prev.runtime.ConfigHash == runtime.ConfigHash {
+		return false, nil
 	}
 	transport := mirror.NewTransport(runtime.Transport)
 	if checkUpstreams {
-		if err := runUpstreamChecks(runtime, transport); err != nil {
-			return err
+		if err := runUpstreamChecks(context.Background(), runtime, transport); err != nil {
+			return false, err
 		}
 	}
-	proxy, err := mirror.New(runtime, transport)
+	proxy, err := mirror.NewWithMetrics(runtime, transport, handler.metrics.Load())
 	if err != nil {
-		return err
+		return false, err
+	}
+	handler.metrics.Store(proxy.Metrics())
+	if runtime.Transport.WarmupConnections {
+		warmup(proxy, runtime)
 	}
 	next := &activeState{runtime: runtime, transport: transport, handler: proxy.Handler()}
-	prev, _ := handler.current.Load().(*activeState)
 	handler.Store(next)
-	if prev != nil {
-		if closer, ok := prev.transport.(interface{ CloseIdleConnections() }); ok {
-			closer.CloseIdleConnections()
+	proxy.Activate()
+	if prev != nil && prev != next {
+		handler.retire(prev)
+		if runtime.Timeouts.ReloadDrain > 0 {
+			go drainState(prev, runtime.Timeouts.ReloadDrain)
+		} else {
+			go prev.closeIdleConnections()
 		}
 	}
-	return nil
+	return true, nil
 }
 
-func runUpstreamChecks(runtime mirror.RuntimeConfig, transport http.RoundTripper) error {
-	timeout := runtime.Transport.ResponseHeaderTimeout
+func warmup(proxy *mirror.Mirror, runtime mirror.RuntimeConfig) {
+	timeout := runtime.Transport.DialTimeout + runtime.Transport.TLSHandshakeTimeout + runtime.Transport.ResponseHeaderTimeout
 	if timeout <= 0 {
 		timeout = 10 * time.Second
 	}
-	client := &http.Client{Transport: transport, Timeout: timeout}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	proxy.Warmup(ctx)
+}
+
+func runUpstreamChecks(ctx context.Context, runtime mirror.RuntimeConfig, transport http.RoundTripper) error {
+	checkTimeout := func(rt mirror.RuntimeTransport) time.Duration {
+		if rt.ResponseHeaderTimeout <= 0 {
+			return 10 * time.Second
+		}
+		return rt.ResponseHeaderTimeout
+	}
+	// Routes with transport overrides are checked through a transport of
+	// their own, as the mirror sends their requests.
+	clients := map[string]*http.Client{"": {Transport: transport, Timeout: checkTimeout(runtime.Transport)}}
+	defer func() {
+		for key, client := range clients {
+			if key != "" {
+				client.CloseIdleConnections()
+			}
+		}
+	}()
 	var failures []string
+	seen := make(map[upstreamProbe]struct{})
 	for _, route := range runtime.Routes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		transportKey := ""
+		if rt, overridden := runtime.RouteTransport(route); overridden {
+			transportKey = fmt.Sprintf("%+v", rt)
+			if _, ok := clients[transportKey]; !ok {
+				clients[transportKey] = &http.Client{Transport: mirror.NewTransport(rt), Timeout: checkTimeout(rt)}
+			}
+		}
 		target, err := parseUpstreamURL(route.Upstream)
 		if err != nil {
 			failures = append(failures, err.Error())
 			continue
 		}
-		if target.Path == "" {
-			target.Path = "/"
+		if route.UpstreamScheme != "" {
+			target.Scheme = route.UpstreamScheme
+		}
+		// Routes sharing an upstream host are probed once per pass, at its
+		// root unless they ask for a specific health path. Nothing carries
+		// over between passes, so every reload sees the upstream as it is.
+		probe := upstreamProbe{
+			target:       target.Scheme + "://" + target.Host + "/",
+			expectStatus: route.ExpectStatus,
+			expectBody:   route.ExpectBodyContains,
+			transport:    transportKey,
+		}
+		if route.HealthPath != "" {
+			probe.target = target.Scheme + "://" + target.Host + route.HealthPath
 		}
-		if err := checkUpstream(client, target.String()); err != nil {
-			failures = append(failures, target.String()+": "+err.Error())
+		if _, ok := seen[probe]; ok {
+			continue
+		}
+		seen[probe] = struct{}{}
+		if err := probe.check(ctx, clients[transportKey]); err != nil {
+			failures = append(failures, probe.target+": "+err.Error())
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if len(failures) > 0 {
 		return errors.New(strings.Join(failures, "; "))
 	}
 	return nil
 }
 
+// upstreamProbe is one upstream check. Without expectations any status
+// below 500 passes; otherwise the probe is a GET whose status and body must
+// match.
+type upstreamProbe struct {
+	target       string
+	expectStatus int
+	expectBody   string
+	transport    string
+}
+
+const maxProbeBody = 64 << 10
+
+func (p upstreamProbe) check(ctx context.Context, client *http.Client) error {
+	if p.expectStatus != 0 || p.expectBody != "" {
+		return checkUpstreamExpect(ctx, client, p)
+	}
+	return checkUpstream(ctx, client, p.target)
+}
+
 func parseUpstreamURL(raw string) (*url.URL, error) {
 	candidate := strings.TrimSpace(raw)
 	if candidate == "" {
@@ -240,12 +729,12 @@ func parseUpstreamURL(raw string) (*url.URL, error) {
 	return u, nil
 }
 
-func checkUpstream(client *http.Client, target string) error {
+func checkUpstream(parent context.Context, client *http.Client, target string) error {
 	timeout := client.Timeout
 	if timeout <= 0 {
 		timeout = 10 * time.Second
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
@@ -258,7 +747,10 @@ func checkUpstream(client *http.Client, target string) error {
 			io.Copy(io.Discard, resp.Body)
 			resp.Body.Close()
 		}
-		ctx2, cancel2 := context.WithTimeout(context.Background(), timeout)
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		ctx2, cancel2 := context.WithTimeout(parent, timeout)
 		defer cancel2()
 		req, err = http.NewRequestWithContext(ctx2, http.MethodGet, target, nil)
 		if err != nil {
@@ -280,6 +772,47 @@ func checkUpstream(client *http.Client, target string) error {
 	return nil
 }
 
+func checkUpstreamExpect(parent context.Context, client *http.Client, probe upstreamProbe) error {
+	timeout := client.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	// A 3xx expectation is checked against the redirect itself.
+	if probe.expectStatus >= 300 && probe.expectStatus < 400 {
+		noFollow := *client
+		noFollow.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		client = &noFollow
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+	if err != nil {
+		return err
+	}
+	switch {
+	case probe.expectStatus != 0 && resp.StatusCode != probe.expectStatus:
+		return fmt.Errorf("upstream returned %s, expected %d", resp.Status, probe.expectStatus)
+	case probe.expectStatus == 0 && resp.StatusCode >= 500:
+		return errors.New("upstream returned " + resp.Status)
+	}
+	if probe.expectBody != "" && !strings.Contains(string(body), probe.expectBody) {
+		return fmt.Errorf("upstream body does not contain %q", probe.expectBody)
+	}
+	return nil
+}
+
 type appLogger struct {
 	logger *log.Logger
 }
@@ -292,6 +825,10 @@ func (l *appLogger) Info(msg string, fields map[string]any) {
 	l.log("info", msg, fields)
 }
 
+func (l *appLogger) Warn(msg string, fields map[string]any) {
+	l.log("warn", msg, fields)
+}
+
 func (l *appLogger) Error(msg string, fields map[string]any) {
 	l.log("error", msg, fields)
 }
@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KaranocaVe/terasu-RM/internal/mirror"
+)
+
+func TestWatchdogRestoresLastGoodState(t *testing.T) {
+	handler := newDynamicHandler()
+	handler.Store(&activeState{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})})
+	handler.current.Store((*activeState)(nil))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with nil state, got %d", rec.Code)
+	}
+
+	if !handler.ensureAvailable(newAppLogger()) {
+		t.Fatal("expected watchdog to restore the last good state")
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after recovery, got %d", rec.Code)
+	}
+}
+
+func TestWatchdogWithoutLastGoodState(t *testing.T) {
+	handler := newDynamicHandler()
+	handler.current.Store((*activeState)(nil))
+	if handler.ensureAvailable(newAppLogger()) {
+		t.Fatal("expected recovery to fail without a previous state")
+	}
+}
+
+func writeMirrorConfig(t *testing.T, path, upstream string) {
+	t.Helper()
+	cfg := mirror.DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Timeouts.ReloadDrain = "5s"
+	cfg.Routes = []mirror.RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream}}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func TestReloadThroughSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	writeMirrorConfig(t, filepath.Join(dir, "v1.json"), "https://registry-1.docker.io")
+	writeMirrorConfig(t, filepath.Join(dir, "v2.json"), "https://registry-1.docker.io")
+	writeMirrorConfig(t, filepath.Join(dir, "v4.json"), "https://ghcr.io")
+	if err := os.WriteFile(filepath.Join(dir, "v3.json"), []byte(`{"routes":[]}`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	path := filepath.Join(dir, "config.json")
+	swap := func(target string) {
+		t.Helper()
+		tmp := filepath.Join(dir, "config.json.tmp")
+		if err := os.Symlink(target, tmp); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("rename: %v", err)
+		}
+	}
+
+	handler := newDynamicHandler()
+	swap("v1.json")
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("initial load: applied=%v err=%v", applied, err)
+	}
+	first, _ := handler.current.Load().(*activeState)
+
+	swap("v2.json")
+	if applied, err := reloadConfig(path, false, handler); err != nil || applied {
+		t.Fatalf("identical content: applied=%v err=%v", applied, err)
+	}
+	if state, _ := handler.current.Load().(*activeState); state != first {
+		t.Fatal("identical content replaced the active state")
+	}
+
+	swap("v3.json")
+	if applied, err := reloadConfig(path, false, handler); err == nil || applied {
+		t.Fatalf("invalid content: applied=%v err=%v", applied, err)
+	}
+	if state, _ := handler.current.Load().(*activeState); state != first {
+		t.Fatal("invalid content replaced the active state")
+	}
+
+	swap("v4.json")
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("changed content: applied=%v err=%v", applied, err)
+	}
+	if state, _ := handler.current.Load().(*activeState); state == first || state.runtime.Routes[0].Upstream != "https://ghcr.io" {
+		t.Fatal("changed content was not applied")
+	}
+}
+
+func TestReloadAppliesRotatedCAFile(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeTestCert(t, dir)
+	cfg := mirror.DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []mirror.RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: "https://registry-1.docker.io", Transport: &mirror.RouteTransportConfig{CAFile: caFile}}}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	handler := newDynamicHandler()
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("initial load: applied=%v err=%v", applied, err)
+	}
+	if applied, err := reloadConfig(path, false, handler); err != nil || applied {
+		t.Fatalf("unchanged CA file: applied=%v err=%v", applied, err)
+	}
+	first, _ := handler.current.Load().(*activeState)
+
+	writeTestCert(t, dir)
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("rotated CA file: applied=%v err=%v", applied, err)
+	}
+	if state, _ := handler.current.Load().(*activeState); state == first {
+		t.Fatal("rotated CA file was not applied")
+	}
+}
+
+func TestReloadDrainFinishesRequestsOnPreviousState(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	oldUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("old"))
+	}))
+	defer oldUpstream.Close()
+	newUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	}))
+	defer newUpstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeMirrorConfig(t, path, oldUpstream.URL)
+	handler := newDynamicHandler()
+	if _, err := reloadConfig(path, false, handler); err != nil {
+		t.Fatalf("initial load: %v", err)
+	}
+	first, _ := handler.current.Load().(*activeState)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	get := func() (string, error) {
+		resp, err := http.Get(srv.URL + "/v2/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	longBody := make(chan string, 1)
+	go func() {
+		body, err := get()
+		if err != nil {
+			body = err.Error()
+		}
+		longBody <- body
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("long request did not reach the old upstream")
+	}
+
+	writeMirrorConfig(t, path, newUpstream.URL)
+	if _, err := reloadConfig(path, false, handler); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if body, err := get(); err != nil || body != "new" {
+		t.Fatalf("expected new request to use the new config, got %q (%v)", body, err)
+	}
+	select {
+	case <-first.retire():
+		t.Fatal("previous state drained while a request was still in flight")
+	default:
+	}
+
+	close(release)
+	if body := <-longBody; body != "old" {
+		t.Fatalf("expected long request to finish on the old upstream, got %q", body)
+	}
+	select {
+	case <-first.retire():
+	case <-time.After(5 * time.Second):
+		t.Fatal("previous state did not drain after its request finished")
+	}
+}
+
+// queuedHandler holds every request until StopAdmitting, like a Mirror
+// with requests queued for an inflight slot.
+type queuedHandler struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func (h *queuedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	<-h.stop
+	http.Error(w, "shutting down", http.StatusServiceUnavailable)
+}
+
+func (h *queuedHandler) StopAdmitting() {
+	h.once.Do(func() { close(h.stop) })
+}
+
+func TestStopAdmittingReachesDrainingStates(t *testing.T) {
+	handler := newDynamicHandler()
+	old := &activeState{handler: &queuedHandler{stop: make(chan struct{})}}
+	handler.Store(old)
+	queued := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		queued <- rec.Code
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		old.mu.Lock()
+		inflight := old.inflight
+		old.mu.Unlock()
+		if inflight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request never reached the old state")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	handler.Store(&activeState{handler: &queuedHandler{stop: make(chan struct{})}})
+	drained := handler.retire(old)
+	handler.stopAdmitting()
+	select {
+	case code := <-queued:
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 for the queued request, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request queued on the replaced state was not released")
+	}
+	<-drained
+}
+
+func TestReloadLoopWithConcurrentRequests(t *testing.T) {
+	handler := newDynamicHandler()
+	newState := func() *activeState {
+		return &activeState{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+	}
+	handler.Store(newState())
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				if rec.Code != http.StatusOK {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2000; i++ {
+		prev, _ := handler.current.Load().(*activeState)
+		handler.Store(newState())
+		// A zero drain window: retire closes drained at once when idle.
+		go drainState(prev, 0)
+	}
+	close(stop)
+	wg.Wait()
+	if n := failures.Load(); n != 0 {
+		t.Fatalf("expected every request to be served across reloads, %d failed", n)
+	}
+
+	// The window the loop aims at: a request that loaded a state which was
+	// retired, and drained, before it could acquire it.
+	retired := newState()
+	<-retired.retire()
+	if retired.acquire() {
+		t.Fatal("expected acquire to fail on a retired state")
+	}
+}
+
+func TestReloadUnderLoadClosesIdleConnections(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(name string) {
+		t.Helper()
+		cfg := mirror.DefaultConfig()
+		cfg.AccessLog = false
+		cfg.Routes = []mirror.RouteConfig{{Name: name, PublicPrefix: "/", Upstream: upstream.URL}}
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("marshal config: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	write("v0")
+	handler := newDynamicHandler()
+	if _, err := reloadConfig(path, false, handler); err != nil {
+		t.Fatalf("initial load: %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	before := idleClosedTotal(t, srv.URL)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var requests, failures atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := http.Get(srv.URL + "/pkg")
+				requests.Add(1)
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		write(fmt.Sprintf("v%d", i))
+		if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+			t.Fatalf("reload %d: applied=%v err=%v", i, applied, err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if n := failures.Load(); n > 0 {
+		t.Fatalf("%d of %d requests failed during reloads", n, requests.Load())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for idleClosedTotal(t, srv.URL) <= before {
+		if time.Now().After(deadline) {
+			t.Fatal("expected idle connections closed by reloads to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleConnRecycleInterval(t *testing.T) {
+	var closed atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	cfg := mirror.DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Transport.IdleConnRecycleInterval = "50ms"
+	cfg.Routes = []mirror.RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	handler := newDynamicHandler()
+	if _, err := reloadConfig(path, false, handler); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runWatchdog(ctx, handler, 10*time.Millisecond, newAppLogger())
+
+	before := idleClosedTotal(t, srv.URL)
+	for round := int64(1); round <= 2; round++ {
+		resp, err := http.Get(srv.URL + "/pkg")
+		if err != nil {
+			t.Fatalf("request %d: %v", round, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for closed.Load() < round {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected idle upstream connection to be recycled in round %d", round)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if got := idleClosedTotal(t, srv.URL); got < before+2 {
+		t.Fatalf("expected at least 2 recycled connections counted, got %v", got-before)
+	}
+}
+
+func TestReloadKeepsMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(prefix string, buckets []float64) {
+		cfg := mirror.DefaultConfig()
+		cfg.AccessLog = false
+		cfg.LogLevel = "error"
+		cfg.ResponseSizeBuckets = buckets
+		cfg.Routes = []mirror.RouteConfig{{Name: "root", PublicPrefix: prefix, Upstream: upstream.URL}}
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("marshal config: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	handler := newDynamicHandler()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	get := func(path string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	writeConfig("/", nil)
+	if _, err := reloadConfig(path, false, handler); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	get("/a")
+	get("/b")
+	if got := scrapeMetric(t, srv.URL, "rmirror_requests_total"); got != 2 {
+		t.Fatalf("expected 2 requests before reload, got %v", got)
+	}
+
+	writeConfig("/pkg", nil)
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("reload: applied=%v err=%v", applied, err)
+	}
+	get("/pkg/c")
+	if got := scrapeMetric(t, srv.URL, "rmirror_requests_total"); got != 3 {
+		t.Fatalf("expected counters to carry over the reload, got %v", got)
+	}
+	if got := scrapeMetric(t, srv.URL, "rmirror_config_info"); got != 1 {
+		t.Fatalf("expected a single config_info series after reload, got %v", got)
+	}
+
+	// Histogram buckets cannot change in place, so new buckets start over.
+	writeConfig("/pkg", []float64{1024, 1 << 20})
+	if applied, err := reloadConfig(path, false, handler); err != nil || !applied {
+		t.Fatalf("reload: applied=%v err=%v", applied, err)
+	}
+	get("/pkg/d")
+	if got := scrapeMetric(t, srv.URL, "rmirror_requests_total"); got != 1 {
+		t.Fatalf("expected a fresh registry after response_size_buckets changed, got %v", got)
+	}
+}
+
+func idleClosedTotal(t *testing.T, base string) float64 {
+	t.Helper()
+	return scrapeMetric(t, base, "rmirror_idle_connections_closed_total")
+}
+
+// scrapeMetric sums every series of the named metric served at base.
+func scrapeMetric(t *testing.T, base, name string) float64 {
+	t.Helper()
+	resp, err := http.Get(base + "/metrics")
+	if err != nil {
+		t.Fatalf("metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	total, found := 0.0, false
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(line, name+" ") && !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+		n, err := strconv.ParseFloat(line[strings.LastIndexByte(line, ' ')+1:], 64)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		total += n
+		found = true
+	}
+	if !found {
+		t.Fatalf("%s not exported", name)
+	}
+	return total
+}
+
+func TestUpstreamChecksProbeEachHostOnce(t *testing.T) {
+	var probes int32
+	newUpstream := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&probes, 1)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	registry := newUpstream()
+	defer registry.Close()
+	blob := newUpstream()
+	defer blob.Close()
+
+	cfg := mirror.DefaultConfig()
+	cfg.Routes = []mirror.RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "registry-v1", PublicPrefix: "/v1", Upstream: registry.URL + "/v1"},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	transport := mirror.NewTransport(runtime.Transport)
+	for i := 1; i <= 2; i++ {
+		if err := runUpstreamChecks(context.Background(), runtime, transport); err != nil {
+			t.Fatalf("upstream checks: %v", err)
+		}
+		// Each pass probes both hosts again rather than reusing the last
+		// pass's results.
+		if got := atomic.LoadInt32(&probes); got != int32(2*i) {
+			t.Fatalf("pass %d: expected 2 probes for 2 hosts per pass, got %d in total", i, got)
+		}
+	}
+}
+
+func TestUpstreamChecksUseRouteTransport(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+
+	// Only the route's own transport trusts the upstream's certificate.
+	cfg := mirror.DefaultConfig()
+	cfg.Routes = []mirror.RouteConfig{{
+		Name:         "private",
+		PublicPrefix: "/",
+		Upstream:     upstream.URL,
+		Transport:    &mirror.RouteTransportConfig{CAFile: caFile},
+	}}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	if err := runUpstreamChecks(context.Background(), runtime, mirror.NewTransport(runtime.Transport)); err != nil {
+		t.Fatalf("expected the check to go through the route transport, got %v", err)
+	}
+}
+
+func TestUpstreamChecksExpectations(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status":"ok"}`))
+			return
+		case "/login":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+			return
+		}
+		w.Write([]byte("<html>maintenance</html>"))
+	}))
+	defer upstream.Close()
+
+	check := func(route mirror.RouteConfig) error {
+		t.Helper()
+		cfg := mirror.DefaultConfig()
+		route.Name, route.PublicPrefix, route.Upstream = "registry", "/", upstream.URL
+		cfg.Routes = []mirror.RouteConfig{route}
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		return runUpstreamChecks(context.Background(), runtime, mirror.NewTransport(runtime.Transport))
+	}
+	if err := check(mirror.RouteConfig{}); err != nil {
+		t.Fatalf("default check should pass any non-5xx, got %v", err)
+	}
+	if err := check(mirror.RouteConfig{ExpectBodyContains: `"status":"ok"`}); err == nil || !strings.Contains(err.Error(), "does not contain") {
+		t.Fatalf("expected wrong body to fail, got %v", err)
+	}
+	if err := check(mirror.RouteConfig{HealthPath: "/healthz", ExpectStatus: http.StatusNoContent}); err == nil || !strings.Contains(err.Error(), "expected 204") {
+		t.Fatalf("expected wrong status to fail, got %v", err)
+	}
+	if err := check(mirror.RouteConfig{HealthPath: "/healthz", ExpectStatus: http.StatusOK, ExpectBodyContains: `"status":"ok"`}); err != nil {
+		t.Fatalf("expected health path check to pass, got %v", err)
+	}
+	if err := check(mirror.RouteConfig{HealthPath: "/login", ExpectStatus: http.StatusFound}); err != nil {
+		t.Fatalf("expected the redirect itself to be checked, got %v", err)
+	}
+}
+
+func TestDumpRoutes(t *testing.T) {
+	cfg := mirror.DefaultConfig()
+	cfg.Routes = []mirror.RouteConfig{
+		{Name: "root", PublicPrefix: "/", Upstream: "https://example.com"},
+		{Name: "registry", PublicPrefix: "/v2/", Upstream: "https://registry-1.docker.io/v2", PreserveHost: true},
+		{Name: "library", PublicPrefix: "/v2/library", Upstream: "https://registry-1.docker.io/v2/library/"},
+		{Name: "ghcr", PublicHost: "ghcr.example.com", PublicPrefix: "/", Upstream: "https://ghcr.io"},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	var out bytes.Buffer
+	if err := dumpRoutes(runtime, &out); err != nil {
+		t.Fatalf("dump routes: %v", err)
+	}
+	var table []mirror.RouteInfo
+	if err := json.Unmarshal(out.Bytes(), &table); err != nil {
+		t.Fatalf("decode %s: %v", out.String(), err)
+	}
+	var names []string
+	for i, info := range table {
+		if info.Order != i+1 {
+			t.Fatalf("expected order %d for %s, got %d", i+1, info.Name, info.Order)
+		}
+		names = append(names, info.Name)
+	}
+	if got := strings.Join(names, ","); got != "ghcr,library,registry,root" {
+		t.Fatalf("expected host route first, then longest prefix first, got %s", got)
+	}
+	registry := table[2]
+	if registry.PublicPrefix != "/v2" || registry.UpstreamScheme != "https" || registry.UpstreamHost != "registry-1.docker.io" || registry.UpstreamBasePath != "/v2" || !registry.PreserveHost {
+		t.Fatalf("unexpected registry entry: %+v", registry)
+	}
+	if table[1].UpstreamBasePath != "/v2/library" || table[0].PublicHost != "ghcr.example.com" {
+		t.Fatalf("unexpected entries: %+v", table[:2])
+	}
+}
+
+func TestProbeRoute(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.Header.Get("Accept") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", blob.URL+"/data"+r.URL.Path)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	cfg := mirror.DefaultConfig()
+	cfg.Routes = []mirror.RouteConfig{
+		{Name: "registry", PublicPrefix: "/v2", Upstream: registry.URL + "/v2"},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	var out bytes.Buffer
+	probe := probeRequest{
+		route:   "registry",
+		method:  http.MethodHead,
+		path:    "/library/alpine/manifests/latest",
+		headers: headerFlags{"Accept: application/json", "Host: mirror.example.com"},
+	}
+	if err := probeRoute(runtime, mirror.NewTransport(runtime.Transport), probe, &out); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	var result routeProbeResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("decode %s: %v", out.String(), err)
+	}
+	if result.Status != http.StatusTemporaryRedirect || result.URL != "http://mirror.example.com/v2/library/alpine/manifests/latest" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if got, want := result.Headers["Location"], "http://mirror.example.com/_blob/data/v2/library/alpine/manifests/latest"; len(got) != 1 || got[0] != want {
+		t.Fatalf("unexpected Location %v, want %q", got, want)
+	}
+
+	probe.route = "missing"
+	if err := probeRoute(runtime, mirror.NewTransport(runtime.Transport), probe, &out); err == nil {
+		t.Fatal("expected unknown route error")
+	}
+}
+
+func TestUpstreamChecksAbortOnCancel(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	cfg := mirror.DefaultConfig()
+	cfg.Routes = []mirror.RouteConfig{{Name: "slow", PublicPrefix: "/", Upstream: upstream.URL + "/slow-check"}}
+	cfg.Transport.ResponseHeaderTimeout = "30s"
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err = runUpstreamChecks(ctx, runtime, mirror.NewTransport(runtime.Transport))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("upstream checks took %v after cancel", elapsed)
+	}
+}
+
+func TestListenWithCustomBacklog(t *testing.T) {
+	cfg := mirror.DefaultConfig()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.ListenBacklog = 16
+	cfg.TCPKeepAlive = "30s"
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	var logs strings.Builder
+	ln, err := listen(runtime.Listen, runtime, false, &appLogger{logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected log output: %s", logs.String())
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	cfg := mirror.DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []mirror.RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	proxy, err := mirror.New(runtime, mirror.NewTransport(runtime.Transport))
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	before := mirror.ProcessStats()
+	srv := httptest.NewServer(proxy.Handler())
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL + "/")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	srv.Close()
+
+	var logs strings.Builder
+	logShutdownSummary(&appLogger{logger: log.New(&logs, "", 0)}, 0)
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+		t.Fatalf("decode summary %q: %v", logs.String(), err)
+	}
+	if entry["msg"] != "shutdown summary" {
+		t.Fatalf("unexpected log message: %v", entry["msg"])
+	}
+	if got := entry["requests"].(float64); got-float64(before.Requests) < 3 {
+		t.Fatalf("expected at least 3 new requests, got %v (before %d)", got, before.Requests)
+	}
+	if got := entry["response_bytes"].(float64); got-float64(before.ResponseBytes) < 15 {
+		t.Fatalf("expected at least 15 new response bytes, got %v", got)
+	}
+	for _, field := range []string{"request_bytes", "uptime", "inflight", "unfinished"} {
+		if _, ok := entry[field]; !ok {
+			t.Fatalf("summary missing %q: %v", field, entry)
+		}
+	}
+}
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestDisableHTTP2Server(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	for _, disable := range []bool{false, true} {
+		cfg := mirror.DefaultConfig()
+		cfg.Listen = "127.0.0.1:0"
+		cfg.TLS = &mirror.TLSConfig{CertFile: certFile, KeyFile: keyFile}
+		cfg.DisableHTTP2Server = disable
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		logger := &appLogger{logger: log.New(io.Discard, "", 0)}
+		listeners, err := listenAll(runtime, false, logger)
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+		certs, err := newCertHolder(runtime.TLS)
+		if err != nil {
+			t.Fatalf("load certificate: %v", err)
+		}
+		servers, _ := serveAll(runtime, handler, listeners, certs, logger)
+
+		client := &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://" + listeners[0].Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "HTTP/2.0"
+		if disable {
+			want = "HTTP/1.1"
+		}
+		if resp.Proto != want || string(body) != want {
+			t.Fatalf("disable=%v: expected %s, got %s (server saw %s)", disable, want, resp.Proto, body)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		shutdownAll(ctx, servers, logger)
+		cancel()
+	}
+}
+
+func TestReloadRotatesCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	cfg := mirror.DefaultConfig()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.TLS = &mirror.TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	handler := newDynamicHandler()
+	handler.Store(&activeState{runtime: runtime, handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})})
+	var logs bytes.Buffer
+	logger := &appLogger{logger: log.New(&logs, "", 0)}
+	certs, err := newCertHolder(runtime.TLS)
+	if err != nil {
+		t.Fatalf("load certificate: %v", err)
+	}
+	listeners, err := listenAll(runtime, false, logger)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	servers, _ := serveAll(runtime, handler, listeners, certs, logger)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdownAll(ctx, servers, logger)
+	}()
+
+	url := "https://" + listeners[0].Addr().String() + "/"
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	served := func(client *http.Client) []byte {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Raw
+	}
+	kept := newClient()
+	original := served(kept)
+
+	writeTestCert(t, dir)
+	reloadCertificate(certs, handler, logger)
+	rotated := served(newClient())
+	if bytes.Equal(rotated, original) {
+		t.Fatal("new connections still present the original certificate")
+	}
+	if !strings.Contains(logs.String(), "certificate reloaded") {
+		t.Fatalf("expected reload to be logged, got %q", logs.String())
+	}
+	if got := served(kept); !bytes.Equal(got, original) {
+		t.Fatal("established connection was not kept across the rotation")
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	reloadCertificate(certs, handler, logger)
+	if !strings.Contains(logs.String(), "certificate reload rejected") {
+		t.Fatalf("expected invalid pair to be rejected, got %q", logs.String())
+	}
+	if got := served(newClient()); !bytes.Equal(got, rotated) {
+		t.Fatal("invalid pair replaced the served certificate")
+	}
+}
+
+func TestServeMultipleListenAddresses(t *testing.T) {
+	cfg := mirror.DefaultConfig()
+	cfg.Listen = ""
+	cfg.ListenAddresses = []string{"127.0.0.1:0", "127.0.0.1:0"}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	logger := &appLogger{logger: log.New(io.Discard, "", 0)}
+	listeners, err := listenAll(runtime, false, logger)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	servers, errCh := serveAll(runtime, handler, listeners, nil, logger)
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(servers))
+	}
+
+	for _, ln := range listeners {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("get %s: %v", ln.Addr(), err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("unexpected status from %s: %d", ln.Addr(), resp.StatusCode)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdownAll(ctx, servers, logger)
+	for range servers {
+		if err := <-errCh; err != http.ErrServerClosed {
+			t.Fatalf("expected server closed, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KaranocaVe/terasu-RM/internal/mirror"
+)
+
+// headerFlags collects repeated -probe-header "Name: value" flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return errors.New("header must be \"Name: value\"")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+type probeRequest struct {
+	route   string
+	method  string
+	path    string
+	headers headerFlags
+}
+
+type routeProbeResult struct {
+	Route      string              `json:"route"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Status     int                 `json:"status"`
+	Headers    map[string][]string `json:"headers"`
+	BodyBytes  int64               `json:"body_bytes"`
+	DurationMS float64             `json:"duration_ms"`
+}
+
+// probeRoute sends one request for the named route through the full proxy,
+// with the configured transport and response rewriting, and writes the
+// outcome to w as JSON.
+func probeRoute(runtime mirror.RuntimeConfig, transport http.RoundTripper, probe probeRequest, w io.Writer) error {
+	var target *mirror.RouteConfig
+	for i := range runtime.Routes {
+		if runtime.Routes[i].Name == probe.route {
+			target = &runtime.Routes[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("unknown route %q", probe.route)
+	}
+	runtime.AccessLog = false
+	proxy, err := mirror.New(runtime, transport)
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(target.PublicPrefix, "/") + "/" + strings.TrimPrefix(probe.path, "/")
+	req, err := http.NewRequest(probe.method, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	if target.PublicHost != "" && !strings.HasPrefix(target.PublicHost, "*") {
+		req.Host = target.PublicHost
+	}
+	for _, header := range probe.headers {
+		name, value, _ := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(name, value)
+	}
+
+	rec := &probeRecorder{header: make(http.Header)}
+	start := time.Now()
+	proxy.Handler().ServeHTTP(rec, req)
+	elapsed := time.Since(start)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(routeProbeResult{
+		Route:      target.Name,
+		Method:     req.Method,
+		URL:        "http://" + req.Host + req.URL.RequestURI(),
+		Status:     rec.status,
+		Headers:    rec.header,
+		BodyBytes:  rec.bytes,
+		DurationMS: float64(elapsed.Microseconds()) / 1000,
+	})
+}
+
+// probeRecorder captures the status and headers and counts the body.
+type probeRecorder struct {
+	header http.Header
+	status int
+	bytes  int64
+}
+
+func (r *probeRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *probeRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *probeRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.bytes += int64(len(p))
+	return len(p), nil
+}
+
+func (r *probeRecorder) Flush() {}
+
+// dumpRoutes writes the route table of runtime to w as JSON, in match order.
+func dumpRoutes(runtime mirror.RuntimeConfig, w io.Writer) error {
+	table, err := mirror.RouteTable(runtime)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(table)
+}
@@ -2,21 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -58,6 +66,10 @@ func main() {
 	if err != nil {
 		logger.Fatal("invalid config", map[string]any{"error": err.Error()})
 	}
+	configHash, err := daemonConfigHash(*configPath, runtimeCfg)
+	if err != nil {
+		logger.Fatal("load config failed", map[string]any{"error": err.Error()})
+	}
 	if *validateOnly {
 		logger.Info("config ok", nil)
 		return
@@ -68,6 +80,18 @@ func main() {
 	if err := supervisor.Apply(runtimeCfg); err != nil {
 		logger.Fatal("start failed", map[string]any{"error": err.Error()})
 	}
+	if runtimeCfg.requireInitialStart {
+		// Only the initial start is fatal; instances failing after a reload
+		// are left to the restart policy.
+		started, failed := supervisor.waitStarted(runtimeCfg.initialStartTimeout)
+		for name, err := range failed {
+			logger.Error("instance did not start", map[string]any{"name": name, "error": err.Error()})
+		}
+		if started == 0 {
+			supervisor.StopAll(runtimeCfg.shutdownTimeout)
+			logger.Fatal("no instances started", map[string]any{"instances": len(failed), "timeout": runtimeCfg.initialStartTimeout.String()})
+		}
+	}
 
 	stop := make(chan os.Signal, 1)
 	reload := make(chan os.Signal, 1)
@@ -76,50 +100,187 @@ func main() {
 		signal.Notify(reload, syscall.SIGHUP)
 	}
 
-	var reloadMu sync.Mutex
+	reloads := newReloader(logger, runtimeCfg, configHash, func() (daemonRuntime, string, error) {
+		cfg, err := loadDaemonConfig(*configPath)
+		if err != nil {
+			return daemonRuntime{}, "", err
+		}
+		next, err := cfg.runtime(*configPath)
+		if err != nil {
+			return daemonRuntime{}, "", err
+		}
+		hash, err := daemonConfigHash(*configPath, next)
+		if err != nil {
+			return daemonRuntime{}, "", err
+		}
+		return next, hash, nil
+	}, supervisor.Apply)
+	var statusSrv *http.Server
+	if runtimeCfg.statusListen != "" {
+		statusSrv = &http.Server{
+			Addr:              runtimeCfg.statusListen,
+			Handler:           newStatusHandler(supervisor, reloads.load),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			logger.Info("status listening", map[string]any{"addr": runtimeCfg.statusListen})
+			if err := statusSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("status server failed", map[string]any{"error": err.Error()})
+			}
+		}()
+	}
+
 	for {
 		select {
 		case sig := <-stop:
 			logger.Info("signal received", map[string]any{"signal": sig.String()})
-			supervisor.StopAll(runtimeCfg.shutdownTimeout)
+			if statusSrv != nil {
+				_ = statusSrv.Close()
+			}
+			reloads.close()
+			supervisor.StopAll(reloads.active().shutdownTimeout)
 			return
 		case <-reload:
-			reloadMu.Lock()
-			cfg, err := loadDaemonConfig(*configPath)
-			if err != nil {
-				logger.Error("reload failed", map[string]any{"error": err.Error()})
-				reloadMu.Unlock()
-				continue
-			}
-			nextRuntime, err := cfg.runtime(*configPath)
-			if err != nil {
-				logger.Error("reload failed", map[string]any{"error": err.Error()})
-				reloadMu.Unlock()
-				continue
-			}
-			if err := supervisor.Apply(nextRuntime); err != nil {
-				logger.Error("reload failed", map[string]any{"error": err.Error()})
-			} else {
-				logger.Info("reload succeeded", nil)
-				runtimeCfg = nextRuntime
-			}
-			reloadMu.Unlock()
+			reloads.trigger()
 		}
 	}
 }
 
+// reloader coalesces bursts of reload triggers into a single Apply once no
+// new trigger has arrived for the debounce interval.
+type reloader struct {
+	logger *appLogger
+	load   func() (daemonRuntime, string, error)
+	apply  func(daemonRuntime) error
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	current daemonRuntime
+	closed  bool
+
+	runMu    sync.Mutex
+	lastHash string
+}
+
+func newReloader(logger *appLogger, current daemonRuntime, hash string, load func() (daemonRuntime, string, error), apply func(daemonRuntime) error) *reloader {
+	return &reloader{
+		logger:   logger,
+		load:     load,
+		apply:    apply,
+		current:  current,
+		lastHash: hash,
+	}
+}
+
+func (r *reloader) trigger() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(r.current.reloadDebounce, r.run)
+}
+
+func (r *reloader) run() {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+	r.mu.Lock()
+	closed := r.closed
+	skipUnchanged := r.current.skipUnchangedReload
+	r.mu.Unlock()
+	if closed {
+		return
+	}
+
+	next, hash, err := r.load()
+	if err != nil {
+		r.logger.Error("reload failed", map[string]any{"error": err.Error()})
+		return
+	}
+	if skipUnchanged && hash == r.lastHash {
+		r.logger.Info("reload skipped", map[string]any{"reason": "config unchanged", "config_hash": hash})
+		return
+	}
+	if err := r.apply(next); err != nil {
+		r.logger.Error("reload failed", map[string]any{"error": err.Error()})
+		return
+	}
+	r.lastHash = hash
+	r.mu.Lock()
+	r.current = next
+	r.mu.Unlock()
+	r.logger.Info("reload succeeded", map[string]any{"config_hash": hash})
+}
+
+func (r *reloader) active() daemonRuntime {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// close cancels a pending reload and waits for one in progress to finish.
+func (r *reloader) close() {
+	r.mu.Lock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mu.Unlock()
+	r.runMu.Lock()
+	r.runMu.Unlock()
+}
+
+// daemonConfigHash covers the daemon config and every instance config so an
+// edit to either counts as a change.
+func daemonConfigHash(path string, rt daemonRuntime) (string, error) {
+	h := sha256.New()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	for _, inst := range rt.instances {
+		data, err := os.ReadFile(inst.configPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%s: %w", inst.name, err)
+		}
+		fmt.Fprintf(h, "\x00%s\x00%d\x00", inst.name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 type DaemonConfig struct {
-	Command         string           `json:"command"`
-	WorkingDir      string           `json:"working_dir"`
-	ShutdownTimeout string           `json:"shutdown_timeout"`
-	Restart         RestartConfig     `json:"restart"`
-	Instances       []InstanceConfig  `json:"instances"`
+	Command             string           `json:"command"`
+	WorkingDir          string           `json:"working_dir"`
+	ShutdownTimeout     string           `json:"shutdown_timeout"`
+	ReloadDebounce      string           `json:"reload_debounce"`
+	SkipUnchangedReload bool             `json:"skip_unchanged_reload"`
+	StatusListen        string           `json:"status_listen"`
+	ReusePort           bool             `json:"reuse_port"`
+	UpgradeTimeout      string           `json:"upgrade_timeout"`
+	RequireInitialStart bool             `json:"require_initial_start"`
+	InitialStartTimeout string           `json:"initial_start_timeout"`
+	AutoPort            *PortRange       `json:"auto_port"`
+	Restart             RestartConfig    `json:"restart"`
+	Instances           []InstanceConfig `json:"instances"`
+}
+
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
 }
 
 type RestartConfig struct {
 	Enabled  *bool  `json:"enabled"`
 	MinDelay string `json:"min_delay"`
 	MaxDelay string `json:"max_delay"`
+	// ResetAfter is the uptime after which a crash restarts with min_delay
+	// again; it defaults to max_delay.
+	ResetAfter string `json:"reset_after"`
 }
 
 type InstanceConfig struct {
@@ -131,12 +292,23 @@ type InstanceConfig struct {
 	Disabled       bool              `json:"disabled"`
 	Command        string            `json:"command"`
 	WorkingDir     string            `json:"working_dir"`
-	Restart        *RestartConfig     `json:"restart"`
+	Restart        *RestartConfig    `json:"restart"`
+	LivenessProbe  *ProbeConfig      `json:"liveness_probe"`
+	ReadinessProbe *ProbeConfig      `json:"readiness_probe"`
+}
+
+type ProbeConfig struct {
+	HTTP             string `json:"http"`
+	TCP              string `json:"tcp"`
+	Interval         string `json:"interval"`
+	Timeout          string `json:"timeout"`
+	FailureThreshold int    `json:"failure_threshold"`
 }
 
 func DefaultDaemonConfig() DaemonConfig {
 	return DaemonConfig{
 		ShutdownTimeout: "10s",
+		ReloadDebounce:  "500ms",
 		Restart: RestartConfig{
 			Enabled:  boolPtr(true),
 			MinDelay: "1s",
@@ -172,28 +344,47 @@ func loadDaemonConfig(path string) (DaemonConfig, error) {
 }
 
 type daemonRuntime struct {
-	defaultCommand  string
-	defaultWorkDir  string
-	shutdownTimeout time.Duration
-	defaultRestart  restartPolicy
-	instances       []instanceSpec
+	defaultCommand      string
+	defaultWorkDir      string
+	shutdownTimeout     time.Duration
+	reloadDebounce      time.Duration
+	skipUnchangedReload bool
+	statusListen        string
+	upgradeTimeout      time.Duration
+	requireInitialStart bool
+	initialStartTimeout time.Duration
+	autoPort            *PortRange
+	defaultRestart      restartPolicy
+	instances           []instanceSpec
 }
 
 type restartPolicy struct {
-	enabled  bool
-	minDelay time.Duration
-	maxDelay time.Duration
+	enabled    bool
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	resetAfter time.Duration
 }
 
 type instanceSpec struct {
-	name          string
-	configPath    string
-	command       string
-	workingDir    string
-	args          []string
-	env           map[string]string
-	restart       restartPolicy
+	name           string
+	configPath     string
+	command        string
+	workingDir     string
+	args           []string
+	env            map[string]string
+	autoPort       int
+	restart        restartPolicy
 	checkUpstreams bool
+	liveness       *probeSpec
+	readiness      *probeSpec
+}
+
+type probeSpec struct {
+	http             string
+	tcp              string
+	interval         time.Duration
+	timeout          time.Duration
+	failureThreshold int
 }
 
 func (cfg DaemonConfig) runtime(path string) (daemonRuntime, error) {
@@ -209,6 +400,45 @@ func (cfg DaemonConfig) runtime(path string) (daemonRuntime, error) {
 		}
 		shutdownTimeout = parsed
 	}
+	reloadDebounce := 500 * time.Millisecond
+	if cfg.ReloadDebounce != "" {
+		parsed, err := time.ParseDuration(cfg.ReloadDebounce)
+		if err != nil {
+			return daemonRuntime{}, fmt.Errorf("reload_debounce: %w", err)
+		}
+		if parsed < 0 {
+			return daemonRuntime{}, errors.New("reload_debounce must be >= 0")
+		}
+		reloadDebounce = parsed
+	}
+	upgradeTimeout := 30 * time.Second
+	if cfg.UpgradeTimeout != "" {
+		parsed, err := time.ParseDuration(cfg.UpgradeTimeout)
+		if err != nil {
+			return daemonRuntime{}, fmt.Errorf("upgrade_timeout: %w", err)
+		}
+		if parsed <= 0 {
+			return daemonRuntime{}, errors.New("upgrade_timeout must be > 0")
+		}
+		upgradeTimeout = parsed
+	}
+	initialStartTimeout := 30 * time.Second
+	if cfg.InitialStartTimeout != "" {
+		parsed, err := time.ParseDuration(cfg.InitialStartTimeout)
+		if err != nil {
+			return daemonRuntime{}, fmt.Errorf("initial_start_timeout: %w", err)
+		}
+		if parsed <= 0 {
+			return daemonRuntime{}, errors.New("initial_start_timeout must be > 0")
+		}
+		initialStartTimeout = parsed
+	}
+
+	if r := cfg.AutoPort; r != nil {
+		if r.Start <= 0 || r.End > 65535 || r.Start > r.End {
+			return daemonRuntime{}, errors.New("auto_port must satisfy 0 < start <= end <= 65535")
+		}
+	}
 
 	defaultRestart, err := parseRestart(cfg.Restart, restartPolicy{
 		enabled:  true,
@@ -278,33 +508,95 @@ func (cfg DaemonConfig) runtime(path string) (daemonRuntime, error) {
 			}
 		}
 
+		var liveness *probeSpec
+		if inst.LivenessProbe != nil {
+			probe, err := parseProbe(*inst.LivenessProbe)
+			if err != nil {
+				return daemonRuntime{}, fmt.Errorf("instances[%d].liveness_probe: %w", i, err)
+			}
+			liveness = &probe
+		}
+		var readiness *probeSpec
+		if inst.ReadinessProbe != nil {
+			probe, err := parseProbe(*inst.ReadinessProbe)
+			if err != nil {
+				return daemonRuntime{}, fmt.Errorf("instances[%d].readiness_probe: %w", i, err)
+			}
+			readiness = &probe
+		}
+
+		if _, err := renderEnv(inst.Env, envTemplateData{Name: inst.Name, AutoPort: 1}); err != nil {
+			return daemonRuntime{}, fmt.Errorf("instances[%d].env: %w", i, err)
+		}
+
 		args := []string{"-config", configPath}
 		if inst.CheckUpstreams {
 			args = append(args, "-check-upstreams")
 		}
+		if cfg.ReusePort && !hasFlag(inst.Args, "-reuse-port") {
+			args = append(args, "-reuse-port")
+		}
 		args = append(args, inst.Args...)
 
 		instances = append(instances, instanceSpec{
-			name:          inst.Name,
-			configPath:    configPath,
-			command:       command,
-			workingDir:    workDir,
-			args:          args,
-			env:           inst.Env,
-			restart:       restart,
+			name:           inst.Name,
+			configPath:     configPath,
+			command:        command,
+			workingDir:     workDir,
+			args:           args,
+			env:            inst.Env,
+			restart:        restart,
 			checkUpstreams: inst.CheckUpstreams,
+			liveness:       liveness,
+			readiness:      readiness,
 		})
 	}
 
 	return daemonRuntime{
-		defaultCommand:  defaultCommand,
-		defaultWorkDir:  defaultWorkDir,
-		shutdownTimeout: shutdownTimeout,
-		defaultRestart:  defaultRestart,
-		instances:       instances,
+		defaultCommand:      defaultCommand,
+		defaultWorkDir:      defaultWorkDir,
+		shutdownTimeout:     shutdownTimeout,
+		reloadDebounce:      reloadDebounce,
+		skipUnchangedReload: cfg.SkipUnchangedReload,
+		statusListen:        strings.TrimSpace(cfg.StatusListen),
+		upgradeTimeout:      upgradeTimeout,
+		requireInitialStart: cfg.RequireInitialStart,
+		initialStartTimeout: initialStartTimeout,
+		autoPort:            cfg.AutoPort,
+		defaultRestart:      defaultRestart,
+		instances:           instances,
 	}, nil
 }
 
+// envTemplateData is available to instance env values as a text/template.
+type envTemplateData struct {
+	Name     string
+	AutoPort int
+}
+
+func renderEnv(env map[string]string, data envTemplateData) (map[string]string, error) {
+	if len(env) == 0 {
+		return env, nil
+	}
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		if !strings.Contains(v, "{{") {
+			out[k] = v
+			continue
+		}
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = b.String()
+	}
+	return out, nil
+}
+
 func parseRestart(cfg RestartConfig, def restartPolicy) (restartPolicy, error) {
 	out := def
 	if cfg.Enabled != nil {
@@ -333,9 +625,108 @@ func parseRestart(cfg RestartConfig, def restartPolicy) (restartPolicy, error) {
 	if out.maxDelay < out.minDelay {
 		return restartPolicy{}, errors.New("max_delay must be >= min_delay")
 	}
+	if cfg.ResetAfter != "" {
+		parsed, err := time.ParseDuration(cfg.ResetAfter)
+		if err != nil {
+			return restartPolicy{}, err
+		}
+		if parsed < 0 {
+			return restartPolicy{}, errors.New("reset_after must be >= 0")
+		}
+		out.resetAfter = parsed
+	}
 	return out, nil
 }
 
+func parseProbe(cfg ProbeConfig) (probeSpec, error) {
+	out := probeSpec{
+		http:             strings.TrimSpace(cfg.HTTP),
+		tcp:              strings.TrimSpace(cfg.TCP),
+		interval:         10 * time.Second,
+		timeout:          2 * time.Second,
+		failureThreshold: 3,
+	}
+	if (out.http == "") == (out.tcp == "") {
+		return probeSpec{}, errors.New("exactly one of http or tcp must be set")
+	}
+	if out.http != "" {
+		u, err := url.Parse(out.http)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return probeSpec{}, errors.New("http must be an absolute http(s) URL")
+		}
+	}
+	if cfg.Interval != "" {
+		parsed, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return probeSpec{}, fmt.Errorf("interval: %w", err)
+		}
+		if parsed <= 0 {
+			return probeSpec{}, errors.New("interval must be > 0")
+		}
+		out.interval = parsed
+	}
+	if cfg.Timeout != "" {
+		parsed, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return probeSpec{}, fmt.Errorf("timeout: %w", err)
+		}
+		if parsed <= 0 {
+			return probeSpec{}, errors.New("timeout must be > 0")
+		}
+		out.timeout = parsed
+	}
+	if cfg.FailureThreshold < 0 {
+		return probeSpec{}, errors.New("failure_threshold must be >= 0")
+	}
+	if cfg.FailureThreshold > 0 {
+		out.failureThreshold = cfg.FailureThreshold
+	}
+	return out, nil
+}
+
+// probeTransport dials every probe afresh, so a pooled connection cannot keep
+// reaching a process that has since stopped accepting, or the old process of
+// an upgrade.
+var probeTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableKeepAlives = true
+	return t
+}()
+
+func (p probeSpec) check() error {
+	return p.checkPID(0)
+}
+
+// checkPID is check that, for an http probe and pid > 0, also requires the
+// answer to come from that process: during an upgrade the old and the new
+// rmirror share the probed address, and rmirror names itself in the
+// X-Rmirror-Pid header of its health endpoints.
+func (p probeSpec) checkPID(pid int) error {
+	if p.http != "" {
+		client := &http.Client{Timeout: p.timeout, Transport: probeTransport}
+		resp, err := client.Get(p.http)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if pid > 0 {
+			if got := resp.Header.Get(pidHeader); got != strconv.Itoa(pid) {
+				return fmt.Errorf("answered by pid %q, not %d", got, pid)
+			}
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", p.tcp, p.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func resolvePath(baseDir, value string) string {
 	if value == "" {
 		return value
@@ -386,20 +777,54 @@ func hasFlag(args []string, flag string) bool {
 
 type supervisor struct {
 	logger  *appLogger
+	applyMu sync.Mutex
 	mu      sync.Mutex
 	runners map[string]*runner
+	ports   map[string]int
+	upgrade upgradeStatus
+}
+
+type upgradeStatus struct {
+	State      string     `json:"state"`
+	Instances  []string   `json:"instances,omitempty"`
+	Current    string     `json:"current,omitempty"`
+	Completed  []string   `json:"completed,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type instanceStatus struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	PID     int    `json:"pid"`
+	Running bool   `json:"running"`
+	Port    int    `json:"port,omitempty"`
+}
+
+type daemonStatus struct {
+	Instances []instanceStatus `json:"instances"`
+	Upgrade   upgradeStatus    `json:"upgrade"`
 }
 
 func newSupervisor(logger *appLogger) *supervisor {
 	return &supervisor{
 		logger:  logger,
 		runners: make(map[string]*runner),
+		ports:   make(map[string]int),
+		upgrade: upgradeStatus{State: "idle"},
 	}
 }
 
 func (s *supervisor) Apply(runtimeCfg daemonRuntime) error {
-	desired := make(map[string]instanceSpec, len(runtimeCfg.instances))
-	for _, inst := range runtimeCfg.instances {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	instances, err := s.assignPorts(runtimeCfg.instances, runtimeCfg.autoPort)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]instanceSpec, len(instances))
+	for _, inst := range instances {
 		desired[inst.name] = inst
 	}
 
@@ -416,9 +841,9 @@ func (s *supervisor) Apply(runtimeCfg daemonRuntime) error {
 			continue
 		}
 		if !runner.spec.equal(spec) {
+			// Started by the loop below, which sees the name as missing.
 			delete(s.runners, name)
 			toStop = append(toStop, runner)
-			toStart = append(toStart, spec)
 			continue
 		}
 		toReload = append(toReload, runner)
@@ -456,6 +881,93 @@ func (s *supervisor) Apply(runtimeCfg daemonRuntime) error {
 	return nil
 }
 
+// waitStarted waits up to timeout for every instance to become ready, as for
+// an upgrade, and reports how many did along with why the others did not.
+func (s *supervisor) waitStarted(timeout time.Duration) (int, map[string]error) {
+	s.mu.Lock()
+	runners := make([]*runner, 0, len(s.runners))
+	for _, r := range s.runners {
+		runners = append(runners, r)
+	}
+	s.mu.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	for _, r := range runners {
+		wg.Add(1)
+		go func(r *runner) {
+			defer wg.Done()
+			if err := r.waitReady(timeout); err != nil {
+				mu.Lock()
+				failed[r.spec.name] = err
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return len(runners) - len(failed), failed
+}
+
+// assignPorts gives every instance a port from the auto_port range and renders
+// its env templates. Assignments are kept across reloads, so an unchanged
+// instance keeps its port and is not restarted.
+func (s *supervisor) assignPorts(instances []instanceSpec, ports *PortRange) ([]instanceSpec, error) {
+	names := make(map[string]struct{}, len(instances))
+	for _, inst := range instances {
+		names[inst.name] = struct{}{}
+	}
+	// Assignments are worked out on a copy and kept only if every instance
+	// gets one, so a failed reload leaves the running instances' ports as
+	// they were.
+	assigned := make(map[string]int, len(s.ports))
+	used := make(map[int]struct{}, len(s.ports))
+	for name, port := range s.ports {
+		_, keep := names[name]
+		if !keep || ports == nil || port < ports.Start || port > ports.End {
+			continue
+		}
+		assigned[name] = port
+		used[port] = struct{}{}
+	}
+	out := make([]instanceSpec, 0, len(instances))
+	for _, inst := range instances {
+		if ports != nil {
+			port, ok := assigned[inst.name]
+			if !ok {
+				for candidate := ports.Start; candidate <= ports.End; candidate++ {
+					if _, taken := used[candidate]; !taken {
+						port = candidate
+						break
+					}
+				}
+				if port == 0 {
+					return nil, fmt.Errorf("auto_port range exhausted assigning %s", inst.name)
+				}
+				assigned[inst.name] = port
+				used[port] = struct{}{}
+			}
+			inst.autoPort = port
+		}
+		inst, err := renderSpec(inst)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, inst)
+	}
+	s.ports = assigned
+	return out, nil
+}
+
+func renderSpec(spec instanceSpec) (instanceSpec, error) {
+	env, err := renderEnv(spec.env, envTemplateData{Name: spec.name, AutoPort: spec.autoPort})
+	if err != nil {
+		return spec, fmt.Errorf("instance %s env: %w", spec.name, err)
+	}
+	spec.env = env
+	return spec, nil
+}
+
 func (s *supervisor) StopAll(timeout time.Duration) {
 	s.mu.Lock()
 	runners := make([]*runner, 0, len(s.runners))
@@ -470,11 +982,208 @@ func (s *supervisor) StopAll(timeout time.Duration) {
 	}
 }
 
+func (s *supervisor) status() daemonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := daemonStatus{Instances: make([]instanceStatus, 0, len(s.runners)), Upgrade: s.upgrade}
+	out.Upgrade.Instances = append([]string(nil), s.upgrade.Instances...)
+	out.Upgrade.Completed = append([]string(nil), s.upgrade.Completed...)
+	for name, runner := range s.runners {
+		pid := runner.pid()
+		out.Instances = append(out.Instances, instanceStatus{
+			Name:    name,
+			Command: runner.spec.command,
+			PID:     pid,
+			Running: pid != 0,
+			Port:    runner.spec.autoPort,
+		})
+	}
+	sort.Slice(out.Instances, func(i, j int) bool { return out.Instances[i].Name < out.Instances[j].Name })
+	return out
+}
+
+func (s *supervisor) beginUpgrade(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upgrade.State == "running" {
+		return errors.New("upgrade already in progress")
+	}
+	for _, name := range names {
+		if _, ok := s.runners[name]; !ok {
+			return fmt.Errorf("instance %q is not running", name)
+		}
+	}
+	now := time.Now()
+	s.upgrade = upgradeStatus{State: "running", Instances: names, StartedAt: &now}
+	return nil
+}
+
+// Upgrade replaces each instance in turn, starting the new process from the
+// given spec and stopping the old one only once the new one is ready. With
+// reuse_port both processes share the listen address during the handover.
+func (s *supervisor) Upgrade(specs []instanceSpec, readyTimeout, shutdownTimeout time.Duration) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	for _, spec := range specs {
+		s.mu.Lock()
+		s.upgrade.Current = spec.name
+		s.mu.Unlock()
+		s.logger.Info("instance upgrade started", map[string]any{"name": spec.name, "command": spec.command})
+		spec.autoPort = s.ports[spec.name]
+		spec, err := renderSpec(spec)
+		if err == nil {
+			err = s.upgradeInstance(spec, readyTimeout, shutdownTimeout)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", spec.name, err)
+			s.logger.Error("instance upgrade failed", map[string]any{"name": spec.name, "error": err.Error()})
+			s.finishUpgrade(err)
+			return err
+		}
+		s.mu.Lock()
+		s.upgrade.Completed = append(s.upgrade.Completed, spec.name)
+		s.mu.Unlock()
+		s.logger.Info("instance upgrade succeeded", map[string]any{"name": spec.name})
+	}
+	s.finishUpgrade(nil)
+	return nil
+}
+
+func (s *supervisor) upgradeInstance(spec instanceSpec, readyTimeout, shutdownTimeout time.Duration) error {
+	s.mu.Lock()
+	old := s.runners[spec.name]
+	s.mu.Unlock()
+	if old == nil {
+		return errors.New("instance not running")
+	}
+	next := newRunner(spec, s.logger)
+	next.start()
+	if err := next.waitReady(readyTimeout); err != nil {
+		next.stop(shutdownTimeout)
+		return err
+	}
+	s.mu.Lock()
+	s.runners[spec.name] = next
+	s.mu.Unlock()
+	old.stop(shutdownTimeout)
+	return nil
+}
+
+// upgradeProbe is the probe an upgrade waits on for the new process.
+func (s instanceSpec) upgradeProbe() *probeSpec {
+	if s.readiness != nil {
+		return s.readiness
+	}
+	return s.liveness
+}
+
+// checkUpgradable rejects instances an upgrade cannot hand over without
+// downtime or without knowing the new process is the one serving: the new
+// process must be able to bind the address the old one still holds, and a
+// tcp probe would be answered by the old process as well.
+func checkUpgradable(spec instanceSpec) error {
+	if !hasFlag(spec.args, "-reuse-port") {
+		return fmt.Errorf("instance %q does not listen with -reuse-port; set reuse_port", spec.name)
+	}
+	if probe := spec.upgradeProbe(); probe != nil && probe.http == "" {
+		return fmt.Errorf("instance %q needs an http readiness_probe to be upgraded", spec.name)
+	}
+	return nil
+}
+
+// isLoopback reports whether the request came from this host; /upgrade
+// starts processes and is not served to anyone else.
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *supervisor) finishUpgrade(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.upgrade.Current = ""
+	s.upgrade.FinishedAt = &now
+	if err != nil {
+		s.upgrade.State = "failed"
+		s.upgrade.Error = err.Error()
+		return
+	}
+	s.upgrade.State = "succeeded"
+}
+
+func newStatusHandler(s *supervisor, load func() (daemonRuntime, string, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeStatus(w, http.StatusOK, s.status())
+	})
+	mux.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLoopback(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next, _, err := load()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		specs := next.instances
+		if name := r.URL.Query().Get("instance"); name != "" {
+			specs = nil
+			for _, spec := range next.instances {
+				if spec.name == name {
+					specs = append(specs, spec)
+				}
+			}
+			if len(specs) == 0 {
+				http.Error(w, "unknown instance", http.StatusNotFound)
+				return
+			}
+		}
+		names := make([]string, 0, len(specs))
+		for _, spec := range specs {
+			if err := checkUpgradable(spec); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			names = append(names, spec.name)
+		}
+		if err := s.beginUpgrade(names); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		go func() {
+			_ = s.Upgrade(specs, next.upgradeTimeout, next.shutdownTimeout)
+		}()
+		writeStatus(w, http.StatusAccepted, s.status())
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, code int, status daemonStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
 type runner struct {
 	spec     instanceSpec
 	logger   *appLogger
 	mu       sync.Mutex
 	cmd      *exec.Cmd
+	started  time.Time
 	stopping atomic.Bool
 	stopped  chan struct{}
 	stopCh   chan struct{}
@@ -483,7 +1192,7 @@ type runner struct {
 func newRunner(spec instanceSpec, logger *appLogger) *runner {
 	return &runner{
 		spec:    spec,
-		logger: logger,
+		logger:  logger,
 		stopped: make(chan struct{}),
 		stopCh:  make(chan struct{}),
 	}
@@ -521,13 +1230,24 @@ func (r *runner) loop() {
 			continue
 		}
 		r.setCmd(cmd)
+		startedAt := time.Now()
 		r.logger.Info("instance started", map[string]any{"name": r.spec.name, "pid": cmd.Process.Pid})
+		exited := make(chan struct{})
+		if r.spec.liveness != nil {
+			go r.watchLiveness(cmd, *r.spec.liveness, exited)
+		}
 		err := cmd.Wait()
+		close(exited)
 		r.clearCmd()
 		if r.stopping.Load() {
 			return
 		}
 		exitCode := exitStatus(err)
+		// A crash after a long healthy run starts over from min_delay rather
+		// than inheriting the backoff of earlier crashes.
+		if time.Since(startedAt) >= r.spec.restart.resetThreshold() {
+			backoff = r.spec.restart.minDelay
+		}
 		fields := map[string]any{
 			"name": r.spec.name,
 			"code": exitCode,
@@ -535,6 +1255,9 @@ func (r *runner) loop() {
 		if err != nil {
 			fields["error"] = err.Error()
 		}
+		if r.spec.restart.enabled {
+			fields["restart_in"] = backoff.String()
+		}
 		r.logger.Error("instance exited", fields)
 		if !r.spec.restart.enabled {
 			return
@@ -544,6 +1267,40 @@ func (r *runner) loop() {
 	}
 }
 
+// watchLiveness kills a running child after consecutive probe failures; the
+// run loop then restarts it under the usual restart policy.
+func (r *runner) watchLiveness(cmd *exec.Cmd, probe probeSpec, exited <-chan struct{}) {
+	ticker := time.NewTicker(probe.interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-exited:
+			return
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+		}
+		err := probe.check()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if failures < probe.failureThreshold {
+			continue
+		}
+		r.logger.Error("liveness probe failed", map[string]any{
+			"name":     r.spec.name,
+			"pid":      cmd.Process.Pid,
+			"failures": failures,
+			"error":    err.Error(),
+		})
+		_ = cmd.Process.Kill()
+		return
+	}
+}
+
 func (r *runner) reload() error {
 	r.mu.Lock()
 	cmd := r.cmd
@@ -581,9 +1338,52 @@ func (r *runner) stop(timeout time.Duration) {
 func (r *runner) setCmd(cmd *exec.Cmd) {
 	r.mu.Lock()
 	r.cmd = cmd
+	r.started = time.Now()
 	r.mu.Unlock()
 }
 
+func (r *runner) pid() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd == nil || r.cmd.Process == nil {
+		return 0
+	}
+	return r.cmd.Process.Pid
+}
+
+// waitReady waits until the child itself passes its readiness (or liveness)
+// probe, or without a probe until it has stayed up for readyGrace.
+func (r *runner) waitReady(timeout time.Duration) error {
+	probe := r.spec.upgradeProbe()
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.Lock()
+		var pid int
+		if r.cmd != nil && r.cmd.Process != nil {
+			pid = r.cmd.Process.Pid
+		}
+		started := r.started
+		r.mu.Unlock()
+		if pid > 0 {
+			if probe != nil {
+				if probe.checkPID(pid) == nil {
+					return nil
+				}
+			} else if time.Since(started) >= readyGrace {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready within %s", timeout)
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-r.stopped:
+			return errors.New("instance exited")
+		}
+	}
+}
+
 func (r *runner) clearCmd() {
 	r.mu.Lock()
 	r.cmd = nil
@@ -602,6 +1402,21 @@ func (r *runner) sleepBackoff(delay time.Duration) {
 	timer.Stop()
 }
 
+const (
+	readyGrace        = time.Second
+	readyPollInterval = 100 * time.Millisecond
+)
+
+// pidHeader is set by rmirror's health endpoints to its process ID.
+const pidHeader = "X-Rmirror-Pid"
+
+func (p restartPolicy) resetThreshold() time.Duration {
+	if p.resetAfter > 0 {
+		return p.resetAfter
+	}
+	return p.maxDelay
+}
+
 func nextBackoff(current, max time.Duration) time.Duration {
 	if current <= 0 {
 		return current
@@ -670,7 +1485,9 @@ func (s instanceSpec) equal(other instanceSpec) bool {
 		s.command != other.command ||
 		s.workingDir != other.workingDir ||
 		s.checkUpstreams != other.checkUpstreams ||
-		!restartEqual(s.restart, other.restart) {
+		!restartEqual(s.restart, other.restart) ||
+		!probeEqual(s.liveness, other.liveness) ||
+		!probeEqual(s.readiness, other.readiness) {
 		return false
 	}
 	if !stringSliceEqual(s.args, other.args) {
@@ -683,7 +1500,14 @@ func (s instanceSpec) equal(other instanceSpec) bool {
 }
 
 func restartEqual(a, b restartPolicy) bool {
-	return a.enabled == b.enabled && a.minDelay == b.minDelay && a.maxDelay == b.maxDelay
+	return a.enabled == b.enabled && a.minDelay == b.minDelay && a.maxDelay == b.maxDelay && a.resetAfter == b.resetAfter
+}
+
+func probeEqual(a, b *probeSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
 
 func stringSliceEqual(a, b []string) bool {
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *appLogger {
+	return &appLogger{logger: log.New(io.Discard, "", 0)}
+}
+
+type recordingApply struct {
+	mu      sync.Mutex
+	applied []daemonRuntime
+}
+
+func (r *recordingApply) apply(rt daemonRuntime) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied = append(r.applied, rt)
+	return nil
+}
+
+func (r *recordingApply) snapshot() []daemonRuntime {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]daemonRuntime(nil), r.applied...)
+}
+
+func TestReloaderCoalescesBursts(t *testing.T) {
+	var mu sync.Mutex
+	version := 0
+	load := func() (daemonRuntime, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return daemonRuntime{shutdownTimeout: time.Duration(version), reloadDebounce: 50 * time.Millisecond}, "hash", nil
+	}
+	var rec recordingApply
+	reloads := newReloader(newTestLogger(), daemonRuntime{reloadDebounce: 50 * time.Millisecond}, "initial", load, rec.apply)
+	defer reloads.close()
+
+	for i := 1; i <= 5; i++ {
+		mu.Lock()
+		version = i
+		mu.Unlock()
+		reloads.trigger()
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	applied := rec.snapshot()
+	if len(applied) != 1 {
+		t.Fatalf("expected a single apply, got %d", len(applied))
+	}
+	if got := applied[0].shutdownTimeout; got != 5 {
+		t.Fatalf("expected final config version 5, got %d", got)
+	}
+}
+
+func TestReloaderSkipsUnchangedConfig(t *testing.T) {
+	var mu sync.Mutex
+	hash := "initial"
+	load := func() (daemonRuntime, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return daemonRuntime{skipUnchangedReload: true}, hash, nil
+	}
+	var rec recordingApply
+	reloads := newReloader(newTestLogger(), daemonRuntime{skipUnchangedReload: true}, "initial", load, rec.apply)
+	defer reloads.close()
+
+	reloads.trigger()
+	time.Sleep(50 * time.Millisecond)
+	if got := len(rec.snapshot()); got != 0 {
+		t.Fatalf("expected unchanged config to be skipped, got %d applies", got)
+	}
+
+	mu.Lock()
+	hash = "changed"
+	mu.Unlock()
+	reloads.trigger()
+	time.Sleep(50 * time.Millisecond)
+	reloads.trigger()
+	time.Sleep(50 * time.Millisecond)
+	if got := len(rec.snapshot()); got != 1 {
+		t.Fatalf("expected one apply for the changed config, got %d", got)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("RMIRRORD_TEST_HELPER") != "1" {
+		return
+	}
+	// Like rmirror, survive the SIGHUP a reload sends.
+	signal.Ignore(syscall.SIGHUP)
+	if out := os.Getenv("RMIRRORD_TEST_ENV_OUT"); out != "" {
+		_ = os.WriteFile(out, []byte(os.Getenv("PORT")), 0o644)
+	}
+	if counter := os.Getenv("RMIRRORD_TEST_RUNS"); counter != "" {
+		// The first runs crash at once; later ones stay up for a while first.
+		data, _ := os.ReadFile(counter)
+		_ = os.WriteFile(counter, append(data, '.'), 0o644)
+		if len(data) >= 3 {
+			time.Sleep(400 * time.Millisecond)
+		}
+		os.Exit(1)
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+// TestDaemonMainProcess runs main with the config named by
+// RMIRRORD_TEST_MAIN, so tests can observe the daemon's exit status.
+func TestDaemonMainProcess(t *testing.T) {
+	path := os.Getenv("RMIRRORD_TEST_MAIN")
+	if path == "" {
+		return
+	}
+	os.Args = []string{"rmirrord", "-config", path}
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+	os.Exit(0)
+}
+
+func TestRequireInitialStartExitsNonZero(t *testing.T) {
+	failing, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mirror.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatalf("write instance config: %v", err)
+	}
+	cfg := DaemonConfig{
+		Command:             failing,
+		ShutdownTimeout:     "1s",
+		RequireInitialStart: true,
+		InitialStartTimeout: "300ms",
+		Restart:             RestartConfig{MinDelay: "10ms", MaxDelay: "10ms"},
+		Instances: []InstanceConfig{
+			{Name: "a", Config: "mirror.json"},
+			{Name: "b", Config: "mirror.json"},
+		},
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	path := filepath.Join(dir, "daemon.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write daemon config: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDaemonMainProcess$")
+	cmd.Env = append(os.Environ(), "RMIRRORD_TEST_MAIN="+path)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() == 0 {
+		t.Fatalf("expected a non-zero exit, got %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "no instances started") {
+		t.Fatalf("expected fatal log, got:\n%s", out)
+	}
+}
+
+func TestLivenessProbeRestartsHungInstance(t *testing.T) {
+	// The listener is never accepted from, so connections open but requests hang.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	var logs syncBuffer
+	spec := instanceSpec{
+		name:    "hung",
+		command: os.Args[0],
+		args:    []string{"-test.run=^TestHelperProcess$"},
+		env:     map[string]string{"RMIRRORD_TEST_HELPER": "1"},
+		restart: restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond},
+		liveness: &probeSpec{
+			http:             "http://" + ln.Addr().String() + "/_rmirror/healthz",
+			interval:         50 * time.Millisecond,
+			timeout:          50 * time.Millisecond,
+			failureThreshold: 2,
+		},
+	}
+	r := newRunner(spec, &appLogger{logger: log.New(&logs, "", 0)})
+	r.start()
+	defer r.stop(time.Second)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		out := logs.String()
+		if strings.Contains(out, "liveness probe failed") && strings.Count(out, "instance started") >= 2 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected hung instance to be restarted, logs:\n%s", logs.String())
+}
+
+func TestBackoffResetsAfterLongRun(t *testing.T) {
+	var logs syncBuffer
+	spec := helperSpec("flaky", nil)
+	spec.env["RMIRRORD_TEST_RUNS"] = filepath.Join(t.TempDir(), "runs")
+	spec.restart = restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: time.Second, resetAfter: 250 * time.Millisecond}
+	r := newRunner(spec, &appLogger{logger: log.New(&logs, "", 0)})
+	r.start()
+	defer r.stop(time.Second)
+
+	var delays []string
+	deadline := time.Now().Add(10 * time.Second)
+	for len(delays) < 4 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		delays = delays[:0]
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var entry map[string]any
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "instance exited" {
+				delays = append(delays, entry["restart_in"].(string))
+			}
+		}
+	}
+	if len(delays) < 4 {
+		t.Fatalf("expected 4 exits, got %v", delays)
+	}
+	want := []string{"10ms", "20ms", "40ms", "10ms"}
+	for i, d := range want {
+		if delays[i] != d {
+			t.Fatalf("unexpected restart delays %v, want prefix %v", delays, want)
+		}
+	}
+}
+
+func TestReloadAppliesResetAfter(t *testing.T) {
+	s := newSupervisor(&appLogger{logger: log.New(io.Discard, "", 0)})
+	defer s.StopAll(time.Second)
+
+	spec := helperSpec("a", nil)
+	spec.restart = restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: time.Second, resetAfter: time.Minute}
+	if err := s.Apply(daemonRuntime{instances: []instanceSpec{spec}, shutdownTimeout: time.Second}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	waitRunning(t, s, "a")
+
+	spec.restart.resetAfter = 5 * time.Minute
+	if err := s.Apply(daemonRuntime{instances: []instanceSpec{spec}, shutdownTimeout: time.Second}); err != nil {
+		t.Fatalf("reapply: %v", err)
+	}
+	s.mu.Lock()
+	got := s.runners["a"].spec.restart.resetAfter
+	s.mu.Unlock()
+	if got != 5*time.Minute {
+		t.Fatalf("expected the reload to apply reset_after, runner has %v", got)
+	}
+}
+
+// There is no separate restart budget: the crash-loop protection is the
+// restart backoff, which only the run loop's crash path advances. Restarts
+// for a config change replace the runner instead, so they must neither log
+// as crashes nor leave the backoff raised.
+func TestConfigRestartsDoNotCountAsCrashes(t *testing.T) {
+	var logs syncBuffer
+	s := newSupervisor(&appLogger{logger: log.New(&logs, "", 0)})
+	defer s.StopAll(time.Second)
+
+	spec := helperSpec("a", nil)
+	spec.restart = restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: time.Second}
+	var pid int
+	for gen := 0; gen < 4; gen++ {
+		spec.env = map[string]string{"RMIRRORD_TEST_HELPER": "1", "GEN": strconv.Itoa(gen)}
+		if err := s.Apply(daemonRuntime{instances: []instanceSpec{spec}, shutdownTimeout: time.Second}); err != nil {
+			t.Fatalf("apply %d: %v", gen, err)
+		}
+		next := waitRunning(t, s, "a")["a"]
+		if next == pid {
+			t.Fatalf("apply %d did not restart the instance", gen)
+		}
+		pid = next
+	}
+	if strings.Contains(logs.String(), `"instance exited"`) {
+		t.Fatalf("config restarts were logged as crashes:\n%s", logs.String())
+	}
+	// A changed instance is replaced by exactly one new process.
+	if got := strings.Count(logs.String(), `"instance started"`); got != 4 {
+		t.Fatalf("expected one start per config, got %d:\n%s", got, logs.String())
+	}
+
+	// A real crash now still restarts after min_delay.
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), `"instance exited"`) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "instance exited" {
+			if entry["restart_in"] != "10ms" {
+				t.Fatalf("expected the first crash to restart after min_delay, got %v", entry["restart_in"])
+			}
+			return
+		}
+	}
+	t.Fatalf("expected the killed instance to be reported, logs:\n%s", logs.String())
+}
+
+func TestParseProbeRequiresSingleTarget(t *testing.T) {
+	if _, err := parseProbe(ProbeConfig{}); err == nil {
+		t.Fatal("expected error without a probe target")
+	}
+	if _, err := parseProbe(ProbeConfig{HTTP: "http://127.0.0.1:5000/_rmirror/healthz", TCP: "127.0.0.1:5000"}); err == nil {
+		t.Fatal("expected error with both http and tcp set")
+	}
+	probe, err := parseProbe(ProbeConfig{TCP: "127.0.0.1:5000"})
+	if err != nil {
+		t.Fatalf("parse probe: %v", err)
+	}
+	if probe.interval != 10*time.Second || probe.timeout != 2*time.Second || probe.failureThreshold != 3 {
+		t.Fatalf("unexpected probe defaults: %+v", probe)
+	}
+}
+
+func helperSpec(name string, readiness *probeSpec) instanceSpec {
+	return instanceSpec{
+		name:      name,
+		command:   os.Args[0],
+		args:      []string{"-test.run=^TestHelperProcess$"},
+		env:       map[string]string{"RMIRRORD_TEST_HELPER": "1"},
+		restart:   restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond},
+		readiness: readiness,
+	}
+}
+
+func waitRunning(t *testing.T, s *supervisor, names ...string) map[string]int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pids := map[string]int{}
+		for _, inst := range s.status().Instances {
+			if inst.Running {
+				pids[inst.Name] = inst.PID
+			}
+		}
+		if len(pids) == len(names) {
+			return pids
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("instances %v did not start", names)
+	return nil
+}
+
+func TestAutoPortInjectsDistinctPorts(t *testing.T) {
+	dir := t.TempDir()
+	specs := []instanceSpec{helperSpec("a", nil), helperSpec("b", nil)}
+	for i := range specs {
+		specs[i].env["PORT"] = "{{.AutoPort}}"
+		specs[i].env["RMIRRORD_TEST_ENV_OUT"] = filepath.Join(dir, "{{.Name}}")
+	}
+	cfg := daemonRuntime{instances: specs, shutdownTimeout: time.Second, autoPort: &PortRange{Start: 18000, End: 18001}}
+	s := newSupervisor(newTestLogger())
+	defer s.StopAll(time.Second)
+	if err := s.Apply(cfg); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	before := waitRunning(t, s, "a", "b")
+
+	ports := map[string]string{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ports) < 2 && time.Now().Before(deadline) {
+		for _, name := range []string{"a", "b"} {
+			if data, err := os.ReadFile(filepath.Join(dir, name)); err == nil && len(data) > 0 {
+				ports[name] = string(data)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if ports["a"] == "" || ports["b"] == "" || ports["a"] == ports["b"] {
+		t.Fatalf("expected distinct injected ports, got %v", ports)
+	}
+
+	// Reloading keeps assignments, so neither instance is restarted.
+	if err := s.Apply(cfg); err != nil {
+		t.Fatalf("reapply: %v", err)
+	}
+	after := waitRunning(t, s, "a", "b")
+	for name, pid := range before {
+		if after[name] != pid {
+			t.Fatalf("instance %s restarted on reload", name)
+		}
+	}
+
+	exhausted := cfg
+	exhausted.instances = append(cfg.instances, helperSpec("c", nil))
+	if err := s.Apply(exhausted); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Fatalf("expected exhausted range error, got %v", err)
+	}
+	// A reload that fails partway through assigning keeps the previous
+	// assignments, which an upgrade renders the running instances with.
+	moved := exhausted
+	moved.autoPort = &PortRange{Start: 18001, End: 18002}
+	if err := s.Apply(moved); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Fatalf("expected exhausted range error, got %v", err)
+	}
+	if len(s.ports) != 2 || strconv.Itoa(s.ports["a"]) != ports["a"] || strconv.Itoa(s.ports["b"]) != ports["b"] {
+		t.Fatalf("expected a failed reload to keep the assignments %v, got %v", ports, s.ports)
+	}
+}
+
+func TestStatusHandlerUpgradeUnknownInstance(t *testing.T) {
+	s := newSupervisor(newTestLogger())
+	load := func() (daemonRuntime, string, error) {
+		return daemonRuntime{instances: []instanceSpec{
+			{name: "a", args: []string{"-reuse-port"}},
+			{name: "shared", args: []string{"-reuse-port"}, readiness: &probeSpec{tcp: "127.0.0.1:8080"}},
+			{name: "exclusive"},
+		}}, "", nil
+	}
+	handler := newStatusHandler(s, load)
+	upgrade := func(target, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := upgrade("/upgrade?instance=a", "192.0.2.1:1234"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a remote client, got %d", rec.Code)
+	}
+	if rec := upgrade("/upgrade?instance=missing", "127.0.0.1:1234"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown instance, got %d", rec.Code)
+	}
+	if rec := upgrade("/upgrade?instance=a", "[::1]:1234"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "not running") {
+		t.Fatalf("expected 409 for an instance that is not running, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := upgrade("/upgrade?instance=exclusive", "127.0.0.1:1234"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "reuse_port") {
+		t.Fatalf("expected 409 for an instance without reuse_port, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := upgrade("/upgrade?instance=shared", "127.0.0.1:1234"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "http readiness_probe") {
+		t.Fatalf("expected 409 for an instance probed over tcp, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"idle"`) {
+		t.Fatalf("unexpected status response: %d %s", rec.Code, rec.Body.String())
+	}
+}
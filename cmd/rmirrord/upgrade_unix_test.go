@@ -0,0 +1,117 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestReusePortHelperProcess stands in for rmirror -reuse-port: it serves a
+// health endpoint naming its PID on RMIRRORD_TEST_LISTEN, optionally after
+// RMIRRORD_TEST_LISTEN_DELAY.
+func TestReusePortHelperProcess(t *testing.T) {
+	addr := os.Getenv("RMIRRORD_TEST_LISTEN")
+	if addr == "" {
+		return
+	}
+	if delay, err := time.ParseDuration(os.Getenv("RMIRRORD_TEST_LISTEN_DELAY")); err == nil {
+		time.Sleep(delay)
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(pidHeader, strconv.Itoa(os.Getpid()))
+	}))
+	os.Exit(0)
+}
+
+func reusePortSpec(t *testing.T, name string) instanceSpec {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return instanceSpec{
+		name:      name,
+		command:   os.Args[0],
+		args:      []string{"-test.run=^TestReusePortHelperProcess$"},
+		env:       map[string]string{"RMIRRORD_TEST_LISTEN": addr},
+		restart:   restartPolicy{enabled: true, minDelay: 10 * time.Millisecond, maxDelay: 10 * time.Millisecond},
+		readiness: &probeSpec{http: "http://" + addr + "/_rmirror/healthz", interval: time.Second, timeout: time.Second, failureThreshold: 1},
+	}
+}
+
+func TestRollingUpgradeReplacesEachInstance(t *testing.T) {
+	specs := []instanceSpec{reusePortSpec(t, "a"), reusePortSpec(t, "b")}
+	s := newSupervisor(newTestLogger())
+	defer s.StopAll(time.Second)
+	if err := s.Apply(daemonRuntime{instances: specs, shutdownTimeout: time.Second}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	before := waitRunning(t, s, "a", "b")
+	for _, spec := range specs {
+		deadline := time.Now().Add(5 * time.Second)
+		for spec.readiness.checkPID(before[spec.name]) != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("instance %s never became ready", spec.name)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	if err := s.beginUpgrade([]string{"a", "b"}); err != nil {
+		t.Fatalf("begin upgrade: %v", err)
+	}
+	if err := s.beginUpgrade([]string{"a"}); err == nil {
+		t.Fatal("expected concurrent upgrade to be rejected")
+	}
+	// The old process keeps answering the shared address while the new one
+	// starts up, so only a probe answered by the new PID may end the wait.
+	next := make([]instanceSpec, len(specs))
+	for i, spec := range specs {
+		spec.env = map[string]string{
+			"RMIRRORD_TEST_LISTEN":       spec.env["RMIRRORD_TEST_LISTEN"],
+			"RMIRRORD_TEST_LISTEN_DELAY": "300ms",
+		}
+		next[i] = spec
+	}
+	if err := s.Upgrade(next, 5*time.Second, time.Second); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	after := waitRunning(t, s, "a", "b")
+	for _, spec := range specs {
+		if after[spec.name] == before[spec.name] {
+			t.Fatalf("instance %s was not replaced (pid %d)", spec.name, before[spec.name])
+		}
+		if err := spec.readiness.checkPID(after[spec.name]); err != nil {
+			t.Fatalf("instance %s: expected the new process to serve right after the upgrade: %v", spec.name, err)
+		}
+	}
+	status := s.status().Upgrade
+	if status.State != "succeeded" || len(status.Completed) != 2 || status.Completed[0] != "a" || status.Completed[1] != "b" {
+		t.Fatalf("unexpected upgrade status: %+v", status)
+	}
+}
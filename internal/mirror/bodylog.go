@@ -0,0 +1,86 @@
+package mirror
+
+import (
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+const maxDebugBodyLog = 64 << 10
+
+// bodyCapture keeps the first limit bytes written to it and counts the rest,
+// so it can sit behind a tee without buffering whole bodies. The transport
+// may still be reading a request body when the request is logged.
+type bodyCapture struct {
+	mu    sync.Mutex
+	limit int
+	data  []byte
+	total int64
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += int64(len(p))
+	if room := c.limit - len(c.data); room > 0 {
+		c.data = append(c.data, p[:min(len(p), room)]...)
+	}
+	return len(p), nil
+}
+
+// bodyLog holds the request and response snippets of one request on a route
+// with debug_body_log.
+type bodyLog struct {
+	request  bodyCapture
+	response bodyCapture
+}
+
+func newBodyLog(limit int) *bodyLog {
+	return &bodyLog{request: bodyCapture{limit: limit}, response: bodyCapture{limit: limit}}
+}
+
+var (
+	// The closing quote is optional so a value cut off by the snippet limit
+	// is still masked.
+	secretJSONField = regexp.MustCompile(`(?i)("[a-z_-]*(?:token|password|secret)[a-z_-]*"\s*:\s*")[^"]*"?`)
+	secretFormField = regexp.MustCompile(`(?i)(\b[a-z_-]*(?:token|password|secret)[a-z_-]*=)[^&\s"]*`)
+)
+
+// snippet renders captured bytes as UTF-8 when they are text and as hex
+// otherwise, along with the total body size. Text has token, password and
+// secret fields and URL query values masked.
+func (c *bodyCapture) snippet() (string, string, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := c.data
+	if int64(len(data)) < c.total {
+		// The cut may land inside a multi-byte rune.
+		for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	if !utf8.Valid(data) {
+		return hex.EncodeToString(c.data), "hex", c.total
+	}
+	text := secretJSONField.ReplaceAllString(string(data), `${1}REDACTED"`)
+	text = secretFormField.ReplaceAllString(text, "${1}REDACTED")
+	return redactQuery(text), "utf8", c.total
+}
+
+func (m *Mirror) logBodies(route *route, r *http.Request, bodies *bodyLog) {
+	reqBody, reqEncoding, reqBytes := bodies.request.snippet()
+	respBody, respEncoding, respBytes := bodies.response.snippet()
+	m.logger.Debug("body snippet", map[string]any{
+		"route":                  routeMetricLabel(route, r.URL.Path),
+		"method":                 r.Method,
+		"path":                   r.URL.Path,
+		"request_body":           reqBody,
+		"request_body_encoding":  reqEncoding,
+		"request_bytes":          reqBytes,
+		"response_body":          respBody,
+		"response_body_encoding": respEncoding,
+		"response_bytes":         respBytes,
+	})
+}
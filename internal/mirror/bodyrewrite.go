@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// absoluteURLPattern finds http(s) URLs in HTML and JSON text, stopping at
+// the quotes, brackets and whitespace that delimit them there.
+var absoluteURLPattern = regexp.MustCompile("https?://[^\\s\"'<>`()\\\\]+")
+
+// escapedURLPattern finds the same URLs written with JSON's optional \/
+// escape, as PHP's json_encode and inline scripts emit them.
+var escapedURLPattern = regexp.MustCompile("https?:\\\\/\\\\/(?:[^\\s\"'<>`()\\\\]|\\\\/)+")
+
+func isBodyRewriteContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || isJSONContentType(value)
+}
+
+// rewriteBodyURLs rewrites absolute upstream URLs anywhere in HTML and JSON
+// bodies for routes with rewrite_body. gzip bodies are decoded and sent back
+// unencoded; other encodings, and bodies larger than the route's limit, pass
+// through untouched.
+func (m *Mirror) rewriteBodyURLs(resp *http.Response, r *route, pb publicBase) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if !isBodyRewriteContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "gzip" {
+		return
+	}
+	limit := int64(r.maxBodyRewriteBytes)
+	if resp.ContentLength > limit {
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil || int64(len(raw)) > limit {
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(raw), resp.Body), Closer: resp.Body}
+		return
+	}
+	resp.Body = readCloser{Reader: bytes.NewReader(raw), Closer: resp.Body}
+	data := raw
+	if encoding == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(gz, limit+1))
+		if err != nil || int64(len(data)) > limit {
+			return
+		}
+	}
+	changed := false
+	out := absoluteURLPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		rewritten, ok := m.rewriteURL(string(match), pb)
+		if !ok {
+			return match
+		}
+		changed = true
+		return []byte(rewritten)
+	})
+	out = escapedURLPattern.ReplaceAllFunc(out, func(match []byte) []byte {
+		rewritten, ok := m.rewriteURL(strings.ReplaceAll(string(match), `\/`, "/"), pb)
+		if !ok {
+			return match
+		}
+		changed = true
+		return []byte(strings.ReplaceAll(rewritten, "/", `\/`))
+	})
+	if !changed {
+		return
+	}
+	resp.Body = readCloser{Reader: bytes.NewReader(out), Closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	redigest(resp.Header, out)
+}
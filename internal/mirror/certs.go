@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	errNoPeerCertificate = errors.New("upstream presented no certificate")
+	errNoTLSDialer       = errors.New("transport has no TLS dialer")
+)
+
+// CheckCertExpiry records the remaining validity of each https upstream's leaf
+// certificate. It only dials and handshakes, through the route transport's
+// dialer, so the handshake uses the same fragmentation as proxied traffic
+// without sending a request upstream.
+func (m *Mirror) CheckCertExpiry(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range m.upstreamTargets() {
+		if target.scheme != "https" {
+			continue
+		}
+		wg.Add(1)
+		go func(target upstreamTarget) {
+			defer wg.Done()
+			notAfter, err := upstreamCertExpiry(ctx, target.transport, target.host)
+			if err != nil {
+				if m.logger != nil {
+					m.logger.Error("cert check failed", map[string]any{"upstream": target.host, "error": err.Error()})
+				}
+				return
+			}
+			m.metrics.setCertExpiry(target.host, time.Until(notAfter))
+		}(target)
+	}
+	wg.Wait()
+}
+
+func upstreamCertExpiry(ctx context.Context, transport http.RoundTripper, host string) (time.Time, error) {
+	dial := tlsDialer(transport)
+	if dial == nil {
+		return time.Time{}, errNoTLSDialer
+	}
+	u := &url.URL{Host: host}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return time.Time{}, errNoPeerCertificate
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, errNoPeerCertificate
+	}
+	return certs[0].NotAfter, nil
+}
+
+// tlsDialer returns the dial-and-handshake step of a transport built by
+// NewTransport, using the primary fragment length of a fallback chain.
+func tlsDialer(rt http.RoundTripper) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if f, ok := rt.(*fallbackRoundTripper); ok {
+		rt = f.primary
+	}
+	if t, ok := rt.(*http.Transport); ok {
+		return t.DialTLSContext
+	}
+	return nil
+}
@@ -1,14 +1,26 @@
 package mirror
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -17,6 +29,8 @@ const (
 	defaultIdleTimeout           = 60 * time.Second
 	defaultShutdownTimeout       = 5 * time.Second
 	defaultMaxHeaderBytes        = 1 << 20
+	minBufferSize                = 1 << 10
+	maxBufferSize                = 4 << 20
 	defaultDialTimeout           = 10 * time.Second
 	defaultKeepAlive             = 30 * time.Second
 	defaultMaxIdleConns          = 256
@@ -26,84 +40,239 @@ const (
 	defaultResponseHeaderTimeout = 30 * time.Second
 	defaultExpectContinueTimeout = 1 * time.Second
 	defaultFirstFragmentLen      = 3
+	defaultRetryBackoff          = 100 * time.Millisecond
+	defaultDNSTimeout            = 2 * time.Second
+	maxStatusRetries             = 10
+	defaultRobotsBody            = "User-agent: *\nDisallow: /\n"
 )
 
-// Config is loaded from JSON.
+// Config is loaded from JSON, or TOML when the file ends in .toml.
 type Config struct {
-	Listen        string          `json:"listen"`
-	PublicBaseURL string          `json:"public_base_url"`
-	AccessLog     bool            `json:"access_log"`
-	TLS           *TLSConfig      `json:"tls"`
-	Timeouts      ServerTimeouts  `json:"timeouts"`
-	Transport     TransportConfig `json:"transport"`
-	Limits        LimitsConfig    `json:"limits"`
-	Routes        []RouteConfig   `json:"routes"`
+	Listen               string          `json:"listen" toml:"listen"`
+	ListenAddresses      []string        `json:"listen_addresses" toml:"listen_addresses"`
+	ListenBacklog        int             `json:"listen_backlog" toml:"listen_backlog"`
+	TCPKeepAlive         string          `json:"tcp_keepalive" toml:"tcp_keepalive"`
+	PublicBaseURL        string          `json:"public_base_url" toml:"public_base_url"`
+	PublicBaseMode       string          `json:"public_base_mode" toml:"public_base_mode"`
+	PublicBaseScheme     string          `json:"public_base_scheme" toml:"public_base_scheme"`
+	PublicBaseHosts      []string        `json:"public_base_hosts" toml:"public_base_hosts"`
+	AccessLog            bool            `json:"access_log" toml:"access_log"`
+	LogLevel             string          `json:"log_level" toml:"log_level"`
+	AdminToken           string          `json:"admin_token" toml:"admin_token"`
+	AllowMetricsReset    bool            `json:"allow_metrics_reset" toml:"allow_metrics_reset"`
+	ResponseSizeBuckets  []float64       `json:"response_size_buckets" toml:"response_size_buckets"`
+	DisableHTTP2Server   bool            `json:"disable_http2_server" toml:"disable_http2_server"`
+	TimeoutsPreset       string          `json:"timeouts_preset" toml:"timeouts_preset"`
+	DuplicateUpstreams   string          `json:"duplicate_upstreams" toml:"duplicate_upstreams"`
+	AllowedUpstreamHosts []string        `json:"allowed_upstream_hosts" toml:"allowed_upstream_hosts"`
+	DeniedUpstreamHosts  []string        `json:"denied_upstream_hosts" toml:"denied_upstream_hosts"`
+	TLS                  *TLSConfig      `json:"tls" toml:"tls"`
+	Timeouts             ServerTimeouts  `json:"timeouts" toml:"timeouts"`
+	Transport            TransportConfig `json:"transport" toml:"transport"`
+	Limits               LimitsConfig    `json:"limits" toml:"limits"`
+	Builtins             BuiltinsConfig  `json:"builtins" toml:"builtins"`
+	Statsd               *StatsdConfig   `json:"statsd" toml:"statsd"`
+	DNS                  *DNSConfig      `json:"dns" toml:"dns"`
+	Routes               []RouteConfig   `json:"routes" toml:"routes"`
 }
 
 type TLSConfig struct {
-	CertFile string `json:"cert_file"`
-	KeyFile  string `json:"key_file"`
+	CertFile string `json:"cert_file" toml:"cert_file"`
+	KeyFile  string `json:"key_file" toml:"key_file"`
 }
 
 type ServerTimeouts struct {
-	ReadHeaderTimeout string `json:"read_header_timeout"`
-	ReadTimeout       string `json:"read_timeout"`
-	WriteTimeout      string `json:"write_timeout"`
-	IdleTimeout       string `json:"idle_timeout"`
-	ShutdownTimeout   string `json:"shutdown_timeout"`
-	MaxHeaderBytes    int    `json:"max_header_bytes"`
+	ReadHeaderTimeout  string `json:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout        string `json:"read_timeout" toml:"read_timeout"`
+	WriteTimeout       string `json:"write_timeout" toml:"write_timeout"`
+	IdleTimeout        string `json:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout    string `json:"shutdown_timeout" toml:"shutdown_timeout"`
+	ReloadDrain        string `json:"reload_drain" toml:"reload_drain"`
+	MaxHeaderBytes     int    `json:"max_header_bytes" toml:"max_header_bytes"`
+	RequestMaxDuration string `json:"request_max_duration" toml:"request_max_duration"`
 }
 
 type TransportConfig struct {
-	FirstFragmentLen      int    `json:"first_fragment_len"`
-	DialTimeout           string `json:"dial_timeout"`
-	KeepAlive             string `json:"keepalive"`
-	MaxIdleConns          int    `json:"max_idle_conns"`
-	MaxIdleConnsPerHost   int    `json:"max_idle_conns_per_host"`
-	MaxConnsPerHost       int    `json:"max_conns_per_host"`
-	IdleConnTimeout       string `json:"idle_conn_timeout"`
-	TLSHandshakeTimeout   string `json:"tls_handshake_timeout"`
-	ResponseHeaderTimeout string `json:"response_header_timeout"`
-	ExpectContinueTimeout string `json:"expect_continue_timeout"`
-	ForceHTTP2            bool   `json:"force_http2"`
-	DisableCompression    bool   `json:"disable_compression"`
+	FirstFragmentLen        int      `json:"first_fragment_len" toml:"first_fragment_len"`
+	AdaptiveFragment        bool     `json:"adaptive_fragment" toml:"adaptive_fragment"`
+	FragmentStrategy        string   `json:"fragment_strategy" toml:"fragment_strategy"`
+	DialTimeout             string   `json:"dial_timeout" toml:"dial_timeout"`
+	MaxDialsPerHost         int      `json:"max_dials_per_host" toml:"max_dials_per_host"`
+	DialQueueTimeout        string   `json:"dial_queue_timeout" toml:"dial_queue_timeout"`
+	DialKeepAlive           string   `json:"dial_keepalive" toml:"dial_keepalive"`
+	KeepAlive               string   `json:"keepalive,omitempty" toml:"keepalive,omitempty"` // Deprecated: use DialKeepAlive.
+	MaxIdleConns            int      `json:"max_idle_conns" toml:"max_idle_conns"`
+	MaxIdleConnsPerHost     int      `json:"max_idle_conns_per_host" toml:"max_idle_conns_per_host"`
+	MaxConnsPerHost         int      `json:"max_conns_per_host" toml:"max_conns_per_host"`
+	IdleConnTimeout         string   `json:"idle_conn_timeout" toml:"idle_conn_timeout"`
+	TLSHandshakeTimeout     string   `json:"tls_handshake_timeout" toml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout   string   `json:"response_header_timeout" toml:"response_header_timeout"`
+	ExpectContinueTimeout   string   `json:"expect_continue_timeout" toml:"expect_continue_timeout"`
+	ForceHTTP2              bool     `json:"force_http2" toml:"force_http2"`
+	DisableCompression      bool     `json:"disable_compression" toml:"disable_compression"`
+	RetryOn                 []string `json:"retry_on" toml:"retry_on"`
+	MaxFallbackAttempts     int      `json:"max_fallback_attempts" toml:"max_fallback_attempts"`
+	RetryOnStatus           []int    `json:"retry_on_status" toml:"retry_on_status"`
+	MaxRetries              int      `json:"max_retries" toml:"max_retries"`
+	RetryBackoff            string   `json:"retry_backoff" toml:"retry_backoff"`
+	RetryBufferBytes        int      `json:"retry_buffer_bytes" toml:"retry_buffer_bytes"`
+	ProxyURL                string   `json:"proxy_url" toml:"proxy_url"`
+	CAFile                  string   `json:"ca_file" toml:"ca_file"`
+	InsecureSkipVerify      bool     `json:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	TLSMinVersion           string   `json:"tls_min_version" toml:"tls_min_version"`
+	TLSMaxVersion           string   `json:"tls_max_version" toml:"tls_max_version"`
+	WarmupConnections       bool     `json:"warmup_connections" toml:"warmup_connections"`
+	HeaderCasing            []string `json:"header_casing" toml:"header_casing"`
+	CertCheckInterval       string   `json:"cert_check_interval" toml:"cert_check_interval"`
+	IdleConnRecycleInterval string   `json:"idle_conn_recycle_interval" toml:"idle_conn_recycle_interval"`
+	ReadBufferSize          int      `json:"read_buffer_size" toml:"read_buffer_size"`
+	WriteBufferSize         int      `json:"write_buffer_size" toml:"write_buffer_size"`
+	DNSCacheTTL             string   `json:"dns_cache_ttl" toml:"dns_cache_ttl"`
+	IPMode                  string   `json:"ip_mode" toml:"ip_mode"`
+}
+
+// RouteTransportConfig overrides selected transport fields for one route.
+// Unset fields keep the value from the top-level transport.
+type RouteTransportConfig struct {
+	FirstFragmentLen      *int     `json:"first_fragment_len,omitempty" toml:"first_fragment_len,omitempty"`
+	AdaptiveFragment      *bool    `json:"adaptive_fragment,omitempty" toml:"adaptive_fragment,omitempty"`
+	DialTimeout           string   `json:"dial_timeout,omitempty" toml:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   string   `json:"tls_handshake_timeout,omitempty" toml:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout string   `json:"response_header_timeout,omitempty" toml:"response_header_timeout,omitempty"`
+	ForceHTTP2            *bool    `json:"force_http2,omitempty" toml:"force_http2,omitempty"`
+	DisableCompression    *bool    `json:"disable_compression,omitempty" toml:"disable_compression,omitempty"`
+	RetryOn               []string `json:"retry_on,omitempty" toml:"retry_on,omitempty"`
+	MaxFallbackAttempts   *int     `json:"max_fallback_attempts,omitempty" toml:"max_fallback_attempts,omitempty"`
+	CAFile                string   `json:"ca_file,omitempty" toml:"ca_file,omitempty"`
+	InsecureSkipVerify    *bool    `json:"insecure_skip_verify,omitempty" toml:"insecure_skip_verify,omitempty"`
+	SNI                   string   `json:"sni,omitempty" toml:"sni,omitempty"`
 }
 
 type LimitsConfig struct {
-	MaxInflight     int    `json:"max_inflight"`
-	MaxInflightWait string `json:"max_inflight_wait"`
+	MaxInflight       int      `json:"max_inflight" toml:"max_inflight"`
+	MaxInflightWait   string   `json:"max_inflight_wait" toml:"max_inflight_wait"`
+	MaxHeaderCount    int      `json:"max_header_count" toml:"max_header_count"`
+	ExemptMethods     []string `json:"limiter_exempt_methods" toml:"limiter_exempt_methods"`
+	ExemptPaths       []string `json:"limiter_exempt_paths" toml:"limiter_exempt_paths"`
+	MinHTTPVersion    string   `json:"min_http_version" toml:"min_http_version"`
+	RequireHost       bool     `json:"require_host" toml:"require_host"`
+	MissingHostStatus int      `json:"missing_host_status" toml:"missing_host_status"`
+	MissingHostBody   string   `json:"missing_host_body" toml:"missing_host_body"`
+}
+
+type BuiltinsConfig struct {
+	Favicon    bool   `json:"favicon" toml:"favicon"`
+	Robots     bool   `json:"robots" toml:"robots"`
+	RobotsBody string `json:"robots_body" toml:"robots_body"`
+}
+
+type StatsdConfig struct {
+	Address string   `json:"address" toml:"address"`
+	Prefix  string   `json:"prefix" toml:"prefix"`
+	Tags    []string `json:"tags" toml:"tags"`
+}
+
+// DNSConfig replaces the terasu resolver for upstream hosts with queries to
+// the given servers, tried in order, over DNS over TLS unless Protocol is
+// udp.
+type DNSConfig struct {
+	Servers  []string `json:"servers" toml:"servers"`
+	Protocol string   `json:"protocol" toml:"protocol"`
+	CAFile   string   `json:"ca_file" toml:"ca_file"`
+	Timeout  string   `json:"timeout" toml:"timeout"`
 }
 
 type RouteConfig struct {
-	Name         string `json:"name"`
-	PublicPrefix string `json:"public_prefix"`
-	Upstream     string `json:"upstream"`
-	PreserveHost bool   `json:"preserve_host"`
+	Name                   string                `json:"name" toml:"name"`
+	PublicHost             string                `json:"public_host,omitempty" toml:"public_host,omitempty"`
+	PublicPrefix           string                `json:"public_prefix" toml:"public_prefix"`
+	MatchRegex             string                `json:"match_regex,omitempty" toml:"match_regex,omitempty"`
+	Methods                []string              `json:"methods,omitempty" toml:"methods,omitempty"`
+	UpstreamPathTemplate   string                `json:"upstream_path_template,omitempty" toml:"upstream_path_template,omitempty" envsubst:"-"`
+	Upstream               string                `json:"upstream" toml:"upstream"`
+	UpstreamScheme         string                `json:"upstream_scheme,omitempty" toml:"upstream_scheme,omitempty"`
+	IgnoreUpstreamScheme   bool                  `json:"ignore_upstream_scheme,omitempty" toml:"ignore_upstream_scheme,omitempty"`
+	PreserveHost           bool                  `json:"preserve_host" toml:"preserve_host"`
+	PreserveHostFor        []string              `json:"preserve_host_for,omitempty" toml:"preserve_host_for,omitempty"`
+	PreserveRawPath        bool                  `json:"preserve_raw_path,omitempty" toml:"preserve_raw_path,omitempty"`
+	RewriteLocation        *bool                 `json:"rewrite_location,omitempty" toml:"rewrite_location,omitempty"`
+	RewriteWWWAuthenticate *bool                 `json:"rewrite_www_authenticate,omitempty" toml:"rewrite_www_authenticate,omitempty"`
+	RewriteHeaders         []string              `json:"rewrite_headers,omitempty" toml:"rewrite_headers,omitempty"`
+	RewriteJSONPaths       []string              `json:"rewrite_json_paths,omitempty" toml:"rewrite_json_paths,omitempty"`
+	ForwardHeaders         []string              `json:"forward_headers,omitempty" toml:"forward_headers,omitempty"`
+	MaxRewriteBytes        int                   `json:"max_rewrite_bytes,omitempty" toml:"max_rewrite_bytes,omitempty"`
+	RewriteBody            bool                  `json:"rewrite_body,omitempty" toml:"rewrite_body,omitempty"`
+	MaxBodyRewriteBytes    int                   `json:"max_body_rewrite_bytes,omitempty" toml:"max_body_rewrite_bytes,omitempty"`
+	AcceptEncoding         string                `json:"accept_encoding,omitempty" toml:"accept_encoding,omitempty"`
+	Decompress             bool                  `json:"decompress,omitempty" toml:"decompress,omitempty"`
+	MaxInflight            int                   `json:"max_inflight,omitempty" toml:"max_inflight,omitempty"`
+	MaxInflightWait        string                `json:"max_inflight_wait,omitempty" toml:"max_inflight_wait,omitempty"`
+	IdleConnTimeout        string                `json:"idle_conn_timeout,omitempty" toml:"idle_conn_timeout,omitempty"`
+	Transport              *RouteTransportConfig `json:"transport,omitempty" toml:"transport,omitempty"`
+	IsolatedPool           bool                  `json:"isolated_pool,omitempty" toml:"isolated_pool,omitempty"`
+	MaxIdleConns           int                   `json:"max_idle_conns,omitempty" toml:"max_idle_conns,omitempty"`
+	MaxConnsPerHost        int                   `json:"max_conns_per_host,omitempty" toml:"max_conns_per_host,omitempty"`
+	VerifyDigest           bool                  `json:"verify_digest,omitempty" toml:"verify_digest,omitempty"`
+	DigestHeader           string                `json:"digest_header,omitempty" toml:"digest_header,omitempty"`
+	TokenCache             bool                  `json:"token_cache,omitempty" toml:"token_cache,omitempty"`
+	AccessLog              *bool                 `json:"access_log,omitempty" toml:"access_log,omitempty"`
+	DebugBodyLog           int                   `json:"debug_body_log,omitempty" toml:"debug_body_log,omitempty"`
+	FollowRedirects        int                   `json:"follow_redirects,omitempty" toml:"follow_redirects,omitempty"`
+	FollowCrossRoute       bool                  `json:"follow_cross_route,omitempty" toml:"follow_cross_route,omitempty"`
+	HeadViaGet             bool                  `json:"head_via_get,omitempty" toml:"head_via_get,omitempty"`
+	HeadResponse           string                `json:"head_response,omitempty" toml:"head_response,omitempty"`
+	HealthPath             string                `json:"health_path,omitempty" toml:"health_path,omitempty"`
+	ExpectStatus           int                   `json:"expect_status,omitempty" toml:"expect_status,omitempty"`
+	ExpectBodyContains     string                `json:"expect_body_contains,omitempty" toml:"expect_body_contains,omitempty"`
 }
 
 type RuntimeConfig struct {
-	Listen        string
-	PublicBaseURL *url.URL
-	AccessLog     bool
-	TLS           *TLSConfig
-	Timeouts      RuntimeTimeouts
-	Transport     RuntimeTransport
-	Limits        RuntimeLimits
-	Routes        []RouteConfig
+	ConfigHash          string
+	Listen              string
+	ListenAddresses     []string
+	ListenBacklog       int
+	TCPKeepAlive        time.Duration
+	PublicBaseURL       *url.URL
+	PublicBaseMode      string
+	PublicBaseScheme    string
+	PublicBaseHosts     []string
+	AccessLog           bool
+	LogLevel            string
+	AdminToken          string
+	AllowMetricsReset   bool
+	ResponseSizeBuckets []float64
+	DisableHTTP2Server  bool
+	DuplicateUpstreams  string
+	TLS                 *TLSConfig
+	Timeouts            RuntimeTimeouts
+	Transport           RuntimeTransport
+	Limits              RuntimeLimits
+	Builtins            BuiltinsConfig
+	Statsd              *StatsdConfig
+	Deprecations        []Deprecation
+	// UpstreamDuplicates is filled when DuplicateUpstreams is "warn".
+	UpstreamDuplicates []DuplicateUpstreamError
+	Routes             []RouteConfig
 }
 
 type RuntimeTimeouts struct {
-	ReadHeaderTimeout time.Duration
-	ReadTimeout       time.Duration
-	WriteTimeout      time.Duration
-	IdleTimeout       time.Duration
-	ShutdownTimeout   time.Duration
-	MaxHeaderBytes    int
+	ReadHeaderTimeout  time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	ShutdownTimeout    time.Duration
+	ReloadDrain        time.Duration
+	MaxHeaderBytes     int
+	RequestMaxDuration time.Duration
 }
 
 type RuntimeTransport struct {
 	FirstFragmentLen      uint8
+	AdaptiveFragment      bool
+	FragmentStrategy      string
 	DialTimeout           time.Duration
+	MaxDialsPerHost       int
+	DialQueueTimeout      time.Duration
 	KeepAlive             time.Duration
 	MaxIdleConns          int
 	MaxIdleConnsPerHost   int
@@ -114,11 +283,57 @@ type RuntimeTransport struct {
 	ExpectContinueTimeout time.Duration
 	ForceHTTP2            bool
 	DisableCompression    bool
+	RetryOn               []string
+	MaxFallbackAttempts   int
+	RetryOnStatus         []int
+	MaxRetries            int
+	RetryBackoff          time.Duration
+	RetryBufferBytes      int
+	ProxyURL              *url.URL
+	CAFile                string
+	InsecureSkipVerify    bool
+	TLSMinVersion         uint16
+	TLSMaxVersion         uint16
+	// SNI, set only per route, replaces the upstream host as the TLS
+	// server name; addresses are still resolved from the upstream host.
+	SNI                     string
+	WarmupConnections       bool
+	HeaderCasing            []string
+	CertCheckInterval       time.Duration
+	IdleConnRecycleInterval time.Duration
+	ReadBufferSize          int
+	WriteBufferSize         int
+	// Pool, when set, keeps this transport from being shared with routes
+	// whose settings happen to match.
+	Pool string
+	// IPMode is one of the ipMode constants; auto is decided by probing the
+	// host's IPv6 setup when the transport is built.
+	IPMode string
+	// DNSCacheTTL keeps resolved upstream addresses for this long; 0 turns
+	// the cache off.
+	DNSCacheTTL time.Duration
+	// DNSServers, DNSProtocol, DNSCAFile and DNSTimeout come from the
+	// top-level dns block.
+	DNSServers  []string
+	DNSProtocol string
+	DNSCAFile   string
+	DNSTimeout  time.Duration
+	// hostPolicy comes from the top-level allowed_upstream_hosts and
+	// denied_upstream_hosts.
+	hostPolicy *upstreamHostPolicy
 }
 
 type RuntimeLimits struct {
 	MaxInflight     int
 	MaxInflightWait time.Duration
+	MaxHeaderCount  int
+	ExemptMethods   []string
+	ExemptPaths     []string
+	// MinHTTPVersion is major*10+minor, e.g. 11 for HTTP/1.1; 0 accepts all.
+	MinHTTPVersion    int
+	RequireHost       bool
+	MissingHostStatus int
+	MissingHostBody   string
 }
 
 func LoadConfig(path string) (Config, error) {
@@ -127,20 +342,145 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, err
 	}
 	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		md, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return Config{}, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return Config{}, fmt.Errorf("unknown config key %q", undecoded[0].String())
+		}
+	case ".yaml", ".yml":
+		// Decoded through JSON so the json tags, and so field names and
+		// validation, are shared with the JSON format.
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return Config{}, err
+		}
+		if doc != nil {
+			converted, err := json.Marshal(doc)
+			if err != nil {
+				return Config{}, err
+			}
+			if err := json.Unmarshal(converted, &cfg); err != nil {
+				return Config{}, err
+			}
+		}
+	default:
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := expandConfigEnv(&cfg); err != nil {
 		return Config{}, err
 	}
 	return cfg, nil
 }
 
+// EncodeConfig writes cfg in the given format ("json", "toml" or "yaml").
+func EncodeConfig(w io.Writer, cfg Config, format string) error {
+	switch strings.ToLower(format) {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cfg)
+	case "toml":
+		return toml.NewEncoder(w).Encode(cfg)
+	case "yaml", "yml":
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		// JSON is valid YAML; decoding it into a node keeps the field order,
+		// and dropping the flow styles yields block YAML.
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		clearYAMLStyle(&node)
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unsupported config format %q", format)
+	}
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
 func (c Config) Runtime() (RuntimeConfig, error) {
+	if strings.TrimSpace(c.Listen) != "" && len(c.ListenAddresses) > 0 {
+		return RuntimeConfig{}, errors.New("listen and listen_addresses are mutually exclusive; move listen into listen_addresses")
+	}
 	if c.Listen == "" {
 		c.Listen = defaultListen
 	}
+	if err := c.applyTimeoutsPreset(); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("timeouts_preset: %w", err)
+	}
 	publicBase, err := parsePublicBaseURL(c.PublicBaseURL)
 	if err != nil {
 		return RuntimeConfig{}, err
 	}
+	listenAddresses := append([]string(nil), c.ListenAddresses...)
+	if len(listenAddresses) == 0 {
+		listenAddresses = []string{c.Listen}
+	}
+	for i, addr := range listenAddresses {
+		if strings.TrimSpace(addr) == "" {
+			return RuntimeConfig{}, fmt.Errorf("listen_addresses[%d] must not be empty", i)
+		}
+		// An empty port would bind a random one, as a "${PORT:-}" left unset
+		// by rmirrord does.
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return RuntimeConfig{}, fmt.Errorf("listen_addresses[%d]: %w", i, err)
+		}
+		if port == "" {
+			return RuntimeConfig{}, fmt.Errorf("listen_addresses[%d]: missing port", i)
+		}
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return RuntimeConfig{}, fmt.Errorf("listen_addresses[%d]: invalid port %q", i, port)
+		}
+	}
+	if c.ListenBacklog < 0 {
+		return RuntimeConfig{}, errors.New("listen_backlog must be >= 0")
+	}
+	tcpKeepAlive, err := parseDuration(c.TCPKeepAlive, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("tcp_keepalive: %w", err)
+	}
+	publicBaseMode, err := parsePublicBaseMode(c.PublicBaseMode)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("public_base_mode: %w", err)
+	}
+	duplicateUpstreams, err := parseDuplicateUpstreams(c.DuplicateUpstreams)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("duplicate_upstreams: %w", err)
+	}
+	publicBaseScheme, err := parsePublicBaseScheme(c.PublicBaseScheme)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("public_base_scheme: %w", err)
+	}
+	if publicBaseMode == publicBaseAllowlist && len(c.PublicBaseHosts) == 0 {
+		return RuntimeConfig{}, errors.New("public_base_hosts must not be empty when public_base_mode is allowlist")
+	}
+	publicBaseHosts := make([]string, 0, len(c.PublicBaseHosts))
+	for _, host := range c.PublicBaseHosts {
+		publicBaseHosts = append(publicBaseHosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("log_level: %w", err)
+	}
 	readHeaderTimeout, err := parseDuration(c.Timeouts.ReadHeaderTimeout, defaultReadHeaderTimeout)
 	if err != nil {
 		return RuntimeConfig{}, fmt.Errorf("read_header_timeout: %w", err)
@@ -161,18 +501,46 @@ func (c Config) Runtime() (RuntimeConfig, error) {
 	if err != nil {
 		return RuntimeConfig{}, fmt.Errorf("shutdown_timeout: %w", err)
 	}
+	reloadDrain, err := parseDuration(c.Timeouts.ReloadDrain, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("reload_drain: %w", err)
+	}
 	maxHeaderBytes := c.Timeouts.MaxHeaderBytes
 	if maxHeaderBytes <= 0 {
 		maxHeaderBytes = defaultMaxHeaderBytes
 	}
+	requestMaxDuration, err := parseDuration(c.Timeouts.RequestMaxDuration, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("request_max_duration: %w", err)
+	}
 
 	dialTimeout, err := parseDuration(c.Transport.DialTimeout, defaultDialTimeout)
 	if err != nil {
 		return RuntimeConfig{}, fmt.Errorf("dial_timeout: %w", err)
 	}
-	keepAlive, err := parseDuration(c.Transport.KeepAlive, defaultKeepAlive)
+	if c.Transport.MaxDialsPerHost < 0 {
+		return RuntimeConfig{}, errors.New("max_dials_per_host must be >= 0")
+	}
+	dialQueueTimeout, err := parseDuration(c.Transport.DialQueueTimeout, dialTimeout)
 	if err != nil {
-		return RuntimeConfig{}, fmt.Errorf("keepalive: %w", err)
+		return RuntimeConfig{}, fmt.Errorf("dial_queue_timeout: %w", err)
+	}
+	// keepalive is an alias of dial_keepalive; a config setting both to
+	// different values is refused rather than silently ignoring one.
+	var deprecations []Deprecation
+	dialKeepAlive, keepAliveField := c.Transport.DialKeepAlive, "dial_keepalive"
+	if c.Transport.KeepAlive != "" {
+		deprecations = append(deprecations, Deprecation{Field: "transport.keepalive", Replacement: "transport.dial_keepalive"})
+		switch {
+		case dialKeepAlive == "":
+			dialKeepAlive, keepAliveField = c.Transport.KeepAlive, "keepalive"
+		case strings.TrimSpace(dialKeepAlive) != strings.TrimSpace(c.Transport.KeepAlive):
+			return RuntimeConfig{}, fmt.Errorf("keepalive %q conflicts with dial_keepalive %q; set only dial_keepalive", c.Transport.KeepAlive, dialKeepAlive)
+		}
+	}
+	keepAlive, err := parseDuration(dialKeepAlive, defaultKeepAlive)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("%s: %w", keepAliveField, err)
 	}
 	idleConnTimeout, err := parseDuration(c.Transport.IdleConnTimeout, defaultIdleConnTimeout)
 	if err != nil {
@@ -190,6 +558,82 @@ func (c Config) Runtime() (RuntimeConfig, error) {
 	if err != nil {
 		return RuntimeConfig{}, fmt.Errorf("expect_continue_timeout: %w", err)
 	}
+	retryOn := c.Transport.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{retryTriggerReset}
+	}
+	if _, err := parseRetryTriggers(retryOn); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("retry_on: %w", err)
+	}
+	if c.Transport.MaxFallbackAttempts < 0 {
+		return RuntimeConfig{}, errors.New("max_fallback_attempts must be >= 0")
+	}
+	for _, status := range c.Transport.RetryOnStatus {
+		if status < 400 || status > 599 {
+			return RuntimeConfig{}, fmt.Errorf("retry_on_status: %d is not between 400 and 599", status)
+		}
+	}
+	if c.Transport.MaxRetries < 0 || c.Transport.MaxRetries > maxStatusRetries {
+		return RuntimeConfig{}, fmt.Errorf("max_retries must be between 0 and %d", maxStatusRetries)
+	}
+	retryBackoff, err := parseDuration(c.Transport.RetryBackoff, defaultRetryBackoff)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("retry_backoff: %w", err)
+	}
+	if c.Transport.RetryBufferBytes < 0 {
+		return RuntimeConfig{}, errors.New("retry_buffer_bytes must be >= 0")
+	}
+	proxyURL, err := parseProxyURL(c.Transport.ProxyURL)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("proxy_url: %w", err)
+	}
+	if _, err := loadCAFile(c.Transport.CAFile); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("ca_file: %w", err)
+	}
+	tlsMinVersion, err := parseTLSVersion(c.Transport.TLSMinVersion, tls.VersionTLS12)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("tls_min_version: %w", err)
+	}
+	tlsMaxVersion, err := parseTLSVersion(c.Transport.TLSMaxVersion, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("tls_max_version: %w", err)
+	}
+	if tlsMaxVersion != 0 && tlsMinVersion > tlsMaxVersion {
+		return RuntimeConfig{}, fmt.Errorf("tls_min_version %s is above tls_max_version %s", tlsVersionName(tlsMinVersion), tlsVersionName(tlsMaxVersion))
+	}
+	if _, err := parseHeaderCasing(c.Transport.HeaderCasing); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("header_casing: %w", err)
+	}
+	certCheckInterval, err := parseDuration(c.Transport.CertCheckInterval, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("cert_check_interval: %w", err)
+	}
+	idleConnRecycleInterval, err := parseDuration(c.Transport.IdleConnRecycleInterval, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("idle_conn_recycle_interval: %w", err)
+	}
+	ipMode, err := parseIPMode(c.Transport.IPMode)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("ip_mode: %w", err)
+	}
+	dnsCacheTTL, err := parseDuration(c.Transport.DNSCacheTTL, 0)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("dns_cache_ttl: %w", err)
+	}
+	if dnsCacheTTL < 0 {
+		return RuntimeConfig{}, errors.New("dns_cache_ttl must be >= 0")
+	}
+	if err := validateBufferSize(c.Transport.ReadBufferSize); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("read_buffer_size: %w", err)
+	}
+	if err := validateBufferSize(c.Transport.WriteBufferSize); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("write_buffer_size: %w", err)
+	}
+	for i, bound := range c.ResponseSizeBuckets {
+		if bound <= 0 || (i > 0 && bound <= c.ResponseSizeBuckets[i-1]) {
+			return RuntimeConfig{}, errors.New("response_size_buckets must be positive and strictly increasing")
+		}
+	}
 	maxInflight := c.Limits.MaxInflight
 	if maxInflight < 0 {
 		return RuntimeConfig{}, errors.New("max_inflight must be >= 0")
@@ -198,6 +642,37 @@ func (c Config) Runtime() (RuntimeConfig, error) {
 	if err != nil {
 		return RuntimeConfig{}, fmt.Errorf("max_inflight_wait: %w", err)
 	}
+	if c.Limits.MaxHeaderCount < 0 {
+		return RuntimeConfig{}, errors.New("max_header_count must be >= 0")
+	}
+	minHTTPVersion, err := parseHTTPVersion(c.Limits.MinHTTPVersion)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("min_http_version: %w", err)
+	}
+	missingHostStatus := c.Limits.MissingHostStatus
+	if missingHostStatus == 0 {
+		missingHostStatus = http.StatusBadRequest
+	}
+	if missingHostStatus < 400 || missingHostStatus > 599 {
+		return RuntimeConfig{}, errors.New("missing_host_status must be between 400 and 599")
+	}
+	missingHostBody := c.Limits.MissingHostBody
+	if missingHostBody == "" {
+		missingHostBody = defaultMissingHostBody
+	}
+	exemptMethods := make([]string, 0, len(c.Limits.ExemptMethods))
+	for _, method := range c.Limits.ExemptMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return RuntimeConfig{}, fmt.Errorf("limiter_exempt_methods: invalid method %q", method)
+		}
+		exemptMethods = append(exemptMethods, method)
+	}
+	for _, prefix := range c.Limits.ExemptPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return RuntimeConfig{}, fmt.Errorf("limiter_exempt_paths: %q must start with /", prefix)
+		}
+	}
 
 	maxIdleConns := c.Transport.MaxIdleConns
 	if maxIdleConns <= 0 {
@@ -214,46 +689,196 @@ func (c Config) Runtime() (RuntimeConfig, error) {
 	if firstFragmentLen < 0 || firstFragmentLen > 255 {
 		return RuntimeConfig{}, errors.New("first_fragment_len must be between 0 and 255")
 	}
+	fragmentStrategy, err := parseFragmentStrategy(c.Transport.FragmentStrategy)
+	if err != nil {
+		return RuntimeConfig{}, fmt.Errorf("fragment_strategy: %w", err)
+	}
+	hostPolicy, err := newUpstreamHostPolicy(c.AllowedUpstreamHosts, c.DeniedUpstreamHosts)
+	if err != nil {
+		return RuntimeConfig{}, err
+	}
+
+	builtins := c.Builtins
+	if builtins.RobotsBody == "" {
+		builtins.RobotsBody = defaultRobotsBody
+	}
+	if c.Statsd != nil {
+		if _, _, err := net.SplitHostPort(c.Statsd.Address); err != nil {
+			return RuntimeConfig{}, fmt.Errorf("statsd.address: %w", err)
+		}
+		for i, tag := range c.Statsd.Tags {
+			if tag == "" || strings.ContainsAny(tag, ",|#") {
+				return RuntimeConfig{}, fmt.Errorf("statsd.tags[%d] must be a non-empty key:value without ',', '|' or '#'", i)
+			}
+		}
+	}
+	var dnsServers []string
+	var dnsProtocol, dnsCAFile string
+	var dnsTimeout time.Duration
+	if c.DNS != nil {
+		for i, server := range c.DNS.Servers {
+			if _, err := parseDNSServer(server); err != nil {
+				return RuntimeConfig{}, fmt.Errorf("dns.servers[%d]: %w", i, err)
+			}
+			dnsServers = append(dnsServers, strings.TrimSpace(server))
+		}
+		dnsProtocol, err = parseDNSProtocol(c.DNS.Protocol)
+		if err != nil {
+			return RuntimeConfig{}, fmt.Errorf("dns.protocol: %w", err)
+		}
+		if c.DNS.CAFile != "" {
+			if _, err := loadCAFile(c.DNS.CAFile); err != nil {
+				return RuntimeConfig{}, fmt.Errorf("dns.ca_file: %w", err)
+			}
+		}
+		dnsCAFile = c.DNS.CAFile
+		dnsTimeout, err = parseDuration(c.DNS.Timeout, defaultDNSTimeout)
+		if err != nil {
+			return RuntimeConfig{}, fmt.Errorf("dns.timeout: %w", err)
+		}
+		if dnsTimeout <= 0 {
+			return RuntimeConfig{}, errors.New("dns.timeout must be > 0")
+		}
+	}
+
+	hash, err := c.hash()
+	if err != nil {
+		return RuntimeConfig{}, err
+	}
 
 	cfg := RuntimeConfig{
-		Listen:        c.Listen,
-		PublicBaseURL: publicBase,
-		AccessLog:     c.AccessLog,
-		TLS:           c.TLS,
+		ConfigHash:          hash,
+		Listen:              listenAddresses[0],
+		ListenAddresses:     listenAddresses,
+		ListenBacklog:       c.ListenBacklog,
+		TCPKeepAlive:        tcpKeepAlive,
+		PublicBaseURL:       publicBase,
+		PublicBaseMode:      publicBaseMode,
+		PublicBaseScheme:    publicBaseScheme,
+		DuplicateUpstreams:  duplicateUpstreams,
+		PublicBaseHosts:     publicBaseHosts,
+		AccessLog:           c.AccessLog,
+		LogLevel:            c.LogLevel,
+		AdminToken:          c.AdminToken,
+		AllowMetricsReset:   c.AllowMetricsReset,
+		ResponseSizeBuckets: c.ResponseSizeBuckets,
+		DisableHTTP2Server:  c.DisableHTTP2Server,
+		TLS:                 c.TLS,
 		Timeouts: RuntimeTimeouts{
-			ReadHeaderTimeout: readHeaderTimeout,
-			ReadTimeout:       readTimeout,
-			WriteTimeout:      writeTimeout,
-			IdleTimeout:       idleTimeout,
-			ShutdownTimeout:   shutdownTimeout,
-			MaxHeaderBytes:    maxHeaderBytes,
+			ReadHeaderTimeout:  readHeaderTimeout,
+			ReadTimeout:        readTimeout,
+			WriteTimeout:       writeTimeout,
+			IdleTimeout:        idleTimeout,
+			ShutdownTimeout:    shutdownTimeout,
+			ReloadDrain:        reloadDrain,
+			MaxHeaderBytes:     maxHeaderBytes,
+			RequestMaxDuration: requestMaxDuration,
 		},
 		Transport: RuntimeTransport{
-			FirstFragmentLen:      uint8(firstFragmentLen),
-			DialTimeout:           dialTimeout,
-			KeepAlive:             keepAlive,
-			MaxIdleConns:          maxIdleConns,
-			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
-			MaxConnsPerHost:       c.Transport.MaxConnsPerHost,
-			IdleConnTimeout:       idleConnTimeout,
-			TLSHandshakeTimeout:   tlsHandshakeTimeout,
-			ResponseHeaderTimeout: responseHeaderTimeout,
-			ExpectContinueTimeout: expectContinueTimeout,
-			ForceHTTP2:            c.Transport.ForceHTTP2,
-			DisableCompression:    c.Transport.DisableCompression,
+			FirstFragmentLen:        uint8(firstFragmentLen),
+			AdaptiveFragment:        c.Transport.AdaptiveFragment,
+			FragmentStrategy:        fragmentStrategy,
+			DialTimeout:             dialTimeout,
+			MaxDialsPerHost:         c.Transport.MaxDialsPerHost,
+			DialQueueTimeout:        dialQueueTimeout,
+			KeepAlive:               keepAlive,
+			MaxIdleConns:            maxIdleConns,
+			MaxIdleConnsPerHost:     maxIdleConnsPerHost,
+			MaxConnsPerHost:         c.Transport.MaxConnsPerHost,
+			IdleConnTimeout:         idleConnTimeout,
+			TLSHandshakeTimeout:     tlsHandshakeTimeout,
+			ResponseHeaderTimeout:   responseHeaderTimeout,
+			ExpectContinueTimeout:   expectContinueTimeout,
+			ForceHTTP2:              c.Transport.ForceHTTP2,
+			DisableCompression:      c.Transport.DisableCompression,
+			RetryOn:                 retryOn,
+			MaxFallbackAttempts:     c.Transport.MaxFallbackAttempts,
+			RetryOnStatus:           c.Transport.RetryOnStatus,
+			MaxRetries:              c.Transport.MaxRetries,
+			RetryBackoff:            retryBackoff,
+			RetryBufferBytes:        c.Transport.RetryBufferBytes,
+			ProxyURL:                proxyURL,
+			CAFile:                  c.Transport.CAFile,
+			InsecureSkipVerify:      c.Transport.InsecureSkipVerify,
+			TLSMinVersion:           tlsMinVersion,
+			TLSMaxVersion:           tlsMaxVersion,
+			WarmupConnections:       c.Transport.WarmupConnections,
+			HeaderCasing:            c.Transport.HeaderCasing,
+			CertCheckInterval:       certCheckInterval,
+			IdleConnRecycleInterval: idleConnRecycleInterval,
+			ReadBufferSize:          c.Transport.ReadBufferSize,
+			WriteBufferSize:         c.Transport.WriteBufferSize,
+			IPMode:                  ipMode,
+			DNSCacheTTL:             dnsCacheTTL,
+			DNSServers:              dnsServers,
+			DNSProtocol:             dnsProtocol,
+			DNSCAFile:               dnsCAFile,
+			DNSTimeout:              dnsTimeout,
+			hostPolicy:              hostPolicy,
 		},
 		Limits: RuntimeLimits{
-			MaxInflight:     maxInflight,
-			MaxInflightWait: maxInflightWait,
+			MaxInflight:       maxInflight,
+			MaxInflightWait:   maxInflightWait,
+			MaxHeaderCount:    c.Limits.MaxHeaderCount,
+			ExemptMethods:     exemptMethods,
+			ExemptPaths:       c.Limits.ExemptPaths,
+			MinHTTPVersion:    minHTTPVersion,
+			RequireHost:       c.Limits.RequireHost,
+			MissingHostStatus: missingHostStatus,
+			MissingHostBody:   missingHostBody,
 		},
-		Routes: c.Routes,
+		Builtins:     builtins,
+		Statsd:       c.Statsd,
+		Routes:       c.Routes,
+		Deprecations: deprecations,
 	}
 	if err := cfg.validateRoutes(); err != nil {
 		return RuntimeConfig{}, err
 	}
+	if cfg.DuplicateUpstreams == duplicateUpstreamsWarn {
+		cfg.UpstreamDuplicates = cfg.duplicateUpstreams()
+	}
 	return cfg, nil
 }
 
+// hash covers the config and the CA bundles it references, which the
+// transports read from disk, so rotating a bundle counts as a change.
+func (c Config) hash() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	for _, path := range c.caFiles() {
+		// Runtime has already loaded each bundle; a read error still
+		// hashes differently from the contents it had.
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			contents = []byte(err.Error())
+		}
+		fmt.Fprintf(h, "\x00%s\x00%d\x00", path, len(contents))
+		h.Write(contents)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c Config) caFiles() []string {
+	var files []string
+	if c.Transport.CAFile != "" {
+		files = append(files, c.Transport.CAFile)
+	}
+	if c.DNS != nil && c.DNS.CAFile != "" {
+		files = append(files, c.DNS.CAFile)
+	}
+	for _, route := range c.Routes {
+		if route.Transport != nil && route.Transport.CAFile != "" {
+			files = append(files, route.Transport.CAFile)
+		}
+	}
+	return files
+}
+
 func (c RuntimeConfig) validateRoutes() error {
 	if len(c.Routes) == 0 {
 		return errors.New("routes must not be empty")
@@ -270,13 +895,378 @@ func (c RuntimeConfig) validateRoutes() error {
 		if prefix == "/" {
 			prefix = ""
 		}
-		if _, ok := seen[prefix]; ok {
-			return fmt.Errorf("routes[%d].public_prefix duplicates another route", i)
+		host := strings.ToLower(strings.TrimSpace(route.PublicHost))
+		if strings.Contains(host, "*") && (!strings.HasPrefix(host, "*.") || strings.Count(host, "*") > 1) {
+			return fmt.Errorf("routes[%d].public_host wildcard must be a leading \"*.\"", i)
+		}
+		for _, pattern := range route.PreserveHostFor {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == "" {
+				return fmt.Errorf("routes[%d].preserve_host_for must not contain empty hosts", i)
+			}
+			if strings.Contains(pattern, "*") && (!strings.HasPrefix(pattern, "*.") || strings.Count(pattern, "*") > 1) {
+				return fmt.Errorf("routes[%d].preserve_host_for wildcard must be a leading \"*.\"", i)
+			}
+		}
+		key := host + prefix
+		if route.MatchRegex != "" {
+			if prefix != "" {
+				return fmt.Errorf("routes[%d].match_regex cannot be combined with public_prefix", i)
+			}
+			if _, err := regexp.Compile(route.MatchRegex); err != nil {
+				return fmt.Errorf("routes[%d].match_regex (route %q): %w", i, route.Name, err)
+			}
+			key = host + "~" + route.MatchRegex
+		} else if route.UpstreamPathTemplate != "" {
+			return fmt.Errorf("routes[%d].upstream_path_template requires match_regex", i)
 		}
-		seen[prefix] = struct{}{}
-		if _, err := parseUpstream(route.Upstream); err != nil {
+		// Routes on the same prefix may split it by method; each method, and
+		// the method-agnostic fallback, can be claimed once.
+		keys := []string{key}
+		if len(route.Methods) > 0 {
+			keys = keys[:0]
+			for _, method := range route.Methods {
+				method = strings.ToUpper(strings.TrimSpace(method))
+				if method == "" || strings.ContainsAny(method, " \t/") {
+					return fmt.Errorf("routes[%d].methods: invalid method %q", i, method)
+				}
+				keys = append(keys, key+" "+method)
+			}
+		}
+		for _, key := range keys {
+			if _, ok := seen[key]; ok {
+				return fmt.Errorf("routes[%d].public_prefix duplicates another route", i)
+			}
+			seen[key] = struct{}{}
+		}
+		upstream, err := parseUpstream(route.Upstream)
+		if err != nil {
 			return fmt.Errorf("routes[%d].upstream: %w", i, err)
 		}
+		if reason := c.Transport.hostPolicy.blockReason(upstream.Hostname(), netip.Addr{}, false); reason != "" {
+			return fmt.Errorf("routes[%d].upstream: %w", i, &BlockedUpstreamError{Host: upstream.Hostname(), Reason: reason})
+		}
+		if route.DebugBodyLog < 0 || route.DebugBodyLog > maxDebugBodyLog {
+			return fmt.Errorf("routes[%d].debug_body_log must be between 0 and %d", i, maxDebugBodyLog)
+		}
+		if route.FollowRedirects < 0 {
+			return fmt.Errorf("routes[%d].follow_redirects must be >= 0", i)
+		}
+		if route.UpstreamScheme != "" && route.UpstreamScheme != "http" && route.UpstreamScheme != "https" {
+			return fmt.Errorf("routes[%d].upstream_scheme must be http or https", i)
+		}
+		for j, expr := range route.RewriteJSONPaths {
+			if _, err := parseJSONPath(expr); err != nil {
+				return fmt.Errorf("routes[%d].rewrite_json_paths[%d]: %w", i, j, err)
+			}
+		}
+		if strings.ContainsAny(route.AcceptEncoding, "\r\n") {
+			return fmt.Errorf("routes[%d].accept_encoding must be a single header value", i)
+		}
+		if route.MaxRewriteBytes < 0 {
+			return fmt.Errorf("routes[%d].max_rewrite_bytes must be >= 0", i)
+		}
+		if route.MaxBodyRewriteBytes < 0 {
+			return fmt.Errorf("routes[%d].max_body_rewrite_bytes must be >= 0", i)
+		}
+		if route.MaxInflight < 0 {
+			return fmt.Errorf("routes[%d].max_inflight must be >= 0", i)
+		}
+		if _, err := parseDuration(route.MaxInflightWait, 0); err != nil {
+			return fmt.Errorf("routes[%d].max_inflight_wait: %w", i, err)
+		}
+		if route.HealthPath != "" && !strings.HasPrefix(route.HealthPath, "/") {
+			return fmt.Errorf("routes[%d].health_path must start with /", i)
+		}
+		if route.ExpectStatus != 0 && (route.ExpectStatus < 100 || route.ExpectStatus > 599) {
+			return fmt.Errorf("routes[%d].expect_status must be between 100 and 599", i)
+		}
+		if _, _, err := c.routeTransport(route); err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+	}
+	if c.DuplicateUpstreams == duplicateUpstreamsError {
+		if dups := c.duplicateUpstreams(); len(dups) > 0 {
+			return &dups[0]
+		}
+	}
+	return nil
+}
+
+// DuplicateUpstreamError reports a route whose effective upstream mapping,
+// scheme, host and base path plus any upstream_path_template, is identical
+// to an earlier route's, which usually means a copied route was not edited.
+// Routes sharing a public prefix, such as a prefix split by methods, are not
+// compared with each other.
+type DuplicateUpstreamError struct {
+	Index         int
+	Route         string
+	PreviousIndex int
+	PreviousRoute string
+	Upstream      string
+}
+
+func (e *DuplicateUpstreamError) Error() string {
+	return fmt.Sprintf("routes[%d] (route %q) maps to the same upstream %s as routes[%d] (route %q)", e.Index, e.Route, e.Upstream, e.PreviousIndex, e.PreviousRoute)
+}
+
+// duplicateUpstreams expects routes that already passed validateRoutes.
+func (c RuntimeConfig) duplicateUpstreams() []DuplicateUpstreamError {
+	type mapping struct {
+		index int
+		match string
+	}
+	seen := map[string]mapping{}
+	var dups []DuplicateUpstreamError
+	for i, route := range c.Routes {
+		upstream, err := parseUpstream(route.Upstream)
+		if err != nil {
+			continue
+		}
+		if route.UpstreamScheme != "" {
+			upstream.Scheme = route.UpstreamScheme
+		}
+		target := strings.ToLower(upstream.Scheme+"://"+upstream.Host) + normalizePath(upstream.Path)
+		if route.UpstreamPathTemplate != "" {
+			target += " " + route.UpstreamPathTemplate
+		}
+		match := strings.ToLower(strings.TrimSpace(route.PublicHost)) + normalizePath(route.PublicPrefix) + "~" + route.MatchRegex
+		prev, ok := seen[target]
+		if !ok {
+			seen[target] = mapping{index: i, match: match}
+			continue
+		}
+		if prev.match == match {
+			continue
+		}
+		dups = append(dups, DuplicateUpstreamError{
+			Index:         i,
+			Route:         route.Name,
+			PreviousIndex: prev.index,
+			PreviousRoute: c.Routes[prev.index].Name,
+			Upstream:      target,
+		})
+	}
+	return dups
+}
+
+// RouteTransport returns the transport settings a route's upstream requests
+// use, and whether they differ from the top-level transport, in which case
+// the route gets a transport of its own.
+func (c RuntimeConfig) RouteTransport(route RouteConfig) (RuntimeTransport, bool) {
+	rt, overridden, err := c.routeTransport(route)
+	if err != nil {
+		// Runtime has already rejected the route.
+		return c.Transport, false
+	}
+	return rt, overridden
+}
+
+func (c RuntimeConfig) routeTransport(route RouteConfig) (RuntimeTransport, bool, error) {
+	rt := c.Transport
+	overridden := false
+	if strings.TrimSpace(route.IdleConnTimeout) != "" {
+		idleConnTimeout, err := time.ParseDuration(route.IdleConnTimeout)
+		if err != nil {
+			return rt, false, fmt.Errorf("idle_conn_timeout: %w", err)
+		}
+		rt.IdleConnTimeout = idleConnTimeout
+		overridden = true
+	}
+	if route.MaxIdleConns < 0 || route.MaxConnsPerHost < 0 {
+		return rt, false, errors.New("max_idle_conns and max_conns_per_host must be >= 0")
+	}
+	if route.MaxIdleConns > 0 {
+		rt.MaxIdleConns = route.MaxIdleConns
+		rt.MaxIdleConnsPerHost = route.MaxIdleConns
+		overridden = true
+	}
+	if route.MaxConnsPerHost > 0 {
+		rt.MaxConnsPerHost = route.MaxConnsPerHost
+		overridden = true
+	}
+	if route.IsolatedPool {
+		rt.Pool = route.Name + "|" + route.PublicHost + route.PublicPrefix
+		overridden = true
+	}
+	if route.Transport != nil {
+		if err := route.Transport.apply(&rt); err != nil {
+			return rt, false, fmt.Errorf("transport.%w", err)
+		}
+		overridden = true
+	}
+	return rt, overridden, nil
+}
+
+func (o *RouteTransportConfig) apply(rt *RuntimeTransport) error {
+	if o.FirstFragmentLen != nil {
+		if *o.FirstFragmentLen < 1 || *o.FirstFragmentLen > 255 {
+			return errors.New("first_fragment_len must be between 1 and 255")
+		}
+		rt.FirstFragmentLen = uint8(*o.FirstFragmentLen)
+	}
+	if o.AdaptiveFragment != nil {
+		rt.AdaptiveFragment = *o.AdaptiveFragment
+	}
+	var err error
+	if rt.DialTimeout, err = parseDuration(o.DialTimeout, rt.DialTimeout); err != nil {
+		return fmt.Errorf("dial_timeout: %w", err)
+	}
+	if rt.TLSHandshakeTimeout, err = parseDuration(o.TLSHandshakeTimeout, rt.TLSHandshakeTimeout); err != nil {
+		return fmt.Errorf("tls_handshake_timeout: %w", err)
+	}
+	if rt.ResponseHeaderTimeout, err = parseDuration(o.ResponseHeaderTimeout, rt.ResponseHeaderTimeout); err != nil {
+		return fmt.Errorf("response_header_timeout: %w", err)
+	}
+	if o.ForceHTTP2 != nil {
+		rt.ForceHTTP2 = *o.ForceHTTP2
+	}
+	if o.DisableCompression != nil {
+		rt.DisableCompression = *o.DisableCompression
+	}
+	if len(o.RetryOn) > 0 {
+		if _, err := parseRetryTriggers(o.RetryOn); err != nil {
+			return fmt.Errorf("retry_on: %w", err)
+		}
+		rt.RetryOn = o.RetryOn
+	}
+	if o.MaxFallbackAttempts != nil {
+		if *o.MaxFallbackAttempts < 0 {
+			return errors.New("max_fallback_attempts must be >= 0")
+		}
+		rt.MaxFallbackAttempts = *o.MaxFallbackAttempts
+	}
+	if o.CAFile != "" {
+		if _, err := loadCAFile(o.CAFile); err != nil {
+			return fmt.Errorf("ca_file: %w", err)
+		}
+		rt.CAFile = o.CAFile
+	}
+	if o.InsecureSkipVerify != nil {
+		rt.InsecureSkipVerify = *o.InsecureSkipVerify
+	}
+	if sni := strings.TrimSpace(o.SNI); sni != "" {
+		if strings.ContainsAny(sni, ":/ ") {
+			return errors.New("sni must be a host name without scheme or port")
+		}
+		rt.SNI = sni
+	}
+	return nil
+}
+
+const (
+	timeoutsPresetDefault    = "default"
+	timeoutsPresetStreaming  = "streaming"
+	timeoutsPresetLowLatency = "low-latency"
+)
+
+type timeoutsPreset struct {
+	timeouts  ServerTimeouts
+	transport TransportConfig
+}
+
+// timeoutsPresets hold the values a preset gives the timeout fields left
+// empty; "default" leaves them to the built-in defaults. "0s" disables a
+// timeout.
+var timeoutsPresets = map[string]timeoutsPreset{
+	timeoutsPresetDefault: {},
+	timeoutsPresetStreaming: {
+		timeouts: ServerTimeouts{
+			ReadTimeout:        "0s",
+			WriteTimeout:       "0s",
+			IdleTimeout:        "5m",
+			RequestMaxDuration: "0s",
+		},
+		transport: TransportConfig{
+			IdleConnTimeout:       "5m",
+			TLSHandshakeTimeout:   "30s",
+			ResponseHeaderTimeout: "5m",
+		},
+	},
+	timeoutsPresetLowLatency: {
+		timeouts: ServerTimeouts{
+			ReadHeaderTimeout:  "5s",
+			ReadTimeout:        "30s",
+			WriteTimeout:       "30s",
+			IdleTimeout:        "30s",
+			RequestMaxDuration: "30s",
+		},
+		transport: TransportConfig{
+			DialTimeout:           "3s",
+			TLSHandshakeTimeout:   "5s",
+			ResponseHeaderTimeout: "10s",
+			ExpectContinueTimeout: "500ms",
+		},
+	},
+}
+
+// applyTimeoutsPreset sets the timeout fields the user did not set from the
+// selected preset. A field counts as set when it is non-empty and differs from
+// DefaultConfig, so the defaults written out by -print-default-config still
+// give way to the preset.
+func (c *Config) applyTimeoutsPreset() error {
+	name := strings.ToLower(strings.TrimSpace(c.TimeoutsPreset))
+	if name == "" {
+		name = timeoutsPresetDefault
+	}
+	preset, ok := timeoutsPresets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q", c.TimeoutsPreset)
+	}
+	defaults := DefaultConfig()
+	fields := []struct {
+		dst   *string
+		def   string
+		value string
+	}{
+		{&c.Timeouts.ReadHeaderTimeout, defaults.Timeouts.ReadHeaderTimeout, preset.timeouts.ReadHeaderTimeout},
+		{&c.Timeouts.ReadTimeout, defaults.Timeouts.ReadTimeout, preset.timeouts.ReadTimeout},
+		{&c.Timeouts.WriteTimeout, defaults.Timeouts.WriteTimeout, preset.timeouts.WriteTimeout},
+		{&c.Timeouts.IdleTimeout, defaults.Timeouts.IdleTimeout, preset.timeouts.IdleTimeout},
+		{&c.Timeouts.RequestMaxDuration, defaults.Timeouts.RequestMaxDuration, preset.timeouts.RequestMaxDuration},
+		{&c.Transport.DialTimeout, defaults.Transport.DialTimeout, preset.transport.DialTimeout},
+		{&c.Transport.IdleConnTimeout, defaults.Transport.IdleConnTimeout, preset.transport.IdleConnTimeout},
+		{&c.Transport.TLSHandshakeTimeout, defaults.Transport.TLSHandshakeTimeout, preset.transport.TLSHandshakeTimeout},
+		{&c.Transport.ResponseHeaderTimeout, defaults.Transport.ResponseHeaderTimeout, preset.transport.ResponseHeaderTimeout},
+		{&c.Transport.ExpectContinueTimeout, defaults.Transport.ExpectContinueTimeout, preset.transport.ExpectContinueTimeout},
+	}
+	for _, field := range fields {
+		if field.value != "" && !explicitDuration(*field.dst, field.def) {
+			*field.dst = field.value
+		}
+	}
+	return nil
+}
+
+// explicitDuration reports whether raw is set to something other than def.
+// Values that do not parse count as set, so Runtime reports them.
+func explicitDuration(raw, def string) bool {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return false
+	}
+	if def == "" {
+		return true
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return true
+	}
+	want, err := time.ParseDuration(def)
+	return err != nil || value != want
+}
+
+// Deprecation names a config field that is still honored but has been
+// superseded.
+type Deprecation struct {
+	Field       string
+	Replacement string
+}
+
+// validateBufferSize accepts 0 (Go's 4KiB default) or 1KiB to 4MiB.
+func validateBufferSize(size int) error {
+	if size != 0 && (size < minBufferSize || size > maxBufferSize) {
+		return fmt.Errorf("must be 0 or between %d and %d", minBufferSize, maxBufferSize)
 	}
 	return nil
 }
@@ -309,6 +1299,182 @@ func parsePublicBaseURL(raw string) (*url.URL, error) {
 	return u, nil
 }
 
+const (
+	publicBaseFixed     = "fixed"
+	publicBaseRequest   = "request"
+	publicBaseAllowlist = "allowlist"
+)
+
+func parsePublicBaseMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "":
+		return publicBaseFixed, nil
+	case publicBaseFixed, publicBaseRequest, publicBaseAllowlist:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", raw)
+	}
+}
+
+// HEAD responses carrying a body are stripped to headers only in strict mode
+// and passed through as before in lenient mode.
+const (
+	headResponseStrict  = "strict"
+	headResponseLenient = "lenient"
+)
+
+func parseHeadResponseMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "":
+		return headResponseStrict, nil
+	case headResponseStrict, headResponseLenient:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", raw)
+	}
+}
+
+// ipMode selects the address families used for upstreams. auto keeps IPv6
+// when the host has an IPv6 default route and a global address, and is
+// ipv4-only otherwise.
+const (
+	ipModeAuto     = "auto"
+	ipModeIPv4Only = "ipv4-only"
+	ipModeIPv6Only = "ipv6-only"
+	ipModeDual     = "dual"
+)
+
+func parseIPMode(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "":
+		return ipModeAuto, nil
+	case ipModeAuto, ipModeIPv4Only, ipModeIPv6Only, ipModeDual:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q (want auto, ipv4-only, ipv6-only or dual)", raw)
+	}
+}
+
+const (
+	duplicateUpstreamsAllow = "allow"
+	duplicateUpstreamsWarn  = "warn"
+	duplicateUpstreamsError = "error"
+)
+
+// parseDuplicateUpstreams accepts "allow", "warn", which logs each route
+// that maps to the same upstream as an earlier one, and "error", which
+// rejects the config.
+func parseDuplicateUpstreams(raw string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(raw)); mode {
+	case "":
+		return duplicateUpstreamsAllow, nil
+	case duplicateUpstreamsAllow, duplicateUpstreamsWarn, duplicateUpstreamsError:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", raw)
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion accepts "1.0" to "1.3"; an empty value selects def.
+func parseTLSVersion(raw string, def uint16) (uint16, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	version, ok := tlsVersions[raw]
+	if !ok {
+		return 0, fmt.Errorf("unknown version %q (want 1.0, 1.1, 1.2 or 1.3)", raw)
+	}
+	return version, nil
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+const (
+	fragmentStrategyFirstRecord = "first_record"
+	fragmentStrategyAllRecords  = "all_records"
+	fragmentStrategyByteCount   = "byte_count"
+)
+
+// fragmentStrategies lists the ClientHello fragmentation strategies and
+// whether the linked terasu version implements them. terasu currently only
+// exposes HandshakeContext(ctx, firstFragmentLen), which splits the first
+// record; the others are recognised so a config written for a newer build
+// fails with a clear error instead of an unknown-value one.
+var fragmentStrategies = map[string]bool{
+	fragmentStrategyFirstRecord: true,
+	fragmentStrategyAllRecords:  false,
+	fragmentStrategyByteCount:   false,
+}
+
+func parseFragmentStrategy(raw string) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(raw))
+	if strategy == "" {
+		return fragmentStrategyFirstRecord, nil
+	}
+	supported, ok := fragmentStrategies[strategy]
+	if !ok {
+		return "", fmt.Errorf("unknown strategy %q", raw)
+	}
+	if !supported {
+		return "", fmt.Errorf("%q is not supported by the linked terasu version (supported: %s)", raw, fragmentStrategyFirstRecord)
+	}
+	return strategy, nil
+}
+
+// parsePublicBaseScheme accepts "fixed", where rewrites always use the
+// public_base_url scheme, and "request", where they follow the scheme the
+// client used.
+func parsePublicBaseScheme(raw string) (string, error) {
+	switch scheme := strings.ToLower(strings.TrimSpace(raw)); scheme {
+	case "":
+		return publicBaseFixed, nil
+	case publicBaseFixed, publicBaseRequest:
+		return scheme, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", raw)
+	}
+}
+
+const defaultMissingHostBody = "missing Host header"
+
+// parseHTTPVersion accepts "1.0", "1.1" or "2" and returns major*10+minor.
+func parseHTTPVersion(raw string) (int, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(raw)), "HTTP/") {
+	case "":
+		return 0, nil
+	case "1.0":
+		return 10, nil
+	case "1.1":
+		return 11, nil
+	case "2", "2.0":
+		return 20, nil
+	default:
+		return 0, fmt.Errorf("unsupported version %q", raw)
+	}
+}
+
+func boolValue(v *bool, fallback bool) bool {
+	if v == nil {
+		return fallback
+	}
+	return *v
+}
+
 func normalizePath(raw string) string {
 	if raw == "" {
 		return "/"
@@ -350,34 +1516,85 @@ func parseUpstream(raw string) (*url.URL, error) {
 
 func DefaultConfig() Config {
 	return Config{
-		Listen:        defaultListen,
-		PublicBaseURL: "",
-		AccessLog:     true,
+		Listen:               defaultListen,
+		ListenAddresses:      nil,
+		ListenBacklog:        0,
+		TCPKeepAlive:         "",
+		PublicBaseURL:        "",
+		PublicBaseMode:       publicBaseFixed,
+		PublicBaseScheme:     publicBaseFixed,
+		PublicBaseHosts:      nil,
+		AccessLog:            true,
+		LogLevel:             "info",
+		AllowMetricsReset:    false,
+		ResponseSizeBuckets:  nil,
+		DisableHTTP2Server:   false,
+		TimeoutsPreset:       timeoutsPresetDefault,
+		DuplicateUpstreams:   duplicateUpstreamsAllow,
+		AllowedUpstreamHosts: nil,
+		DeniedUpstreamHosts:  nil,
 		Timeouts: ServerTimeouts{
-			ReadHeaderTimeout: defaultReadHeaderTimeout.String(),
-			ReadTimeout:       "",
-			WriteTimeout:      "",
-			IdleTimeout:       defaultIdleTimeout.String(),
-			ShutdownTimeout:   defaultShutdownTimeout.String(),
-			MaxHeaderBytes:    defaultMaxHeaderBytes,
+			ReadHeaderTimeout:  defaultReadHeaderTimeout.String(),
+			ReadTimeout:        "",
+			WriteTimeout:       "",
+			IdleTimeout:        defaultIdleTimeout.String(),
+			ShutdownTimeout:    defaultShutdownTimeout.String(),
+			ReloadDrain:        "",
+			MaxHeaderBytes:     defaultMaxHeaderBytes,
+			RequestMaxDuration: "",
 		},
 		Transport: TransportConfig{
-			FirstFragmentLen:      defaultFirstFragmentLen,
-			DialTimeout:           defaultDialTimeout.String(),
-			KeepAlive:             defaultKeepAlive.String(),
-			MaxIdleConns:          defaultMaxIdleConns,
-			MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
-			MaxConnsPerHost:       0,
-			IdleConnTimeout:       defaultIdleConnTimeout.String(),
-			TLSHandshakeTimeout:   defaultTLSHandshakeTimeout.String(),
-			ResponseHeaderTimeout: defaultResponseHeaderTimeout.String(),
-			ExpectContinueTimeout: defaultExpectContinueTimeout.String(),
-			ForceHTTP2:            true,
-			DisableCompression:    false,
+			FirstFragmentLen:        defaultFirstFragmentLen,
+			AdaptiveFragment:        false,
+			FragmentStrategy:        fragmentStrategyFirstRecord,
+			DialTimeout:             defaultDialTimeout.String(),
+			MaxDialsPerHost:         0,
+			DialQueueTimeout:        "",
+			DialKeepAlive:           defaultKeepAlive.String(),
+			MaxIdleConns:            defaultMaxIdleConns,
+			MaxIdleConnsPerHost:     defaultMaxIdleConnsPerHost,
+			MaxConnsPerHost:         0,
+			IdleConnTimeout:         defaultIdleConnTimeout.String(),
+			TLSHandshakeTimeout:     defaultTLSHandshakeTimeout.String(),
+			ResponseHeaderTimeout:   defaultResponseHeaderTimeout.String(),
+			ExpectContinueTimeout:   defaultExpectContinueTimeout.String(),
+			ForceHTTP2:              true,
+			DisableCompression:      false,
+			RetryOn:                 []string{retryTriggerReset},
+			MaxFallbackAttempts:     0,
+			RetryOnStatus:           nil,
+			MaxRetries:              0,
+			RetryBackoff:            defaultRetryBackoff.String(),
+			RetryBufferBytes:        0,
+			ProxyURL:                "",
+			CAFile:                  "",
+			InsecureSkipVerify:      false,
+			TLSMinVersion:           "1.2",
+			TLSMaxVersion:           "",
+			WarmupConnections:       false,
+			HeaderCasing:            nil,
+			CertCheckInterval:       "",
+			IdleConnRecycleInterval: "",
+			ReadBufferSize:          0,
+			WriteBufferSize:         0,
+			DNSCacheTTL:             "",
+			IPMode:                  ipModeAuto,
 		},
 		Limits: LimitsConfig{
-			MaxInflight:     0,
-			MaxInflightWait: "",
+			MaxInflight:       0,
+			MaxInflightWait:   "",
+			MaxHeaderCount:    0,
+			ExemptMethods:     nil,
+			ExemptPaths:       nil,
+			MinHTTPVersion:    "",
+			RequireHost:       false,
+			MissingHostStatus: http.StatusBadRequest,
+			MissingHostBody:   defaultMissingHostBody,
+		},
+		Builtins: BuiltinsConfig{
+			Favicon:    false,
+			Robots:     false,
+			RobotsBody: defaultRobotsBody,
 		},
 		Routes: []RouteConfig{
 			{
@@ -0,0 +1,473 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func loadRuntime(t *testing.T, path string) RuntimeConfig {
+	t.Helper()
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load %s: %v", filepath.Base(path), err)
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime %s: %v", filepath.Base(path), err)
+	}
+	return runtime
+}
+
+func TestTOMLConfigMatchesJSON(t *testing.T) {
+	jsonPath := writeConfigFile(t, "config.json", `{
+  "listen": "127.0.0.1:5001",
+  "access_log": true,
+  "log_level": "debug",
+  "timeouts": {"read_header_timeout": "5s", "idle_timeout": "2m"},
+  "transport": {"first_fragment_len": 5, "dial_timeout": "3s", "retry_on": ["reset", "handshake_timeout"]},
+  "limits": {"max_inflight": 32, "max_inflight_wait": "250ms"},
+  "routes": [
+    {"name": "registry", "public_prefix": "/", "upstream": "https://registry-1.docker.io"},
+    {"name": "auth", "public_prefix": "/_auth", "upstream": "https://auth.docker.io", "rewrite_location": false, "idle_conn_timeout": "15s"}
+  ]
+}`)
+	tomlPath := writeConfigFile(t, "config.toml", `listen = "127.0.0.1:5001"
+access_log = true
+log_level = "debug"
+
+[timeouts]
+read_header_timeout = "5s"
+idle_timeout = "2m"
+
+[transport]
+first_fragment_len = 5
+dial_timeout = "3s"
+retry_on = ["reset", "handshake_timeout"]
+
+[limits]
+max_inflight = 32
+max_inflight_wait = "250ms"
+
+[[routes]]
+name = "registry"
+public_prefix = "/"
+upstream = "https://registry-1.docker.io"
+
+[[routes]]
+name = "auth"
+public_prefix = "/_auth"
+upstream = "https://auth.docker.io"
+rewrite_location = false
+idle_conn_timeout = "15s"
+`)
+
+	fromJSON := loadRuntime(t, jsonPath)
+	fromTOML := loadRuntime(t, tomlPath)
+	if !reflect.DeepEqual(fromJSON, fromTOML) {
+		t.Fatalf("TOML runtime differs from JSON:\njson: %+v\ntoml: %+v", fromJSON, fromTOML)
+	}
+}
+
+func TestTOMLConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "config.toml", `listen = "127.0.0.1:5001"
+
+[transport]
+first_fragment_length = 5
+`)
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "transport.first_fragment_length") {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestEncodeDefaultConfigTOMLRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeConfig(&buf, DefaultConfig(), "toml"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	path := writeConfigFile(t, "default.toml", buf.String())
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load encoded default: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Fatalf("round-tripped default config differs:\n%+v\n%+v", cfg, DefaultConfig())
+	}
+}
+
+func TestConfigEnvSubstitution(t *testing.T) {
+	t.Setenv("RMIRROR_TEST_UPSTREAM", "https://mirror.internal")
+	t.Setenv("RMIRROR_TEST_EMPTY", "")
+	path := writeConfigFile(t, "mirror.json", `{
+  "listen": "${RMIRROR_TEST_HOST:-127.0.0.1}:${RMIRROR_TEST_PORT:-5001}",
+  "public_base_url": "https://${RMIRROR_TEST_EMPTY:-mirror.example.com}",
+  "routes": [{"name": "root", "public_prefix": "/", "upstream": "${RMIRROR_TEST_UPSTREAM}/v2"}]
+}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Listen != "127.0.0.1:5001" {
+		t.Fatalf("unexpected listen %q", cfg.Listen)
+	}
+	if cfg.PublicBaseURL != "https://mirror.example.com" {
+		t.Fatalf("unexpected public_base_url %q", cfg.PublicBaseURL)
+	}
+	if cfg.Routes[0].Upstream != "https://mirror.internal/v2" {
+		t.Fatalf("unexpected upstream %q", cfg.Routes[0].Upstream)
+	}
+
+	toml := writeConfigFile(t, "mirror.toml", `[tls]
+cert_file = "${RMIRROR_TEST_UNSET}/cert.pem"
+key_file = "key.pem"
+`)
+	_, err = LoadConfig(toml)
+	if err == nil || !strings.Contains(err.Error(), "tls.cert_file") || !strings.Contains(err.Error(), "RMIRROR_TEST_UNSET") {
+		t.Fatalf("expected error naming the field and variable, got %v", err)
+	}
+
+	// ${name} in upstream_path_template is a capture group, not a variable.
+	t.Setenv("rest", "from-env")
+	template := writeConfigFile(t, "template.json", `{
+  "routes": [{"name": "blobs", "match_regex": "^/v2/(?P<name>.+)/blobs/(?P<rest>.*)$", "upstream": "https://blobs.internal", "upstream_path_template": "/${name}/${rest}"}]
+}`)
+	cfg, err = LoadConfig(template)
+	if err != nil {
+		t.Fatalf("load template: %v", err)
+	}
+	if got := cfg.Routes[0].UpstreamPathTemplate; got != "/${name}/${rest}" {
+		t.Fatalf("expected the template to be kept as written, got %q", got)
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime: %v", err)
+	}
+	routes, err := buildRoutes(runtime)
+	if err != nil {
+		t.Fatalf("build routes: %v", err)
+	}
+	if got := routes[0].upstreamPath("/v2/library/alpine/blobs/sha256:abc"); got != "/library/alpine/sha256:abc" {
+		t.Fatalf("expected capture groups in the upstream path, got %q", got)
+	}
+
+	bad := writeConfigFile(t, "bad.json", `{"listen": "${RMIRROR_TEST_HOST"}`)
+	if _, err := LoadConfig(bad); err == nil || !strings.Contains(err.Error(), "listen") {
+		t.Fatalf("expected unterminated reference error, got %v", err)
+	}
+
+	// A port left empty by its variable is rejected rather than binding a
+	// random one; the variable is expanded once, when the file is loaded.
+	t.Setenv("PORT", "5002")
+	for _, content := range []string{
+		`{"listen": "127.0.0.1:${RMIRROR_TEST_EMPTY:-}"}`,
+		`{"listen_addresses": ["127.0.0.1:${PORT}", "[::1]:"]}`,
+	} {
+		cfg, err := LoadConfig(writeConfigFile(t, "listen.json", content))
+		if err != nil {
+			t.Fatalf("load %s: %v", content, err)
+		}
+		if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "missing port") {
+			t.Fatalf("%s: expected missing port error, got %v", content, err)
+		}
+	}
+	cfg = DefaultConfig()
+	cfg.Listen = "127.0.0.1:${PORT}"
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "listen_addresses[0]") {
+		t.Fatalf("expected an unexpanded listen address to be rejected, got %v", err)
+	}
+
+	both, err := LoadConfig(writeConfigFile(t, "both.json", `{"listen": "127.0.0.1:5001", "listen_addresses": ["127.0.0.1:5002"]}`))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := both.Runtime(); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("expected listen with listen_addresses to be rejected, got %v", err)
+	}
+}
+
+func TestYAMLConfigMatchesJSON(t *testing.T) {
+	jsonPath := writeConfigFile(t, "config.json", `{
+  "listen": "127.0.0.1:5001",
+  "access_log": true,
+  "transport": {"first_fragment_len": 5, "retry_on": ["reset", "handshake_timeout"]},
+  "limits": {"max_inflight": 10},
+  "routes": [
+    {"name": "docker", "public_prefix": "/", "upstream": "https://registry-1.docker.io", "rewrite_location": false},
+    {"name": "ghcr", "public_host": "*.ghcr.example.com", "public_prefix": "/", "upstream": "https://ghcr.io"}
+  ]
+}`)
+	yamlPath := writeConfigFile(t, "config.yml", `listen: "127.0.0.1:5001"
+access_log: true
+transport:
+  first_fragment_len: 5
+  retry_on: [reset, handshake_timeout]
+limits:
+  max_inflight: 10
+routes:
+  - name: docker
+    public_prefix: /
+    upstream: https://registry-1.docker.io
+    rewrite_location: false
+  - name: ghcr
+    public_host: "*.ghcr.example.com"
+    public_prefix: /
+    upstream: https://ghcr.io
+`)
+	fromJSON := loadRuntime(t, jsonPath)
+	fromYAML := loadRuntime(t, yamlPath)
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Fatalf("YAML runtime differs from JSON:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeConfig(&buf, DefaultConfig(), "yaml"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if strings.Contains(buf.String(), "{") {
+		t.Fatalf("expected block-style YAML, got:\n%s", buf.String())
+	}
+	cfg, err := LoadConfig(writeConfigFile(t, "default.yaml", buf.String()))
+	if err != nil {
+		t.Fatalf("load encoded default: %v", err)
+	}
+	want, _ := DefaultConfig().Runtime()
+	got, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round-tripped default config differs:\n%+v\n%+v", got, want)
+	}
+}
+
+func TestDeprecatedKeepAliveStillApplies(t *testing.T) {
+	path := writeConfigFile(t, "mirror.json", `{
+  "transport": {"keepalive": "45s"},
+  "routes": [{"name": "root", "public_prefix": "/", "upstream": "https://registry-1.docker.io"}]
+}`)
+	runtime := loadRuntime(t, path)
+	if runtime.Transport.KeepAlive != 45*time.Second {
+		t.Fatalf("expected deprecated keepalive to apply, got %v", runtime.Transport.KeepAlive)
+	}
+	want := []Deprecation{{Field: "transport.keepalive", Replacement: "transport.dial_keepalive"}}
+	if !reflect.DeepEqual(runtime.Deprecations, want) {
+		t.Fatalf("unexpected deprecations: %+v", runtime.Deprecations)
+	}
+
+	var out bytes.Buffer
+	m, err := newMirror(runtime, NewTransport(runtime.Transport), nil, &out)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"msg":"config field deprecated"`)) || !bytes.Contains(out.Bytes(), []byte(`"field":"transport.keepalive"`)) {
+		t.Fatalf("expected deprecation warning, got %s", out.Bytes())
+	}
+	if got := metricValue(t, m.metrics, "rmirror_config_deprecations_total", map[string]string{"field": "transport.keepalive"}); got != 1 {
+		t.Fatalf("expected deprecation counter 1, got %v", got)
+	}
+
+	// The old key is an alias: the same value alongside dial_keepalive is
+	// accepted, a different one is refused rather than ignored.
+	cfg := DefaultConfig()
+	cfg.Transport.KeepAlive = cfg.Transport.DialKeepAlive
+	if _, err := cfg.Runtime(); err != nil {
+		t.Fatalf("expected matching keepalive and dial_keepalive to load, got %v", err)
+	}
+	cfg.Transport.KeepAlive = "45s"
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "conflicts with dial_keepalive") {
+		t.Fatalf("expected conflicting keepalive values to be rejected, got %v", err)
+	}
+	cfg.Transport.DialKeepAlive, cfg.Transport.KeepAlive = "", "soon"
+	if _, err := cfg.Runtime(); err == nil || !strings.HasPrefix(err.Error(), "keepalive:") {
+		t.Fatalf("expected an invalid keepalive to be reported under its own name, got %v", err)
+	}
+
+	defaults, err := DefaultConfig().Runtime()
+	if err == nil && len(defaults.Deprecations) != 0 {
+		t.Fatalf("default config must not use deprecated fields: %+v", defaults.Deprecations)
+	}
+}
+
+func TestFragmentStrategy(t *testing.T) {
+	for _, strategy := range []string{"", "first_record", " First_Record "} {
+		cfg := DefaultConfig()
+		cfg.Transport.FragmentStrategy = strategy
+		runtime, err := cfg.Runtime()
+		if err != nil || runtime.Transport.FragmentStrategy != fragmentStrategyFirstRecord {
+			t.Fatalf("expected %q to select first_record, got %q %v", strategy, runtime.Transport.FragmentStrategy, err)
+		}
+	}
+	for _, strategy := range []string{"all_records", "byte_count"} {
+		cfg := DefaultConfig()
+		cfg.Transport.FragmentStrategy = strategy
+		_, err := cfg.Runtime()
+		if err == nil || !strings.Contains(err.Error(), "not supported by the linked terasu version") || !strings.Contains(err.Error(), "first_record") {
+			t.Fatalf("expected %q to be rejected as unsupported, got %v", strategy, err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.Transport.FragmentStrategy = "random"
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), `fragment_strategy: unknown strategy "random"`) {
+		t.Fatalf("expected unknown strategy to be rejected, got %v", err)
+	}
+}
+
+func TestUpstreamHostPolicyAtConfigTime(t *testing.T) {
+	runtimeFor := func(upstream string, allowed, denied []string) error {
+		cfg := DefaultConfig()
+		cfg.AllowedUpstreamHosts = allowed
+		cfg.DeniedUpstreamHosts = denied
+		cfg.Routes = []RouteConfig{
+			{Name: "hub", PublicPrefix: "/hub", Upstream: "https://registry-1.docker.io"},
+			{Name: "target", PublicPrefix: "/target", Upstream: upstream},
+		}
+		_, err := cfg.Runtime()
+		return err
+	}
+
+	err := runtimeFor("http://internal.corp.example", []string{"*.docker.io"}, []string{"*.corp.example"})
+	var blocked *BlockedUpstreamError
+	if !errors.As(err, &blocked) || blocked.Reason != blockedDenied || !strings.Contains(err.Error(), "routes[1].upstream: upstream internal.corp.example is blocked by denied_upstream_hosts") {
+		t.Fatalf("expected denied host to be rejected, got %v", err)
+	}
+	if err := runtimeFor("https://ghcr.io", []string{"*.docker.io"}, nil); !errors.As(err, &blocked) || blocked.Reason != blockedNotListed {
+		t.Fatalf("expected host missing from the allowlist to be rejected, got %v", err)
+	}
+	if err := runtimeFor("http://169.254.169.254", nil, nil); !errors.As(err, &blocked) || blocked.Reason != blockedLinkLocal {
+		t.Fatalf("expected metadata address to be rejected by default, got %v", err)
+	}
+	if err := runtimeFor("http://169.254.169.254", nil, []string{"10.0.0.0/8"}); !errors.As(err, &blocked) || blocked.Reason != blockedLinkLocal {
+		t.Fatalf("expected metadata address to stay blocked with an unrelated denylist, got %v", err)
+	}
+	if err := runtimeFor("http://169.254.169.254", []string{"*.docker.io", "169.254.169.254"}, nil); err != nil {
+		t.Fatalf("expected an allowlisted metadata address to be accepted, got %v", err)
+	}
+	// Names can only be checked against address entries once resolved.
+	if err := runtimeFor("http://registry.internal", []string{"*.docker.io", "10.0.0.0/8"}, nil); err != nil {
+		t.Fatalf("expected name to be left to the dial-time check, got %v", err)
+	}
+	if err := runtimeFor("https://ghcr.io", []string{"10.0.0.0/33"}, nil); err == nil || !strings.Contains(err.Error(), "allowed_upstream_hosts[0]") {
+		t.Fatalf("expected invalid CIDR to be rejected, got %v", err)
+	}
+	if err := runtimeFor("https://ghcr.io", nil, []string{"foo.*.example"}); err == nil || !strings.Contains(err.Error(), "denied_upstream_hosts[0]: wildcard") {
+		t.Fatalf("expected invalid wildcard to be rejected, got %v", err)
+	}
+}
+
+func TestDuplicateUpstreams(t *testing.T) {
+	routes := []RouteConfig{
+		{Name: "hub", PublicPrefix: "/hub", Upstream: "https://registry-1.docker.io"},
+		{Name: "hub-copy", PublicPrefix: "/docker", Upstream: "https://Registry-1.docker.io/"},
+		{Name: "ghcr", PublicPrefix: "/ghcr", Upstream: "https://ghcr.io"},
+		{Name: "hub-writes", PublicPrefix: "/hub", Upstream: "https://registry-1.docker.io", Methods: []string{"PUT"}},
+		{Name: "hub-v1", PublicPrefix: "/hub-v1", Upstream: "https://registry-1.docker.io/v1"},
+	}
+	runtimeFor := func(mode string) (RuntimeConfig, error) {
+		cfg := DefaultConfig()
+		cfg.DuplicateUpstreams = mode
+		cfg.Routes = routes
+		return cfg.Runtime()
+	}
+
+	allowed, err := runtimeFor("allow")
+	if err != nil || len(allowed.UpstreamDuplicates) != 0 {
+		t.Fatalf("expected allow to accept duplicates silently, got %v %+v", err, allowed.UpstreamDuplicates)
+	}
+
+	warned, err := runtimeFor("warn")
+	if err != nil {
+		t.Fatalf("runtime: %v", err)
+	}
+	want := []DuplicateUpstreamError{{Index: 1, Route: "hub-copy", PreviousIndex: 0, PreviousRoute: "hub", Upstream: "https://registry-1.docker.io/"}}
+	if !reflect.DeepEqual(warned.UpstreamDuplicates, want) {
+		t.Fatalf("unexpected duplicates: %+v", warned.UpstreamDuplicates)
+	}
+	var out bytes.Buffer
+	if _, err := newMirror(warned, NewTransport(warned.Transport), nil, &out); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"msg":"routes share an upstream"`)) || !bytes.Contains(out.Bytes(), []byte(`"previous_route":"hub"`)) {
+		t.Fatalf("expected duplicate upstream warning, got %s", out.Bytes())
+	}
+
+	_, err = runtimeFor("error")
+	var dupErr *DuplicateUpstreamError
+	if !errors.As(err, &dupErr) || dupErr.Route != "hub-copy" || dupErr.PreviousRoute != "hub" {
+		t.Fatalf("expected a DuplicateUpstreamError naming both routes, got %v", err)
+	}
+	if _, err := runtimeFor("strict"); err == nil || !strings.Contains(err.Error(), "duplicate_upstreams") {
+		t.Fatalf("expected unknown mode to be rejected, got %v", err)
+	}
+}
+
+func TestTimeoutsPreset(t *testing.T) {
+	streaming := loadRuntime(t, writeConfigFile(t, "streaming.json", `{
+  "timeouts_preset": "streaming",
+  "timeouts": {"idle_timeout": "90s"},
+  "routes": [{"name": "r", "public_prefix": "/", "upstream": "https://registry-1.docker.io"}]
+}`))
+	if streaming.Timeouts.WriteTimeout != 0 || streaming.Timeouts.RequestMaxDuration != 0 {
+		t.Fatalf("expected streaming to disable write and request timeouts, got %+v", streaming.Timeouts)
+	}
+	if streaming.Transport.ResponseHeaderTimeout != 5*time.Minute || streaming.Transport.IdleConnTimeout != 5*time.Minute {
+		t.Fatalf("expected streaming transport timeouts of 5m, got %+v", streaming.Transport)
+	}
+	if streaming.Timeouts.IdleTimeout != 90*time.Second {
+		t.Fatalf("expected explicit idle_timeout to override the preset, got %v", streaming.Timeouts.IdleTimeout)
+	}
+	if streaming.Transport.DialTimeout != defaultDialTimeout {
+		t.Fatalf("expected fields outside the preset to keep their defaults, got %v", streaming.Transport.DialTimeout)
+	}
+
+	lowLatency := loadRuntime(t, writeConfigFile(t, "low-latency.json", `{
+  "timeouts_preset": "low-latency",
+  "transport": {"dial_timeout": "1s"},
+  "routes": [{"name": "r", "public_prefix": "/", "upstream": "https://registry-1.docker.io"}]
+}`))
+	if lowLatency.Timeouts.ReadHeaderTimeout != 5*time.Second || lowLatency.Timeouts.RequestMaxDuration != 30*time.Second {
+		t.Fatalf("unexpected low-latency server timeouts: %+v", lowLatency.Timeouts)
+	}
+	if lowLatency.Transport.ResponseHeaderTimeout != 10*time.Second || lowLatency.Transport.ExpectContinueTimeout != 500*time.Millisecond {
+		t.Fatalf("unexpected low-latency transport timeouts: %+v", lowLatency.Transport)
+	}
+	if lowLatency.Transport.DialTimeout != time.Second {
+		t.Fatalf("expected explicit dial_timeout to override the preset, got %v", lowLatency.Transport.DialTimeout)
+	}
+
+	defaults := DefaultConfig()
+	defaults.TimeoutsPreset = timeoutsPresetStreaming
+	defaults.Timeouts.ReadHeaderTimeout = "20s"
+	defaults.Routes = []RouteConfig{{Name: "r", PublicPrefix: "/", Upstream: "https://registry-1.docker.io"}}
+	runtime, err := defaults.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	if runtime.Timeouts.IdleTimeout != 5*time.Minute || runtime.Transport.TLSHandshakeTimeout != 30*time.Second {
+		t.Fatalf("expected the preset to replace default values, got %+v and %+v", runtime.Timeouts, runtime.Transport)
+	}
+	if runtime.Timeouts.ReadHeaderTimeout != 20*time.Second {
+		t.Fatalf("expected explicit read_header_timeout to be kept, got %v", runtime.Timeouts.ReadHeaderTimeout)
+	}
+
+	cfg := DefaultConfig()
+	cfg.TimeoutsPreset = "bulk"
+	cfg.Routes = []RouteConfig{{Name: "r", PublicPrefix: "/", Upstream: "https://registry-1.docker.io"}}
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "timeouts_preset") {
+		t.Fatalf("expected unknown preset to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rewriteSetCookies points the Domain and Path attributes of upstream cookies
+// at the mirror, so browsers accept them. Cookies whose Domain names a host
+// that is not a configured upstream are left alone, as are all attributes
+// other than Domain and Path.
+func (m *Mirror) rewriteSetCookies(resp *http.Response, r *route, pb publicBase) {
+	values := resp.Header["Set-Cookie"]
+	for i, value := range values {
+		if rewritten, ok := m.rewriteSetCookie(value, r, pb); ok {
+			values[i] = rewritten
+			m.auditRewrite(resp, "Set-Cookie", value, rewritten)
+		}
+	}
+}
+
+func (m *Mirror) rewriteSetCookie(value string, r *route, pb publicBase) (string, bool) {
+	parts := strings.Split(value, ";")
+	domainAt, pathAt := -1, -1
+	for i := 1; i < len(parts); i++ {
+		name, _, _ := strings.Cut(parts[i], "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			domainAt = i
+		case "path":
+			pathAt = i
+		}
+	}
+	target := r
+	if domainAt >= 0 {
+		_, domain, _ := strings.Cut(parts[domainAt], "=")
+		if target = m.cookieDomainRoute(strings.TrimSpace(domain), r); target == nil {
+			return value, false
+		}
+	}
+	changed := false
+	if pathAt >= 0 {
+		name, path, _ := strings.Cut(parts[pathAt], "=")
+		path = strings.TrimSpace(path)
+		if strings.HasPrefix(path, "/") {
+			if mapped := target.mapUpstreamPath(path); mapped != path {
+				parts[pathAt] = name + "=" + mapped
+				changed = true
+			}
+		}
+	}
+	if domainAt >= 0 {
+		name, _, _ := strings.Cut(parts[domainAt], "=")
+		// Without a public base the client's own host is the right scope,
+		// which is what a cookie without Domain gets.
+		host := ""
+		if m.publicBase != nil {
+			host = hostWithoutPort(target.publicHostFor(pb.Host))
+		}
+		if host == "" {
+			parts = append(parts[:domainAt], parts[domainAt+1:]...)
+		} else {
+			parts[domainAt] = name + "=" + host
+		}
+		changed = true
+	}
+	if !changed {
+		return value, false
+	}
+	return strings.Join(parts, ";"), true
+}
+
+// cookieDomainRoute returns the route whose upstream host domain-matches a
+// cookie Domain, preferring the route that served the response.
+func (m *Mirror) cookieDomainRoute(domain string, r *route) *route {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" {
+		return nil
+	}
+	matches := func(candidate *route) bool {
+		host := strings.ToLower(candidate.upstream.Hostname())
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	if matches(r) {
+		return r
+	}
+	for _, candidate := range m.routesByUpstream {
+		if matches(candidate) {
+			return candidate
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// maxConcurrentDials bounds the connection attempts of one dial that
+	// are in flight at the same time.
+	maxConcurrentDials = 3
+	// maxDialAttempts bounds the addresses one dial tries; past a few
+	// addresses each extra one only adds another dial timeout.
+	maxDialAttempts = 6
+)
+
+// dialRaceDelay is how long an attempt runs alone before the next address
+// is tried alongside it, RFC 8305's Connection Attempt Delay.
+var dialRaceDelay = 250 * time.Millisecond
+
+// dialableAddrs drops the addresses the host policy blocks, interleaves
+// IPv6 and IPv4 addresses and keeps at most maxDialAttempts of them.
+// Addresses that failed an earlier attempt of the request stay last. The
+// error is the last block when no address is left.
+func (d *mirrorDialer) dialableAddrs(ctx context.Context, host string, addrs []string) ([]string, error) {
+	addrs = dialedIPsFrom(ctx).order(interleaveFamilies(addrs))
+	out := make([]string, 0, len(addrs))
+	var blocked error
+	for _, ip := range addrs {
+		if err := d.checkDial(host, ip); err != nil {
+			blocked = err
+			continue
+		}
+		out = append(out, ip)
+	}
+	if len(out) > maxDialAttempts {
+		out = out[:maxDialAttempts]
+	}
+	if len(out) == 0 && blocked != nil {
+		return nil, blocked
+	}
+	return out, nil
+}
+
+// interleaveFamilies alternates IPv6 and IPv4 addresses, starting with the
+// family of the first one, so a dead record of one family is raced against
+// the other early. Names, which a proxy resolves, are left in place.
+func interleaveFamilies(addrs []string) []string {
+	var first, second, names []string
+	var firstIs6, seen bool
+	for _, addr := range addrs {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			names = append(names, addr)
+			continue
+		}
+		is6 := ip.Is6() && !ip.Is4In6()
+		if !seen {
+			firstIs6, seen = is6, true
+		}
+		if is6 == firstIs6 {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	if len(second) == 0 {
+		return addrs
+	}
+	out := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return append(out, names...)
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   string
+	err  error
+}
+
+// dialRace connects to the first of addrs that answers. Attempts start in
+// order, each dialRaceDelay after the previous one or as soon as one fails,
+// with at most maxConcurrentDials in flight, and each keeps the dial
+// timeout. The losers are cancelled. rest holds the addresses that were not
+// tried or were cancelled, for the caller to go on with when the winner
+// fails its handshake.
+func (d *mirrorDialer) dialRace(ctx context.Context, network, port string, addrs []string) (conn net.Conn, ip string, rest []string, err error) {
+	if len(addrs) == 1 {
+		conn, err := d.dialWithTimeout(ctx, network, net.JoinHostPort(addrs[0], port))
+		return conn, addrs[0], nil, err
+	}
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	failed := make(map[string]bool)
+	next, inflight := 0, 0
+	var wait <-chan time.Time
+	start := func() {
+		ip := addrs[next]
+		next++
+		inflight++
+		go func() {
+			conn, err := d.dialWithTimeout(raceCtx, network, net.JoinHostPort(ip, port))
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+		wait = nil
+		if next < len(addrs) {
+			wait = time.After(dialRaceDelay)
+		}
+	}
+	start()
+	var lastErr error
+	for inflight > 0 {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err != nil {
+				failed[res.ip] = true
+				lastErr = res.err
+				if next < len(addrs) {
+					start()
+				}
+				continue
+			}
+			cancel()
+			go closeLateDials(results, inflight)
+			for _, addr := range addrs {
+				if addr != res.ip && !failed[addr] {
+					rest = append(rest, addr)
+				}
+			}
+			return res.conn, res.ip, rest, nil
+		case <-wait:
+			if inflight < maxConcurrentDials {
+				start()
+			} else {
+				wait = time.After(dialRaceDelay)
+			}
+		}
+	}
+	return nil, "", nil, lastErr
+}
+
+// closeLateDials closes connections that completed after the race was won.
+func closeLateDials(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if res := <-results; res.conn != nil {
+			_ = res.conn.Close()
+		}
+	}
+}
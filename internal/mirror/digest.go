@@ -0,0 +1,171 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const defaultDigestHeader = "Docker-Content-Digest"
+
+const digestChunkSize = 32 << 10
+
+var errDigestMismatch = errors.New("response body does not match digest header")
+
+func newDigestHash(digest string) (hash.Hash, []byte, bool) {
+	algo, encoded, ok := strings.Cut(strings.TrimSpace(digest), ":")
+	if !ok {
+		return nil, nil, false
+	}
+	want, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, false
+	}
+	var h hash.Hash
+	switch strings.ToLower(algo) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, nil, false
+	}
+	if len(want) != h.Size() {
+		return nil, nil, false
+	}
+	return h, want, true
+}
+
+// redigest points the Docker-Content-Digest of a body the mirror rewrote at
+// out, keeping the upstream's algorithm, so clients verifying it do not
+// reject the response. A digest that cannot be recomputed is dropped.
+func redigest(header http.Header, out []byte) {
+	digest := header.Get(defaultDigestHeader)
+	if digest == "" {
+		return
+	}
+	h, _, ok := newDigestHash(digest)
+	if !ok {
+		header.Del(defaultDigestHeader)
+		return
+	}
+	h.Write(out)
+	algo, _, _ := strings.Cut(strings.TrimSpace(digest), ":")
+	header.Set(defaultDigestHeader, strings.ToLower(algo)+":"+hex.EncodeToString(h.Sum(nil)))
+}
+
+// verifyDigest checks the body against the route's digest header. Bodies
+// that fit in one chunk are checked before the response is sent, so a
+// mismatch becomes a 502; larger ones are checked as they stream and the
+// response is aborted on a mismatch.
+func (m *Mirror) verifyDigest(resp *http.Response, r *route) error {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	digest := resp.Header.Get(r.digestHeader)
+	if digest == "" {
+		return nil
+	}
+	h, want, ok := newDigestHash(digest)
+	if !ok {
+		return nil
+	}
+	onMismatch := func(got []byte) {
+		routeLabel := routeMetricLabel(r, resp.Request.URL.Path)
+		m.metrics.observeDigestMismatch(routeLabel)
+		m.logger.Error("digest mismatch", map[string]any{
+			"route":    routeLabel,
+			"upstream": resp.Request.URL.Host,
+			"path":     resp.Request.URL.Path,
+			"expected": digest,
+			"actual":   hex.EncodeToString(got),
+		})
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength <= digestChunkSize {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, digestChunkSize+1))
+		if err != nil {
+			return err
+		}
+		resp.Body = readCloser{Reader: bytes.NewReader(data), Closer: resp.Body}
+		h.Write(data)
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			onMismatch(got)
+			return errDigestMismatch
+		}
+		return nil
+	}
+	resp.Body = &digestReader{
+		body:       resp.Body,
+		hash:       h,
+		want:       want,
+		onMismatch: onMismatch,
+	}
+	return nil
+}
+
+// digestReader hashes the body as it streams and holds back the most recent
+// chunk until the next read succeeds, so a mismatch is reported before the
+// client has received the complete body.
+type digestReader struct {
+	body       io.ReadCloser
+	hash       hash.Hash
+	want       []byte
+	onMismatch func(got []byte)
+	held       []byte
+	spare      []byte
+	out        []byte
+	err        error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.fill()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *digestReader) fill() {
+	if d.spare == nil {
+		d.spare = make([]byte, digestChunkSize)
+	}
+	n, err := d.body.Read(d.spare)
+	chunk := d.spare[:n]
+	d.hash.Write(chunk)
+	switch {
+	case err == io.EOF:
+		got := d.hash.Sum(nil)
+		if !bytes.Equal(got, d.want) {
+			d.onMismatch(got)
+			d.held = nil
+			d.err = errDigestMismatch
+			return
+		}
+		d.out = append(d.held, chunk...)
+		d.held = nil
+		d.err = io.EOF
+	case err != nil:
+		d.err = err
+	case n > 0:
+		d.out, d.held = d.held, chunk
+		if d.out != nil {
+			d.spare = d.out[:cap(d.out)]
+		} else {
+			d.spare = nil
+		}
+	}
+}
+
+func (d *digestReader) Close() error {
+	return d.body.Close()
+}
@@ -0,0 +1,276 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fumiama/terasu"
+)
+
+const (
+	dnsProtocolTLS = "tls"
+	dnsProtocolUDP = "udp"
+)
+
+// dnsServer is one dns.servers entry, "[server_name@]host:port". The server
+// name is what the DoT certificate is checked against; it defaults to host.
+type dnsServer struct {
+	addr       string
+	serverName string
+}
+
+func parseDNSServer(raw string) (dnsServer, error) {
+	raw = strings.TrimSpace(raw)
+	name, addr, named := strings.Cut(raw, "@")
+	if !named {
+		addr = raw
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dnsServer{}, err
+	}
+	if host == "" {
+		return dnsServer{}, errors.New("missing host")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return dnsServer{}, fmt.Errorf("invalid port %q", port)
+	}
+	if named && name == "" {
+		return dnsServer{}, errors.New("empty server name before @")
+	}
+	if !named {
+		name = host
+	}
+	return dnsServer{addr: addr, serverName: name}, nil
+}
+
+func parseDNSProtocol(raw string) (string, error) {
+	switch protocol := strings.ToLower(strings.TrimSpace(raw)); protocol {
+	case "":
+		return dnsProtocolTLS, nil
+	case dnsProtocolTLS, dnsProtocolUDP:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unknown protocol %q (want tls or udp)", raw)
+	}
+}
+
+// dnsResolver resolves upstream hosts with the servers of the dns block,
+// trying the next server when one fails or times out. Like terasu's own
+// resolver it speaks DNS over TLS, with the first record fragmented as for
+// upstreams; plain DNS, which anyone on the path can answer, needs
+// dns.protocol udp. It replaces terasu's resolver and its lookup cache;
+// upstream connections are pooled, so lookups stay infrequent. /etc/hosts
+// is still consulted first.
+type dnsResolver struct {
+	servers   []string
+	resolvers []*net.Resolver
+	timeout   time.Duration
+	network   string
+}
+
+func newDNSResolver(cfg RuntimeTransport) *dnsResolver {
+	if len(cfg.DNSServers) == 0 {
+		return nil
+	}
+	// Checked by Runtime; an unreadable bundle fails verification rather
+	// than trusting the system roots.
+	var roots *x509.CertPool
+	if cfg.DNSCAFile != "" {
+		pool, err := loadCAFile(cfg.DNSCAFile)
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		roots = pool
+	}
+	r := &dnsResolver{servers: cfg.DNSServers, timeout: cfg.DNSTimeout, network: "ip"}
+	if EffectiveIPMode(cfg.IPMode) == ipModeIPv4Only {
+		r.network = "ip4"
+	}
+	for _, raw := range cfg.DNSServers {
+		server, _ := parseDNSServer(raw)
+		dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.addr)
+		}
+		if cfg.DNSProtocol != dnsProtocolUDP {
+			dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialDoT(ctx, server, roots, cfg.FirstFragmentLen)
+			}
+		}
+		r.resolvers = append(r.resolvers, &net.Resolver{PreferGo: true, Dial: dial})
+	}
+	return r
+}
+
+// dialDoT connects to a DNS over TLS server. The resolver sees a stream
+// conn and frames its queries as DNS over TCP.
+func dialDoT(ctx context.Context, server dnsServer, roots *x509.CertPool, firstFragmentLen uint8) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: server.serverName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"dns"},
+		RootCAs:    roots,
+	})
+	if firstFragmentLen > 0 {
+		err = terasu.Use(tlsConn).HandshakeContext(ctx, firstFragmentLen)
+	} else {
+		err = tlsConn.HandshakeContext(ctx)
+	}
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	var lastErr error
+	for i, resolver := range r.resolvers {
+		ips, err := r.query(ctx, resolver, r.network, host)
+		if err == nil && len(ips) > 0 {
+			return ipStrings(ips), nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		lastErr = fmt.Errorf("dns %s: %w", r.servers[i], err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (r *dnsResolver) query(ctx context.Context, resolver *net.Resolver, network, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return resolver.LookupIP(ctx, network, host)
+}
+
+// dnsNegativeCacheTTL caps how long a failed lookup is remembered, so an
+// upstream whose name starts resolving again is not locked out for the whole
+// dns_cache_ttl.
+const dnsNegativeCacheTTL = 5 * time.Second
+
+// dnsCache keeps lookup results per host for transport.dns_cache_ttl.
+// Failures are kept for at most dnsNegativeCacheTTL; lookups abandoned
+// because the request went away are not kept at all.
+type dnsCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &dnsCache{ttl: ttl, entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(host string, now time.Time) (dnsCacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[host]
+	if !ok || !now.Before(entry.expires) {
+		return dnsCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *dnsCache) set(host string, addrs []string, err error, now time.Time) {
+	ttl := c.ttl
+	if err != nil {
+		ttl = min(ttl, dnsNegativeCacheTTL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[host] = dnsCacheEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+}
+
+// lookup resolves host with the configured DNS servers or terasu's
+// resolver, going through the cache when dns_cache_ttl is set.
+func (d *mirrorDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	resolve := d.resolveFamilies
+	if d.dnsCache == nil {
+		return resolve(ctx, host)
+	}
+	now := time.Now()
+	if entry, ok := d.dnsCache.get(host, now); ok {
+		if entry.err != nil {
+			d.observeDNSCache(dnsCacheNegativeHit)
+			return nil, entry.err
+		}
+		d.observeDNSCache(dnsCacheHit)
+		return append([]string(nil), entry.addrs...), nil
+	}
+	d.observeDNSCache(dnsCacheMiss)
+	addrs, err := resolve(ctx, host)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	d.dnsCache.set(host, append([]string(nil), addrs...), err, now)
+	return addrs, err
+}
+
+// resolveFamilies resolves host and keeps the addresses of the families
+// ip_mode allows.
+func (d *mirrorDialer) resolveFamilies(ctx context.Context, host string) ([]string, error) {
+	resolve := lookupUpstream
+	if d.resolver != nil {
+		resolve = d.resolver.lookup
+	}
+	addrs, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	switch d.ipMode {
+	case ipModeIPv4Only:
+		addrs = filterIPv4(addrs)
+	case ipModeIPv6Only:
+		addrs = filterIPv6(addrs)
+	default:
+		return addrs, nil
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s allowed by ip_mode %s", host, d.ipMode)
+	}
+	return addrs, nil
+}
+
+const (
+	dnsCacheHit         = "hit"
+	dnsCacheNegativeHit = "negative_hit"
+	dnsCacheMiss        = "miss"
+)
+
+func (d *mirrorDialer) observeDNSCache(result string) {
+	if d.observer != nil {
+		d.observer.metrics.observeDNSCache(result)
+	}
+}
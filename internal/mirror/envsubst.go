@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// expandConfigEnv replaces ${VAR} and ${VAR:-default} in every string value
+// of cfg, so one config file can be deployed with hosts and secrets taken
+// from the environment. Errors name the field, e.g. routes[1].upstream.
+// Fields tagged envsubst:"-", where ${name} means something else, are left
+// alone.
+func expandConfigEnv(cfg *Config) error {
+	return expandEnvValue(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func expandEnvValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		out, err := expandEnvString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(out)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return expandEnvValue(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() || field.Tag.Get("envsubst") == "-" {
+				continue
+			}
+			name := configFieldName(field)
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := expandEnvValue(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnvValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			out, err := expandEnvString(v.MapIndex(key).String())
+			if err != nil {
+				return fmt.Errorf("%s.%v: %w", path, key, err)
+			}
+			v.SetMapIndex(key, reflect.ValueOf(out).Convert(v.Type().Elem()))
+		}
+	}
+	return nil
+}
+
+func configFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// expandEnvString expands ${VAR} and ${VAR:-default}; as in the shell, the
+// default also applies when VAR is set but empty. A lone $ is left alone.
+func expandEnvString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", errors.New("unterminated ${")
+		}
+		b.WriteString(s[:start])
+		expr := s[start+2 : start+end]
+		name, def, hasDefault := strings.Cut(expr, ":-")
+		if name == "" || strings.ContainsAny(name, " ${") {
+			return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+		}
+		value, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && value == "":
+			value = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+		s = s[start+end+1:]
+	}
+}
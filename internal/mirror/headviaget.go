@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// headViaGet answers client HEAD requests for routes with head_via_get when
+// the upstream rejects HEAD with 405: the request is sent again as a GET for
+// the first byte, and the client gets that response's headers, with the
+// status and Content-Length of the whole resource, and no body.
+type headViaGet struct {
+	next http.RoundTripper
+}
+
+func (h *headViaGet) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := h.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodHead || resp.StatusCode != http.StatusMethodNotAllowed {
+		return resp, err
+	}
+	drainBody(resp)
+	get := req.Clone(req.Context())
+	get.Method = http.MethodGet
+	// A client that asked for a range gets the headers of that range.
+	ranged := get.Header.Get("Range") != ""
+	if !ranged {
+		get.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err = h.next.RoundTrip(get)
+	if err != nil {
+		return nil, err
+	}
+	drainBody(resp)
+	resp.Body = http.NoBody
+	resp.Request = req
+	if ranged {
+		return resp, nil
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// 416 is what an empty resource answers to bytes=0-0.
+		size, ok := contentRangeSize(resp.Header.Get("Content-Range"))
+		if !ok {
+			return resp, nil
+		}
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header.Del("Content-Range")
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		resp.ContentLength = size
+	}
+	// Anything else, including a 200 from an upstream that ignores Range,
+	// already carries the headers a GET would; a missing Content-Length
+	// stays missing.
+	return resp, nil
+}
+
+// contentRangeSize returns the complete length from a "bytes 0-0/N" or
+// "bytes */N" Content-Range.
+func contentRangeSize(value string) (int64, bool) {
+	unit, rest, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(unit, "bytes") {
+		return 0, false
+	}
+	_, total, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(total), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,198 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+const (
+	blockedDenied    = "denied"
+	blockedNotListed = "not_allowed"
+	blockedLinkLocal = "link_local"
+)
+
+// linkLocalNets are never dialed unless an address entry in
+// allowed_upstream_hosts covers them; cloud metadata endpoints such as
+// 169.254.169.254 live there.
+var linkLocalNets = []netip.Prefix{
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+}
+
+// hostList holds host names, "*.suffix" wildcards and IP or CIDR entries.
+type hostList struct {
+	names []string
+	nets  []netip.Prefix
+}
+
+func parseHostList(entries []string) (hostList, error) {
+	var list hostList
+	for i, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			return hostList{}, fmt.Errorf("[%d]: empty host", i)
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return hostList{}, fmt.Errorf("[%d]: %w", i, err)
+			}
+			list.nets = append(list.nets, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(strings.Trim(entry, "[]")); err == nil {
+			addr = addr.Unmap()
+			list.nets = append(list.nets, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if strings.Contains(entry, "*") && (!strings.HasPrefix(entry, "*.") || strings.Count(entry, "*") > 1) {
+			return hostList{}, fmt.Errorf("[%d]: wildcard must be a leading \"*.\"", i)
+		}
+		list.names = append(list.names, entry)
+	}
+	return list, nil
+}
+
+func (l hostList) empty() bool {
+	return len(l.names) == 0 && len(l.nets) == 0
+}
+
+func (l hostList) matchName(host string) bool {
+	for _, name := range l.names {
+		if name == host || strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l hostList) matchAddr(addr netip.Addr) bool {
+	for _, prefix := range l.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHostPolicy applies allowed_upstream_hosts and
+// denied_upstream_hosts. Upstreams are checked by name when the config is
+// loaded and again by name and resolved address on every dial, including
+// dials for redirects the mirror follows and plain http requests handed to
+// an http proxy. A nil policy still blocks
+// link-local addresses.
+type upstreamHostPolicy struct {
+	allowed hostList
+	denied  hostList
+}
+
+func newUpstreamHostPolicy(allowed, denied []string) (*upstreamHostPolicy, error) {
+	allowedList, err := parseHostList(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_upstream_hosts%w", err)
+	}
+	deniedList, err := parseHostList(denied)
+	if err != nil {
+		return nil, fmt.Errorf("denied_upstream_hosts%w", err)
+	}
+	return &upstreamHostPolicy{allowed: allowedList, denied: deniedList}, nil
+}
+
+// blockReason returns why host, reached at addr, must not be dialed, or ""
+// when it may be. addr is invalid when the address is not known: at config
+// time the verdict of address entries is then left to the dial, while at
+// dial time, behind a proxy that resolves names, an allowlist has to match
+// the name.
+func (p *upstreamHostPolicy) blockReason(host string, addr netip.Addr, dialing bool) string {
+	if p == nil {
+		p = &upstreamHostPolicy{}
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if !addr.IsValid() {
+		if parsed, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+			addr = parsed
+		}
+	}
+	addr = addr.Unmap()
+	if p.denied.matchName(host) || addr.IsValid() && p.denied.matchAddr(addr) {
+		return blockedDenied
+	}
+	addrAllowed := addr.IsValid() && p.allowed.matchAddr(addr)
+	if addr.IsValid() && !addrAllowed {
+		for _, prefix := range linkLocalNets {
+			if prefix.Contains(addr) {
+				return blockedLinkLocal
+			}
+		}
+	}
+	if p.allowed.empty() || addrAllowed || p.allowed.matchName(host) {
+		return ""
+	}
+	if !addr.IsValid() && !dialing && len(p.allowed.nets) > 0 {
+		return ""
+	}
+	return blockedNotListed
+}
+
+// BlockedUpstreamError is returned for an upstream the host policy rejects.
+// Addr is empty when the upstream was rejected by name.
+type BlockedUpstreamError struct {
+	Host   string
+	Addr   string
+	Reason string
+}
+
+func (e *BlockedUpstreamError) Error() string {
+	target := e.Host
+	if e.Addr != "" && e.Addr != e.Host {
+		target = fmt.Sprintf("%s (%s)", e.Host, e.Addr)
+	}
+	switch e.Reason {
+	case blockedDenied:
+		return fmt.Sprintf("upstream %s is blocked by denied_upstream_hosts", target)
+	case blockedLinkLocal:
+		return fmt.Sprintf("upstream %s is blocked: link-local and metadata addresses need an address entry in allowed_upstream_hosts", target)
+	default:
+		return fmt.Sprintf("upstream %s is blocked: not in allowed_upstream_hosts", target)
+	}
+}
+
+// checkDial is called for every address the dialer is about to connect to;
+// addr is a host name when the upstream proxy resolves names.
+func (d *mirrorDialer) checkDial(host, addr string) error {
+	ip, _ := netip.ParseAddr(addr)
+	reason := d.hostPolicy.blockReason(host, ip, true)
+	if reason == "" {
+		return nil
+	}
+	err := &BlockedUpstreamError{Host: host, Addr: addr, Reason: reason}
+	if d.observer != nil {
+		d.observer.metrics.observeBlockedDial(reason)
+		d.observer.logger.Warn("upstream dial blocked", map[string]any{"host": host, "addr": addr, "reason": reason})
+	}
+	return err
+}
+
+// httpProxy hands plain http upstreams to an http proxy_url. The dial then
+// goes to the proxy, so the upstream is checked here, by name.
+func (d *mirrorDialer) httpProxy(req *http.Request) (*url.URL, error) {
+	u, err := d.proxy.httpProxy(req)
+	if u == nil || err != nil {
+		return u, err
+	}
+	host := req.URL.Hostname()
+	if err := d.checkDial(host, host); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func isBlockedUpstream(err error) bool {
+	var blocked *BlockedUpstreamError
+	return errors.As(err, &blocked)
+}
@@ -0,0 +1,181 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxRewriteBytes = 1 << 20
+
+// jsonPath is a parsed subset of JSONPath: "$" followed by ".name",
+// "['name']", "[N]", ".*" or "[*]" steps.
+type jsonPath []jsonPathStep
+
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New("must start with $")
+	}
+	rest := expr[1:]
+	var path jsonPath
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, errors.New("recursive descent is not supported")
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, errors.New("empty field name")
+			case "*":
+				path = append(path, jsonPathStep{wildcard: true})
+			default:
+				path = append(path, jsonPathStep{key: name})
+			}
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				path = append(path, jsonPathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				path = append(path, jsonPathStep{key: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q", inner)
+				}
+				path = append(path, jsonPathStep{index: n, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[:1])
+		}
+	}
+	if len(path) == 0 {
+		return nil, errors.New("path selects the whole document")
+	}
+	return path, nil
+}
+
+// rewrite replaces the string values selected by p with fn's result and
+// reports whether anything changed. Maps and slices are updated in place.
+func (p jsonPath) rewrite(v any, fn func(string) (string, bool)) (any, bool) {
+	if len(p) == 0 {
+		s, ok := v.(string)
+		if !ok {
+			return v, false
+		}
+		out, ok := fn(s)
+		if !ok {
+			return v, false
+		}
+		return out, true
+	}
+	step, rest := p[0], p[1:]
+	changed := false
+	switch node := v.(type) {
+	case map[string]any:
+		if step.isIndex {
+			break
+		}
+		for k, child := range node {
+			if !step.wildcard && k != step.key {
+				continue
+			}
+			if next, ok := rest.rewrite(child, fn); ok {
+				node[k] = next
+				changed = true
+			}
+		}
+	case []any:
+		for i, child := range node {
+			if !step.wildcard && (!step.isIndex || i != step.index) {
+				continue
+			}
+			if next, ok := rest.rewrite(child, fn); ok {
+				node[i] = next
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+func isJSONContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// rewriteJSONBody rewrites upstream URLs in the JSON fields selected by the
+// route's paths. Bodies that are encoded, not JSON, or larger than the
+// route's limit pass through untouched.
+func (m *Mirror) rewriteJSONBody(resp *http.Response, r *route, pb publicBase) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" || !isJSONContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+	if resp.ContentLength > int64(r.maxRewriteBytes) {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(r.maxRewriteBytes)+1))
+	if err != nil || len(data) > r.maxRewriteBytes {
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), resp.Body), Closer: resp.Body}
+		return
+	}
+	resp.Body = readCloser{Reader: bytes.NewReader(data), Closer: resp.Body}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return
+	}
+	changed := false
+	for _, path := range r.jsonPaths {
+		var ok bool
+		if doc, ok = path.rewrite(doc, func(s string) (string, bool) { return m.rewriteURL(s, pb) }); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return
+	}
+	out := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	resp.Body = readCloser{Reader: bytes.NewReader(out), Closer: resp.Body}
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	redigest(resp.Header, out)
+}
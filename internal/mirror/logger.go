@@ -2,25 +2,78 @@ package mirror
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 )
 
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func parseLogLevel(raw string) (logLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug":
+		return levelDebug, nil
+	case "", "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, fmt.Errorf("unknown log level %q", raw)
+	}
+}
+
 type structuredLogger struct {
 	logger *log.Logger
+	level  logLevel
+	tap    *tapHub
+}
+
+func newStructuredLogger(level logLevel) *structuredLogger {
+	return newStructuredLoggerTo(os.Stdout, level)
+}
+
+func newStructuredLoggerTo(w io.Writer, level logLevel) *structuredLogger {
+	return &structuredLogger{logger: log.New(w, "", 0), level: level}
 }
 
-func newStructuredLogger() *structuredLogger {
-	return &structuredLogger{logger: log.New(os.Stdout, "", 0)}
+func (l *structuredLogger) enabled(level logLevel) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *structuredLogger) Debug(msg string, fields map[string]any) {
+	if l.enabled(levelDebug) {
+		l.log("debug", msg, fields)
+	}
 }
 
 func (l *structuredLogger) Info(msg string, fields map[string]any) {
-	l.log("info", msg, fields)
+	if l.enabled(levelInfo) {
+		l.log("info", msg, fields)
+	}
+}
+
+func (l *structuredLogger) Warn(msg string, fields map[string]any) {
+	if l.enabled(levelWarn) {
+		l.log("warn", msg, fields)
+	}
 }
 
 func (l *structuredLogger) Error(msg string, fields map[string]any) {
-	l.log("error", msg, fields)
+	if l.enabled(levelError) {
+		l.log("error", msg, fields)
+	}
 }
 
 func (l *structuredLogger) log(level, msg string, fields map[string]any) {
@@ -38,4 +91,5 @@ func (l *structuredLogger) log(level, msg string, fields map[string]any) {
 		return
 	}
 	l.logger.Print(string(data))
+	l.tap.publish(data)
 }
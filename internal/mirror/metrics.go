@@ -1,26 +1,92 @@
 package mirror
 
 import (
+	"net/http"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type metrics struct {
+var handlerUnavailable = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rmirror_handler_unavailable_total",
+		Help: "Total times the active handler was found unavailable.",
+	},
+)
+
+// idleConnsClosed is process-wide because the sweep runs on the transports
+// of the state a reload just replaced, whose registry is no longer served.
+var idleConnsClosed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rmirror_idle_connections_closed_total",
+		Help: "Total idle upstream connections closed when sweeping connection pools.",
+	},
+)
+
+// defaultResponseSizeBuckets span 1KiB to 1GiB in powers of four, from small
+// manifests up to large blobs.
+var defaultResponseSizeBuckets = prometheus.ExponentialBuckets(1024, 4, 11)
+
+// ObserveHandlerUnavailable is process-wide so the count survives reloads.
+func ObserveHandlerUnavailable() {
+	handlerUnavailable.Inc()
+}
+
+// Metrics owns the Prometheus registry and collectors behind /metrics. It
+// outlives a Mirror: passing the same Metrics to NewWithMetrics on every
+// reload keeps counters, histograms and the served history.
+type Metrics struct {
+	resetMu        sync.RWMutex
 	registry       *prometheus.Registry
+	handler        http.Handler
+	sizeBuckets    []float64
 	requests       *prometheus.CounterVec
 	requestBytes   *prometheus.CounterVec
 	responseBytes  *prometheus.CounterVec
+	responseSize   *prometheus.HistogramVec
 	upstreamErrors *prometheus.CounterVec
 	fallbacks      *prometheus.CounterVec
+	statusRetries  *prometheus.CounterVec
+	blockedDials   *prometheus.CounterVec
+	dnsCache       *prometheus.CounterVec
 	inflight       prometheus.Gauge
+	inflightQueue  prometheus.Gauge
+	routeInflight  *prometheus.GaugeVec
 	duration       *prometheus.HistogramVec
+	configInfo     *prometheus.GaugeVec
+	dialWait       *prometheus.HistogramVec
+	warmups        *prometheus.CounterVec
+	fragmentLen    *prometheus.GaugeVec
+	digestMismatch *prometheus.CounterVec
+	certExpiry     *prometheus.GaugeVec
+	deprecations   *prometheus.CounterVec
+	handshakePaths *prometheus.CounterVec
+	upstreamProtos *prometheus.CounterVec
+}
+
+// metrics is what one Mirror records into: the shared collectors plus its
+// own statsd client.
+type metrics struct {
+	*Metrics
+	statsd *statsdClient
 }
 
-func newMetrics() *metrics {
-	m := &metrics{
-		registry: prometheus.NewRegistry(),
+func newMetrics(sizeBuckets []float64) *metrics {
+	return &metrics{Metrics: NewMetrics(sizeBuckets)}
+}
+
+// NewMetrics creates a registry with response size buckets taken from
+// response_size_buckets, or the defaults when empty.
+func NewMetrics(sizeBuckets []float64) *Metrics {
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = defaultResponseSizeBuckets
+	}
+	m := &Metrics{
+		registry:    prometheus.NewRegistry(),
+		sizeBuckets: sizeBuckets,
 		requests: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "rmirror_requests_total",
@@ -42,6 +108,14 @@ func newMetrics() *metrics {
 			},
 			[]string{"route"},
 		),
+		responseSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rmirror_response_size_bytes",
+				Help:    "Size of proxied response bodies in bytes.",
+				Buckets: sizeBuckets,
+			},
+			[]string{"route"},
+		),
 		upstreamErrors: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "rmirror_upstream_errors_total",
@@ -56,12 +130,46 @@ func newMetrics() *metrics {
 			},
 			[]string{"from", "to"},
 		),
+		blockedDials: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_blocked_dials_total",
+				Help: "Total upstream dials refused by the upstream host policy, by reason (denied, not_allowed, link_local).",
+			},
+			[]string{"reason"},
+		),
+		dnsCache: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_dns_cache_lookups_total",
+				Help: "Total upstream host lookups through the DNS cache, by result (hit, negative_hit, miss).",
+			},
+			[]string{"result"},
+		),
+		statusRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_upstream_status_retries_total",
+				Help: "Total requests replayed because the upstream answered with a retry_on_status code.",
+			},
+			[]string{"route", "status"},
+		),
 		inflight: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Name: "rmirror_inflight_requests",
 				Help: "Current inflight requests.",
 			},
 		),
+		inflightQueue: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rmirror_inflight_queue_depth",
+				Help: "Requests currently waiting for an inflight slot.",
+			},
+		),
+		routeInflight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rmirror_route_inflight_requests",
+				Help: "Current inflight requests per route.",
+			},
+			[]string{"route"},
+		),
 		duration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "rmirror_request_duration_seconds",
@@ -70,6 +178,70 @@ func newMetrics() *metrics {
 			},
 			[]string{"method", "route"},
 		),
+		configInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rmirror_config_info",
+				Help: "Active config hash.",
+			},
+			[]string{"hash"},
+		),
+		dialWait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rmirror_dial_wait_seconds",
+				Help:    "Time spent waiting for a per-host dial slot.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"host"},
+		),
+		warmups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_warmup_connections_total",
+				Help: "Total upstream connection warmup attempts.",
+			},
+			[]string{"host", "result"},
+		),
+		fragmentLen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rmirror_fragment_length",
+				Help: "First TLS fragment length currently preferred per upstream host.",
+			},
+			[]string{"host"},
+		),
+		digestMismatch: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_digest_mismatch_total",
+				Help: "Total responses whose body did not match the digest header.",
+			},
+			[]string{"route"},
+		),
+		certExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "rmirror_upstream_cert_expiry_seconds",
+				Help: "Seconds until the upstream leaf certificate expires.",
+			},
+			[]string{"upstream"},
+		),
+		deprecations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_config_deprecations_total",
+				Help: "Total deprecated config fields seen when loading config.",
+			},
+			[]string{"field"},
+		),
+		handshakePaths: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_tls_handshake_path_total",
+				Help: "Total upstream TLS handshakes by path taken (fragmented, plain, plain_fallback, failed).",
+			},
+			[]string{"path"},
+		),
+		upstreamProtos: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rmirror_upstream_protocol_total",
+				Help: "Total upstream responses by route and protocol.",
+			},
+			[]string{"route", "proto"},
+		),
 	}
 	m.registry.MustRegister(
 		prometheus.NewGoCollector(),
@@ -77,18 +249,54 @@ func newMetrics() *metrics {
 		m.requests,
 		m.requestBytes,
 		m.responseBytes,
+		m.responseSize,
 		m.upstreamErrors,
 		m.fallbacks,
+		m.statusRetries,
+		m.blockedDials,
+		m.dnsCache,
 		m.inflight,
+		m.inflightQueue,
+		m.routeInflight,
 		m.duration,
+		m.configInfo,
+		m.dialWait,
+		m.warmups,
+		m.fragmentLen,
+		m.digestMismatch,
+		m.certExpiry,
+		m.deprecations,
+		m.handshakePaths,
+		m.upstreamProtos,
+		handlerUnavailable,
+		idleConnsClosed,
 	)
+	m.handler = newMetricsHandler(m.registry)
 	return m
 }
 
+// fits reports whether a config with these response_size_buckets can keep
+// recording into m; histogram buckets cannot change once registered.
+func (m *Metrics) fits(sizeBuckets []float64) bool {
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = defaultResponseSizeBuckets
+	}
+	return slices.Equal(m.sizeBuckets, sizeBuckets)
+}
+
+// forgetConfig drops gauges labelled by upstreams of the config being
+// replaced; the new Mirror sets them again for its own upstreams.
+func (m *Metrics) forgetConfig() {
+	m.fragmentLen.Reset()
+	m.certExpiry.Reset()
+}
+
 func (m *metrics) observeRequest(route, method string, status int, duration time.Duration, reqBytes, respBytes int64) {
 	if m == nil {
 		return
 	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
 	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
 	if reqBytes > 0 {
 		m.requestBytes.WithLabelValues(route).Add(float64(reqBytes))
@@ -96,19 +304,169 @@ func (m *metrics) observeRequest(route, method string, status int, duration time
 	if respBytes > 0 {
 		m.responseBytes.WithLabelValues(route).Add(float64(respBytes))
 	}
+	m.responseSize.WithLabelValues(route).Observe(float64(respBytes))
 	m.duration.WithLabelValues(method, route).Observe(duration.Seconds())
+	tags := []string{"method:" + method, "route:" + route, "status:" + strconv.Itoa(status)}
+	m.statsd.count("requests", tags...)
+	m.statsd.timing("request_duration", duration, tags[:2]...)
+}
+
+func (m *metrics) setConfigHash(hash string) {
+	if m == nil {
+		return
+	}
+	m.configInfo.Reset()
+	m.configInfo.WithLabelValues(hash).Set(1)
 }
 
 func (m *metrics) observeUpstreamError(route string) {
 	if m == nil {
 		return
 	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
 	m.upstreamErrors.WithLabelValues(route).Inc()
+	m.statsd.count("upstream_errors", "route:"+route)
+}
+
+func (m *metrics) observeDialWait(host string, wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.dialWait.WithLabelValues(host).Observe(wait.Seconds())
+}
+
+func (m *metrics) observeWarmup(host string, err error) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.warmups.WithLabelValues(host, result).Inc()
+}
+
+func (m *metrics) setFragmentLength(host string, frag uint8) {
+	if m == nil {
+		return
+	}
+	m.fragmentLen.WithLabelValues(host).Set(float64(frag))
 }
 
 func (m *metrics) observeFallback(from, to uint8) {
 	if m == nil {
 		return
 	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
 	m.fallbacks.WithLabelValues(strconv.Itoa(int(from)), strconv.Itoa(int(to))).Inc()
+	m.statsd.count("fallbacks", "from:"+strconv.Itoa(int(from)), "to:"+strconv.Itoa(int(to)))
+}
+
+func (m *metrics) observeStatusRetry(route string, status int) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.statusRetries.WithLabelValues(route, strconv.Itoa(status)).Inc()
+}
+
+func (m *metrics) observeDigestMismatch(route string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.digestMismatch.WithLabelValues(route).Inc()
+}
+
+func (m *metrics) observeBlockedDial(reason string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.blockedDials.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) observeDNSCache(result string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.dnsCache.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) observeHandshakePath(path string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.handshakePaths.WithLabelValues(path).Inc()
+}
+
+func (m *metrics) observeUpstreamProto(route, proto string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.upstreamProtos.WithLabelValues(route, proto).Inc()
+}
+
+func (m *metrics) observeDeprecation(field string) {
+	if m == nil {
+		return
+	}
+	m.resetMu.RLock()
+	defer m.resetMu.RUnlock()
+	m.deprecations.WithLabelValues(field).Inc()
+}
+
+func (m *metrics) addRouteInflight(route string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.routeInflight.WithLabelValues(route).Add(delta)
+}
+
+func (m *metrics) setCertExpiry(upstream string, remaining time.Duration) {
+	if m == nil {
+		return
+	}
+	m.certExpiry.WithLabelValues(upstream).Set(remaining.Seconds())
+}
+
+// reset zeroes counters and histograms. Gauges describe current state and are
+// left alone, as is the process-wide handler_unavailable counter.
+func (m *metrics) reset() {
+	if m == nil {
+		return
+	}
+	m.resetMu.Lock()
+	defer m.resetMu.Unlock()
+	m.requests.Reset()
+	m.requestBytes.Reset()
+	m.responseBytes.Reset()
+	m.responseSize.Reset()
+	m.upstreamErrors.Reset()
+	m.fallbacks.Reset()
+	m.statusRetries.Reset()
+	m.blockedDials.Reset()
+	m.dnsCache.Reset()
+	m.duration.Reset()
+	m.dialWait.Reset()
+	m.warmups.Reset()
+	m.digestMismatch.Reset()
+	m.deprecations.Reset()
+	m.handshakePaths.Reset()
+	m.upstreamProtos.Reset()
 }
@@ -1,14 +1,25 @@
 package mirror
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,15 +27,43 @@ type Mirror struct {
 	routes           []*route
 	routesByUpstream []*route
 	transport        http.RoundTripper
+	routeTransports  map[string]http.RoundTripper
+	configHash       string
 	publicBase       *publicBase
+	publicBaseMode   string
+	publicBaseScheme string
+	schemeWarning    sync.Once
+	publicBaseHosts  []string
 	accessLog        bool
 	maxInflight      chan struct{}
 	maxInflightWait  time.Duration
+	draining         chan struct{}
+	drainOnce        sync.Once
+	exemptMethods    []string
+	exemptPaths      []string
+	maxHeaderCount   int
+	clientLimits     RuntimeLimits
+	maxDuration      time.Duration
 	metrics          *metrics
 	metricsHandler   http.Handler
 	logger           *structuredLogger
+	tap              *tapHub
+	adminToken       string
+	allowReset       bool
+	headerCasing     map[string]string
+	retryBufferBytes int64
+	builtins         BuiltinsConfig
 }
 
+var processStart = time.Now()
+
+// pidHeader carries the process ID on health responses, so a supervisor
+// probing an address shared through SO_REUSEPORT can tell which process
+// answered.
+const pidHeader = "X-Rmirror-Pid"
+
+var processPID = strconv.Itoa(os.Getpid())
+
 type publicBase struct {
 	Scheme string
 	Host   string
@@ -35,9 +74,25 @@ type ctxKey int
 const (
 	ctxPublicBaseKey ctxKey = iota
 	ctxRouteKey
+	ctxTokenKey
+	ctxDialedIPsKey
+	ctxLogWriterKey
 )
 
 func New(cfg RuntimeConfig, transport http.RoundTripper) (*Mirror, error) {
+	return NewWithMetrics(cfg, transport, nil)
+}
+
+// NewWithMetrics is New recording into shared, so metrics survive the
+// reloads that replace the Mirror. A nil shared, or one registered with
+// different response_size_buckets, is replaced by a new Metrics; Metrics
+// returns the one in use.
+func NewWithMetrics(cfg RuntimeConfig, transport http.RoundTripper, shared *Metrics) (*Mirror, error) {
+	return newMirror(cfg, transport, shared, os.Stdout)
+}
+
+// newMirror is NewWithMetrics logging to logOut.
+func newMirror(cfg RuntimeConfig, transport http.RoundTripper, shared *Metrics, logOut io.Writer) (*Mirror, error) {
 	if transport == nil {
 		return nil, errors.New("transport must not be nil")
 	}
@@ -46,33 +101,167 @@ func New(cfg RuntimeConfig, transport http.RoundTripper) (*Mirror, error) {
 		return nil, err
 	}
 	m := &Mirror{
-		routes:    routes,
-		transport: transport,
-		accessLog: cfg.AccessLog,
+		routes:           routes,
+		transport:        transport,
+		configHash:       cfg.ConfigHash,
+		accessLog:        cfg.AccessLog,
+		tap:              newTapHub(),
+		adminToken:       cfg.AdminToken,
+		allowReset:       cfg.AllowMetricsReset,
+		builtins:         cfg.Builtins,
+		maxHeaderCount:   cfg.Limits.MaxHeaderCount,
+		clientLimits:     cfg.Limits,
+		maxDuration:      cfg.Timeouts.RequestMaxDuration,
+		retryBufferBytes: int64(cfg.Transport.RetryBufferBytes),
+	}
+	m.headerCasing, err = parseHeaderCasing(cfg.Transport.HeaderCasing)
+	if err != nil {
+		return nil, err
 	}
 	if cfg.PublicBaseURL != nil {
 		m.publicBase = &publicBase{Scheme: cfg.PublicBaseURL.Scheme, Host: cfg.PublicBaseURL.Host}
+		m.publicBaseMode = cfg.PublicBaseMode
+		m.publicBaseScheme = cfg.PublicBaseScheme
+		m.publicBaseHosts = cfg.PublicBaseHosts
+	}
+	bucketsChanged := shared != nil && !shared.fits(cfg.ResponseSizeBuckets)
+	fresh := shared == nil || bucketsChanged
+	if fresh {
+		shared = NewMetrics(cfg.ResponseSizeBuckets)
+	}
+	m.metrics = &metrics{Metrics: shared}
+	m.metrics.statsd, err = newStatsdClient(cfg.Statsd)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	m.metricsHandler = shared.handler
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	m.logger = newStructuredLoggerTo(logOut, level)
+	m.logger.tap = m.tap
+	if bucketsChanged {
+		m.logger.Warn("response_size_buckets changed; metrics restart from zero", nil)
+	}
+	if fresh {
+		// Nothing else records into a new registry yet.
+		m.metrics.setConfigHash(m.configHash)
+	}
+	if cfg.TLS != nil && m.publicBase != nil && m.publicBase.Scheme == "http" && m.publicBaseScheme == publicBaseFixed {
+		m.logger.Warn("public_base_url uses http but the listener serves TLS", map[string]any{"public_base_url": cfg.PublicBaseURL.String()})
+	}
+	for _, d := range cfg.Deprecations {
+		m.logger.Warn("config field deprecated", map[string]any{"field": d.Field, "replacement": d.Replacement})
+		m.metrics.observeDeprecation(d.Field)
+	}
+	if cfg.Transport.InsecureSkipVerify {
+		m.logger.Warn("upstream TLS certificate verification is disabled; connections can be intercepted", map[string]any{"field": "transport.insecure_skip_verify"})
+	}
+	for _, r := range routes {
+		if r.transportConfig != nil && r.transportConfig.InsecureSkipVerify && !cfg.Transport.InsecureSkipVerify {
+			m.logger.Warn("upstream TLS certificate verification is disabled; connections can be intercepted", map[string]any{"field": "routes[].transport.insecure_skip_verify", "route": r.name})
+		}
+	}
+	for _, d := range cfg.UpstreamDuplicates {
+		m.logger.Warn("routes share an upstream", map[string]any{
+			"route":          d.Route,
+			"previous_route": d.PreviousRoute,
+			"upstream":       d.Upstream,
+		})
 	}
-	m.metrics = newMetrics()
-	m.metricsHandler = newMetricsHandler(m.metrics.registry)
-	m.logger = newStructuredLogger()
 	m.routesByUpstream = append([]*route(nil), routes...)
 	sort.SliceStable(m.routesByUpstream, func(i, j int) bool {
 		return len(m.routesByUpstream[i].upstreamBasePath) > len(m.routesByUpstream[j].upstreamBasePath)
 	})
+	m.routeTransports = make(map[string]http.RoundTripper)
 	for _, r := range routes {
+		if r.transportConfig != nil {
+			key := fmt.Sprintf("%+v", *r.transportConfig)
+			rt, ok := m.routeTransports[key]
+			if !ok {
+				rt = NewTransport(*r.transportConfig)
+				m.routeTransports[key] = rt
+			}
+			r.transport = rt
+		}
 		r.proxy = m.buildProxy(r)
 	}
+	limited := false
+	for _, r := range routes {
+		if r.maxInflight != nil {
+			limited = true
+		}
+	}
 	if cfg.Limits.MaxInflight > 0 {
 		m.maxInflight = make(chan struct{}, cfg.Limits.MaxInflight)
 		m.maxInflightWait = cfg.Limits.MaxInflightWait
+		limited = true
+	}
+	if limited {
+		m.draining = make(chan struct{})
+		m.exemptMethods = cfg.Limits.ExemptMethods
+		m.exemptPaths = cfg.Limits.ExemptPaths
+	}
+	for _, rt := range m.transports() {
+		if fallback, ok := rt.(*fallbackRoundTripper); ok {
+			fallback.setMetrics(m.metrics)
+			fallback.setLogger(m.logger)
+		}
 	}
-	if fallback, ok := transport.(*fallbackRoundTripper); ok {
-		fallback.metrics = m.metrics
+	if fresh {
+		m.setFragmentLengths()
 	}
 	return m, nil
 }
 
+// Activate makes m the Mirror its shared Metrics describe: it drops the
+// gauges of the config m replaces and records m's config hash. Call it once m
+// has been swapped in, so a reload that fails midway leaves them untouched.
+func (m *Mirror) Activate() {
+	m.metrics.forgetConfig()
+	m.metrics.setConfigHash(m.configHash)
+	m.setFragmentLengths()
+}
+
+// setFragmentLengths records the fixed first-fragment length of each route's
+// upstream when its transport is not adaptive; adaptive transports record
+// theirs as they learn them.
+func (m *Mirror) setFragmentLengths() {
+	for _, r := range m.routes {
+		rt := r.transport
+		if rt == nil {
+			rt = m.transport
+		}
+		if fallback, ok := rt.(*fallbackRoundTripper); ok && !fallback.adaptive {
+			m.metrics.setFragmentLength(r.upstream.Host, fallback.primaryFragment)
+		}
+	}
+}
+
+// Metrics returns the registry this Mirror records into, for passing to the
+// NewWithMetrics call that replaces it.
+func (m *Mirror) Metrics() *Metrics {
+	return m.metrics.Metrics
+}
+
+func (m *Mirror) transports() []http.RoundTripper {
+	out := make([]http.RoundTripper, 0, len(m.routeTransports)+1)
+	out = append(out, m.transport)
+	for _, rt := range m.routeTransports {
+		out = append(out, rt)
+	}
+	return out
+}
+
+func (m *Mirror) CloseIdleConnections() {
+	for _, rt := range m.transports() {
+		if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+}
+
 func (m *Mirror) Handler() http.Handler {
 	return m
 }
@@ -82,24 +271,159 @@ func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	start := time.Now()
-	rw := &logResponseWriter{ResponseWriter: w, status: 0}
-	route := m.matchRoute(r.URL.Path)
-	routeLabel := routeMetricLabel(route, r.URL.Path)
+	rw := &logResponseWriter{ResponseWriter: w, status: 0, head: r.Method == http.MethodHead}
+	if r.Body != nil && r.Body != http.NoBody {
+		rw.reqBody = &countingBody{ReadCloser: r.Body}
+		r.Body = rw.reqBody
+	}
+	if status, msg, ok := m.rejectClient(r); ok {
+		http.Error(rw, msg, status)
+		m.recordRequest(nil, r, rw, time.Since(start))
+		return
+	}
+	route := m.matchRoute(r.Host, r.Method, r.URL.Path)
+	if route != nil && route.debugBodyLog > 0 && m.logger.enabled(levelDebug) {
+		rw.bodies = newBodyLog(route.debugBodyLog)
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = readCloser{Reader: io.TeeReader(r.Body, &rw.bodies.request), Closer: r.Body}
+		}
+	}
 	if route == nil {
 		http.Error(rw, "no route matched", http.StatusNotFound)
+	} else if m.tooManyHeaders(r) {
+		http.Error(rw, "too many request headers", http.StatusRequestHeaderFieldsTooLarge)
 	} else {
-		if !m.acquire(rw, r) {
-			m.recordRequest(routeLabel, r, rw, time.Since(start))
+		if m.maxDuration > 0 && !isLongLived(r) {
+			// A timer rather than a context deadline, so modifyResponse can
+			// lift the limit once the response turns out to be a stream.
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+			rw.deadline = time.AfterFunc(m.maxDuration, func() { cancel(errMaxDuration) })
+			defer rw.deadline.Stop()
+			r = r.WithContext(ctx)
+		}
+		exempt := m.limiterExempt(r)
+		// The route limit is taken before the global one, so requests queued
+		// for a saturated route do not hold global slots other routes need.
+		if !exempt && !m.acquire(rw, r, route.maxInflight, route.maxInflightWait) {
+			m.recordRequest(route, r, rw, time.Since(start))
 			return
 		}
+		if !exempt {
+			defer release(route.maxInflight)
+		}
+		if !exempt && !m.acquire(rw, r, m.maxInflight, m.maxInflightWait) {
+			m.recordRequest(route, r, rw, time.Since(start))
+			return
+		}
+		if !exempt {
+			defer release(m.maxInflight)
+		}
 		if m.metrics != nil {
 			m.metrics.inflight.Inc()
 			defer m.metrics.inflight.Dec()
 		}
-		defer m.release()
+		routeLabel := routeMetricLabel(route, r.URL.Path)
+		m.metrics.addRouteInflight(routeLabel, 1)
+		defer m.metrics.addRouteInflight(routeLabel, -1)
+		processStats.inflight.Add(1)
+		defer processStats.inflight.Add(-1)
+		if route.tokens != nil {
+			key, ok := tokenCacheKey(r)
+			if ok && route.tokens.serve(rw, key) {
+				m.recordRequest(route, r, rw, time.Since(start))
+				return
+			}
+			if ok {
+				r = r.WithContext(context.WithValue(r.Context(), ctxTokenKey, key))
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), ctxLogWriterKey, rw))
+		bufferRequestBody(r, m.retryBufferBytes)
 		route.proxy.ServeHTTP(rw, r)
 	}
-	m.recordRequest(routeLabel, r, rw, time.Since(start))
+	m.recordRequest(route, r, rw, time.Since(start))
+}
+
+// limiterExempt reports requests that skip the inflight limiter because of
+// their method or path.
+func (m *Mirror) limiterExempt(r *http.Request) bool {
+	for _, method := range m.exemptMethods {
+		if r.Method == method {
+			return true
+		}
+	}
+	for _, prefix := range m.exemptPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectClient enforces limits.min_http_version and limits.require_host
+// before any routing.
+func (m *Mirror) rejectClient(r *http.Request) (int, string, bool) {
+	if minVersion := m.clientLimits.MinHTTPVersion; minVersion > 0 && r.ProtoMajor*10+r.ProtoMinor < minVersion {
+		return http.StatusHTTPVersionNotSupported, "http version not supported", true
+	}
+	if m.clientLimits.RequireHost && r.Host == "" {
+		return m.clientLimits.MissingHostStatus, m.clientLimits.MissingHostBody, true
+	}
+	return 0, "", false
+}
+
+func (m *Mirror) tooManyHeaders(r *http.Request) bool {
+	if m.maxHeaderCount <= 0 {
+		return false
+	}
+	count := 0
+	for _, values := range r.Header {
+		count += len(values)
+	}
+	return count > m.maxHeaderCount
+}
+
+// errMaxDuration cancels requests that ran into request_max_duration.
+var errMaxDuration = fmt.Errorf("request exceeded max duration: %w", context.DeadlineExceeded)
+
+// isStreamingResponse reports upstream responses exempt from
+// request_max_duration: event streams and bodies of unknown length, which
+// are sent as they are produced rather than as a download of known size.
+func isStreamingResponse(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusSwitchingProtocols {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength < 0
+}
+
+// isLongLived reports requests expected to outlive any request deadline:
+// protocol upgrades and server-sent event streams.
+func isLongLived(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// bufferRequestBody reads request bodies of up to limit bytes into memory
+// and sets GetBody, so the transport can replay them on a retry or fallback.
+// Larger bodies are streamed as before and stay non-retryable.
+func bufferRequestBody(r *http.Request, limit int64) {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody || r.GetBody != nil || r.ContentLength > limit {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), r.Body), Closer: r.Body}
+		return
+	}
+	body := r.Body
+	r.Body = readCloser{Reader: bytes.NewReader(data), Closer: body}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
 }
 
 func buildRoutes(cfg RuntimeConfig) ([]*route, error) {
@@ -109,17 +433,41 @@ func buildRoutes(cfg RuntimeConfig) ([]*route, error) {
 		if err != nil {
 			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
 		}
+		rt, overridden, err := cfg.routeTransport(rc)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+		}
+		if overridden {
+			r.transportConfig = &rt
+		}
 		routes = append(routes, r)
 	}
+	// Regex routes keep their config order ahead of the prefix routes, which
+	// are tried longest prefix first, with routes limited to some methods
+	// ahead of a method-agnostic route on the same prefix.
 	sort.SliceStable(routes, func(i, j int) bool {
-		return len(routes[i].publicPrefix) > len(routes[j].publicPrefix)
+		if (routes[i].matchRegex != nil) != (routes[j].matchRegex != nil) {
+			return routes[i].matchRegex != nil
+		}
+		if routes[i].matchRegex != nil {
+			return false
+		}
+		if len(routes[i].publicPrefix) != len(routes[j].publicPrefix) {
+			return len(routes[i].publicPrefix) > len(routes[j].publicPrefix)
+		}
+		return len(routes[i].methods) > 0 && len(routes[j].methods) == 0
 	})
 	return routes, nil
 }
 
-func (m *Mirror) matchRoute(path string) *route {
+func (m *Mirror) matchRoute(host, method, path string) *route {
 	for _, r := range m.routes {
-		if r.matchesPath(path) {
+		if r.publicHost != "" && r.matchesHost(host) && r.matchesMethod(method) && r.matchesPath(path) {
+			return r
+		}
+	}
+	for _, r := range m.routes {
+		if r.publicHost == "" && r.matchesMethod(method) && r.matchesPath(path) {
 			return r
 		}
 	}
@@ -127,9 +475,22 @@ func (m *Mirror) matchRoute(path string) *route {
 }
 
 func (m *Mirror) buildProxy(r *route) *httputil.ReverseProxy {
+	transport := m.transport
+	if r.transport != nil {
+		transport = r.transport
+	}
+	if m.headerCasing != nil {
+		transport = &headerCaser{casing: m.headerCasing, next: transport}
+	}
+	if r.followRedirects > 0 {
+		transport = &redirectFollower{m: m, route: r, max: r.followRedirects, crossRoute: r.followCrossRoute, next: transport}
+	}
+	if r.headViaGet {
+		transport = &headViaGet{next: transport}
+	}
 	proxy := &httputil.ReverseProxy{
 		Director:       m.director(r),
-		Transport:      m.transport,
+		Transport:      transport,
 		ModifyResponse: m.modifyResponse,
 		ErrorHandler:   m.errorHandler,
 		FlushInterval:  100 * time.Millisecond,
@@ -139,41 +500,228 @@ func (m *Mirror) buildProxy(r *route) *httputil.ReverseProxy {
 
 func (m *Mirror) director(r *route) func(*http.Request) {
 	return func(req *http.Request) {
-		publicBase := m.resolvePublicBase(req)
+		publicBase := m.resolvePublicBase(req, r)
 		ctx := context.WithValue(req.Context(), ctxPublicBaseKey, publicBase)
 		ctx = context.WithValue(ctx, ctxRouteKey, r)
 		*req = *req.WithContext(ctx)
 
-		trimmed := r.stripPrefix(req.URL.Path)
+		rawPath := req.URL.RawPath
 		req.URL.Scheme = r.upstream.Scheme
 		req.URL.Host = r.upstream.Host
-		req.URL.Path = r.joinUpstreamPath(trimmed)
+		req.URL.Path = r.upstreamPath(req.URL.Path)
 		req.URL.RawPath = ""
-		if !r.preserveHost {
+		if r.preserveRawPath && rawPath != "" && r.pathTemplate == "" {
+			// net/url ignores a RawPath that does not decode to Path, so a
+			// prefix the client sent percent-encoded falls back to re-encoding.
+			req.URL.RawPath = r.joinUpstreamPath(r.stripPrefix(rawPath))
+		}
+		if !r.keepsHost(req.Host) {
 			req.Host = r.upstream.Host
 		}
+		if r.forwardHeaders != nil {
+			r.filterHeaders(req.Header)
+		}
+		if r.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", r.acceptEncoding)
+		}
 	}
 }
 
-func (m *Mirror) resolvePublicBase(req *http.Request) publicBase {
+func (m *Mirror) resolvePublicBase(req *http.Request, r *route) publicBase {
 	if m.publicBase != nil {
-		return *m.publicBase
+		scheme := m.publicBaseSchemeFor(req)
+		if r != nil && r.publicHost != "" {
+			return publicBase{Scheme: scheme, Host: req.Host}
+		}
+		switch m.publicBaseMode {
+		case publicBaseRequest:
+			return publicBase{Scheme: scheme, Host: req.Host}
+		case publicBaseAllowlist:
+			if m.allowedPublicHost(req.Host) {
+				return publicBase{Scheme: scheme, Host: req.Host}
+			}
+		}
+		return publicBase{Scheme: scheme, Host: m.publicBase.Host}
 	}
 	scheme := schemeFromRequest(req)
 	return publicBase{Scheme: scheme, Host: req.Host}
 }
 
+// publicBaseSchemeFor returns the scheme for rewritten URLs when
+// public_base_url is set. A fixed http base seen by an https client would
+// downgrade its redirects, which is logged once per config.
+func (m *Mirror) publicBaseSchemeFor(req *http.Request) string {
+	if m.publicBaseScheme == publicBaseRequest {
+		return schemeFromRequest(req)
+	}
+	if m.publicBase.Scheme == "http" && schemeFromRequest(req) == "https" {
+		m.schemeWarning.Do(func() {
+			m.logger.Warn("public_base_url scheme differs from request", map[string]any{
+				"public_base_scheme": m.publicBase.Scheme,
+				"request_scheme":     "https",
+			})
+		})
+	}
+	return m.publicBase.Scheme
+}
+
+// allowedPublicHost reports whether host, with or without its port, is listed
+// in public_base_hosts.
+func (m *Mirror) allowedPublicHost(host string) bool {
+	host = strings.ToLower(host)
+	bare := hostWithoutPort(host)
+	for _, allowed := range m.publicBaseHosts {
+		if allowed == host || allowed == bare {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Mirror) modifyResponse(resp *http.Response) error {
 	ctx := resp.Request.Context()
+	r, _ := ctx.Value(ctxRouteKey).(*route)
+	if rw, ok := ctx.Value(ctxLogWriterKey).(*logResponseWriter); ok {
+		rw.upstreamProto = resp.Proto
+		if rw.deadline != nil && isStreamingResponse(resp) {
+			rw.deadline.Stop()
+		}
+	}
+	if resp.Request.Method == http.MethodHead && (r == nil || !r.lenientHead) && resp.Body != nil && resp.Body != http.NoBody {
+		// Content-Length is kept: for HEAD it describes the GET response.
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	if r != nil && r.decompress {
+		if err := decompressResponse(resp); err != nil {
+			return err
+		}
+	}
+	if r != nil && r.digestHeader != "" {
+		if err := m.verifyDigest(resp, r); err != nil {
+			return err
+		}
+	}
 	pb, ok := ctx.Value(ctxPublicBaseKey).(publicBase)
-	if !ok || pb.Host == "" || pb.Scheme == "" {
+	hasBase := ok && pb.Host != "" && pb.Scheme != ""
+	// Rewritten before the token cache stores the body, so cache hits carry
+	// the same public URLs as misses.
+	if hasBase && r != nil && len(r.jsonPaths) > 0 {
+		m.rewriteJSONBody(resp, r, pb)
+	}
+	if hasBase && r != nil && r.rewriteBody {
+		m.rewriteBodyURLs(resp, r, pb)
+	}
+	if key, ok := ctx.Value(ctxTokenKey).(string); ok && r != nil && r.tokens != nil {
+		r.tokens.store(resp, key)
+	}
+	if !hasBase {
 		return nil
 	}
-	if loc := resp.Header.Get("Location"); loc != "" {
-		if rewritten, ok := m.rewriteURL(loc, pb); ok {
-			resp.Header.Set("Location", rewritten)
+	if r == nil || r.rewriteLocation {
+		m.rewriteLocationHeader(resp, pb)
+		m.rewriteLinkHeaders(resp, pb)
+	}
+	if r == nil || r.rewriteAuth {
+		m.rewriteAuthHeaders(resp, pb)
+	}
+	if r != nil {
+		for _, header := range r.rewriteHeaders {
+			m.rewriteURLHeader(resp, pb, header)
 		}
+		m.rewriteSetCookies(resp, r, pb)
 	}
+	return nil
+}
+
+// decompressResponse decodes a gzip body so the client, digest checks and
+// body rewriting all see the identity encoding.
+func decompressResponse(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	// A range of the encoded stream cannot be decoded on its own.
+	if resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Range") != "" {
+		return nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("decompress upstream body: %w", err)
+	}
+	resp.Body = readCloser{Reader: gz, Closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func (m *Mirror) rewriteLocationHeader(resp *http.Response, pb publicBase) {
+	m.rewriteURLHeader(resp, pb, "Location")
+}
+
+// rewriteURLHeader rewrites every value of header that is an absolute URL
+// on a configured upstream; other values are left as they are.
+func (m *Mirror) rewriteURLHeader(resp *http.Response, pb publicBase, header string) {
+	values := resp.Header[http.CanonicalHeaderKey(header)]
+	for i, value := range values {
+		if rewritten, ok := m.rewriteURL(value, pb); ok {
+			values[i] = rewritten
+			m.auditRewrite(resp, header, value, rewritten)
+		}
+	}
+}
+
+// rewriteLinkHeaders rewrites the <URI> targets of RFC 8288 Link headers,
+// such as registry pagination, leaving rel and other params untouched.
+func (m *Mirror) rewriteLinkHeaders(resp *http.Response, pb publicBase) {
+	values := resp.Header["Link"]
+	for i, value := range values {
+		if rewritten, ok := m.rewriteLinkHeader(value, pb); ok {
+			values[i] = rewritten
+			m.auditRewrite(resp, "Link", value, rewritten)
+		}
+	}
+}
+
+func (m *Mirror) rewriteLinkHeader(value string, pb publicBase) (string, bool) {
+	changed := false
+	var b strings.Builder
+	inQuote := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(value):
+			b.WriteByte(c)
+			i++
+			c = value[i]
+		case c == '"':
+			inQuote = !inQuote
+		case !inQuote && c == '<':
+			end := strings.IndexByte(value[i+1:], '>')
+			if end < 0 {
+				break
+			}
+			target := value[i+1 : i+1+end]
+			if rewritten, ok := m.rewriteURL(target, pb); ok {
+				target = rewritten
+				changed = true
+			}
+			b.WriteByte('<')
+			b.WriteString(target)
+			b.WriteByte('>')
+			i += end + 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if !changed {
+		return value, false
+	}
+	return b.String(), true
+}
+
+func (m *Mirror) rewriteAuthHeaders(resp *http.Response, pb publicBase) {
 	values := resp.Header.Values("WWW-Authenticate")
 	if len(values) > 0 {
 		changed := false
@@ -182,6 +730,7 @@ func (m *Mirror) modifyResponse(resp *http.Response) error {
 			updated, ok := m.rewriteAuthHeader(value, pb)
 			if ok {
 				changed = true
+				m.auditRewrite(resp, "WWW-Authenticate", value, updated)
 				newValues = append(newValues, updated)
 			} else {
 				newValues = append(newValues, value)
@@ -194,7 +743,46 @@ func (m *Mirror) modifyResponse(resp *http.Response) error {
 			}
 		}
 	}
-	return nil
+}
+
+func (m *Mirror) auditRewrite(resp *http.Response, header, before, after string) {
+	if !m.logger.enabled(levelDebug) {
+		return
+	}
+	r, _ := resp.Request.Context().Value(ctxRouteKey).(*route)
+	m.logger.Debug("header rewritten", map[string]any{
+		"header": header,
+		"route":  routeMetricLabel(r, resp.Request.URL.Path),
+		"before": redactQuery(before),
+		"after":  redactQuery(after),
+	})
+}
+
+// redactQuery masks query parameter values in every URL found in value.
+func redactQuery(value string) string {
+	var b strings.Builder
+	inQuery, inValue := false, false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == ',' || c == ' ':
+			inQuery, inValue = false, false
+			b.WriteByte(c)
+		case c == '?':
+			inQuery, inValue = true, false
+			b.WriteByte(c)
+		case inQuery && c == '&':
+			inValue = false
+			b.WriteByte(c)
+		case inQuery && c == '=' && !inValue:
+			inValue = true
+			b.WriteString("=REDACTED")
+		case inValue:
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
 
 func (m *Mirror) rewriteURL(raw string, pb publicBase) (string, bool) {
@@ -202,7 +790,7 @@ func (m *Mirror) rewriteURL(raw string, pb publicBase) (string, bool) {
 	if err != nil {
 		return "", false
 	}
-	route := m.matchUpstreamURL(u)
+	route := m.matchUpstreamURL(u, pb.Host)
 	if route == nil {
 		return "", false
 	}
@@ -212,33 +800,85 @@ func (m *Mirror) rewriteURL(raw string, pb publicBase) (string, bool) {
 	}
 	newURL := *u
 	newURL.Scheme = pb.Scheme
-	newURL.Host = pb.Host
+	newURL.Host = route.publicHostFor(pb.Host)
 	newURL.Path = mappedPath
 	newURL.RawPath = ""
+	if route.preserveRawPath && u.RawPath != "" {
+		newURL.RawPath = route.mapUpstreamPath(u.RawPath)
+	}
 	return newURL.String(), true
 }
 
-func (m *Mirror) matchUpstreamURL(u *url.URL) *route {
+func (m *Mirror) matchUpstreamURL(u *url.URL, publicHost string) *route {
 	if u == nil || u.Host == "" {
 		return nil
 	}
+	var fallback, relaxed *route
 	for _, r := range m.routesByUpstream {
-		if !strings.EqualFold(u.Host, r.upstream.Host) {
+		schemeDiffers := r.upstream.Scheme != "" && u.Scheme != "" && !strings.EqualFold(u.Scheme, r.upstream.Scheme)
+		if schemeDiffers {
+			// Routes with ignore_upstream_scheme still match an upstream that
+			// redirects to itself over the other scheme, e.g. http -> https.
+			if !r.ignoreScheme || !sameHostAcrossSchemes(u, r.upstream) {
+				continue
+			}
+		} else if !strings.EqualFold(u.Host, r.upstream.Host) {
 			continue
 		}
 		if r.upstreamBasePath != "/" && !hasPathPrefix(u.Path, r.upstreamBasePath) {
 			continue
 		}
-		if r.upstream.Scheme != "" && u.Scheme != "" && !strings.EqualFold(u.Scheme, r.upstream.Scheme) {
+		if schemeDiffers {
+			if relaxed == nil || (!relaxed.matchesHost(publicHost) && r.matchesHost(publicHost)) {
+				relaxed = r
+			}
 			continue
 		}
-		return r
+		if r.matchesHost(publicHost) {
+			return r
+		}
+		if fallback == nil {
+			fallback = r
+		}
 	}
-	return nil
+	if fallback == nil {
+		return relaxed
+	}
+	return fallback
 }
 
+// sameHostAcrossSchemes reports whether a and b name the same host once
+// default ports are dropped, so http://h and https://h:443 compare equal.
+func sameHostAcrossSchemes(a, b *url.URL) bool {
+	if !strings.EqualFold(a.Hostname(), b.Hostname()) {
+		return false
+	}
+	portA, portB := a.Port(), b.Port()
+	if portA == portB {
+		return true
+	}
+	return isDefaultPort(a.Scheme, portA) && isDefaultPort(b.Scheme, portB)
+}
+
+func isDefaultPort(scheme, port string) bool {
+	switch port {
+	case "":
+		return true
+	case "80":
+		return strings.EqualFold(scheme, "http")
+	case "443":
+		return strings.EqualFold(scheme, "https")
+	}
+	return false
+}
+
+const maxAuthHeaderScan = 16 << 10
+
 func (m *Mirror) rewriteAuthHeader(value string, pb publicBase) (string, bool) {
-	lower := strings.ToLower(value)
+	if len(value) > maxAuthHeaderScan {
+		return value, false
+	}
+	lower := asciiLower(value)
 	idx := 0
 	changed := false
 	var b strings.Builder
@@ -251,19 +891,24 @@ func (m *Mirror) rewriteAuthHeader(value string, pb publicBase) (string, bool) {
 		b.WriteString(value[idx:pos])
 		b.WriteString(value[pos : pos+len("realm=")])
 		start := pos + len("realm=")
+		if !isParamBoundary(value, pos) {
+			idx = start
+			continue
+		}
 		if start >= len(value) {
 			idx = start
 			break
 		}
 		if value[start] == '"' {
-			end := strings.IndexByte(value[start+1:], '"')
+			end := closingQuote(value, start+1)
 			if end < 0 {
 				idx = start
 				break
 			}
-			end = start + 1 + end
 			realm := value[start+1 : end]
-			if rewritten, ok := m.rewriteURL(realm, pb); ok {
+			if strings.IndexByte(realm, '\\') >= 0 {
+				b.WriteString(value[start : end+1])
+			} else if rewritten, ok := m.rewriteURL(realm, pb); ok {
 				b.WriteByte('"')
 				b.WriteString(rewritten)
 				b.WriteByte('"')
@@ -291,6 +936,41 @@ func (m *Mirror) rewriteAuthHeader(value string, pb publicBase) (string, bool) {
 	return b.String(), changed
 }
 
+// asciiLower keeps byte offsets aligned with the input, unlike strings.ToLower.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func closingQuote(value string, from int) int {
+	for i := from; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isParamBoundary(value string, pos int) bool {
+	if pos == 0 {
+		return true
+	}
+	switch value[pos-1] {
+	case ' ', '\t', ',':
+		return true
+	default:
+		return false
+	}
+}
+
 func (m *Mirror) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
 	status := http.StatusBadGateway
 	msg := "upstream error"
@@ -298,6 +978,17 @@ func (m *Mirror) errorHandler(w http.ResponseWriter, r *http.Request, err error)
 		status = http.StatusRequestTimeout
 		msg = "request canceled"
 	}
+	if errors.Is(context.Cause(r.Context()), context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+		msg = "request exceeded max duration"
+	}
+	if errors.Is(err, errRedirectLoop) {
+		status = http.StatusLoopDetected
+		msg = "upstream redirect loop"
+	}
+	if isBlockedUpstream(err) {
+		msg = "upstream host blocked"
+	}
 	if m.logger != nil {
 		m.logger.Error("upstream error", map[string]any{
 			"method": r.Method,
@@ -305,7 +996,8 @@ func (m *Mirror) errorHandler(w http.ResponseWriter, r *http.Request, err error)
 			"error":  err.Error(),
 		})
 	}
-	routeLabel := routeMetricLabel(m.matchRoute(r.URL.Path), r.URL.Path)
+	route, _ := r.Context().Value(ctxRouteKey).(*route)
+	routeLabel := routeMetricLabel(route, r.URL.Path)
 	if m.metrics != nil {
 		m.metrics.observeUpstreamError(routeLabel)
 	}
@@ -340,10 +1032,17 @@ func parseAbsoluteURL(raw string) (*url.URL, error) {
 func (m *Mirror) serveInternal(w http.ResponseWriter, r *http.Request) bool {
 	switch r.URL.Path {
 	case "/_rmirror/healthz":
+		w.Header().Set(pidHeader, processPID)
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		_ = json.NewEncoder(w).Encode(healthStatus{
+			Status:     "ok",
+			ConfigHash: m.configHash,
+			Uptime:     time.Since(processStart).Seconds(),
+		})
 		return true
 	case "/_rmirror/readyz":
+		w.Header().Set(pidHeader, processPID)
 		if m.maxInflight != nil && len(m.maxInflight) >= cap(m.maxInflight) {
 			http.Error(w, "busy", http.StatusServiceUnavailable)
 			return true
@@ -351,6 +1050,39 @@ func (m *Mirror) serveInternal(w http.ResponseWriter, r *http.Request) bool {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 		return true
+	case "/_rmirror/tap":
+		m.serveTap(w, r)
+		return true
+	case "/_rmirror/metrics/reset":
+		if !m.allowReset {
+			http.NotFound(w, r)
+			return true
+		}
+		if !m.authorizeAdmin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return true
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		m.metrics.reset()
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/favicon.ico":
+		if !m.builtins.Favicon {
+			return false
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	case "/robots.txt":
+		if !m.builtins.Robots {
+			return false
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(m.builtins.RobotsBody))
+		return true
 	case "/metrics":
 		if m.metricsHandler != nil {
 			m.metricsHandler.ServeHTTP(w, r)
@@ -363,56 +1095,107 @@ func (m *Mirror) serveInternal(w http.ResponseWriter, r *http.Request) bool {
 	}
 }
 
-func (m *Mirror) acquire(w http.ResponseWriter, r *http.Request) bool {
-	if m.maxInflight == nil {
+type healthStatus struct {
+	Status     string  `json:"status"`
+	ConfigHash string  `json:"config_hash"`
+	Uptime     float64 `json:"uptime"`
+}
+
+// StopAdmitting is called when shutdown begins: requests waiting for an
+// inflight slot, and any that arrive later, are rejected with 503 instead of
+// holding up the shutdown until max_inflight_wait expires.
+func (m *Mirror) StopAdmitting() {
+	if m.draining == nil {
+		return
+	}
+	m.drainOnce.Do(func() { close(m.draining) })
+}
+
+// acquire takes a slot from slots, either limits.max_inflight or a route's
+// max_inflight, waiting up to wait for one to free up.
+func (m *Mirror) acquire(w http.ResponseWriter, r *http.Request, slots chan struct{}, wait time.Duration) bool {
+	if slots == nil {
 		return true
 	}
-	if m.maxInflightWait <= 0 {
+	select {
+	case <-m.draining:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return false
+	default:
+	}
+	if wait <= 0 {
 		select {
-		case m.maxInflight <- struct{}{}:
+		case slots <- struct{}{}:
 			return true
 		default:
 			http.Error(w, "server busy", http.StatusTooManyRequests)
 			return false
 		}
 	}
-	timer := time.NewTimer(m.maxInflightWait)
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if m.metrics != nil {
+		m.metrics.inflightQueue.Inc()
+		defer m.metrics.inflightQueue.Dec()
+	}
+	timer := time.NewTimer(wait)
 	defer timer.Stop()
 	select {
-	case m.maxInflight <- struct{}{}:
+	case slots <- struct{}{}:
 		return true
 	case <-timer.C:
 		http.Error(w, "server busy", http.StatusServiceUnavailable)
 		return false
+	case <-m.draining:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return false
 	case <-r.Context().Done():
+		if errors.Is(context.Cause(r.Context()), context.DeadlineExceeded) {
+			http.Error(w, "request exceeded max duration", http.StatusGatewayTimeout)
+			return false
+		}
 		http.Error(w, "request canceled", http.StatusRequestTimeout)
 		return false
 	}
 }
 
-func (m *Mirror) release() {
-	if m.maxInflight == nil {
+func release(slots chan struct{}) {
+	if slots == nil {
 		return
 	}
 	select {
-	case <-m.maxInflight:
+	case <-slots:
 	default:
 	}
 }
 
-func (m *Mirror) recordRequest(routeLabel string, r *http.Request, rw *logResponseWriter, elapsed time.Duration) {
+func (m *Mirror) recordRequest(route *route, r *http.Request, rw *logResponseWriter, elapsed time.Duration) {
+	routeLabel := routeMetricLabel(route, r.URL.Path)
 	status := rw.status
 	if status == 0 {
 		status = http.StatusOK
 	}
-	reqBytes := r.ContentLength
-	if reqBytes < 0 {
-		reqBytes = 0
+	var reqBytes int64
+	if rw.reqBody != nil {
+		reqBytes = rw.reqBody.n.Load()
 	}
 	if m.metrics != nil {
 		m.metrics.observeRequest(routeLabel, r.Method, status, elapsed, reqBytes, rw.bytes)
+		if rw.upstreamProto != "" {
+			m.metrics.observeUpstreamProto(routeLabel, rw.upstreamProto)
+		}
+	}
+	processStats.requests.Add(1)
+	processStats.requestBytes.Add(reqBytes)
+	processStats.responseBytes.Add(rw.bytes)
+	accessLog := m.accessLog
+	if route != nil {
+		accessLog = boolValue(route.accessLog, accessLog)
 	}
-	if m.accessLog && m.logger != nil {
+	if accessLog && m.logger != nil {
 		fields := map[string]any{
 			"method":   r.Method,
 			"path":     r.URL.Path,
@@ -421,11 +1204,17 @@ func (m *Mirror) recordRequest(routeLabel string, r *http.Request, rw *logRespon
 			"duration": elapsed.Milliseconds(),
 			"route":    routeLabel,
 		}
-		if route := m.matchRoute(r.URL.Path); route != nil {
+		if route != nil {
 			fields["upstream"] = route.upstream.Host
 		}
+		if rw.upstreamProto != "" {
+			fields["upstream_proto"] = rw.upstreamProto
+		}
 		m.logger.Info("request", fields)
 	}
+	if rw.bodies != nil {
+		m.logBodies(route, r, rw.bodies)
+	}
 }
 
 func routeMetricLabel(route *route, path string) string {
@@ -443,12 +1232,40 @@ func routeMetricLabel(route *route, path string) string {
 
 type logResponseWriter struct {
 	http.ResponseWriter
-	status int
-	bytes  int64
+	status  int
+	bytes   int64
+	reqBody *countingBody
+	// head suppresses byte counting: net/http discards HEAD response bodies.
+	head bool
+	// bodies captures body snippets for routes with debug_body_log.
+	bodies *bodyLog
+	// upstreamProto is the protocol of the upstream response, set by
+	// modifyResponse; empty when no upstream response was received.
+	upstreamProto string
+	// deadline enforces request_max_duration; it is stopped for streaming
+	// responses.
+	deadline *time.Timer
 }
 
+// countingBody counts request body bytes as the transport reads them, so
+// chunked uploads without a Content-Length are still measured.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// WriteHeader relays informational responses such as 103 Early Hints without
+// recording them as the final status.
 func (l *logResponseWriter) WriteHeader(code int) {
-	l.status = code
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		l.status = code
+	}
 	l.ResponseWriter.WriteHeader(code)
 }
 
@@ -457,6 +1274,42 @@ func (l *logResponseWriter) Write(p []byte) (int, error) {
 		l.status = http.StatusOK
 	}
 	n, err := l.ResponseWriter.Write(p)
-	l.bytes += int64(n)
+	if !l.head {
+		l.bytes += int64(n)
+		if l.bodies != nil {
+			l.bodies.response.Write(p[:n])
+		}
+	}
 	return n, err
 }
+
+func (l *logResponseWriter) Flush() {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	_ = http.NewResponseController(l.ResponseWriter).Flush()
+}
+
+func (l *logResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err == nil && l.status == 0 {
+		l.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+func (l *logResponseWriter) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := l.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+func (l *logResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
@@ -1,11 +1,31 @@
 package mirror
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -19,6 +39,11 @@ func newTestMirror(t *testing.T, routes []RouteConfig) *httptest.Server {
 }
 
 func newTestMirrorWithConfig(t *testing.T, cfg Config) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(newTestMirrorInstance(t, cfg).Handler())
+}
+
+func newTestMirrorInstance(t *testing.T, cfg Config) *Mirror {
 	t.Helper()
 	runtime, err := cfg.Runtime()
 	if err != nil {
@@ -29,7 +54,36 @@ func newTestMirrorWithConfig(t *testing.T, cfg Config) *httptest.Server {
 	if err != nil {
 		t.Fatalf("mirror: %v", err)
 	}
-	return httptest.NewServer(m.Handler())
+	return m
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) entries(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode log line %q: %v", line, err)
+		}
+		out = append(out, entry)
+	}
+	return out
 }
 
 func noRedirectClient() *http.Client {
@@ -70,221 +124,3333 @@ func TestRouteSelectionLongestPrefix(t *testing.T) {
 	}
 }
 
-func TestRequestRewriteWithUpstreamBasePath(t *testing.T) {
+func TestRouteSelectionByPublicHost(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	docker := newUpstream("docker")
+	defer docker.Close()
+	ghcr := newUpstream("ghcr")
+	defer ghcr.Close()
+	fallback := newUpstream("fallback")
+	defer fallback.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "docker", PublicHost: "docker.example.com", PublicPrefix: "/", Upstream: docker.URL},
+		{Name: "ghcr", PublicHost: "*.ghcr.example.com", PublicPrefix: "/", Upstream: ghcr.URL},
+		{Name: "fallback", PublicPrefix: "/", Upstream: fallback.URL},
+	})
+	defer mirror.Close()
+
+	cases := []struct {
+		host string
+		want string
+	}{
+		{"docker.example.com", "docker"},
+		{"Docker.Example.com:8443", "docker"},
+		{"eu.ghcr.example.com", "ghcr"},
+		{"ghcr.example.com", "fallback"},
+		{"other.example.com", "fallback"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, mirror.URL+"/v2/", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = tc.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Upstream"); got != tc.want {
+			t.Fatalf("host %q: expected %s upstream, got %q", tc.host, tc.want, got)
+		}
+	}
+}
+
+func TestPreserveHostFor(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Path", r.URL.Path)
-		w.Header().Set("X-Query", r.URL.RawQuery)
+		w.Header().Set("X-Seen-Host", r.Host)
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer upstream.Close()
 
 	mirror := newTestMirror(t, []RouteConfig{
-		{Name: "api", PublicPrefix: "/api", Upstream: upstream.URL + "/v1"},
+		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL, PreserveHostFor: []string{"tenant.example.com", "*.vhost.example.com"}},
 	})
 	defer mirror.Close()
 
-	resp, err := http.Get(mirror.URL + "/api/users?id=42")
-	if err != nil {
-		t.Fatalf("request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if got := resp.Header.Get("X-Path"); got != "/v1/users" {
-		t.Fatalf("unexpected upstream path: %q", got)
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+	cases := []struct {
+		host string
+		want string
+	}{
+		{"tenant.example.com", "tenant.example.com"},
+		{"Tenant.Example.com:8443", "Tenant.Example.com:8443"},
+		{"a.vhost.example.com", "a.vhost.example.com"},
+		{"other.example.com", upstreamHost},
+		{"vhost.example.com", upstreamHost},
 	}
-	if got := resp.Header.Get("X-Query"); got != "id=42" {
-		t.Fatalf("unexpected upstream query: %q", got)
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, mirror.URL+"/v2/", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = tc.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Seen-Host"); got != tc.want {
+			t.Fatalf("host %q: expected upstream to see %q, got %q", tc.host, tc.want, got)
+		}
 	}
 }
 
-func TestLocationRewrite(t *testing.T) {
-	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func TestForwardHeadersAllowlist(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
 		w.WriteHeader(http.StatusOK)
 	}))
-	defer blob.Close()
-
-	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Location", blob.URL+"/data")
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	}))
-	defer registry.Close()
+	defer upstream.Close()
 
 	mirror := newTestMirror(t, []RouteConfig{
-		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
-		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL, ForwardHeaders: []string{"accept", "Authorization"}},
 	})
 	defer mirror.Close()
 
-	client := noRedirectClient()
-	resp, err := client.Get(mirror.URL + "/v2/test")
+	req, err := http.NewRequest(http.MethodGet, mirror.URL+"/v2/", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Client-Id", "laptop")
+	req.Header.Set("User-Agent", "curl/8.0")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("request failed: %v", err)
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 
-	got := resp.Header.Get("Location")
-	want := mirror.URL + "/_blob/data"
-	if got != want {
-		t.Fatalf("unexpected location: %q (want %q)", got, want)
+	got := <-seen
+	if got.Get("Accept") != "application/json" || got.Get("Authorization") != "Bearer token" {
+		t.Fatalf("expected allowlisted headers to be forwarded, got %v", got)
+	}
+	for _, name := range []string{"Cookie", "X-Client-Id", "User-Agent", "X-Forwarded-For"} {
+		if _, ok := got[name]; ok {
+			t.Fatalf("expected %s to be stripped, got %v", name, got)
+		}
 	}
-}
 
-func TestWWWAuthenticateRewrite(t *testing.T) {
-	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	}))
-	defer auth.Close()
+	// Headers describing the request itself are kept without being listed.
+	req, err = http.NewRequest(http.MethodPatch, mirror.URL+"/v2/library/alpine/blobs/uploads/1", strings.NewReader("chunk"))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	protocol := map[string]string{
+		"Content-Type":  "application/octet-stream",
+		"Content-Range": "0-4",
+		"Range":         "bytes=0-4",
+		"If-None-Match": `"etag"`,
+	}
+	for name, value := range protocol {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Cookie", "session=secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	got = <-seen
+	for name, value := range protocol {
+		if got.Get(name) != value {
+			t.Fatalf("expected %s to be forwarded, got %v", name, got)
+		}
+	}
+	if _, ok := got["Cookie"]; ok {
+		t.Fatalf("expected Cookie to be stripped, got %v", got)
+	}
+}
 
-	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("WWW-Authenticate", "Bearer realm=\""+auth.URL+"/token\",service=\"registry\"")
-		w.WriteHeader(http.StatusUnauthorized)
-	}))
+func TestRegexRouteMatching(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			w.Header().Set("X-Path", r.URL.Path)
+		}))
+	}
+	blobs := newUpstream("blobs")
+	defer blobs.Close()
+	registry := newUpstream("registry")
 	defer registry.Close()
 
 	mirror := newTestMirror(t, []RouteConfig{
-		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
-		{Name: "auth", PublicPrefix: "/_auth", Upstream: auth.URL},
+		{Name: "registry", PublicPrefix: "/v2", Upstream: registry.URL},
+		{Name: "blobs", MatchRegex: `^/v2/(?P<name>.+)/blobs/(sha256:[0-9a-f]+)$`, UpstreamPathTemplate: "/store/${name}/$2", Upstream: blobs.URL + "/base"},
+		{Name: "uploads", MatchRegex: `^/v2/.+/blobs/uploads/`, Upstream: registry.URL},
 	})
 	defer mirror.Close()
 
-	resp, err := http.Get(mirror.URL + "/v2/")
+	cases := []struct {
+		path     string
+		upstream string
+		want     string
+	}{
+		{"/v2/library/alpine/blobs/sha256:abc123", "blobs", "/base/store/library/alpine/sha256:abc123"},
+		{"/v2/library/alpine/manifests/latest", "registry", "/library/alpine/manifests/latest"},
+		{"/v2/library/alpine/blobs/uploads/1", "registry", "/v2/library/alpine/blobs/uploads/1"},
+	}
+	for _, tc := range cases {
+		resp, err := http.Get(mirror.URL + tc.path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Upstream"); got != tc.upstream {
+			t.Fatalf("%s: expected upstream %s, got %q", tc.path, tc.upstream, got)
+		}
+		if got := resp.Header.Get("X-Path"); got != tc.want {
+			t.Fatalf("%s: expected upstream path %q, got %q", tc.path, tc.want, got)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{{Name: "broken", MatchRegex: "^/v2/(", Upstream: registry.URL}}
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), `"broken"`) {
+		t.Fatalf("expected invalid match_regex to name the route, got %v", err)
+	}
+}
+
+func TestMethodRouteSelection(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+		}))
+	}
+	cdn := newUpstream("cdn")
+	defer cdn.Close()
+	origin := newUpstream("origin")
+	defer origin.Close()
+
+	// The method-agnostic route comes first in the config on purpose.
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "origin", PublicPrefix: "/v2", Upstream: origin.URL},
+		{Name: "cdn", PublicPrefix: "/v2", Upstream: cdn.URL, Methods: []string{"get", "HEAD"}},
+	})
+	defer mirror.Close()
+
+	for _, tc := range []struct {
+		method   string
+		upstream string
+	}{
+		{http.MethodGet, "cdn"},
+		{http.MethodHead, "cdn"},
+		{http.MethodPut, "origin"},
+		{http.MethodPost, "origin"},
+		{http.MethodPatch, "origin"},
+		{http.MethodDelete, "origin"},
+	} {
+		req, _ := http.NewRequest(tc.method, mirror.URL+"/v2/library/alpine/blobs/sha256:abc", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tc.method, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Upstream"); got != tc.upstream {
+			t.Fatalf("%s: expected upstream %s, got %q", tc.method, tc.upstream, got)
+		}
+	}
+
+	readOnly := newTestMirror(t, []RouteConfig{
+		{Name: "cdn", PublicPrefix: "/v2", Upstream: cdn.URL, Methods: []string{"GET"}},
+	})
+	defer readOnly.Close()
+	req, _ := http.NewRequest(http.MethodPut, readOnly.URL+"/v2/x", nil)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("request failed: %v", err)
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 without a route for PUT, got %d", resp.StatusCode)
+	}
 
-	value := resp.Header.Get("WWW-Authenticate")
-	if !strings.Contains(value, "realm=\""+mirror.URL+"/_auth/token\"") {
-		t.Fatalf("unexpected WWW-Authenticate: %q", value)
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{
+		{Name: "a", PublicPrefix: "/v2", Upstream: cdn.URL, Methods: []string{"GET", "HEAD"}},
+		{Name: "b", PublicPrefix: "/v2", Upstream: origin.URL, Methods: []string{"head"}},
+	}
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "routes[1].public_prefix duplicates") {
+		t.Fatalf("expected overlapping methods on one prefix to be rejected, got %v", err)
 	}
 }
 
-func TestUnknownLocationPreserved(t *testing.T) {
+func TestLinkHeaderRewrite(t *testing.T) {
+	var upstreamURL string
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Location", "https://example.com/path")
-		w.WriteHeader(http.StatusTemporaryRedirect)
+		w.Header().Add("Link", "<"+upstreamURL+"/v2/_catalog?last=b&n=2>; rel=\"next\", <"+upstreamURL+"/v2/_catalog?n=2>; rel=\"first\"")
+		w.Header().Add("Link", `<https://other.example/help>; rel="help"; title="see <`+upstreamURL+`/x>"`)
+		w.Header().Add("Link", `</v2/relative>; rel="prev"`)
+		w.WriteHeader(http.StatusOK)
 	}))
 	defer upstream.Close()
+	upstreamURL = upstream.URL
 
 	mirror := newTestMirror(t, []RouteConfig{
-		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL},
+		{Name: "registry", PublicPrefix: "/reg", Upstream: upstream.URL},
 	})
 	defer mirror.Close()
 
-	client := noRedirectClient()
-	resp, err := client.Get(mirror.URL + "/anything")
+	resp, err := http.Get(mirror.URL + "/reg/v2/_catalog?n=2")
 	if err != nil {
 		t.Fatalf("request failed: %v", err)
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
 
-	if got := resp.Header.Get("Location"); got != "https://example.com/path" {
-		t.Fatalf("unexpected location: %q", got)
+	want := []string{
+		"<" + mirror.URL + "/reg/v2/_catalog?last=b&n=2>; rel=\"next\", <" + mirror.URL + "/reg/v2/_catalog?n=2>; rel=\"first\"",
+		`<https://other.example/help>; rel="help"; title="see <` + upstream.URL + `/x>"`,
+		`</v2/relative>; rel="prev"`,
+	}
+	got := resp.Header.Values("Link")
+	if len(got) != len(want) {
+		t.Fatalf("expected %d Link headers, got %q", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Link %d: expected %q, got %q", i, want[i], got[i])
+		}
 	}
 }
 
-func TestConcurrentRequests(t *testing.T) {
-	var count int64
+func TestSetCookieRewrite(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		atomic.AddInt64(&count, 1)
+		w.Header().Add("Set-Cookie", "session=abc; Domain=.127.0.0.1; Path=/v2; Secure; HttpOnly; SameSite=Lax; Max-Age=60")
+		w.Header().Add("Set-Cookie", "other=1; Domain=example.org; Path=/v2")
+		w.Header().Add("Set-Cookie", "plain=1; path=/v2/x")
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer upstream.Close()
 
-	mirror := newTestMirror(t, []RouteConfig{
-		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL},
-	})
-	defer mirror.Close()
+	cases := []struct {
+		name string
+		base string
+		want []string
+	}{
+		{
+			name: "public base",
+			base: "https://mirror.example",
+			want: []string{
+				"session=abc; Domain=mirror.example; Path=/reg/v2; Secure; HttpOnly; SameSite=Lax; Max-Age=60",
+				"other=1; Domain=example.org; Path=/v2",
+				"plain=1; path=/reg/v2/x",
+			},
+		},
+		{
+			name: "request host",
+			want: []string{
+				"session=abc; Path=/reg/v2; Secure; HttpOnly; SameSite=Lax; Max-Age=60",
+				"other=1; Domain=example.org; Path=/v2",
+				"plain=1; path=/reg/v2/x",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AccessLog = false
+			cfg.PublicBaseURL = tc.base
+			cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/reg", Upstream: upstream.URL}}
+			mirror := newTestMirrorWithConfig(t, cfg)
+			defer mirror.Close()
 
-	const total = 25
-	var wg sync.WaitGroup
-	wg.Add(total)
-	for i := 0; i < total; i++ {
-		go func() {
-			defer wg.Done()
-			resp, err := http.Get(mirror.URL + "/ping")
+			resp, err := http.Get(mirror.URL + "/reg/v2/")
 			if err != nil {
-				t.Errorf("request failed: %v", err)
-				return
+				t.Fatalf("request failed: %v", err)
 			}
 			resp.Body.Close()
-		}()
-	}
-	wg.Wait()
-	if got := atomic.LoadInt64(&count); got != total {
-		t.Fatalf("expected %d requests, got %d", total, got)
+			got := resp.Header.Values("Set-Cookie")
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected Set-Cookie headers:\n got %q\nwant %q", got, tc.want)
+			}
+		})
 	}
 }
 
-func TestHealthEndpoints(t *testing.T) {
+func TestRewriteBodyURLs(t *testing.T) {
+	var upstreamURL string
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		page := `<a href="` + upstreamURL + `/ui/repo?x=1">repo</a> <a href="https://elsewhere.example/">out</a>`
+		switch r.URL.Path {
+		case "/ui/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, page)
+		case "/ui/page.gz":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, page)
+			gz.Close()
+		case "/ui/data":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"links":["`+upstreamURL+`/ui/a"]}`)
+		case "/ui/escaped":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"links":["`+strings.ReplaceAll(upstreamURL, "/", `\/`)+`\/ui\/a"]}`)
+		case "/ui/big":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, page+strings.Repeat(" ", 512))
+		case "/ui/text":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, page)
+		}
 	}))
 	defer upstream.Close()
+	upstreamURL = upstream.URL
 
 	cfg := DefaultConfig()
 	cfg.AccessLog = false
-	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	cfg.PublicBaseURL = "https://mirror.example"
+	cfg.Routes = []RouteConfig{{Name: "ui", PublicPrefix: "/web", Upstream: upstream.URL, RewriteBody: true, MaxBodyRewriteBytes: 256}}
 	mirror := newTestMirrorWithConfig(t, cfg)
 	defer mirror.Close()
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	for _, path := range []string{"/_rmirror/healthz", "/_rmirror/readyz"} {
-		resp, err := client.Get(mirror.URL + path)
+	rewritten := `<a href="https://mirror.example/web/ui/repo?x=1">repo</a> <a href="https://elsewhere.example/">out</a>`
+	original := `<a href="` + upstream.URL + `/ui/repo?x=1">repo</a> <a href="https://elsewhere.example/">out</a>`
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/web/ui/page", rewritten},
+		{"/web/ui/page.gz", rewritten},
+		{"/web/ui/data", `{"links":["https://mirror.example/web/ui/a"]}`},
+		{"/web/ui/escaped", `{"links":["https:\/\/mirror.example\/web\/ui\/a"]}`},
+		{"/web/ui/big", original + strings.Repeat(" ", 512)},
+		{"/web/ui/text", original},
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, mirror.URL+tc.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
 		if err != nil {
-			t.Fatalf("request %s failed: %v", path, err)
+			t.Fatalf("request failed: %v", err)
 		}
+		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			t.Fatalf("unexpected status for %s: %d", path, resp.StatusCode)
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("%s: expected an unencoded body, got Content-Encoding %q", tc.path, resp.Header.Get("Content-Encoding"))
+		}
+		if string(body) != tc.want {
+			t.Fatalf("%s: unexpected body:\n got %q\nwant %q", tc.path, body, tc.want)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Fatalf("%s: expected Content-Length %d, got %d", tc.path, len(body), resp.ContentLength)
 		}
 	}
 }
 
-func TestMaxInflightLimit(t *testing.T) {
-	started := make(chan struct{})
-	release := make(chan struct{})
-	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		close(started)
-		<-release
+func TestLocationRewriteAcrossPublicHosts(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
-	defer upstream.Close()
+	defer blob.Close()
 
-	cfg := DefaultConfig()
-	cfg.AccessLog = false
-	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
-	cfg.Limits.MaxInflight = 1
-	cfg.Limits.MaxInflightWait = "0s"
-	mirror := newTestMirrorWithConfig(t, cfg)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", blob.URL+"/data")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicHost: "registry.example.com", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "blob", PublicHost: "blob.example.com", PublicPrefix: "/", Upstream: blob.URL},
+	})
 	defer mirror.Close()
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	firstErr := make(chan error, 1)
-	go func() {
-		resp, err := client.Get(mirror.URL + "/slow")
-		if err == nil {
-			resp.Body.Close()
-		}
-		firstErr <- err
-	}()
-	select {
-	case <-started:
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for upstream to start")
+	req, err := http.NewRequest(http.MethodGet, mirror.URL+"/v2/test", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
 	}
-
-	resp, err := client.Get(mirror.URL + "/busy")
+	req.Host = "registry.example.com:5000"
+	resp, err := noRedirectClient().Do(req)
 	if err != nil {
-		t.Fatalf("second request failed: %v", err)
+		t.Fatalf("request failed: %v", err)
 	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusTooManyRequests {
-		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	defer resp.Body.Close()
+
+	got := resp.Header.Get("Location")
+	want := "http://blob.example.com:5000/data"
+	if got != want {
+		t.Fatalf("unexpected location: %q (want %q)", got, want)
 	}
+}
 
-	close(release)
-	if err := <-firstErr; err != nil {
-		t.Fatalf("first request failed: %v", err)
+func TestRequestRewriteWithUpstreamBasePath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Query", r.URL.RawQuery)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "api", PublicPrefix: "/api", Upstream: upstream.URL + "/v1"},
+	})
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/api/users?id=42")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
 	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("X-Path"); got != "/v1/users" {
+		t.Fatalf("unexpected upstream path: %q", got)
+	}
+	if got := resp.Header.Get("X-Query"); got != "id=42" {
+		t.Fatalf("unexpected upstream query: %q", got)
+	}
+}
+
+func TestTrailersForwarded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("ok"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "grpc", PublicPrefix: "/", Upstream: upstream.URL},
+	})
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/svc/Method")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("expected declared trailer, got %q", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "done" {
+		t.Fatalf("expected undeclared trailer, got %q", got)
+	}
+}
+
+func TestStreamingResponseFlushed(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "stream", PublicPrefix: "/", Upstream: upstream.URL},
+	})
+	defer mirror.Close()
+	defer close(release)
+
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(mirror.URL + "/events")
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		got, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- got
+	}()
+	select {
+	case got := <-line:
+		if got != "first\n" {
+			t.Fatalf("unexpected first line: %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first chunk was not flushed to the client")
+	}
+}
+
+func TestUpgradeHijacksThroughMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		buf.WriteString(line)
+		buf.Flush()
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "ws", PublicPrefix: "/", Upstream: upstream.URL},
+	})
+	defer mirror.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(mirror.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial mirror: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: mirror\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"); err != nil {
+		t.Fatalf("write upgrade request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	got, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if got != "ping\n" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+}
+
+func TestLogResponseWriterOptionalInterfaces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	lw := &logResponseWriter{ResponseWriter: rec}
+	lw.Write([]byte("x"))
+	lw.Flush()
+	if !rec.Flushed {
+		t.Fatal("expected flush to reach the underlying writer")
+	}
+	if _, _, err := lw.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported from hijack, got %v", err)
+	}
+	if err := lw.Push("/x", nil); !errors.Is(err, http.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported from push, got %v", err)
+	}
+}
+
+func TestHeaderCasingPreservedOnHTTP1(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	rawHeaders := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var head strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			head.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		rawHeaders <- head.String()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Transport.HeaderCasing = []string{"X-Custom-HEADER", "x-lower", "x-forwarded-for"}
+	cfg.Routes = []RouteConfig{{Name: "raw", PublicPrefix: "/", Upstream: "http://" + ln.Addr().String()}}
+	mirror := newTestMirrorWithConfig(t, cfg)
+	defer mirror.Close()
+
+	req, err := http.NewRequest(http.MethodGet, mirror.URL+"/v2/", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Custom-Header", "a")
+	req.Header.Set("X-Lower", "b")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	var head string
+	select {
+	case head = <-rawHeaders:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream did not receive the request")
+	}
+	if !strings.Contains(head, "\r\nX-Custom-HEADER: a\r\n") || !strings.Contains(head, "\r\nx-lower: b\r\n") {
+		t.Fatalf("expected configured header casing upstream, got:\n%s", head)
+	}
+	// The proxy appends to X-Forwarded-For after the director; the renamed
+	// header must still be sent once, with the appended address.
+	if strings.Contains(head, "\r\nX-Forwarded-For:") || !strings.Contains(head, "\r\nx-forwarded-for: 192.0.2.1, 127.0.0.1\r\n") {
+		t.Fatalf("expected a single renamed x-forwarded-for upstream, got:\n%s", head)
+	}
+}
+
+func TestLocationRewrite(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", blob.URL+"/data")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	})
+	defer mirror.Close()
+
+	client := noRedirectClient()
+	resp, err := client.Get(mirror.URL + "/v2/test")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	got := resp.Header.Get("Location")
+	want := mirror.URL + "/_blob/data"
+	if got != want {
+		t.Fatalf("unexpected location: %q (want %q)", got, want)
+	}
+}
+
+func TestRewriteCustomHeaders(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Next-Page", blob.URL+"/page/2")
+		w.Header().Set("X-Elsewhere", "https://example.com/page/2")
+		w.Header().Set("X-Unlisted", blob.URL+"/page/3")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL, RewriteHeaders: []string{"x-next-page", "X-Elsewhere"}},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	})
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got, want := resp.Header.Get("X-Next-Page"), mirror.URL+"/_blob/page/2"; got != want {
+		t.Fatalf("unexpected X-Next-Page: %q (want %q)", got, want)
+	}
+	if got := resp.Header.Get("X-Elsewhere"); got != "https://example.com/page/2" {
+		t.Fatalf("non-matching host should be left alone, got %q", got)
+	}
+	if got := resp.Header.Get("X-Unlisted"); got != blob.URL+"/page/3" {
+		t.Fatalf("unlisted header should be left alone, got %q", got)
+	}
+}
+
+func TestRewriteJSONPaths(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(map[string]any{
+			"blobs": []map[string]any{
+				{"url": blob.URL + "/data/a", "note": "mirror of " + blob.URL + "/data/a"},
+				{"url": "data/b", "size": 12},
+			},
+			"homepage": blob.URL + "/",
+		})
+		sum := sha256.Sum256(data)
+		w.Header().Set("Content-Type", "application/vnd.example+json; charset=utf-8")
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+		w.Write(data)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL, RewriteJSONPaths: []string{"$.blobs[*].url", "$['missing'].url"}},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	})
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if resp.ContentLength != int64(len(data)) {
+		t.Fatalf("content length %d does not match body length %d", resp.ContentLength, len(data))
+	}
+	sum := sha256.Sum256(data)
+	if got, want := resp.Header.Get("Docker-Content-Digest"), "sha256:"+hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("expected the digest of the rewritten body %s, got %s", want, got)
+	}
+	var body struct {
+		Blobs []struct {
+			URL  string `json:"url"`
+			Note string `json:"note"`
+			Size int    `json:"size"`
+		} `json:"blobs"`
+		Homepage string `json:"homepage"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	if want := mirror.URL + "/_blob/data/a"; body.Blobs[0].URL != want {
+		t.Fatalf("unexpected url: %q (want %q)", body.Blobs[0].URL, want)
+	}
+	if body.Blobs[0].Note != "mirror of "+blob.URL+"/data/a" {
+		t.Fatalf("unselected field was rewritten: %q", body.Blobs[0].Note)
+	}
+	if body.Blobs[1].URL != "data/b" || body.Blobs[1].Size != 12 {
+		t.Fatalf("non-URL value changed: %+v", body.Blobs[1])
+	}
+	if body.Homepage != blob.URL+"/" {
+		t.Fatalf("unselected field was rewritten: %q", body.Homepage)
+	}
+}
+
+func TestRouteAcceptEncoding(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("plain"))
+			return
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte("compressed"))
+		gz.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Header.Get("Range") == "bytes=0-9" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-9/%d", buf.Len()))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(buf.Bytes()[:10])
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "br", PublicPrefix: "/br", Upstream: upstream.URL, AcceptEncoding: "br;q=1.0, identity;q=0.5"},
+		{Name: "gzip", PublicPrefix: "/gzip", Upstream: upstream.URL, Decompress: true},
+	})
+	defer mirror.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path string, header ...string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, mirror.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	if _, body := get("/br/x"); body != "plain" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	resp, body := get("/gzip/x")
+	if body != "compressed" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("expected decompressed body, got %q (encoding %q)", body, resp.Header.Get("Content-Encoding"))
+	}
+	// A byte range of a gzip stream cannot be decoded on its own.
+	resp, body = get("/gzip/x", "Range", "bytes=0-9")
+	if resp.StatusCode != http.StatusPartialContent || len(body) != 10 || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the partial gzip body to pass through, got %d %q (encoding %q)", resp.StatusCode, body, resp.Header.Get("Content-Encoding"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 3 || seen[0] != "br;q=1.0, identity;q=0.5" || seen[1] != "gzip" {
+		t.Fatalf("unexpected upstream Accept-Encoding: %q", seen)
+	}
+}
+
+func TestIsolatedPool(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/block") {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Transport.MaxConnsPerHost = 1
+	cfg.Routes = []RouteConfig{
+		{Name: "noisy", PublicPrefix: "/noisy", Upstream: upstream.URL, IsolatedPool: true},
+		{Name: "quiet", PublicPrefix: "/quiet", Upstream: upstream.URL},
+		{Name: "shared", PublicPrefix: "/shared", Upstream: upstream.URL},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	defer close(release)
+	for _, r := range m.routes {
+		if isolated := r.transport != nil && r.transport != m.transport; isolated != (r.name == "noisy") {
+			t.Fatalf("route %s: isolated=%v", r.name, isolated)
+		}
+	}
+
+	go func() {
+		if resp, err := http.Get(srv.URL + "/noisy/block"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	status := func(path string) int {
+		t.Helper()
+		client := &http.Client{Timeout: 300 * time.Millisecond}
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status("/quiet/x"); got != http.StatusOK {
+		t.Fatalf("expected quiet route to be served while noisy pool is saturated, got %d", got)
+	}
+	if got := status("/noisy/x"); got != 0 {
+		t.Fatalf("expected noisy route to wait on its saturated pool, got %d", got)
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for _, expr := range []string{"$.token", "$.blobs[*].url", "$['a b'][0]", "$.*.url"} {
+		if _, err := parseJSONPath(expr); err != nil {
+			t.Fatalf("parse %q: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "token", "$", "$..url", "$.a[", "$.a[-1]", "$.a.", "$a"} {
+		if _, err := parseJSONPath(expr); err == nil {
+			t.Fatalf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestWWWAuthenticateRewrite(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer auth.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\""+auth.URL+"/token\",service=\"registry\"")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "auth", PublicPrefix: "/_auth", Upstream: auth.URL},
+	})
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	value := resp.Header.Get("WWW-Authenticate")
+	if !strings.Contains(value, "realm=\""+mirror.URL+"/_auth/token\"") {
+		t.Fatalf("unexpected WWW-Authenticate: %q", value)
+	}
+}
+
+func TestUnknownLocationPreserved(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "https://example.com/path")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL},
+	})
+	defer mirror.Close()
+
+	client := noRedirectClient()
+	resp, err := client.Get(mirror.URL + "/anything")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Location"); got != "https://example.com/path" {
+		t.Fatalf("unexpected location: %q", got)
+	}
+}
+
+func TestIgnoreUpstreamSchemeRewritesSelfRedirect(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "https://"+r.Host+"/secure"+r.URL.Path)
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name   string
+		ignore bool
+		want   func(mirrorURL string) string
+	}{
+		{"strict", false, func(string) string { return "https://" + strings.TrimPrefix(upstream.URL, "http://") + "/secure/pkg" }},
+		{"ignore", true, func(mirrorURL string) string { return mirrorURL + "/secure/pkg" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mirror := newTestMirror(t, []RouteConfig{
+				{Name: "root", PublicPrefix: "/", Upstream: upstream.URL, IgnoreUpstreamScheme: tc.ignore},
+			})
+			defer mirror.Close()
+
+			resp, err := noRedirectClient().Get(mirror.URL + "/pkg")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if got, want := resp.Header.Get("Location"), tc.want(mirror.URL); got != want {
+				t.Fatalf("expected Location %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSameHostAcrossSchemes(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"https://example.com/x", "http://example.com", true},
+		{"https://example.com:443/x", "http://example.com:80", true},
+		{"https://EXAMPLE.com/x", "http://example.com:8080", false},
+		{"https://example.com:8443/x", "http://example.com:8443", true},
+		{"https://other.com/x", "http://example.com", false},
+	}
+	for _, tc := range cases {
+		a, _ := url.Parse(tc.a)
+		b, _ := url.Parse(tc.b)
+		if got := sameHostAcrossSchemes(a, b); got != tc.want {
+			t.Errorf("sameHostAcrossSchemes(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	var count int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "root", PublicPrefix: "/", Upstream: upstream.URL},
+	})
+	defer mirror.Close()
+
+	const total = 25
+	var wg sync.WaitGroup
+	wg.Add(total)
+	for i := 0; i < total; i++ {
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(mirror.URL + "/ping")
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt64(&count); got != total {
+		t.Fatalf("expected %d requests, got %d", total, got)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	mirror := newTestMirrorWithConfig(t, cfg)
+	defer mirror.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, path := range []string{"/_rmirror/healthz", "/_rmirror/readyz"} {
+		resp, err := client.Get(mirror.URL + path)
+		if err != nil {
+			t.Fatalf("request %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status for %s: %d", path, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Rmirror-Pid"); got != strconv.Itoa(os.Getpid()) {
+			t.Fatalf("expected %s to carry the process ID, got %q", path, got)
+		}
+	}
+}
+
+func TestBuiltinFaviconAndRobots(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "root")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Builtins = BuiltinsConfig{Favicon: true, Robots: true, RobotsBody: "User-agent: *\nAllow: /\n"}
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	mirror := newTestMirrorWithConfig(t, cfg)
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/favicon.ico")
+	if err != nil {
+		t.Fatalf("favicon request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("X-Upstream") != "" {
+		t.Fatalf("expected built-in 204 favicon, got %d (upstream %q)", resp.StatusCode, resp.Header.Get("X-Upstream"))
+	}
+
+	resp, err = http.Get(mirror.URL + "/robots.txt")
+	if err != nil {
+		t.Fatalf("robots request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "User-agent: *\nAllow: /\n" {
+		t.Fatalf("unexpected robots body: %q", body)
+	}
+
+	cfg.Builtins = BuiltinsConfig{}
+	proxied := newTestMirrorWithConfig(t, cfg)
+	defer proxied.Close()
+	for _, path := range []string{"/favicon.ico", "/robots.txt"} {
+		resp, err := http.Get(proxied.URL + path)
+		if err != nil {
+			t.Fatalf("request %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Upstream"); got != "root" {
+			t.Fatalf("expected %s to be proxied when disabled, got upstream %q", path, got)
+		}
+	}
+}
+
+func TestHealthzConfigHashChangesOnReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	readHash := func(cfg Config) string {
+		t.Helper()
+		mirror := newTestMirrorWithConfig(t, cfg)
+		defer mirror.Close()
+		resp, err := http.Get(mirror.URL + "/_rmirror/healthz")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var status healthStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("decode healthz: %v", err)
+		}
+		if status.Status != "ok" || status.ConfigHash == "" {
+			t.Fatalf("unexpected healthz: %+v", status)
+		}
+		return status.ConfigHash
+	}
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	first := readHash(cfg)
+	if again := readHash(cfg); again != first {
+		t.Fatalf("hash not stable: %q != %q", again, first)
+	}
+
+	cfg.Routes = append(cfg.Routes, RouteConfig{Name: "api", PublicPrefix: "/api", Upstream: upstream.URL})
+	if next := readHash(cfg); next == first {
+		t.Fatalf("expected hash to change after reload, got %q", next)
+	}
+}
+
+func TestMetricsReset(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.AllowMetricsReset = true
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	get := func() {
+		resp, err := http.Get(mirror.URL + "/v2/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	requests := func() float64 {
+		return metricValue(t, m.metrics, "rmirror_requests_total", map[string]string{"route": "root"})
+	}
+
+	get()
+	get()
+	if got := requests(); got != 2 {
+		t.Fatalf("expected 2 requests before reset, got %v", got)
+	}
+
+	resp, err := http.Get(mirror.URL + "/_rmirror/metrics/reset")
+	if err != nil {
+		t.Fatalf("reset request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET reset to be rejected, got %d", resp.StatusCode)
+	}
+	resp, err = http.Post(mirror.URL+"/_rmirror/metrics/reset", "", nil)
+	if err != nil {
+		t.Fatalf("reset request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 from reset, got %d", resp.StatusCode)
+	}
+	if got := requests(); got != 0 {
+		t.Fatalf("expected 0 requests after reset, got %v", got)
+	}
+
+	get()
+	if got := requests(); got != 1 {
+		t.Fatalf("expected counting to resume after reset, got %v", got)
+	}
+}
+
+func TestRequestBytesCountChunkedBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "uploads", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	payload := bytes.Repeat([]byte("chunk"), 20000)
+	// Hiding the reader's length forces a chunked request with ContentLength -1.
+	req, err := http.NewRequest(http.MethodPut, mirror.URL+"/v2/blob/uploads/1", io.MultiReader(bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	got := metricValue(t, m.metrics, "rmirror_request_bytes_total", map[string]string{"route": "uploads"})
+	if got != float64(len(payload)) {
+		t.Fatalf("expected %d request bytes, got %v", len(payload), got)
+	}
+}
+
+func TestEarlyHintsNotRecordedAsFinalStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "hints", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	var hints []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, code)
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, mirror.URL+"/index.html", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected final 200, got %d", resp.StatusCode)
+	}
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Fatalf("expected 103 to be relayed, got %v", hints)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_requests_total", map[string]string{"route": "hints", "status": "200"}); got != 1 {
+		t.Fatalf("expected request recorded with status 200, got %v", got)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_requests_total", map[string]string{"route": "hints", "status": "103"}); got != 0 {
+		t.Fatalf("expected no request recorded with status 103, got %v", got)
+	}
+}
+
+func TestActivateSwapsConfigMetrics(t *testing.T) {
+	build := func(hash string, shared *Metrics) *Mirror {
+		cfg := DefaultConfig()
+		cfg.AccessLog = false
+		cfg.Routes = []RouteConfig{{Name: "r", PublicPrefix: "/", Upstream: "https://registry-1.docker.io"}}
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		runtime.ConfigHash = hash
+		m, err := NewWithMetrics(runtime, NewTransport(runtime.Transport), shared)
+		if err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+		return m
+	}
+	prev := build("old", nil)
+	if got := metricValue(t, prev.metrics, "rmirror_config_info", map[string]string{"hash": "old"}); got != 1 {
+		t.Fatalf("expected a new registry to record its config hash, got %v", got)
+	}
+	stale := map[string]string{"host": "stale.example"}
+	prev.metrics.setFragmentLength("stale.example", 3)
+
+	next := build("new", prev.Metrics())
+	if got := metricValue(t, prev.metrics, "rmirror_config_info", map[string]string{"hash": "old"}); got != 1 {
+		t.Fatalf("expected the active config hash to stay until Activate, got %v", got)
+	}
+	if got := metricValue(t, prev.metrics, "rmirror_fragment_length", stale); got != 3 {
+		t.Fatalf("expected the active gauges to stay until Activate, got %v", got)
+	}
+
+	next.Activate()
+	if got := metricValue(t, next.metrics, "rmirror_config_info", map[string]string{"hash": "old"}); got != 0 {
+		t.Fatalf("expected the old config hash to be dropped, got %v", got)
+	}
+	if got := metricValue(t, next.metrics, "rmirror_config_info", map[string]string{"hash": "new"}); got != 1 {
+		t.Fatalf("expected the new config hash after Activate, got %v", got)
+	}
+	if got := metricValue(t, next.metrics, "rmirror_fragment_length", stale); got != 0 {
+		t.Fatalf("expected the old gauges to be dropped, got %v", got)
+	}
+	if got := metricValue(t, next.metrics, "rmirror_fragment_length", map[string]string{"host": "registry-1.docker.io"}); got != defaultFirstFragmentLen {
+		t.Fatalf("expected the fixed fragment length of the new config, got %v", got)
+	}
+}
+
+func TestMetricsResetDisabledByDefault(t *testing.T) {
+	mirror := newTestMirror(t, []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: "http://127.0.0.1:1"}})
+	defer mirror.Close()
+
+	resp, err := http.Post(mirror.URL+"/_rmirror/metrics/reset", "", nil)
+	if err != nil {
+		t.Fatalf("reset request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 when reset is disabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestMaxInflightLimit(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	cfg.Limits.MaxInflight = 1
+	cfg.Limits.MaxInflightWait = "0s"
+	mirror := newTestMirrorWithConfig(t, cfg)
+	defer mirror.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	firstErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(mirror.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		firstErr <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for upstream to start")
+	}
+
+	resp, err := client.Get(mirror.URL + "/busy")
+	if err != nil {
+		t.Fatalf("second request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+
+	close(release)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+}
+
+func TestRouteMaxInflightLimit(t *testing.T) {
+	// The limited route is listed both before and after the catch-all, which
+	// route matching sorts ahead of it.
+	for _, reversed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reversed=%v", reversed), func(t *testing.T) {
+			testRouteMaxInflightLimit(t, reversed)
+		})
+	}
+}
+
+func testRouteMaxInflightLimit(t *testing.T, reversed bool) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/blobs/slow") {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	// Unblocks the upstream handlers when the test fails early.
+	defer unblock()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "blobs", PublicPrefix: "/blobs", Upstream: upstream.URL + "/blobs", MaxInflight: 1, MaxInflightWait: "0s"},
+		{Name: "manifests", PublicPrefix: "/", Upstream: upstream.URL},
+	}
+	if reversed {
+		cfg.Routes[0], cfg.Routes[1] = cfg.Routes[1], cfg.Routes[0]
+	}
+	cfg.Limits.MaxInflight = 10
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	firstErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(mirror.URL + "/blobs/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		firstErr <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for upstream to start")
+	}
+
+	if got := metricValue(t, m.metrics, "rmirror_route_inflight_requests", map[string]string{"route": "blobs"}); got != 1 {
+		t.Fatalf("expected 1 inflight request on blobs, got %v", got)
+	}
+	resp, err := client.Get(mirror.URL + "/blobs/other")
+	if err != nil {
+		t.Fatalf("second blob request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected saturated route to return 429, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(mirror.URL + "/v2/manifest")
+	if err != nil {
+		t.Fatalf("manifest request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected other route to be unaffected, got %d", resp.StatusCode)
+	}
+
+	unblock()
+	if err := <-firstErr; err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for metricValue(t, m.metrics, "rmirror_route_inflight_requests", map[string]string{"route": "blobs"}) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected blobs inflight gauge back to 0")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouteMaxInflightQueueDoesNotHoldGlobalSlots(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/blobs/") {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	// Unblocks the upstream handlers when the test fails early.
+	defer unblock()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "blobs", PublicPrefix: "/blobs", Upstream: upstream.URL + "/blobs", MaxInflight: 1, MaxInflightWait: "5s"},
+		{Name: "manifests", PublicPrefix: "/", Upstream: upstream.URL},
+	}
+	cfg.Limits.MaxInflight = 2
+	cfg.Limits.MaxInflightWait = "0s"
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	blobErrs := make(chan error, 2)
+	getBlob := func() {
+		resp, err := client.Get(mirror.URL + "/blobs/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		blobErrs <- err
+	}
+	go getBlob()
+	<-started
+	// The second blob request waits for the route slot.
+	go getBlob()
+	deadline := time.Now().Add(2 * time.Second)
+	for metricValue(t, m.metrics, "rmirror_inflight_queue_depth", nil) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the second blob request to be queued")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, err := client.Get(mirror.URL + "/v2/manifest")
+	if err != nil {
+		t.Fatalf("manifest request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a request queued on the blobs route to leave a global slot free, got %d", resp.StatusCode)
+	}
+	unblock()
+	for i := 0; i < 2; i++ {
+		if err := <-blobErrs; err != nil {
+			t.Fatalf("blob request failed: %v", err)
+		}
+	}
+}
+
+func TestRetryBufferMakesSmallBodiesReplayable(t *testing.T) {
+	var received atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Transport.RetryBufferBytes = 16
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	var primaryCalls, fallbackCalls atomic.Int32
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		primaryCalls.Add(1)
+		io.Copy(io.Discard, req.Body)
+		return nil, fmt.Errorf("wrap: %w", syscall.ECONNRESET)
+	})
+	fallback := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fallbackCalls.Add(1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	m, err := New(runtime, &fallbackRoundTripper{primary: primary, fallbacks: []http.RoundTripper{fallback}})
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	for _, tc := range []struct {
+		body          string
+		wantStatus    int
+		wantFallbacks int32
+	}{
+		{"small body", http.StatusCreated, 1},
+		{"a body larger than the buffer", http.StatusBadGateway, 0},
+	} {
+		primaryCalls.Store(0)
+		fallbackCalls.Store(0)
+		received.Store("")
+		req, _ := http.NewRequest(http.MethodPost, mirror.URL+"/upload", strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%q: request failed: %v", tc.body, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Fatalf("%q: expected status %d, got %d", tc.body, tc.wantStatus, resp.StatusCode)
+		}
+		if primaryCalls.Load() != 1 || fallbackCalls.Load() != tc.wantFallbacks {
+			t.Fatalf("%q: unexpected calls: primary=%d fallback=%d", tc.body, primaryCalls.Load(), fallbackCalls.Load())
+		}
+		if tc.wantFallbacks > 0 && received.Load() != tc.body {
+			t.Fatalf("%q: expected the replayed body upstream, got %q", tc.body, received.Load())
+		}
+	}
+}
+
+func TestUpstreamConnectionCloseIsNotReused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	upstreamURL := "http://" + ln.Addr().String()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				// Linger 0 turns any write to the closed socket into a reset,
+				// so reusing it would fail the next request.
+				defer conn.(*net.TCPConn).SetLinger(0)
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body := `{"next":"` + upstreamURL + req.URL.Path + `"}`
+				length := fmt.Sprintf("Content-Length: %d\r\n", len(body))
+				if req.URL.Query().Has("eof") {
+					// The body runs to the close instead.
+					length = ""
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: application/json\r\n%s\r\n%s", length, body)
+			}()
+		}
+	}()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstreamURL, RewriteBody: true}}
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	for i := 0; i < 6; i++ {
+		path := "/v2/"
+		if i%2 == 1 {
+			path += "?eof"
+		}
+		resp, err := http.Get(mirror.URL + path)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: unexpected status %d: %s", i, resp.StatusCode, body)
+		}
+		if want := `{"next":"` + mirror.URL + `/v2/"}`; string(body) != want {
+			t.Fatalf("request %d: expected rewritten body %s, got %s", i, want, body)
+		}
+		if resp.Header.Get("Connection") != "" {
+			t.Fatalf("request %d: hop-by-hop Connection header forwarded: %q", i, resp.Header.Get("Connection"))
+		}
+	}
+	if got := accepted.Load(); got != 6 {
+		t.Fatalf("expected a fresh upstream connection per request, got %d", got)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_tls_fallback_total", nil); got != 0 {
+		t.Fatalf("expected no fallbacks, got %v", got)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_upstream_errors_total", nil); got != 0 {
+		t.Fatalf("expected no upstream errors, got %v", got)
+	}
+}
+
+func TestLimiterExemptRequestsBypassSaturatedLimit(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blob" {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	cfg.Limits.MaxInflight = 1
+	cfg.Limits.MaxInflightWait = "0s"
+	cfg.Limits.ExemptMethods = []string{"options", "HEAD"}
+	cfg.Limits.ExemptPaths = []string{"/v2/"}
+	m := newTestMirrorInstance(t, cfg)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+	defer close(release)
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	go func() {
+		if resp, err := client.Get(mirror.URL + "/blob"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for upstream to start")
+	}
+
+	cases := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodOptions, "/manifest", http.StatusOK},
+		{http.MethodHead, "/manifest", http.StatusOK},
+		{http.MethodGet, "/v2/", http.StatusOK},
+		{http.MethodGet, "/manifest", http.StatusTooManyRequests},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, mirror.URL+tc.path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.path, tc.want, resp.StatusCode)
+		}
+	}
+	if got := metricValue(t, m.metrics, "rmirror_requests_total", map[string]string{"method": "OPTIONS", "route": "root", "status": "200"}); got != 1 {
+		t.Fatalf("expected exempt request to be recorded, got %v", got)
+	}
+}
+
+func TestWarmupDialsEachUpstreamHost(t *testing.T) {
+	newCountingServer := func(conns *int32) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(conns, 1)
+			}
+		}
+		srv.Start()
+		return srv
+	}
+	var registryConns, blobConns int32
+	registry := newCountingServer(&registryConns)
+	defer registry.Close()
+	blob := newCountingServer(&blobConns)
+	defer blob.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "registry-v1", PublicPrefix: "/v1", Upstream: registry.URL + "/v1"},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	m.logger = nil
+	m.Warmup(context.Background())
+
+	if got := atomic.LoadInt32(&registryConns); got != 1 {
+		t.Fatalf("expected 1 warmup connection to registry, got %d", got)
+	}
+	if got := atomic.LoadInt32(&blobConns); got != 1 {
+		t.Fatalf("expected 1 warmup connection to blob, got %d", got)
+	}
+}
+
+func TestRewriteAuditLog(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer auth.Close()
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\""+auth.URL+"/token?sig=secret\",service=\"registry\"")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+		{Name: "auth", PublicPrefix: "/_auth", Upstream: auth.URL},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	var logs syncBuffer
+	m.logger = newStructuredLoggerTo(&logs, levelDebug)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	var audit map[string]any
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "header rewritten" {
+			audit = entry
+		}
+	}
+	if audit == nil {
+		t.Fatal("expected an audit entry for the realm rewrite")
+	}
+	if audit["header"] != "WWW-Authenticate" || audit["route"] != "registry" {
+		t.Fatalf("unexpected audit entry: %v", audit)
+	}
+	before, _ := audit["before"].(string)
+	after, _ := audit["after"].(string)
+	if !strings.Contains(before, auth.URL+"/token?sig=REDACTED") {
+		t.Fatalf("unexpected before value: %q", before)
+	}
+	if !strings.Contains(after, mirror.URL+"/_auth/token?sig=REDACTED") {
+		t.Fatalf("unexpected after value: %q", after)
+	}
+	if strings.Contains(before+after, "secret") {
+		t.Fatalf("query secret leaked into audit log: %v", audit)
+	}
+}
+
+func TestRewriteDisabledPerRoute(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", blob.URL+"/data")
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\""+blob.URL+"/token\"")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer cdn.Close()
+
+	disabled := false
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "cdn", PublicPrefix: "/", Upstream: cdn.URL, RewriteLocation: &disabled, RewriteWWWAuthenticate: &disabled},
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+	})
+	defer mirror.Close()
+
+	client := noRedirectClient()
+	resp, err := client.Get(mirror.URL + "/v2/test")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Location"); got != blob.URL+"/data" {
+		t.Fatalf("expected Location passthrough, got %q", got)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); got != "Bearer realm=\""+blob.URL+"/token\"" {
+		t.Fatalf("expected WWW-Authenticate passthrough, got %q", got)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	blob := bytes.Repeat([]byte("rmirror-blob-"), 10<<10)
+	sum := sha256.Sum256(blob)
+	good := "sha256:" + hex.EncodeToString(sum[:])
+	corrupted := append([]byte(nil), blob...)
+	corrupted[len(corrupted)/2] ^= 0xff
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", good)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/corrupted"):
+			w.Write(corrupted)
+		case strings.HasSuffix(r.URL.Path, "/manifest"):
+			w.Write([]byte(`{"schemaVersion":2}`))
+		default:
+			w.Write(blob)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{
+		{Name: "blobs", PublicPrefix: "/", Upstream: upstream.URL, VerifyDigest: true},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	m.logger = nil
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/blobs/good")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read verified body: %v", err)
+	}
+	if !bytes.Equal(body, blob) {
+		t.Fatalf("verified body differs from upstream (%d bytes, want %d)", len(body), len(blob))
+	}
+
+	resp, err = http.Get(mirror.URL + "/v2/blobs/corrupted")
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("expected corrupted transfer to fail, got %d bytes", len(body))
+	}
+	// A small body is checked before anything is sent to the client.
+	resp, err = http.Get(mirror.URL + "/v2/manifest")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 for a small mismatched body, got %d", resp.StatusCode)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_digest_mismatch_total", map[string]string{"route": "blobs"}); got != 2 {
+		t.Fatalf("expected 2 digest mismatches, got %v", got)
+	}
+}
+
+func FuzzRewriteAuthHeader(f *testing.F) {
+	seeds := []string{
+		`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+		`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:user/image:pull"`,
+		`Bearer realm="https://quay.io/v2/auth",service="quay.io"`,
+		`Basic realm="Registry Realm"`,
+		`Bearer realm=https://auth.docker.io/token,service=registry.docker.io`,
+		`Bearer realm=`,
+		`Bearer realm="https://auth.docker.io/token`,
+		`Bearer realm="https://auth.docker.io/\"token\"",service="x"`,
+		`Bearer service="realm=https://auth.docker.io/token"`,
+		`REALM="https://AUTH.DOCKER.IO/token"`,
+		"Bearer realm=\"İhttps://auth.docker.io/token\"",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: "https://registry-1.docker.io"},
+		{Name: "auth", PublicPrefix: "/_auth", Upstream: "https://auth.docker.io"},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		f.Fatalf("runtime config: %v", err)
+	}
+	m, err := New(runtime, roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("unused")
+	}))
+	if err != nil {
+		f.Fatalf("mirror: %v", err)
+	}
+	pb := publicBase{Scheme: "http", Host: "mirror.local"}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		out, changed := m.rewriteAuthHeader(value, pb)
+		if !changed && out != value {
+			t.Fatalf("unchanged result differs from input: %q -> %q", value, out)
+		}
+		if changed && !strings.Contains(strings.ToLower(value), "auth.docker.io") && !strings.Contains(strings.ToLower(value), "registry-1.docker.io") {
+			t.Fatalf("rewrote a header without a matching host: %q -> %q", value, out)
+		}
+	})
+}
+
+func TestRouteIdleConnTimeoutOverrides(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "chatty", PublicPrefix: "/chatty", Upstream: "https://chatty.example", IdleConnTimeout: "5m"},
+		{Name: "chatty-2", PublicPrefix: "/chatty2", Upstream: "https://chatty2.example", IdleConnTimeout: "5m"},
+		{Name: "flaky", PublicPrefix: "/flaky", Upstream: "https://flaky.example", IdleConnTimeout: "5s"},
+		{Name: "default", PublicPrefix: "/", Upstream: "https://default.example"},
+	}
+	m := newTestMirrorInstance(t, cfg)
+
+	transports := map[string]http.RoundTripper{}
+	for _, r := range m.routes {
+		transports[r.name] = r.proxy.Transport
+	}
+	idleTimeout := func(rt http.RoundTripper) time.Duration {
+		t.Helper()
+		fallback, ok := rt.(*fallbackRoundTripper)
+		if !ok {
+			t.Fatalf("unexpected transport type %T", rt)
+		}
+		return fallback.primary.(*http.Transport).IdleConnTimeout
+	}
+
+	if transports["chatty"] != transports["chatty-2"] {
+		t.Fatal("expected routes with identical settings to share a transport")
+	}
+	if transports["chatty"] == transports["flaky"] || transports["flaky"] == transports["default"] {
+		t.Fatal("expected routes with different idle timeouts to use distinct transports")
+	}
+	if got := idleTimeout(transports["chatty"]); got != 5*time.Minute {
+		t.Fatalf("unexpected chatty idle timeout: %v", got)
+	}
+	if got := idleTimeout(transports["flaky"]); got != 5*time.Second {
+		t.Fatalf("unexpected flaky idle timeout: %v", got)
+	}
+	if got := idleTimeout(transports["default"]); got != defaultIdleConnTimeout {
+		t.Fatalf("unexpected default idle timeout: %v", got)
+	}
+}
+
+func TestRouteTransportOverrides(t *testing.T) {
+	fragment := 1
+	disable := true
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "picky", PublicPrefix: "/picky", Upstream: "https://picky.example", Transport: &RouteTransportConfig{FirstFragmentLen: &fragment}},
+		{Name: "raw", PublicPrefix: "/raw", Upstream: "https://raw.example", Transport: &RouteTransportConfig{DisableCompression: &disable, ResponseHeaderTimeout: "2m"}},
+		{Name: "default", PublicPrefix: "/", Upstream: "https://default.example"},
+	}
+	m := newTestMirrorInstance(t, cfg)
+
+	transports := map[string]*fallbackRoundTripper{}
+	for _, r := range m.routes {
+		fallback, ok := r.proxy.Transport.(*fallbackRoundTripper)
+		if !ok {
+			t.Fatalf("unexpected transport type %T", r.proxy.Transport)
+		}
+		transports[r.name] = fallback
+	}
+	if transports["picky"] == transports["raw"] || transports["picky"] == transports["default"] || transports["raw"] == transports["default"] {
+		t.Fatal("expected each overridden route to use its own transport")
+	}
+	if got := transports["picky"].primaryFragment; got != 1 {
+		t.Fatalf("expected picky first fragment 1, got %d", got)
+	}
+	if got := transports["default"].primaryFragment; got != defaultFirstFragmentLen {
+		t.Fatalf("expected default first fragment %d, got %d", defaultFirstFragmentLen, got)
+	}
+	raw := transports["raw"].primary.(*http.Transport)
+	if !raw.DisableCompression || raw.ResponseHeaderTimeout != 2*time.Minute {
+		t.Fatalf("expected raw overrides applied, got compression disabled=%v timeout=%v", raw.DisableCompression, raw.ResponseHeaderTimeout)
+	}
+	if transports["raw"].primaryFragment != defaultFirstFragmentLen || transports["default"].primary.(*http.Transport).DisableCompression {
+		t.Fatal("expected unset fields to keep the top-level transport values")
+	}
+	if len(m.transports()) != 3 {
+		t.Fatalf("expected CloseIdleConnections to cover 3 transports, got %d", len(m.transports()))
+	}
+
+	bad := -1
+	cfg.Routes[0].Transport.MaxFallbackAttempts = &bad
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "routes[0].transport.max_fallback_attempts") {
+		t.Fatalf("expected transport override validation error, got %v", err)
+	}
+}
+
+func TestTapStreamsAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = true
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+	m.logger = newStructuredLoggerTo(io.Discard, levelInfo)
+	m.logger.tap = m.tap
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirror.URL+"/_rmirror/tap", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	tap, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("tap request failed: %v", err)
+	}
+	defer tap.Body.Close()
+	if got := tap.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("unexpected content type: %q", got)
+	}
+
+	resp, err := http.Get(mirror.URL + "/v2/probe")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	scanner := bufio.NewScanner(tap.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry); err != nil {
+			t.Fatalf("decode tap entry: %v", err)
+		}
+		if entry["msg"] == "request" && entry["path"] == "/v2/probe" {
+			return
+		}
+	}
+	t.Fatalf("tap closed without the request entry: %v", scanner.Err())
+}
+
+func TestTapRequiresLoopbackOrToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AdminToken = "s3cret"
+	m := newTestMirrorInstance(t, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/_rmirror/tap", nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for remote client without token, got %d", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if !m.authorizeAdmin(req) {
+		t.Fatal("expected bearer token to authorize remote client")
+	}
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer plain.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL},
+		{Name: "plain", PublicPrefix: "/_plain", Upstream: plain.URL},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	m := newTestMirrorInstance(t, cfg)
+	m.logger = nil
+	transport := newBaseTransport(runtime.Transport, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	transport.TLSClientConfig.RootCAs = pool
+	m.transport = transport
+	m.CheckCertExpiry(context.Background())
+
+	host := strings.TrimPrefix(upstream.URL, "https://")
+	got := metricValue(t, m.metrics, "rmirror_upstream_cert_expiry_seconds", map[string]string{"upstream": host})
+	want := time.Until(upstream.Certificate().NotAfter).Seconds()
+	if got <= 0 || math.Abs(got-want) > 60 {
+		t.Fatalf("expected expiry near %.0fs, got %.0fs", want, got)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("expected a handshake only, upstream saw %d requests", n)
+	}
+}
+
+func TestUpstreamProtocolRecorded(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = true
+	cfg.Transport.ForceHTTP2 = true
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	transport := newBaseTransport(runtime.Transport, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	transport.TLSClientConfig.RootCAs = pool
+	m, err := New(runtime, transport)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	var logs syncBuffer
+	m.logger = newStructuredLoggerTo(&logs, levelInfo)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	resp, err := http.Get(mirror.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := metricValue(t, m.metrics, "rmirror_upstream_protocol_total", map[string]string{"route": "registry", "proto": "HTTP/2.0"}); got != 1 {
+		t.Fatalf("expected one HTTP/2.0 upstream response, got %v", got)
+	}
+	var proto any
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "request" {
+			proto = entry["upstream_proto"]
+		}
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("expected access log upstream_proto HTTP/2.0, got %v", proto)
+	}
+}
+
+func TestResponseSizeHistogram(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.ResponseSizeBuckets = []float64{100, 10000}
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+
+	for _, n := range []int{10, 1000, 50000} {
+		resp, err := http.Get(srv.URL + "/blob?n=" + strconv.Itoa(n))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	families, err := m.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() != "rmirror_response_size_bytes" {
+			continue
+		}
+		found = true
+		hist := family.GetMetric()[0].GetHistogram()
+		if hist.GetSampleCount() != 3 || hist.GetSampleSum() != 51010 {
+			t.Fatalf("expected 3 samples summing to 51010, got %d and %v", hist.GetSampleCount(), hist.GetSampleSum())
+		}
+		want := map[float64]uint64{100: 1, 10000: 2}
+		for _, bucket := range hist.GetBucket() {
+			if got := bucket.GetCumulativeCount(); got != want[bucket.GetUpperBound()] {
+				t.Fatalf("bucket le=%v: expected %d, got %d", bucket.GetUpperBound(), want[bucket.GetUpperBound()], got)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected rmirror_response_size_bytes to be registered")
+	}
+}
+
+// startHeadBodyUpstream answers every request with headers and an 11 byte
+// body, including HEAD requests, and closes the connection afterwards.
+func startHeadBodyUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				req.Body.Close()
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nhello world")
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestHeadResponseBody(t *testing.T) {
+	upstream := startHeadBodyUpstream(t)
+	for _, mode := range []string{headResponseStrict, headResponseLenient} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AccessLog = false
+			cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream, HeadResponse: mode}}
+			m := newTestMirrorInstance(t, cfg)
+			mirror := httptest.NewServer(m.Handler())
+			defer mirror.Close()
+
+			resp, err := http.Head(mirror.URL + "/v2/")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || len(data) != 0 {
+				t.Fatalf("expected 200 without body, got %d with %q", resp.StatusCode, data)
+			}
+			if resp.ContentLength != 11 || resp.Header.Get("Content-Type") != "text/plain" {
+				t.Fatalf("expected upstream headers to be kept, got length %d and %v", resp.ContentLength, resp.Header)
+			}
+			if got := metricValue(t, m.metrics, "rmirror_response_bytes_total", map[string]string{"route": "registry"}); got != 0 {
+				t.Fatalf("expected no response bytes counted for HEAD, got %v", got)
+			}
+
+			resp, err = http.Get(mirror.URL + "/v2/")
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			data, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(data) != "hello world" {
+				t.Fatalf("expected GET body after HEAD, got %q", data)
+			}
+		})
+	}
+}
+
+func TestHeadResponseRejectsUnknownMode(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: "https://registry-1.docker.io", HeadResponse: "loose"}}
+	runtime, err := cfg.Runtime()
+	if err == nil {
+		_, err = New(runtime, NewTransport(runtime.Transport))
+	}
+	if err == nil || !strings.Contains(err.Error(), "head_response") {
+		t.Fatalf("expected head_response error, got %v", err)
+	}
+}
+
+func TestDebugBodyLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/binary" {
+			w.Write([]byte{0xff, 0x00, 0xfe, 0x01, 0x02})
+			return
+		}
+		w.Write(append([]byte("echo:"), data...))
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{
+		{Name: "debug", PublicPrefix: "/", Upstream: upstream.URL, DebugBodyLog: 24},
+		{Name: "quiet", PublicPrefix: "/quiet", Upstream: upstream.URL},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	var logs syncBuffer
+	m.logger = newStructuredLoggerTo(&logs, levelDebug)
+	mirror := httptest.NewServer(m.Handler())
+	defer mirror.Close()
+
+	payload := `{"token":"s3cr3t","name":"alpine","tag":"latest"}`
+	for _, path := range []string{"/echo", "/binary", "/quiet/echo"} {
+		resp, err := http.Post(mirror.URL+path, "application/json", strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if path != "/binary" && string(data) != "echo:"+payload {
+			t.Fatalf("%s: expected the proxied body to be unaffected, got %q", path, data)
+		}
+	}
+
+	var snippets []map[string]any
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "body snippet" {
+			snippets = append(snippets, entry)
+		}
+	}
+	if len(snippets) != 2 {
+		t.Fatalf("expected body snippets only for the debug route, got %v", snippets)
+	}
+	echo, binary := snippets[0], snippets[1]
+	if echo["request_body"] != `{"token":"REDACTED","name"` || echo["request_bytes"] != float64(len(payload)) {
+		t.Fatalf("unexpected request snippet: %v", echo)
+	}
+	if echo["response_body"] != `echo:{"token":"REDACTED","` || echo["response_body_encoding"] != "utf8" {
+		t.Fatalf("unexpected response snippet: %v", echo)
+	}
+	if binary["response_body"] != "ff00fe0102" || binary["response_body_encoding"] != "hex" || binary["response_bytes"] != float64(5) {
+		t.Fatalf("unexpected binary snippet: %v", binary)
+	}
+
+	// The snippet limit cuts this value before its closing quote.
+	before := len(logs.entries(t))
+	resp, err := http.Post(mirror.URL+"/echo", "application/json", strings.NewReader(`{"password":"hunter2-and-more"}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	masked := false
+	for _, entry := range logs.entries(t)[before:] {
+		if entry["msg"] == "body snippet" {
+			masked = entry["request_body"] == `{"password":"REDACTED"`
+		}
+	}
+	if !masked {
+		t.Fatalf("expected truncated secret to be masked, got %v", logs.entries(t)[before:])
+	}
+
+	m.logger = newStructuredLoggerTo(&logs, levelInfo)
+	before = len(logs.entries(t))
+	resp, err = http.Post(mirror.URL+"/echo", "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	for _, entry := range logs.entries(t)[before:] {
+		if entry["msg"] == "body snippet" {
+			t.Fatal("expected no body snippet above debug level")
+		}
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	var calls int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"t%d","expires_in":300}`, n)
+	}))
+	defer auth.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "auth", PublicPrefix: "/_auth", Upstream: auth.URL, TokenCache: true}}
+	m := newTestMirrorInstance(t, cfg)
+	now := time.Now()
+	m.routes[0].tokens.now = func() time.Time { return now }
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+
+	fetch := func(query, authorization string) (string, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/_auth/token?"+query, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("token request: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode token: %v", err)
+		}
+		return body.Token, resp.Header.Get("X-Cache")
+	}
+
+	if token, cache := fetch("service=registry&scope=repository:library/alpine:pull", ""); token != "t1" || cache != "MISS" {
+		t.Fatalf("expected fresh token t1, got %s (%s)", token, cache)
+	}
+	now = now.Add(100 * time.Second)
+	if token, cache := fetch("scope=repository:library/alpine:pull&service=registry", ""); token != "t1" || cache != "HIT" {
+		t.Fatalf("expected cached token t1, got %s (%s)", token, cache)
+	}
+	if token, cache := fetch("service=registry&scope=repository:library/alpine:pull", "Basic dXNlcjpwYXNz"); token != "t2" || cache != "MISS" {
+		t.Fatalf("expected credentials to bypass the anonymous entry, got %s (%s)", token, cache)
+	}
+	now = now.Add(201 * time.Second)
+	if token, cache := fetch("service=registry&scope=repository:library/alpine:pull", ""); token != "t3" || cache != "MISS" {
+		t.Fatalf("expected expired token to be refetched, got %s (%s)", token, cache)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("expected 3 upstream token requests, got %d", got)
+	}
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Limits.MaxHeaderCount = 20
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	srv := newTestMirrorWithConfig(t, cfg)
+	defer srv.Close()
+
+	send := func(lines int) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v2/", nil)
+		for i := 0; i < lines; i++ {
+			req.Header.Add("X-Padding", strconv.Itoa(i))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := send(5); got != http.StatusOK {
+		t.Fatalf("expected 200 below the limit, got %d", got)
+	}
+	if got := send(50); got != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for many header lines, got %d", got)
+	}
+}
+
+func TestClientProtocolLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Limits.RequireHost = true
+	cfg.Limits.MissingHostStatus = http.StatusMisdirectedRequest
+	cfg.Limits.MissingHostBody = "host required"
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+
+	send := func(t *testing.T, addr, raw string) (int, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, raw)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	t.Run("missing host", func(t *testing.T) {
+		srv := newTestMirrorWithConfig(t, cfg)
+		defer srv.Close()
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		if status, body := send(t, addr, "GET /v2/ HTTP/1.0\r\n\r\n"); status != http.StatusMisdirectedRequest || body != "host required" {
+			t.Fatalf("expected 421 host required, got %d %q", status, body)
+		}
+		if status, _ := send(t, addr, "GET /v2/ HTTP/1.0\r\nHost: mirror.example\r\n\r\n"); status != http.StatusOK {
+			t.Fatalf("expected HTTP/1.0 with Host to pass, got %d", status)
+		}
+	})
+
+	t.Run("min version", func(t *testing.T) {
+		strict := cfg
+		strict.Limits.MinHTTPVersion = "1.1"
+		srv := newTestMirrorWithConfig(t, strict)
+		defer srv.Close()
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		if status, _ := send(t, addr, "GET /v2/ HTTP/1.0\r\nHost: mirror.example\r\n\r\n"); status != http.StatusHTTPVersionNotSupported {
+			t.Fatalf("expected 505 for HTTP/1.0, got %d", status)
+		}
+		if status, _ := send(t, addr, "GET /v2/ HTTP/1.1\r\nHost: mirror.example\r\nConnection: close\r\n\r\n"); status != http.StatusOK {
+			t.Fatalf("expected HTTP/1.1 to pass, got %d", status)
+		}
+	})
+}
+
+func TestRequestMaxDuration(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Timeouts.RequestMaxDuration = "100ms"
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	srv := newTestMirrorWithConfig(t, cfg)
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 past the limit, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request held for %v", elapsed)
+	}
+
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 6; i++ {
+			io.WriteString(w, "chunk")
+			http.NewResponseController(w).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer streaming.Close()
+	cfg.Routes = []RouteConfig{{Name: "blobs", PublicPrefix: "/", Upstream: streaming.URL}}
+	streamSrv := newTestMirrorWithConfig(t, cfg)
+	defer streamSrv.Close()
+	resp, err = http.Get(streamSrv.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(data) != strings.Repeat("chunk", 6) {
+		t.Fatalf("expected a streaming response to outlive the limit, got %q %v", data, err)
+	}
+
+	trickle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "30")
+		for i := 0; i < 6; i++ {
+			io.WriteString(w, "chunk")
+			http.NewResponseController(w).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer trickle.Close()
+	cfg.Routes = []RouteConfig{{Name: "blobs", PublicPrefix: "/", Upstream: trickle.URL}}
+	trickleSrv := newTestMirrorWithConfig(t, cfg)
+	defer trickleSrv.Close()
+	// Cut before the headers are flushed, the client sees the connection
+	// close instead of a short body.
+	if resp, err = http.Get(trickleSrv.URL + "/v2/"); err == nil {
+		data, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil || len(data) >= 30 {
+			t.Fatalf("expected a download that keeps writing to be cut at the limit, got %q %v", data, err)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v2/", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	client := &http.Client{Timeout: 300 * time.Millisecond}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("expected event stream to outlive the request limit")
+	}
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Statsd = &StatsdConfig{Address: pc.LocalAddr().String(), Prefix: "mirror", Tags: []string{"env:test"}}
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL},
+		{Name: "dead", PublicPrefix: "/dead", Upstream: dead.URL},
+	}
+	srv := newTestMirrorWithConfig(t, cfg)
+	defer srv.Close()
+
+	for _, path := range []string{"/v2/", "/dead/x"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []string{
+		"mirror.requests:1|c|#method:GET,route:registry,status:200,env:test",
+		"mirror.upstream_errors:1|c|#route:dead,env:test",
+		"mirror.requests:1|c|#method:GET,route:dead,status:502,env:test",
+	}
+	var got []string
+	buf := make([]byte, 1500)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(got) < 5 {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+	joined := strings.Join(got, "\n")
+	for _, packet := range want {
+		if !strings.Contains(joined, packet) {
+			t.Fatalf("missing packet %q in:\n%s", packet, joined)
+		}
+	}
+	if !strings.Contains(joined, "mirror.request_duration:") || !strings.Contains(joined, "|ms|#method:GET,route:registry,env:test") {
+		t.Fatalf("missing duration timing in:\n%s", joined)
+	}
+}
+
+func TestRouteAccessLogOverride(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	off := false
+	cfg := DefaultConfig()
+	cfg.AccessLog = true
+	cfg.Routes = []RouteConfig{
+		{Name: "blob", PublicPrefix: "/_blob", Upstream: upstream.URL},
+		{Name: "auth", PublicPrefix: "/_auth", Upstream: upstream.URL, AccessLog: &off},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	var logs syncBuffer
+	m.logger = newStructuredLoggerTo(&logs, levelInfo)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/_auth/token", "/_blob/sha256:abc"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	var routes []string
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "request" {
+			routes = append(routes, fmt.Sprint(entry["route"]))
+		}
+	}
+	if len(routes) != 1 || routes[0] != "blob" {
+		t.Fatalf("expected only the blob route to be logged, got %v", routes)
+	}
+}
+
+func TestPublicBaseMode(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer blob.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", blob.URL+"/data")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	cases := []struct {
+		mode  string
+		hosts []string
+		host  string
+		want  string
+	}{
+		{mode: "fixed", host: "alt.example", want: "https://mirror.example/_blob/data"},
+		{mode: "request", host: "alt.example", want: "https://alt.example/_blob/data"},
+		{mode: "allowlist", hosts: []string{"alt.example"}, host: "alt.example:5000", want: "https://alt.example:5000/_blob/data"},
+		{mode: "allowlist", hosts: []string{"alt.example"}, host: "evil.example", want: "https://mirror.example/_blob/data"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode+"/"+tc.host, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AccessLog = false
+			cfg.PublicBaseURL = "https://mirror.example"
+			cfg.PublicBaseMode = tc.mode
+			cfg.PublicBaseHosts = tc.hosts
+			cfg.Routes = []RouteConfig{
+				{Name: "registry", PublicPrefix: "/", Upstream: registry.URL},
+				{Name: "blob", PublicPrefix: "/_blob", Upstream: blob.URL},
+			}
+			mirror := newTestMirrorWithConfig(t, cfg)
+			defer mirror.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, mirror.URL+"/v2/test", nil)
+			req.Host = tc.host
+			resp, err := noRedirectClient().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Location"); got != tc.want {
+				t.Fatalf("unexpected location: %q (want %q)", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPublicBaseScheme(t *testing.T) {
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", upstreamURL+"/data")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	cases := []struct {
+		name   string
+		base   string
+		scheme string
+		proto  string
+		want   string
+		warned bool
+	}{
+		{name: "fixed https over http", base: "https://mirror.example", proto: "", want: "https://mirror.example/data"},
+		{name: "fixed http over https", base: "http://mirror.example", proto: "https", want: "http://mirror.example/data", warned: true},
+		{name: "request http base over https", base: "http://mirror.example", scheme: "request", proto: "https", want: "https://mirror.example/data"},
+		{name: "request https base over http", base: "https://mirror.example", scheme: "request", proto: "http", want: "http://mirror.example/data"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AccessLog = false
+			cfg.PublicBaseURL = tc.base
+			cfg.PublicBaseScheme = tc.scheme
+			cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+			m := newTestMirrorInstance(t, cfg)
+			var logs syncBuffer
+			m.logger = newStructuredLoggerTo(&logs, levelInfo)
+			mirror := httptest.NewServer(m.Handler())
+			defer mirror.Close()
+
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, mirror.URL+"/v2/", nil)
+				if tc.proto != "" {
+					req.Header.Set("X-Forwarded-Proto", tc.proto)
+				}
+				resp, err := noRedirectClient().Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				resp.Body.Close()
+				if got := resp.Header.Get("Location"); got != tc.want {
+					t.Fatalf("unexpected location: %q (want %q)", got, tc.want)
+				}
+			}
+			warnings := 0
+			for _, entry := range logs.entries(t) {
+				if entry["msg"] == "public_base_url scheme differs from request" {
+					warnings++
+				}
+			}
+			if tc.warned && warnings != 1 || !tc.warned && warnings != 0 {
+				t.Fatalf("expected warned=%v once, got %d warnings", tc.warned, warnings)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.PublicBaseScheme = "auto"
+	cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL}}
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "public_base_scheme") {
+		t.Fatalf("expected unknown public_base_scheme to be rejected, got %v", err)
+	}
+}
+
+func TestUpstreamSchemeOverride(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	mirror := newTestMirror(t, []RouteConfig{{Name: "internal", PublicPrefix: "/", Upstream: host, UpstreamScheme: "http"}})
+	defer mirror.Close()
+	resp, err := http.Get(mirror.URL + "/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "plain" {
+		t.Fatalf("expected plain http upstream to be dialed, got %d %q", resp.StatusCode, body)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{{Name: "bad", PublicPrefix: "/", Upstream: host, UpstreamScheme: "ftp"}}
+	if _, err := cfg.Runtime(); err == nil {
+		t.Fatal("expected invalid upstream_scheme to be rejected")
+	}
+}
+
+func TestHeadViaGet(t *testing.T) {
+	var gets []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		gets = append(gets, r.URL.Path+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/blob":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("ETag", `"blob"`)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello world"))
+		case "/empty":
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(""))
+		case "/stream":
+			// Ignores Range and sends no Content-Length.
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "chunk")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "chunk")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	srv := newTestMirror(t, []RouteConfig{
+		{Name: "plain", PublicPrefix: "/plain", Upstream: upstream.URL},
+		{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL, HeadViaGet: true},
+	})
+	defer srv.Close()
+	head := func(path, rangeHeader string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodHead, srv.URL+path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("head %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := head("/plain/blob", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 without head_via_get, got %d", resp.StatusCode)
+	}
+	resp := head("/blob", "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 11 || resp.Header.Get("Content-Range") != "" {
+		t.Fatalf("expected 200 with the full length, got %d length %d range %q", resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Range"))
+	}
+	if resp.Header.Get("ETag") != `"blob"` || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("expected the GET headers, got %v", resp.Header)
+	}
+	if resp := head("/empty", ""); resp.StatusCode != http.StatusOK || resp.ContentLength != 0 {
+		t.Fatalf("expected 200 with zero length for an empty resource, got %d length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if resp := head("/stream", ""); resp.StatusCode != http.StatusOK || resp.ContentLength != -1 || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected 200 without a length, got %d length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if resp := head("/blob", "bytes=0-4"); resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 0-4/11" {
+		t.Fatalf("expected the client's range to be kept, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if resp := head("/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 to pass through, got %d", resp.StatusCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gets[0] != "/blob bytes=0-0" || gets[3] != "/blob bytes=0-4" {
+		t.Fatalf("unexpected upstream GETs: %q", gets)
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, upstream.URL+"/c", http.StatusTemporaryRedirect)
+		case "/c":
+			io.WriteString(w, "final")
+		case "/loop1":
+			http.Redirect(w, r, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, r, "/loop1", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	newMirror := func(max int) *httptest.Server {
+		return newTestMirror(t, []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: upstream.URL, FollowRedirects: max}})
+	}
+	get := func(srv *httptest.Server, path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := noRedirectClient().Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	following := newMirror(5)
+	defer following.Close()
+	if resp, body := get(following, "/a"); resp.StatusCode != http.StatusOK || body != "final" {
+		t.Fatalf("expected followed chain to return final body, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := get(following, "/loop1"); resp.StatusCode != http.StatusLoopDetected {
+		t.Fatalf("expected 508 for a redirect loop, got %d", resp.StatusCode)
+	}
+
+	limited := newMirror(1)
+	defer limited.Close()
+	resp, _ := get(limited, "/a")
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != limited.URL+"/c" {
+		t.Fatalf("expected the hop beyond the limit to reach the client, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestFollowRedirectsCrossRoute(t *testing.T) {
+	var files *httptest.Server
+	files = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mirror", files.URL+"/other")
+		io.WriteString(w, "file")
+	}))
+	defer files.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, files.URL+"/blob", http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	mirror := newTestMirror(t, []RouteConfig{
+		{Name: "registry", PublicPrefix: "/", Upstream: registry.URL, FollowRedirects: 3, FollowCrossRoute: true},
+		{Name: "files", PublicPrefix: "/_files", Upstream: files.URL, RewriteHeaders: []string{"X-Mirror"}},
+	})
+	defer mirror.Close()
+
+	resp, err := noRedirectClient().Get(mirror.URL + "/v2/blob")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "file" {
+		t.Fatalf("expected the cross-route redirect to be followed, got %d %q", resp.StatusCode, body)
+	}
+	if got, want := resp.Header.Get("X-Mirror"), mirror.URL+"/_files/other"; got != want {
+		t.Fatalf("expected the target route's header rewrite, got %q want %q", got, want)
+	}
+}
+
+func TestPreserveRawPath(t *testing.T) {
+	var mu sync.Mutex
+	var gotURI string
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gotURI = r.RequestURI
+		mu.Unlock()
+		w.Header().Set("Location", upstream.URL+"/base/v2/library%2Falpine/blobs/upload")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	for _, preserve := range []bool{false, true} {
+		mirror := newTestMirror(t, []RouteConfig{{Name: "registry", PublicPrefix: "/_reg", Upstream: upstream.URL + "/base", PreserveRawPath: preserve}})
+		resp, err := noRedirectClient().Get(mirror.URL + "/_reg/v2/library%2Falpine/manifests/latest")
+		mirror.Close()
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		mu.Lock()
+		uri := gotURI
+		mu.Unlock()
+		wantURI, wantLocation := "/base/v2/library/alpine/manifests/latest", mirror.URL+"/_reg/v2/library/alpine/blobs/upload"
+		if preserve {
+			wantURI, wantLocation = "/base/v2/library%2Falpine/manifests/latest", mirror.URL+"/_reg/v2/library%2Falpine/blobs/upload"
+		}
+		if uri != wantURI {
+			t.Fatalf("preserve=%v: upstream received %q, want %q", preserve, uri, wantURI)
+		}
+		if got := resp.Header.Get("Location"); got != wantLocation {
+			t.Fatalf("preserve=%v: location %q, want %q", preserve, got, wantLocation)
+		}
+	}
+}
+
+func TestStopAdmittingReleasesQueuedRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	cfg.Limits.MaxInflight = 1
+	cfg.Limits.MaxInflightWait = "30s"
+	m := newTestMirrorInstance(t, cfg)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	defer close(release)
+
+	go func() {
+		if resp, err := http.Get(srv.URL + "/slow"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	queued := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/queued")
+		if err != nil {
+			queued <- 0
+			return
+		}
+		resp.Body.Close()
+		queued <- resp.StatusCode
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for metricValue(t, m.metrics, "rmirror_inflight_queue_depth", nil) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("request did not queue for a slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.StopAdmitting()
+	select {
+	case status := <-queued:
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("expected queued request to get 503, got %d", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued request was not released when shutdown began")
+	}
+
+	resp, err := http.Get(srv.URL + "/late")
+	if err != nil {
+		t.Fatalf("late request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected requests after shutdown began to get 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestInflightQueueDepth(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	cfg.Limits.MaxInflight = 1
+	cfg.Limits.MaxInflightWait = "5s"
+	m := newTestMirrorInstance(t, cfg)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	defer close(release)
+
+	var wg sync.WaitGroup
+	get := func() {
+		defer wg.Done()
+		resp, err := http.Get(srv.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	wg.Add(1)
+	go get()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/", nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	waitGauge := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got := metricValue(t, m.metrics, "rmirror_inflight_queue_depth", nil)
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected queue depth %v, got %v", want, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitGauge(2)
+	cancel()
+	waitGauge(0)
+	release <- struct{}{}
+	wg.Wait()
 }
@@ -0,0 +1,158 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseProxyURL accepts http://, socks5:// and socks5h:// proxies. An https
+// proxy would need its own TLS session underneath the fragmented one, which
+// terasu cannot drive.
+func parseProxyURL(raw string) (*url.URL, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, errors.New("scheme must be http, socks5 or socks5h")
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("proxy must include host")
+	}
+	return u, nil
+}
+
+// upstreamProxy carries upstream connections through transport.proxy_url.
+//
+// Through an http proxy, https upstreams are reached over a CONNECT tunnel
+// opened by the dialer itself rather than by http.Transport, so the TLS
+// handshake inside the tunnel is still fragmented. Plain http upstreams are
+// sent to the proxy by http.Transport.Proxy.
+//
+// Name resolution: the http proxy and socks5h resolve upstream hosts
+// themselves, so the custom resolver, and the retry ordering of resolved
+// addresses, is bypassed. With socks5 upstream hosts are still resolved by
+// the custom resolver and the proxy is asked for the IP. The proxy's own host
+// is always resolved by the system resolver, since it is usually an internal
+// name.
+type upstreamProxy struct {
+	url   *url.URL
+	socks proxy.ContextDialer
+}
+
+func newUpstreamProxy(u *url.URL, forward *net.Dialer) *upstreamProxy {
+	if u == nil {
+		return nil
+	}
+	p := &upstreamProxy{url: u}
+	if u.Scheme != "http" {
+		// The scheme was checked by parseProxyURL.
+		dialer, _ := proxy.FromURL(u, forward)
+		p.socks, _ = dialer.(proxy.ContextDialer)
+	}
+	return p
+}
+
+// resolvesNames reports whether the proxy is handed upstream host names
+// instead of addresses from the custom resolver.
+func (p *upstreamProxy) resolvesNames() bool {
+	return p.url.Scheme != "socks5"
+}
+
+// httpProxy returns the proxy for http.Transport.Proxy, which only handles
+// plain http upstreams; https ones go through dial.
+func (p *upstreamProxy) httpProxy(req *http.Request) (*url.URL, error) {
+	if p.url.Scheme != "http" || req.URL.Scheme != "http" {
+		return nil, nil
+	}
+	return p.url, nil
+}
+
+// isProxyAddr reports a dial to the proxy itself, which http.Transport makes
+// for plain http upstreams.
+func (p *upstreamProxy) isProxyAddr(addr string) bool {
+	return p.url.Scheme == "http" && addr == p.hostPort()
+}
+
+func (p *upstreamProxy) hostPort() string {
+	port := p.url.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(p.url.Hostname(), port)
+}
+
+func (p *upstreamProxy) dial(ctx context.Context, forward *net.Dialer, network, addr string) (net.Conn, error) {
+	if p.socks != nil {
+		return p.socks.DialContext(ctx, network, addr)
+	}
+	return p.connect(ctx, forward, network, addr)
+}
+
+// connect opens a CONNECT tunnel to addr through an http proxy.
+func (p *upstreamProxy) connect(ctx context.Context, forward *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := forward.DialContext(ctx, network, p.hostPort())
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := p.url.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect %s: %w", addr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect %s: %w", addr, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect %s: %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn replays bytes the proxy sent right after its CONNECT reply.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
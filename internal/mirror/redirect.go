@@ -0,0 +1,102 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errRedirectLoop = errors.New("upstream redirect loop")
+
+// redirectFollower follows upstream redirects server-side so clients only
+// see the final response. Only GET and HEAD are followed, and only to the
+// route's own upstream unless cross-route redirects are allowed; anything
+// else is returned to the client as usual, with Location rewritten.
+type redirectFollower struct {
+	m          *Mirror
+	route      *route
+	max        int
+	crossRoute bool
+	next       http.RoundTripper
+}
+
+func (f *redirectFollower) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := f.next.RoundTrip(req)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return resp, err
+	}
+	visited := map[string]struct{}{req.URL.String(): {}}
+	for hops := 0; hops < f.max && isFollowableRedirect(resp.StatusCode); hops++ {
+		target, r, transport, ok := f.target(req.URL, resp.Header.Get("Location"))
+		if !ok {
+			return resp, nil
+		}
+		if _, seen := visited[target.String()]; seen {
+			drainBody(resp)
+			return nil, errRedirectLoop
+		}
+		visited[target.String()] = struct{}{}
+		drainBody(resp)
+		ctx := req.Context()
+		if current, _ := ctx.Value(ctxRouteKey).(*route); current != r {
+			// The response is handled by the route that served it, so its
+			// rewrites and verification apply rather than the original's.
+			ctx = context.WithValue(ctx, ctxRouteKey, r)
+		}
+		next := req.Clone(ctx)
+		if !strings.EqualFold(target.Host, req.URL.Host) {
+			next.Header.Del("Authorization")
+			next.Header.Del("Cookie")
+		}
+		next.URL = target
+		next.Host = target.Host
+		req = next
+		resp, err = transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (f *redirectFollower) target(base *url.URL, location string) (*url.URL, *route, http.RoundTripper, bool) {
+	if location == "" {
+		return nil, nil, nil, false
+	}
+	target, err := base.Parse(location)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	target.Fragment = ""
+	r := f.m.matchUpstreamURL(target, "")
+	if r == nil || (r != f.route && !f.crossRoute) {
+		return nil, nil, nil, false
+	}
+	if r == f.route {
+		return target, r, f.next, true
+	}
+	if r.transport != nil {
+		return target, r, r.transport, true
+	}
+	return target, r, f.m.transport, true
+}
+
+func isFollowableRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func drainBody(resp *http.Response) {
+	if resp.Body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+}
@@ -1,20 +1,55 @@
 package mirror
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"net/http/httputil"
 )
 
 type route struct {
-	name              string
-	publicPrefix      string
-	publicPrefixSlash string
-	upstream          *url.URL
-	upstreamBasePath  string
-	preserveHost      bool
-	proxy             *httputil.ReverseProxy
+	name                string
+	publicHost          string
+	publicPrefix        string
+	publicPrefixSlash   string
+	matchRegex          *regexp.Regexp
+	methods             []string
+	pathTemplate        string
+	upstream            *url.URL
+	upstreamBasePath    string
+	preserveHost        bool
+	preserveHostFor     []string
+	preserveRawPath     bool
+	ignoreScheme        bool
+	rewriteLocation     bool
+	rewriteAuth         bool
+	rewriteHeaders      []string
+	forwardHeaders      map[string]bool
+	jsonPaths           []jsonPath
+	maxRewriteBytes     int
+	rewriteBody         bool
+	maxBodyRewriteBytes int
+	acceptEncoding      string
+	decompress          bool
+	digestHeader        string
+	tokens              *tokenCache
+	accessLog           *bool
+	debugBodyLog        int
+	followRedirects     int
+	followCrossRoute    bool
+	headViaGet          bool
+	lenientHead         bool
+	maxInflight         chan struct{}
+	maxInflightWait     time.Duration
+	transportConfig     *RuntimeTransport
+	transport           http.RoundTripper
+	proxy               *httputil.ReverseProxy
 }
 
 func newRoute(cfg RouteConfig) (*route, error) {
@@ -29,6 +64,9 @@ func newRoute(cfg RouteConfig) (*route, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.UpstreamScheme != "" {
+		upstream.Scheme = cfg.UpstreamScheme
+	}
 	basePath := normalizePath(upstream.Path)
 	if basePath == "" {
 		basePath = "/"
@@ -39,10 +77,90 @@ func newRoute(cfg RouteConfig) (*route, error) {
 	upstream.Fragment = ""
 
 	r := &route{
-		name:         cfg.Name,
-		publicPrefix: prefix,
-		upstream:     upstream,
-		preserveHost: cfg.PreserveHost,
+		name:             cfg.Name,
+		publicHost:       strings.ToLower(strings.TrimSpace(cfg.PublicHost)),
+		publicPrefix:     prefix,
+		upstream:         upstream,
+		preserveHost:     cfg.PreserveHost,
+		preserveRawPath:  cfg.PreserveRawPath,
+		rewriteLocation:  boolValue(cfg.RewriteLocation, true),
+		rewriteAuth:      boolValue(cfg.RewriteWWWAuthenticate, true),
+		accessLog:        cfg.AccessLog,
+		debugBodyLog:     cfg.DebugBodyLog,
+		followRedirects:  cfg.FollowRedirects,
+		followCrossRoute: cfg.FollowCrossRoute,
+		headViaGet:       cfg.HeadViaGet,
+	}
+	headResponse, err := parseHeadResponseMode(cfg.HeadResponse)
+	if err != nil {
+		return nil, fmt.Errorf("head_response: %w", err)
+	}
+	r.lenientHead = headResponse == headResponseLenient
+	if cfg.MatchRegex != "" {
+		if r.matchRegex, err = regexp.Compile(cfg.MatchRegex); err != nil {
+			return nil, fmt.Errorf("match_regex: %w", err)
+		}
+		r.pathTemplate = cfg.UpstreamPathTemplate
+	}
+	for _, method := range cfg.Methods {
+		r.methods = append(r.methods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+	for _, pattern := range cfg.PreserveHostFor {
+		r.preserveHostFor = append(r.preserveHostFor, strings.ToLower(strings.TrimSpace(pattern)))
+	}
+	for _, name := range cfg.RewriteHeaders {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, errors.New("rewrite_headers must not contain empty names")
+		}
+		r.rewriteHeaders = append(r.rewriteHeaders, http.CanonicalHeaderKey(name))
+	}
+	for _, name := range cfg.ForwardHeaders {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, errors.New("forward_headers must not contain empty names")
+		}
+		if r.forwardHeaders == nil {
+			r.forwardHeaders = make(map[string]bool)
+		}
+		r.forwardHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, expr := range cfg.RewriteJSONPaths {
+		path, err := parseJSONPath(expr)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite_json_paths %q: %w", expr, err)
+		}
+		r.jsonPaths = append(r.jsonPaths, path)
+	}
+	r.ignoreScheme = cfg.IgnoreUpstreamScheme
+	r.acceptEncoding = strings.TrimSpace(cfg.AcceptEncoding)
+	r.decompress = cfg.Decompress
+	if r.decompress && r.acceptEncoding == "" {
+		r.acceptEncoding = "gzip"
+	}
+	r.maxRewriteBytes = cfg.MaxRewriteBytes
+	if r.maxRewriteBytes <= 0 {
+		r.maxRewriteBytes = defaultMaxRewriteBytes
+	}
+	r.rewriteBody = cfg.RewriteBody
+	r.maxBodyRewriteBytes = cfg.MaxBodyRewriteBytes
+	if r.maxBodyRewriteBytes <= 0 {
+		r.maxBodyRewriteBytes = defaultMaxRewriteBytes
+	}
+	if cfg.MaxInflight > 0 {
+		r.maxInflight = make(chan struct{}, cfg.MaxInflight)
+		if r.maxInflightWait, err = parseDuration(cfg.MaxInflightWait, 0); err != nil {
+			return nil, fmt.Errorf("max_inflight_wait: %w", err)
+		}
+	}
+	if cfg.VerifyDigest {
+		r.digestHeader = strings.TrimSpace(cfg.DigestHeader)
+		if r.digestHeader == "" {
+			r.digestHeader = defaultDigestHeader
+		}
+	}
+	if cfg.TokenCache {
+		r.tokens = newTokenCache()
 	}
 	if prefix == "/" {
 		r.publicPrefixSlash = "/"
@@ -61,6 +179,9 @@ func newRoute(cfg RouteConfig) (*route, error) {
 }
 
 func (r *route) matchesPath(path string) bool {
+	if r.matchRegex != nil {
+		return r.matchRegex.MatchString(path)
+	}
 	if r.publicPrefix == "/" {
 		return true
 	}
@@ -70,6 +191,107 @@ func (r *route) matchesPath(path string) bool {
 	return strings.HasPrefix(path, r.publicPrefixSlash)
 }
 
+func (r *route) matchesMethod(method string) bool {
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) matchesHost(host string) bool {
+	if r.publicHost == "" {
+		return true
+	}
+	return matchHostPattern(r.publicHost, strings.ToLower(hostWithoutPort(host)))
+}
+
+// keepsHost reports whether the client Host is forwarded upstream, either
+// for every request or only for those whose host is in preserve_host_for.
+func (r *route) keepsHost(host string) bool {
+	if r.preserveHost {
+		return true
+	}
+	host = strings.ToLower(hostWithoutPort(host))
+	for _, pattern := range r.preserveHostFor {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostPattern matches a lower-cased host without port against an exact
+// host or a leading "*." wildcard.
+func matchHostPattern(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// publicHostFor returns the public host used when rewriting a URL into this
+// route, keeping the port of the current public host.
+func (r *route) publicHostFor(current string) string {
+	if r.publicHost == "" || strings.HasPrefix(r.publicHost, "*") || r.matchesHost(current) {
+		return current
+	}
+	if _, port, err := net.SplitHostPort(current); err == nil {
+		return net.JoinHostPort(r.publicHost, port)
+	}
+	return r.publicHost
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// protocolHeaders describe the request itself rather than the client, and
+// are forwarded whatever forward_headers says: without them bodies, range
+// and conditional requests, and upgrades break.
+var protocolHeaders = map[string]bool{
+	"Accept":              true,
+	"Accept-Encoding":     true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Range":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// filterHeaders drops every request header not in forward_headers, apart
+// from protocolHeaders. Host is carried outside the header map and is
+// unaffected; X-Forwarded-For is suppressed unless listed, since the reverse
+// proxy would otherwise add it.
+func (r *route) filterHeaders(h http.Header) {
+	for name := range h {
+		if !r.forwardHeaders[name] && !protocolHeaders[name] {
+			delete(h, name)
+		}
+	}
+	if !r.forwardHeaders["X-Forwarded-For"] {
+		h["X-Forwarded-For"] = nil
+	}
+}
+
 func (r *route) stripPrefix(path string) string {
 	if r.publicPrefix == "/" {
 		if path == "" {
@@ -87,6 +309,18 @@ func (r *route) stripPrefix(path string) string {
 	return trimmed
 }
 
+// upstreamPath maps a public path to the upstream path. Regex routes with an
+// upstream_path_template expand it with the pattern's capture groups ($1,
+// ${name}); every other route strips the public prefix.
+func (r *route) upstreamPath(path string) string {
+	if r.matchRegex != nil && r.pathTemplate != "" {
+		if match := r.matchRegex.FindStringSubmatchIndex(path); match != nil {
+			return r.joinUpstreamPath(string(r.matchRegex.ExpandString(nil, r.pathTemplate, path, match)))
+		}
+	}
+	return r.joinUpstreamPath(r.stripPrefix(path))
+}
+
 func (r *route) joinUpstreamPath(path string) string {
 	return joinPaths(r.upstreamBasePath, path)
 }
@@ -127,3 +361,58 @@ func hasPathPrefix(path, prefix string) bool {
 	}
 	return strings.HasPrefix(path, prefix+"/")
 }
+
+// parseHeaderCasing maps canonical header keys to the exact spelling that
+// should be sent upstream.
+func parseHeaderCasing(names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		key := http.CanonicalHeaderKey(name)
+		if _, ok := out[key]; ok {
+			return nil, fmt.Errorf("header %q listed twice", name)
+		}
+		out[key] = name
+	}
+	return out, nil
+}
+
+// headerCaser renames headers to their configured spelling on the way into
+// the transport. It sits below every other wrapper, since Header.Get, Set
+// and Del only see canonical keys: a header renamed earlier would be missed
+// or sent twice by anything that touches it afterwards. net/http writes
+// non-canonical map keys verbatim on HTTP/1.1; HTTP/2 lowercases all header
+// names regardless.
+type headerCaser struct {
+	casing map[string]string
+	next   http.RoundTripper
+}
+
+func (c *headerCaser) RoundTrip(req *http.Request) (*http.Response, error) {
+	var header http.Header
+	for key, name := range c.casing {
+		values, ok := req.Header[key]
+		if key == name || !ok {
+			continue
+		}
+		if header == nil {
+			header = req.Header.Clone()
+		}
+		delete(header, key)
+		header[name] = values
+	}
+	if header == nil {
+		return c.next.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request it was given.
+	out := new(http.Request)
+	*out = *req
+	out.Header = header
+	return c.next.RoundTrip(out)
+}
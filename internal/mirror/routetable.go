@@ -0,0 +1,55 @@
+package mirror
+
+// RouteInfo describes one route as the mirror matches it.
+type RouteInfo struct {
+	Order            int      `json:"order"`
+	Name             string   `json:"name"`
+	PublicHost       string   `json:"public_host,omitempty"`
+	PublicPrefix     string   `json:"public_prefix"`
+	MatchRegex       string   `json:"match_regex,omitempty"`
+	Methods          []string `json:"methods,omitempty"`
+	UpstreamScheme   string   `json:"upstream_scheme"`
+	UpstreamHost     string   `json:"upstream_host"`
+	UpstreamBasePath string   `json:"upstream_base_path"`
+	PreserveHost     bool     `json:"preserve_host"`
+}
+
+// RouteTable returns the routes of cfg in the order requests are matched
+// against them: routes with a public_host first, then the rest, each group
+// with regex routes ahead of prefix routes, longest prefix first.
+func RouteTable(cfg RuntimeConfig) ([]RouteInfo, error) {
+	routes, err := buildRoutes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	table := make([]RouteInfo, 0, len(routes))
+	add := func(r *route) {
+		info := RouteInfo{
+			Order:            len(table) + 1,
+			Name:             r.name,
+			PublicHost:       r.publicHost,
+			PublicPrefix:     r.publicPrefix,
+			Methods:          r.methods,
+			UpstreamScheme:   r.upstream.Scheme,
+			UpstreamHost:     r.upstream.Host,
+			UpstreamBasePath: r.upstream.Path,
+			PreserveHost:     r.preserveHost,
+		}
+		if r.matchRegex != nil {
+			info.MatchRegex = r.matchRegex.String()
+		}
+		table = append(table, info)
+	}
+	// The same two passes as matchRoute.
+	for _, r := range routes {
+		if r.publicHost != "" {
+			add(r)
+		}
+	}
+	for _, r := range routes {
+		if r.publicHost == "" {
+			add(r)
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,36 @@
+package mirror
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// processStats accumulates across every Mirror in the process, so the totals
+// survive config reloads.
+var processStats struct {
+	requests      atomic.Int64
+	requestBytes  atomic.Int64
+	responseBytes atomic.Int64
+	inflight      atomic.Int64
+}
+
+// Stats are process-wide request totals since startup.
+type Stats struct {
+	Requests      int64
+	RequestBytes  int64
+	ResponseBytes int64
+	Inflight      int64
+	Uptime        time.Duration
+}
+
+// ProcessStats returns the totals recorded by every Mirror in the process,
+// with Inflight the requests being served right now.
+func ProcessStats() Stats {
+	return Stats{
+		Requests:      processStats.requests.Load(),
+		RequestBytes:  processStats.requestBytes.Load(),
+		ResponseBytes: processStats.responseBytes.Load(),
+		Inflight:      processStats.inflight.Load(),
+		Uptime:        time.Since(processStart),
+	}
+}
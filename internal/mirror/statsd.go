@@ -0,0 +1,78 @@
+package mirror
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStatsdPrefix = "rmirror"
+
+// statsdClient mirrors a subset of the Prometheus metrics to a StatsD
+// endpoint, one UDP packet per sample with DogStatsD-style tags.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+}
+
+// statsdConns keeps one socket per address so reloads do not leak them.
+var statsdConns = struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}{conns: make(map[string]net.Conn)}
+
+func newStatsdClient(cfg *StatsdConfig) (*statsdClient, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	statsdConns.mu.Lock()
+	defer statsdConns.mu.Unlock()
+	conn, ok := statsdConns.conns[cfg.Address]
+	if !ok {
+		var err error
+		conn, err = net.Dial("udp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		statsdConns.conns[cfg.Address] = conn
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultStatsdPrefix
+	}
+	return &statsdClient{conn: conn, prefix: strings.TrimSuffix(prefix, ".") + ".", tags: cfg.Tags}, nil
+}
+
+func (c *statsdClient) count(name string, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, "1", "c", tags)
+}
+
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+func (c *statsdClient) send(name, value, kind string, tags []string) {
+	var b strings.Builder
+	b.WriteString(c.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	all := append(append([]string(nil), tags...), c.tags...)
+	if len(all) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(all, ","))
+	}
+	// Best effort: a missing collector must not affect request handling.
+	_, _ = c.conn.Write([]byte(b.String()))
+}
@@ -0,0 +1,96 @@
+package mirror
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const tapClientBuffer = 64
+
+type tapHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func newTapHub() *tapHub {
+	return &tapHub{clients: make(map[chan []byte]struct{})}
+}
+
+func (h *tapHub) subscribe() chan []byte {
+	ch := make(chan []byte, tapClientBuffer)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *tapHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// publish never blocks; entries are dropped for clients that fall behind.
+func (h *tapHub) publish(line []byte) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func (m *Mirror) authorizeAdmin(r *http.Request) bool {
+	if m.adminToken != "" {
+		auth := r.Header.Get("Authorization")
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) == 1 {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (m *Mirror) serveTap(w http.ResponseWriter, r *http.Request) {
+	if !m.authorizeAdmin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := m.tap.subscribe()
+	defer m.tap.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
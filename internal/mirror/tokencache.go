@@ -0,0 +1,144 @@
+package mirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Registries that omit expires_in issue tokens valid for 60 seconds.
+	defaultTokenLifetime = 60 * time.Second
+	maxTokenBodyBytes    = 64 << 10
+	maxTokenCacheEntries = 1024
+)
+
+type cachedToken struct {
+	header  http.Header
+	body    map[string]json.RawMessage
+	expires time.Time
+}
+
+// tokenCache holds registry bearer token responses keyed by request URL and
+// caller credentials, until the token's expires_in elapses.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedToken
+	now     func() time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{entries: make(map[string]cachedToken), now: time.Now}
+}
+
+// tokenCacheKey derives the cache key for a token request. Query parameters
+// are sorted so equivalent scope requests share an entry, and credentials are
+// part of the key so one caller never receives another caller's token.
+func tokenCacheKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet {
+		return "", false
+	}
+	h := sha256.New()
+	for _, part := range []string{
+		r.Host,
+		r.URL.Path,
+		r.URL.Query().Encode(),
+		r.Header.Get("Authorization"),
+		r.Header.Get("Cookie"),
+	} {
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func (c *tokenCache) serve(w http.ResponseWriter, key string) bool {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	now := c.now()
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// Report the remaining lifetime so clients refresh when the cached
+	// token expires rather than when a fresh one would have.
+	body := make(map[string]json.RawMessage, len(entry.body)+1)
+	for k, v := range entry.body {
+		body[k] = v
+	}
+	body["expires_in"] = json.RawMessage(strconv.Itoa(int(entry.expires.Sub(now).Seconds())))
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false
+	}
+	for k, v := range entry.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+	return true
+}
+
+func (c *tokenCache) store(resp *http.Response, key string) {
+	resp.Header.Set("X-Cache", "MISS")
+	if resp.StatusCode != http.StatusOK || resp.Body == nil || resp.Header.Get("Set-Cookie") != "" {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenBodyBytes+1))
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), resp.Body), Closer: resp.Body}
+	if err != nil || len(data) > maxTokenBodyBytes {
+		return
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		return
+	}
+	if _, ok := body["token"]; !ok {
+		if _, ok := body["access_token"]; !ok {
+			return
+		}
+	}
+	lifetime := defaultTokenLifetime
+	if raw, ok := body["expires_in"]; ok {
+		var seconds int64
+		if err := json.Unmarshal(raw, &seconds); err != nil || seconds <= 0 {
+			return
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	header := make(http.Header)
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxTokenCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxTokenCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = cachedToken{header: header, body: body, expires: now.Add(lifetime)}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
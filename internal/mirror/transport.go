@@ -3,13 +3,18 @@ package mirror
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,23 +24,46 @@ import (
 )
 
 func NewTransport(cfg RuntimeTransport) http.RoundTripper {
-	configureIPv6()
-	primary := newBaseTransport(cfg)
+	cfg.IPMode = EffectiveIPMode(cfg.IPMode)
+	limiter := newDialLimiter(cfg.MaxDialsPerHost, cfg.DialQueueTimeout)
+	observer := &dialObserver{}
+	primary := newBaseTransport(cfg, limiter, observer)
 	fallbackLens := fallbackFragmentLens(cfg.FirstFragmentLen)
-	fallbacks := buildFallbackTransports(cfg, fallbackLens)
-	if len(fallbacks) == 0 {
-		return primary
-	}
+	fallbacks := buildFallbackTransports(cfg, fallbackLens, limiter, observer)
+	retryOn, _ := parseRetryTriggers(cfg.RetryOn)
 	return &fallbackRoundTripper{
+		retryOn:           retryOn,
+		maxFallbacks:      cfg.MaxFallbackAttempts,
+		retryOnStatus:     cfg.RetryOnStatus,
+		maxRetries:        cfg.MaxRetries,
+		retryBackoff:      cfg.RetryBackoff,
+		adaptive:          cfg.AdaptiveFragment,
 		primary:           primary,
 		primaryFragment:   cfg.FirstFragmentLen,
 		fallbacks:         fallbacks,
 		fallbackFragments: fallbackLens,
+		limiter:           limiter,
+		observer:          observer,
 	}
 }
 
-func newBaseTransport(cfg RuntimeTransport) *http.Transport {
-	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+func newBaseTransport(cfg RuntimeTransport, limiter *dialLimiter, observer *dialObserver) *http.Transport {
+	// DialTLSContext clones this config per connection, so the version range,
+	// RootCAs and InsecureSkipVerify apply to the fragmented handshakes as well.
+	minVersion := cfg.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	tlsConfig := &tls.Config{MinVersion: minVersion, MaxVersion: cfg.TLSMaxVersion, InsecureSkipVerify: cfg.InsecureSkipVerify, ServerName: cfg.SNI}
+	// The bundle was checked by Runtime; if it has become unreadable since,
+	// an empty pool fails verification rather than trusting the system roots.
+	if cfg.CAFile != "" {
+		pool, err := loadCAFile(cfg.CAFile)
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		tlsConfig.RootCAs = pool
+	}
 	if cfg.ForceHTTP2 {
 		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
@@ -47,12 +75,24 @@ func newBaseTransport(cfg RuntimeTransport) *http.Transport {
 	baseDialer := &mirrorDialer{
 		dialer:            dialer,
 		firstFragmentLen:  cfg.FirstFragmentLen,
+		fragmentStrategy:  cfg.FragmentStrategy,
 		tlsHandshakeLimit: cfg.TLSHandshakeTimeout,
 		tlsConfig:         tlsConfig,
+		limiter:           limiter,
+		observer:          observer,
+		proxy:             newUpstreamProxy(cfg.ProxyURL, dialer),
+		hostPolicy:        cfg.hostPolicy,
+		ipMode:            cfg.IPMode,
+		resolver:          newDNSResolver(cfg),
+		dnsCache:          newDNSCache(cfg.DNSCacheTTL),
+	}
+	var proxyFunc func(*http.Request) (*url.URL, error)
+	if baseDialer.proxy != nil {
+		proxyFunc = baseDialer.httpProxy
 	}
 
 	return &http.Transport{
-		Proxy:                 nil,
+		Proxy:                 proxyFunc,
 		DialContext:           baseDialer.DialContext,
 		DialTLSContext:        baseDialer.DialTLSContext,
 		ForceAttemptHTTP2:     cfg.ForceHTTP2,
@@ -64,11 +104,30 @@ func newBaseTransport(cfg RuntimeTransport) *http.Transport {
 		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
 		ExpectContinueTimeout: cfg.ExpectContinueTimeout,
 		DisableCompression:    cfg.DisableCompression,
+		ReadBufferSize:        cfg.ReadBufferSize,
+		WriteBufferSize:       cfg.WriteBufferSize,
 		TLSClientConfig:       tlsConfig,
 	}
 }
 
-func buildFallbackTransports(cfg RuntimeTransport, lens []uint8) []http.RoundTripper {
+// loadCAFile reads a PEM bundle of CA certificates trusted in place of the
+// system roots.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return pool, nil
+}
+
+func buildFallbackTransports(cfg RuntimeTransport, lens []uint8, limiter *dialLimiter, observer *dialObserver) []http.RoundTripper {
 	if len(lens) == 0 {
 		return nil
 	}
@@ -76,7 +135,7 @@ func buildFallbackTransports(cfg RuntimeTransport, lens []uint8) []http.RoundTri
 	for _, frag := range lens {
 		next := cfg
 		next.FirstFragmentLen = frag
-		fallbacks = append(fallbacks, newBaseTransport(next))
+		fallbacks = append(fallbacks, newBaseTransport(next, limiter, observer))
 	}
 	return fallbacks
 }
@@ -95,19 +154,160 @@ func fallbackFragmentLens(current uint8) []uint8 {
 type mirrorDialer struct {
 	dialer            *net.Dialer
 	firstFragmentLen  uint8
+	fragmentStrategy  string
 	tlsHandshakeLimit time.Duration
 	tlsConfig         *tls.Config
+	limiter           *dialLimiter
+	observer          *dialObserver
+	proxy             *upstreamProxy
+	hostPolicy        *upstreamHostPolicy
+	ipMode            string
+	resolver          *dnsResolver
+	dnsCache          *dnsCache
+}
+
+const (
+	handshakeFragmented    = "fragmented"
+	handshakePlain         = "plain"
+	handshakePlainFallback = "plain_fallback"
+	handshakeFailed        = "failed"
+)
+
+// dialObserver is shared by the primary and fallback transports; the
+// Mirror fills it in once its metrics and logger exist.
+type dialObserver struct {
+	metrics  *metrics
+	logger   *structuredLogger
+	sweeping atomic.Int32
 }
 
-var ipv6Once sync.Once
+// track wraps a dialed connection so closes made while the idle pools are
+// being swept are counted. The raw conn is wrapped, never the *tls.Conn,
+// since http.Transport needs the concrete TLS type to negotiate HTTP/2.
+func (o *dialObserver) track(conn net.Conn) net.Conn {
+	if o == nil {
+		return conn
+	}
+	return &trackedConn{Conn: conn, observer: o}
+}
 
-func configureIPv6() {
-	ipv6Once.Do(func() {
-		if hasIPv6DefaultRoute() && hasGlobalIPv6() {
-			return
+type trackedConn struct {
+	net.Conn
+	observer *dialObserver
+	once     sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		if c.observer.sweeping.Load() > 0 {
+			idleConnsClosed.Inc()
 		}
-		ip.IsIPv6Available = false
 	})
+	return c.Conn.Close()
+}
+
+func (o *dialObserver) handshake(host, addr, path string, err error) {
+	if o == nil {
+		return
+	}
+	o.metrics.observeHandshakePath(path)
+	if o.logger.enabled(levelDebug) {
+		fields := map[string]any{"host": host, "addr": addr, "path": path}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		o.logger.Debug("tls handshake", fields)
+	}
+}
+
+var errDialQueueTimeout = errors.New("dial queue timeout")
+
+// dialLimiter is shared by the primary and fallback transports.
+type dialLimiter struct {
+	max     int
+	wait    time.Duration
+	mu      sync.Mutex
+	hosts   map[string]chan struct{}
+	metrics *metrics
+}
+
+func newDialLimiter(max int, wait time.Duration) *dialLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &dialLimiter{
+		max:   max,
+		wait:  wait,
+		hosts: make(map[string]chan struct{}),
+	}
+}
+
+func (l *dialLimiter) semaphore(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.max)
+		l.hosts[host] = sem
+	}
+	return sem
+}
+
+func (l *dialLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	sem := l.semaphore(host)
+	release := func() { <-sem }
+	start := time.Now()
+	select {
+	case sem <- struct{}{}:
+		l.metrics.observeDialWait(host, time.Since(start))
+		return release, nil
+	default:
+	}
+	waitCtx := ctx
+	if l.wait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.wait)
+		defer cancel()
+	}
+	select {
+	case sem <- struct{}{}:
+		l.metrics.observeDialWait(host, time.Since(start))
+		return release, nil
+	case <-waitCtx.Done():
+		l.metrics.observeDialWait(host, time.Since(start))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errDialQueueTimeout
+	}
+}
+
+var probeIPv6 = sync.OnceValue(func() bool {
+	return hasIPv6DefaultRoute() && hasGlobalIPv6()
+})
+
+// EffectiveIPMode returns the address families transport.ip_mode ends up
+// using: auto becomes dual or ipv4-only depending on the host.
+func EffectiveIPMode(mode string) string {
+	if mode != "" && mode != ipModeAuto {
+		return mode
+	}
+	if probeIPv6() {
+		return ipModeDual
+	}
+	return ipModeIPv4Only
+}
+
+// SetProcessIPMode sets terasu's process-wide IPv6 switch, which picks the
+// address family of its own DNS servers, from ip_mode. Lookups read it
+// unsynchronized, so it must be called once at startup before any transport
+// is used; reloads leave it alone and only change the families each
+// transport dials.
+func SetProcessIPMode(mode string) {
+	ip.IsIPv6Available = EffectiveIPMode(mode) != ipModeIPv4Only
 }
 
 func hasGlobalIPv6() bool {
@@ -172,33 +372,42 @@ func (d *mirrorDialer) DialContext(ctx context.Context, network, addr string) (n
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := resolveHost(ctx, host)
+	release, err := d.limiter.acquire(ctx, host)
 	if err != nil {
 		return nil, err
 	}
-	if len(addrs) == 0 {
-		return nil, errors.New("no upstream addresses")
-	}
-	var lastErr error
-	for _, ip := range addrs {
+	defer release()
+	if d.proxy != nil && d.proxy.isProxyAddr(addr) {
+		// http.Transport.Proxy sends plain http upstream requests here.
 		dialCtx := ctx
-		var cancel context.CancelFunc
 		if d.dialer.Timeout > 0 {
+			var cancel context.CancelFunc
 			dialCtx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+			defer cancel()
 		}
-		conn, err := d.dialer.DialContext(dialCtx, network, net.JoinHostPort(ip, port))
-		if cancel != nil {
-			cancel()
-		}
-		if err == nil {
-			return conn, nil
+		conn, err := d.dialer.DialContext(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
 		}
-		lastErr = err
+		return d.observer.track(conn), nil
 	}
-	if lastErr == nil {
-		lastErr = errors.New("no upstream dial succeeded")
+	addrs, err := d.upstreamAddrs(ctx, host)
+	if err != nil {
+		return nil, err
 	}
-	return nil, lastErr
+	addrs, err = d.dialableAddrs(ctx, host, addrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream dial succeeded")
+	}
+	conn, ip, _, err := d.dialRace(ctx, network, port, addrs)
+	if err != nil {
+		return nil, err
+	}
+	dialedIPsFrom(ctx).record(ip)
+	return d.observer.track(conn), nil
 }
 
 func (d *mirrorDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -206,12 +415,14 @@ func (d *mirrorDialer) DialTLSContext(ctx context.Context, network, addr string)
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := resolveHost(ctx, host)
+	release, err := d.limiter.acquire(ctx, host)
 	if err != nil {
 		return nil, err
 	}
-	if len(addrs) == 0 {
-		return nil, errors.New("no upstream addresses")
+	defer release()
+	addrs, err := d.upstreamAddrs(ctx, host)
+	if err != nil {
+		return nil, err
 	}
 	cfg := &tls.Config{}
 	if d.tlsConfig != nil {
@@ -220,30 +431,50 @@ func (d *mirrorDialer) DialTLSContext(ctx context.Context, network, addr string)
 	if cfg.ServerName == "" {
 		cfg.ServerName = host
 	}
+	addrs, err = d.dialableAddrs(ctx, host, addrs)
+	if err != nil {
+		return nil, err
+	}
+	dialed := dialedIPsFrom(ctx)
 	var lastErr error
-	for _, ip := range addrs {
-		conn, err := d.dialWithTimeout(ctx, network, net.JoinHostPort(ip, port))
+	for len(addrs) > 0 {
+		// Only the connects are raced; a winner that fails its handshakes
+		// leaves the race to the remaining addresses.
+		conn, ip, rest, err := d.dialRace(ctx, network, port, addrs)
 		if err != nil {
 			lastErr = err
-			continue
+			break
 		}
-		tlsConn := tls.Client(conn, cfg)
+		addrs = rest
+		target := net.JoinHostPort(ip, port)
+		tlsConn := tls.Client(d.observer.track(conn), cfg)
 		err = d.handshake(ctx, tlsConn)
 		if err == nil {
+			dialed.record(ip)
+			if d.firstFragmentLen > 0 {
+				d.observer.handshake(host, target, handshakeFragmented, nil)
+			} else {
+				d.observer.handshake(host, target, handshakePlain, nil)
+			}
 			return tlsConn, nil
 		}
-		_ = tlsConn.Close()
-		conn, err = d.dialWithTimeout(ctx, network, net.JoinHostPort(ip, port))
+		// Failed attempts close the raw conn, so only connections handed
+		// to the pool can count as closed by a sweep.
+		_ = conn.Close()
+		conn, err = d.dialWithTimeout(ctx, network, target)
 		if err != nil {
 			lastErr = err
 			continue
 		}
-		tlsConn = tls.Client(conn, cfg)
+		tlsConn = tls.Client(d.observer.track(conn), cfg)
 		if err = d.handshakePlain(ctx, tlsConn); err == nil {
+			dialed.record(ip)
+			d.observer.handshake(host, target, handshakePlainFallback, nil)
 			return tlsConn, nil
 		}
-		_ = tlsConn.Close()
-		lastErr = err
+		_ = conn.Close()
+		d.observer.handshake(host, target, handshakeFailed, err)
+		lastErr = &handshakeError{err: err}
 	}
 	if lastErr == nil {
 		lastErr = errors.New("no upstream dial succeeded")
@@ -251,13 +482,35 @@ func (d *mirrorDialer) DialTLSContext(ctx context.Context, network, addr string)
 	return nil, lastErr
 }
 
+// upstreamAddrs resolves host through the DNS cache with the configured DNS
+// servers or terasu's resolver, or returns the name itself when the upstream
+// proxy resolves names.
+func (d *mirrorDialer) upstreamAddrs(ctx context.Context, host string) ([]string, error) {
+	if d.proxy != nil && d.proxy.resolvesNames() {
+		return []string{host}, nil
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream addresses")
+	}
+	return addrs, nil
+}
+
+// dialWithTimeout connects to an upstream address, through the upstream
+// proxy when one is configured.
 func (d *mirrorDialer) dialWithTimeout(ctx context.Context, network, addr string) (net.Conn, error) {
-	if d.dialer.Timeout <= 0 {
-		return d.dialer.DialContext(ctx, network, addr)
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	if d.proxy != nil {
+		return d.proxy.dial(ctx, d.dialer, network, addr)
 	}
-	dialCtx, cancel := context.WithTimeout(ctx, d.dialer.Timeout)
-	defer cancel()
-	return d.dialer.DialContext(dialCtx, network, addr)
+	return d.dialer.DialContext(ctx, network, addr)
 }
 
 func (d *mirrorDialer) handshake(ctx context.Context, conn *tls.Conn) error {
@@ -270,11 +523,22 @@ func (d *mirrorDialer) handshake(ctx context.Context, conn *tls.Conn) error {
 		defer cancel()
 	}
 	if d.firstFragmentLen > 0 {
-		return terasu.Use(conn).HandshakeContext(hsCtx, d.firstFragmentLen)
+		return d.fragmentedHandshake(hsCtx, conn)
 	}
 	return conn.HandshakeContext(hsCtx)
 }
 
+// fragmentedHandshake splits the ClientHello as fragment_strategy asks.
+// Runtime rejects strategies the linked terasu cannot do, so the error is
+// only reached by a dialer built around it.
+func (d *mirrorDialer) fragmentedHandshake(ctx context.Context, conn *tls.Conn) error {
+	switch d.fragmentStrategy {
+	case "", fragmentStrategyFirstRecord:
+		return terasu.Use(conn).HandshakeContext(ctx, d.firstFragmentLen)
+	}
+	return fmt.Errorf("fragment_strategy %q is not supported by the linked terasu version", d.fragmentStrategy)
+}
+
 func (d *mirrorDialer) handshakePlain(ctx context.Context, conn *tls.Conn) error {
 	hsCtx := ctx
 	var cancel context.CancelFunc
@@ -287,6 +551,76 @@ func (d *mirrorDialer) handshakePlain(ctx context.Context, conn *tls.Conn) error
 	return conn.HandshakeContext(hsCtx)
 }
 
+var lookupUpstream = resolveHost
+
+// dialedIPs tracks the upstream address each attempt of a single request
+// connected to. Addresses that failed an earlier attempt are dialed last, so
+// fallback retries try the other resolved addresses first.
+type dialedIPs struct {
+	mu     sync.Mutex
+	last   string
+	failed map[string]struct{}
+}
+
+func withDialedIPs(req *http.Request) (*http.Request, *dialedIPs) {
+	if dialed := dialedIPsFrom(req.Context()); dialed != nil {
+		return req, dialed
+	}
+	dialed := &dialedIPs{}
+	return req.WithContext(context.WithValue(req.Context(), ctxDialedIPsKey, dialed)), dialed
+}
+
+func dialedIPsFrom(ctx context.Context) *dialedIPs {
+	dialed, _ := ctx.Value(ctxDialedIPsKey).(*dialedIPs)
+	return dialed
+}
+
+func (d *dialedIPs) record(ip string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.last = ip
+	d.mu.Unlock()
+}
+
+func (d *dialedIPs) markFailed() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last == "" {
+		return
+	}
+	if d.failed == nil {
+		d.failed = make(map[string]struct{})
+	}
+	d.failed[d.last] = struct{}{}
+	d.last = ""
+}
+
+func (d *dialedIPs) order(addrs []string) []string {
+	if d == nil {
+		return addrs
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.failed) == 0 {
+		return addrs
+	}
+	out := make([]string, 0, len(addrs))
+	var failed []string
+	for _, addr := range addrs {
+		if _, ok := d.failed[addr]; ok {
+			failed = append(failed, addr)
+			continue
+		}
+		out = append(out, addr)
+	}
+	return append(out, failed...)
+}
+
 func resolveHost(ctx context.Context, host string) ([]string, error) {
 	if !ip.IsIPv6Available {
 		ips, err := dns.DefaultResolver.LookupIP(ctx, "ip4", host)
@@ -310,8 +644,20 @@ func resolveHost(ctx context.Context, host string) ([]string, error) {
 	return addrs, nil
 }
 
+// filterIPv6 and filterIPv4 copy, since addrs may be terasu's cached slice.
+func filterIPv6(addrs []string) []string {
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, ":") {
+			continue
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
 func filterIPv4(addrs []string) []string {
-	out := addrs[:0]
+	out := make([]string, 0, len(addrs))
 	for _, addr := range addrs {
 		if strings.Contains(addr, ":") {
 			continue
@@ -336,28 +682,132 @@ func ipStrings(ips []net.IP) []string {
 	return out
 }
 
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return "tls handshake: " + e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
 type fallbackRoundTripper struct {
+	retryOn retryTrigger
+	// maxFallbacks caps how many fallback transports one request may try
+	// after the first attempt fails; 0 tries the whole chain.
+	maxFallbacks int
+	// retryOnStatus lists upstream statuses that are replayed up to
+	// maxRetries times, waiting retryBackoff times the attempt number first.
+	retryOnStatus     []int
+	maxRetries        int
+	retryBackoff      time.Duration
+	adaptive          bool
+	prefMu            sync.Mutex
+	prefs             map[string]*fragmentPreference
 	primary           http.RoundTripper
 	primaryFragment   uint8
 	fallbacks         []http.RoundTripper
 	fallbackFragments []uint8
+	limiter           *dialLimiter
+	observer          *dialObserver
 	metrics           *metrics
 }
 
+func (f *fallbackRoundTripper) setMetrics(m *metrics) {
+	f.metrics = m
+	if f.limiter != nil {
+		f.limiter.metrics = m
+	}
+	if f.observer != nil {
+		f.observer.metrics = m
+	}
+}
+
+func (f *fallbackRoundTripper) setLogger(l *structuredLogger) {
+	if f.observer != nil {
+		f.observer.logger = l
+	}
+}
+
 func (f *fallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	resp, err := f.primary.RoundTrip(req)
-	if err == nil || !shouldRetry(req, err) {
+	resp, err := f.roundTrip(req)
+	for attempt := 1; attempt <= f.maxRetries; attempt++ {
+		if err != nil || !f.retryStatus(resp.StatusCode) || !canReplayRequest(req) {
+			break
+		}
+		if !waitBackoff(req.Context(), time.Duration(attempt)*f.retryBackoff) {
+			break
+		}
+		clone, cloneErr := cloneRequest(req)
+		if cloneErr != nil {
+			break
+		}
+		route, _ := req.Context().Value(ctxRouteKey).(*route)
+		f.metrics.observeStatusRetry(routeMetricLabel(route, req.URL.Path), resp.StatusCode)
+		drainBody(resp)
+		resp, err = f.roundTrip(clone)
+	}
+	return resp, err
+}
+
+func (f *fallbackRoundTripper) retryStatus(status int) bool {
+	for _, s := range f.retryOnStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// waitBackoff reports false if ctx ends first, in which case the response
+// already received is returned rather than a cancellation error.
+func waitBackoff(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (f *fallbackRoundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	req, dialed := withDialedIPs(req)
+	host := req.URL.Host
+	first := f.preferredIndex(host)
+	resp, reused, err := roundTripTracked(f.transportAt(first), req)
+	if err != nil && reused && isIdleClosed(err) && canRetryRequest(req) && req.Context().Err() == nil {
+		if clone, cloneErr := cloneRequest(req); cloneErr == nil {
+			if resp != nil && resp.Body != nil {
+				_ = resp.Body.Close()
+			}
+			resp, err = f.transportAt(first).RoundTrip(clone)
+		}
+	}
+	if err == nil {
+		f.recordSuccess(host, first, first)
+	}
+	if err == nil || !f.shouldRetry(req, err) {
 		return resp, err
 	}
 	if resp != nil && resp.Body != nil {
 		_ = resp.Body.Close()
 	}
-	prevFrag := f.primaryFragment
-	for i, fallback := range f.fallbacks {
-		nextFrag := prevFrag
-		if i < len(f.fallbackFragments) {
-			nextFrag = f.fallbackFragments[i]
+	f.recordFailure(host, first)
+	dialed.markFailed()
+	prevFrag := f.fragmentAt(first)
+	for i := first + 1; i <= len(f.fallbacks); i++ {
+		if f.maxFallbacks > 0 && i-first > f.maxFallbacks {
+			break
 		}
+		nextFrag := f.fragmentAt(i)
 		if f.metrics != nil {
 			f.metrics.observeFallback(prevFrag, nextFrag)
 		}
@@ -365,22 +815,139 @@ func (f *fallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, err
 		if cloneErr != nil {
 			return resp, err
 		}
-		resp, err = fallback.RoundTrip(clone)
-		if err == nil || !shouldRetry(clone, err) {
+		resp, err = f.transportAt(i).RoundTrip(clone)
+		if err == nil {
+			f.recordSuccess(host, first, i)
+		}
+		if err == nil || !f.shouldRetry(clone, err) {
 			return resp, err
 		}
 		if resp != nil && resp.Body != nil {
 			_ = resp.Body.Close()
 		}
+		dialed.markFailed()
 		prevFrag = nextFrag
 	}
 	return resp, err
 }
 
+func (f *fallbackRoundTripper) transportAt(i int) http.RoundTripper {
+	if i == 0 {
+		return f.primary
+	}
+	return f.fallbacks[i-1]
+}
+
+func (f *fallbackRoundTripper) fragmentAt(i int) uint8 {
+	frag := f.primaryFragment
+	for j := 0; j < i && j < len(f.fallbackFragments); j++ {
+		frag = f.fallbackFragments[j]
+	}
+	return frag
+}
+
+const fragmentPromoteAfter = 3
+
+type fragmentPreference struct {
+	preferred int
+	candidate int
+	streak    int
+}
+
+func (f *fallbackRoundTripper) preferredIndex(host string) int {
+	if !f.adaptive {
+		return 0
+	}
+	f.prefMu.Lock()
+	defer f.prefMu.Unlock()
+	if pref, ok := f.prefs[host]; ok {
+		return pref.preferred
+	}
+	return 0
+}
+
+// recordSuccess promotes a fallback fragment length for host once it has
+// rescued fragmentPromoteAfter consecutive requests. The gauge is only
+// written when a host is first seen or its preferred length changes.
+func (f *fallbackRoundTripper) recordSuccess(host string, first, used int) {
+	if !f.adaptive {
+		return
+	}
+	f.prefMu.Lock()
+	if f.prefs == nil {
+		f.prefs = make(map[string]*fragmentPreference)
+	}
+	pref, ok := f.prefs[host]
+	changed := !ok
+	if !ok {
+		pref = &fragmentPreference{}
+		f.prefs[host] = pref
+	}
+	switch {
+	case used == first:
+		pref.candidate, pref.streak = 0, 0
+	case used == pref.candidate:
+		pref.streak++
+	default:
+		pref.candidate, pref.streak = used, 1
+	}
+	if pref.candidate > 0 && pref.streak >= fragmentPromoteAfter {
+		changed = changed || pref.preferred != pref.candidate
+		pref.preferred = pref.candidate
+		pref.candidate, pref.streak = 0, 0
+	}
+	preferred := pref.preferred
+	f.prefMu.Unlock()
+	if changed {
+		f.metrics.setFragmentLength(host, f.fragmentAt(preferred))
+	}
+}
+
+func (f *fallbackRoundTripper) recordFailure(host string, first int) {
+	if !f.adaptive || first == 0 {
+		return
+	}
+	f.prefMu.Lock()
+	reset := false
+	if pref, ok := f.prefs[host]; ok && pref.preferred != 0 {
+		pref.preferred = 0
+		reset = true
+	}
+	f.prefMu.Unlock()
+	if reset {
+		f.metrics.setFragmentLength(host, f.primaryFragment)
+	}
+}
+
+// roundTripTracked also reports whether the attempt ran on a pooled connection.
+func roundTripTracked(rt http.RoundTripper, req *http.Request) (*http.Response, bool, error) {
+	var reused atomic.Bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				reused.Store(true)
+			}
+		},
+	}
+	resp, err := rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	return resp, reused.Load(), err
+}
+
+func isIdleClosed(err error) bool {
+	if isConnReset(err) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "server closed idle connection")
+}
+
 func (f *fallbackRoundTripper) CloseIdleConnections() {
 	if f == nil {
 		return
 	}
+	if f.observer != nil {
+		f.observer.sweeping.Add(1)
+		defer f.observer.sweeping.Add(-1)
+	}
 	if closer, ok := f.primary.(interface{ CloseIdleConnections() }); ok {
 		closer.CloseIdleConnections()
 	}
@@ -391,14 +958,21 @@ func (f *fallbackRoundTripper) CloseIdleConnections() {
 	}
 }
 
-func shouldRetry(req *http.Request, err error) bool {
+func (f *fallbackRoundTripper) shouldRetry(req *http.Request, err error) bool {
 	if err == nil {
 		return false
 	}
 	if !canRetryRequest(req) {
 		return false
 	}
-	return isConnReset(err)
+	if req.Context().Err() != nil || isFatalTLSError(err) {
+		return false
+	}
+	triggers := f.retryOn
+	if triggers == 0 {
+		triggers = retryOnReset
+	}
+	return triggers.matches(err)
 }
 
 func canRetryRequest(req *http.Request) bool {
@@ -414,6 +988,26 @@ func canRetryRequest(req *http.Request) bool {
 	return req.GetBody != nil
 }
 
+// canReplayRequest guards retries after the upstream has answered, when the
+// first attempt may already have taken effect: on top of canRetryRequest,
+// only idempotent methods, or requests the client marked with an
+// Idempotency-Key, are sent again, and only with a body that can be rebuilt
+// through GetBody.
+func canReplayRequest(req *http.Request) bool {
+	if !canRetryRequest(req) {
+		return false
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
 func cloneRequest(req *http.Request) (*http.Request, error) {
 	clone := req.Clone(req.Context())
 	if req.Body == nil || req.Body == http.NoBody {
@@ -430,6 +1024,97 @@ func cloneRequest(req *http.Request) (*http.Request, error) {
 	return clone, nil
 }
 
+const (
+	retryTriggerReset            = "reset"
+	retryTriggerHandshakeTimeout = "handshake_timeout"
+	retryTriggerUnexpectedEOF    = "unexpected_eof"
+	retryTriggerHandshakeFailure = "handshake_failure"
+)
+
+type retryTrigger uint8
+
+const (
+	retryOnReset retryTrigger = 1 << iota
+	retryOnHandshakeTimeout
+	retryOnUnexpectedEOF
+	retryOnHandshakeFailure
+)
+
+func parseRetryTriggers(names []string) (retryTrigger, error) {
+	var out retryTrigger
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case retryTriggerReset:
+			out |= retryOnReset
+		case retryTriggerHandshakeTimeout:
+			out |= retryOnHandshakeTimeout
+		case retryTriggerUnexpectedEOF:
+			out |= retryOnUnexpectedEOF
+		case retryTriggerHandshakeFailure:
+			out |= retryOnHandshakeFailure
+		default:
+			return 0, fmt.Errorf("unknown trigger %q", name)
+		}
+	}
+	return out, nil
+}
+
+func (t retryTrigger) matches(err error) bool {
+	if t&retryOnReset != 0 && isConnReset(err) {
+		return true
+	}
+	if t&retryOnHandshakeTimeout != 0 && isHandshakeTimeout(err) {
+		return true
+	}
+	if t&retryOnUnexpectedEOF != 0 && isUnexpectedEOF(err) {
+		return true
+	}
+	if t&retryOnHandshakeFailure != 0 && isHandshakeFailure(err) {
+		return true
+	}
+	return false
+}
+
+func isFatalTLSError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+func isHandshakeTimeout(err error) bool {
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		if errors.Is(hsErr.err, context.DeadlineExceeded) {
+			return true
+		}
+		var netErr net.Error
+		if errors.As(hsErr.err, &netErr) && netErr.Timeout() {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "tls handshake timeout")
+}
+
+func isUnexpectedEOF(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "unexpected eof")
+}
+
+func isHandshakeFailure(err error) bool {
+	var alert tls.AlertError
+	if errors.As(err, &alert) && alert == 40 {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "tls: handshake failure")
+}
+
 func isConnReset(err error) bool {
 	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) {
 		return true
@@ -1,12 +1,32 @@
 package mirror
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/fumiama/terasu/ip"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 type roundTripperFunc func(*http.Request) (*http.Response, error)
@@ -88,3 +108,1509 @@ func TestFallbackRoundTripperSkipsNonRetryable(t *testing.T) {
 		t.Fatalf("unexpected calls: primary=%d fallback=%d", primaryCalls, fallbackCalls)
 	}
 }
+
+func TestFallbackRoundTripperMaxFallbackAttempts(t *testing.T) {
+	for _, tc := range []struct {
+		max       int
+		wantCalls []int
+	}{
+		{0, []int{1, 1, 1}},
+		{1, []int{1, 1, 0}},
+		{2, []int{1, 1, 1}},
+	} {
+		calls := make([]int, 3)
+		resetting := func(i int) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls[i]++
+				return nil, fmt.Errorf("attempt %d: %w", i, syscall.ECONNRESET)
+			})
+		}
+		rt := &fallbackRoundTripper{
+			maxFallbacks: tc.max,
+			primary:      resetting(0),
+			fallbacks:    []http.RoundTripper{resetting(1), resetting(2)},
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		_, err := rt.RoundTrip(req)
+		if err == nil {
+			t.Fatalf("max=%d: expected the chain to fail", tc.max)
+		}
+		last := 0
+		for i, n := range tc.wantCalls {
+			if n > 0 {
+				last = i
+			}
+		}
+		if want := fmt.Sprintf("attempt %d:", last); !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("max=%d: expected the last attempt's error, got %v", tc.max, err)
+		}
+		for i := range calls {
+			if calls[i] != tc.wantCalls[i] {
+				t.Fatalf("max=%d: expected calls %v, got %v", tc.max, tc.wantCalls, calls)
+			}
+		}
+	}
+}
+
+func TestFallbackRoundTripperRetriesOnStatus(t *testing.T) {
+	var calls int
+	statuses := []int{}
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if req.Body != nil {
+			if body, _ := io.ReadAll(req.Body); string(body) != "data" {
+				t.Errorf("attempt %d: expected replayed body, got %q", calls, body)
+			}
+		}
+		status := http.StatusOK
+		if calls <= len(statuses) {
+			status = statuses[calls-1]
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("body")),
+		}, nil
+	})
+	m := newMetrics(nil)
+	rt := &fallbackRoundTripper{
+		primary:       primary,
+		retryOnStatus: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+		maxRetries:    2,
+		retryBackoff:  time.Millisecond,
+		metrics:       m,
+	}
+	ctx := context.WithValue(context.Background(), ctxRouteKey, &route{name: "blobs"})
+	for _, tc := range []struct {
+		name           string
+		method         string
+		getBody        bool
+		idempotencyKey string
+		statuses       []int
+		wantCalls      int
+		want           int
+	}{
+		{"recovers", http.MethodGet, false, "", []int{502, 503}, 3, http.StatusOK},
+		{"gives up", http.MethodGet, false, "", []int{503, 503, 503}, 3, http.StatusServiceUnavailable},
+		{"other status", http.MethodGet, false, "", []int{500}, 1, http.StatusInternalServerError},
+		{"post without GetBody", http.MethodPost, false, "", []int{503}, 1, http.StatusServiceUnavailable},
+		{"post with GetBody", http.MethodPost, true, "", []int{503}, 1, http.StatusServiceUnavailable},
+		{"post with Idempotency-Key", http.MethodPost, true, "k1", []int{503}, 2, http.StatusOK},
+		{"put with GetBody", http.MethodPut, true, "", []int{503}, 2, http.StatusOK},
+	} {
+		calls, statuses = 0, tc.statuses
+		var body io.Reader
+		if tc.method != http.MethodGet {
+			body = strings.NewReader("data")
+		}
+		req, err := http.NewRequestWithContext(ctx, tc.method, "http://example.com/blob", body)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		if !tc.getBody {
+			req.GetBody = nil
+		}
+		if tc.idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", tc.idempotencyKey)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || calls != tc.wantCalls {
+			t.Fatalf("%s: expected status %d after %d calls, got %d after %d", tc.name, tc.want, tc.wantCalls, resp.StatusCode, calls)
+		}
+	}
+	if got := metricValue(t, m, "rmirror_upstream_status_retries_total", map[string]string{"route": "blobs", "status": "503"}); got != 5 {
+		t.Fatalf("expected 5 retries on 503, got %v", got)
+	}
+	if got := metricValue(t, m, "rmirror_upstream_status_retries_total", map[string]string{"route": "blobs", "status": "502"}); got != 1 {
+		t.Fatalf("expected 1 retry on 502, got %v", got)
+	}
+}
+
+func TestDialLimiterCapsConcurrentDials(t *testing.T) {
+	limiter := newDialLimiter(2, time.Second)
+	var current, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background(), "registry.example")
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+				return
+			}
+			n := atomic.AddInt32(&current, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&current, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&peak); got != 2 {
+		t.Fatalf("expected at most 2 concurrent dials, peak was %d", got)
+	}
+
+	release, err := limiter.acquire(context.Background(), "other.example")
+	if err != nil {
+		t.Fatalf("other host should not be limited: %v", err)
+	}
+	release()
+}
+
+func TestDialLimiterQueueTimeout(t *testing.T) {
+	limiter := newDialLimiter(1, 20*time.Millisecond)
+	release, err := limiter.acquire(context.Background(), "registry.example")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+	if _, err := limiter.acquire(context.Background(), "registry.example"); !errors.Is(err, errDialQueueTimeout) {
+		t.Fatalf("expected queue timeout, got %v", err)
+	}
+}
+
+func TestFallbackRoundTripperRetriesOnHandshakeTimeout(t *testing.T) {
+	var fallbackCalls int
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, &handshakeError{err: context.DeadlineExceeded}
+	})
+	fallback := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fallbackCalls++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	})
+	triggers, err := parseRetryTriggers([]string{"reset", "handshake_timeout"})
+	if err != nil {
+		t.Fatalf("parse triggers: %v", err)
+	}
+	rt := &fallbackRoundTripper{
+		retryOn:   triggers,
+		primary:   primary,
+		fallbacks: []http.RoundTripper{fallback},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected fallback success, got error: %v", err)
+	}
+	resp.Body.Close()
+	if fallbackCalls != 1 {
+		t.Fatalf("expected one fallback call, got %d", fallbackCalls)
+	}
+
+	rt.retryOn = retryOnReset
+	fallbackCalls = 0
+	if _, err := rt.RoundTrip(req); err == nil || fallbackCalls != 0 {
+		t.Fatalf("handshake timeout should not trigger fallback by default (calls=%d)", fallbackCalls)
+	}
+}
+
+func TestFallbackRoundTripperSkipsCertificateErrors(t *testing.T) {
+	var fallbackCalls int
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, &handshakeError{err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}
+	})
+	fallback := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fallbackCalls++
+		return nil, errors.New("unexpected fallback")
+	})
+	triggers, err := parseRetryTriggers([]string{"reset", "handshake_timeout", "unexpected_eof", "handshake_failure"})
+	if err != nil {
+		t.Fatalf("parse triggers: %v", err)
+	}
+	rt := &fallbackRoundTripper{
+		retryOn:   triggers,
+		primary:   primary,
+		fallbacks: []http.RoundTripper{fallback},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("expected certificate error")
+	}
+	if fallbackCalls != 0 {
+		t.Fatalf("certificate error must not trigger fallback, got %d calls", fallbackCalls)
+	}
+}
+
+func TestFallbackRoundTripperRetriesIdleClosedOnSameTransport(t *testing.T) {
+	var primaryCalls, fallbackCalls int
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		primaryCalls++
+		if primaryCalls == 1 {
+			if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+				trace.GotConn(httptrace.GotConnInfo{Reused: true})
+			}
+			return nil, io.EOF
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	})
+	fallback := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		fallbackCalls++
+		return nil, errors.New("unexpected fallback")
+	})
+	rt := &fallbackRoundTripper{
+		primary:   primary,
+		fallbacks: []http.RoundTripper{fallback},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected plain retry success, got error: %v", err)
+	}
+	resp.Body.Close()
+	if primaryCalls != 2 || fallbackCalls != 0 {
+		t.Fatalf("unexpected calls: primary=%d fallback=%d", primaryCalls, fallbackCalls)
+	}
+}
+
+func metricValue(t *testing.T, m *metrics, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	next:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if want, ok := labels[pair.GetName()]; ok && want != pair.GetValue() {
+					continue next
+				}
+			}
+			switch {
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestFixedFragmentLengthGauge(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.Routes = []RouteConfig{{Name: "root", PublicPrefix: "/", Upstream: upstream.URL}}
+	m := newTestMirrorInstance(t, cfg)
+
+	labels := map[string]string{"host": strings.TrimPrefix(upstream.URL, "http://")}
+	if got := metricValue(t, m.metrics, "rmirror_fragment_length", labels); got != defaultFirstFragmentLen {
+		t.Fatalf("expected the fixed fragment length once built, got %v", got)
+	}
+	m.metrics.fragmentLen.Reset()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got := metricValue(t, m.metrics, "rmirror_fragment_length", labels); got != 0 {
+		t.Fatalf("expected requests not to rewrite a fixed fragment length, got %v", got)
+	}
+}
+
+func TestAdaptiveFragmentPromotesFallback(t *testing.T) {
+	var primaryCalls int
+	primary := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		primaryCalls++
+		return nil, fmt.Errorf("wrap: %w", syscall.ECONNRESET)
+	})
+	fallback := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	})
+	m := newMetrics(nil)
+	rt := &fallbackRoundTripper{
+		adaptive:          true,
+		primary:           primary,
+		primaryFragment:   3,
+		fallbacks:         []http.RoundTripper{fallback},
+		fallbackFragments: []uint8{1},
+	}
+	rt.setMetrics(m)
+
+	labels := map[string]string{"host": "example.com"}
+	for i := 0; i < fragmentPromoteAfter; i++ {
+		if got := metricValue(t, m, "rmirror_fragment_length", labels); i > 0 && got != 3 {
+			t.Fatalf("expected fragment length 3 before promotion, got %v", got)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if got := metricValue(t, m, "rmirror_fragment_length", labels); got != 1 {
+		t.Fatalf("expected promoted fragment length 1, got %v", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	resp.Body.Close()
+	if primaryCalls != fragmentPromoteAfter {
+		t.Fatalf("expected promoted host to skip the primary, got %d primary calls", primaryCalls)
+	}
+}
+
+func TestFallbackRetryAvoidsResetAddress(t *testing.T) {
+	good, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("second loopback address unavailable: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(good.Addr().String())
+	bad, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		good.Close()
+		t.Skipf("listen on matching port: %v", err)
+	}
+	defer bad.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go srv.Serve(good)
+	defer srv.Close()
+	var badConns int32
+	go func() {
+		for {
+			conn, err := bad.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&badConns, 1)
+			_, _ = conn.Read(make([]byte, 1024))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.1", "127.0.0.2"}, nil
+	}
+	defer func() { lookupUpstream = prev }()
+
+	cfg := RuntimeTransport{DialTimeout: time.Second}
+	rt := &fallbackRoundTripper{
+		primary:   newBaseTransport(cfg, nil, nil),
+		fallbacks: []http.RoundTripper{newBaseTransport(cfg, nil, nil)},
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://registry.test:"+port+"/", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected retry on the second address to succeed: %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&badConns); got != 1 {
+		t.Fatalf("expected a single attempt on the resetting address, got %d", got)
+	}
+}
+
+func TestUpstreamHostPolicyBlocksResolvedAddresses(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	var resolved []string
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		return resolved, nil
+	}
+	defer func() { lookupUpstream = prev }()
+
+	cases := []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		resolved []string
+		reason   string
+	}{
+		{name: "metadata", resolved: []string{"169.254.169.254"}, reason: blockedLinkLocal},
+		{name: "denied", denied: []string{"127.0.0.0/8"}, resolved: []string{"127.0.0.1"}, reason: blockedDenied},
+		{name: "not allowed", allowed: []string{"10.0.0.0/8"}, resolved: []string{"127.0.0.1"}, reason: blockedNotListed},
+		{name: "allowed", allowed: []string{"10.0.0.0/8", "127.0.0.1"}, resolved: []string{"127.0.0.1"}},
+		{name: "skips blocked address", resolved: []string{"169.254.169.254", "127.0.0.1"}, reason: blockedLinkLocal},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hits.Store(0)
+			resolved = tc.resolved
+			cfg := DefaultConfig()
+			cfg.AccessLog = false
+			cfg.LogLevel = "error"
+			cfg.AllowedUpstreamHosts = tc.allowed
+			cfg.DeniedUpstreamHosts = tc.denied
+			cfg.Routes = []RouteConfig{{Name: "registry", PublicPrefix: "/", Upstream: "http://registry.test:" + port}}
+			m := newTestMirrorInstance(t, cfg)
+			srv := httptest.NewServer(m.Handler())
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/v2/")
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			reachable := tc.reason == "" || len(tc.resolved) > 1
+			if reachable {
+				if resp.StatusCode != http.StatusOK || hits.Load() != 1 {
+					t.Fatalf("expected upstream to be reached, got %d with %d hits", resp.StatusCode, hits.Load())
+				}
+			} else if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "upstream host blocked") || hits.Load() != 0 {
+				t.Fatalf("expected blocked dial, got %d %q with %d hits", resp.StatusCode, body, hits.Load())
+			}
+			if tc.reason != "" {
+				if got := metricValue(t, m.metrics, "rmirror_blocked_dials_total", map[string]string{"reason": tc.reason}); got != 1 {
+					t.Fatalf("expected one blocked dial for %s, got %v", tc.reason, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDialRacesPastBlackholedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	prevLookup, prevDelay := lookupUpstream, dialRaceDelay
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+	dialRaceDelay = 20 * time.Millisecond
+	defer func() { lookupUpstream, dialRaceDelay = prevLookup, prevDelay }()
+
+	cancelled := make(chan struct{})
+	d := &mirrorDialer{dialer: &net.Dialer{
+		Timeout: 10 * time.Second,
+		// 127.0.0.2 never answers, like an address whose packets are dropped.
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if strings.HasPrefix(address, "127.0.0.2:") {
+				<-ctx.Done()
+				close(cancelled)
+				return ctx.Err()
+			}
+			return nil
+		},
+	}}
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("registry.test", port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the second address to be raced early, took %v", elapsed)
+	}
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Fatalf("expected a connection to %s, got %s", ln.Addr(), got)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the losing attempt to be cancelled")
+	}
+
+	got := interleaveFamilies([]string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3"})
+	if want := "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2,192.0.2.3"; strings.Join(got, ",") != want {
+		t.Fatalf("expected %s, got %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestFragmentStrategyHandshake(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+
+	for _, tc := range []struct {
+		strategy string
+		wantErr  string
+	}{
+		{fragmentStrategyFirstRecord, ""},
+		{fragmentStrategyAllRecords, `fragment_strategy "all_records" is not supported`},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		d := &mirrorDialer{firstFragmentLen: 4, fragmentStrategy: tc.strategy}
+		err = d.handshake(context.Background(), tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "example.com"}))
+		conn.Close()
+		if tc.wantErr == "" && err != nil {
+			t.Fatalf("%s: handshake: %v", tc.strategy, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Fatalf("%s: expected %q, got %v", tc.strategy, tc.wantErr, err)
+		}
+	}
+}
+
+func TestIPMode(t *testing.T) {
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		if host == "v4.test" {
+			return []string{"192.0.2.1"}, nil
+		}
+		return []string{"2001:db8::1", "192.0.2.1", "2001:db8::2"}, nil
+	}
+	defer func() { lookupUpstream = prev }()
+
+	for _, tc := range []struct {
+		mode string
+		host string
+		want string
+	}{
+		{ipModeDual, "dual.test", "2001:db8::1,192.0.2.1,2001:db8::2"},
+		{ipModeIPv4Only, "dual.test", "192.0.2.1"},
+		{ipModeIPv6Only, "dual.test", "2001:db8::1,2001:db8::2"},
+		{ipModeIPv6Only, "v4.test", ""},
+	} {
+		d := &mirrorDialer{ipMode: tc.mode}
+		addrs, err := d.lookup(context.Background(), tc.host)
+		if tc.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "ip_mode ipv6-only") {
+				t.Fatalf("%s %s: expected no allowed addresses, got %v %v", tc.mode, tc.host, addrs, err)
+			}
+			continue
+		}
+		if err != nil || strings.Join(addrs, ",") != tc.want {
+			t.Fatalf("%s %s: expected %s, got %v %v", tc.mode, tc.host, tc.want, addrs, err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	runtime, err := cfg.Runtime()
+	if err != nil || runtime.Transport.IPMode != ipModeAuto {
+		t.Fatalf("expected auto by default, got %q %v", runtime.Transport.IPMode, err)
+	}
+	if mode := EffectiveIPMode(ipModeAuto); mode != ipModeDual && mode != ipModeIPv4Only {
+		t.Fatalf("expected auto to become dual or ipv4-only, got %q", mode)
+	}
+	if mode := EffectiveIPMode(ipModeIPv6Only); mode != ipModeIPv6Only {
+		t.Fatalf("expected an explicit mode to be kept, got %q", mode)
+	}
+	cfg.Transport.IPMode = "IPv6-Only"
+	if runtime, err := cfg.Runtime(); err != nil || runtime.Transport.IPMode != ipModeIPv6Only {
+		t.Fatalf("expected ipv6-only, got %q %v", runtime.Transport.IPMode, err)
+	}
+	cfg.Transport.IPMode = "v6"
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "ip_mode") {
+		t.Fatalf("expected an unknown ip_mode to be rejected, got %v", err)
+	}
+
+	// Only SetProcessIPMode writes terasu's switch; transports built on
+	// reload must not race the lookups reading it.
+	defer func(prev bool) { ip.IsIPv6Available = prev }(ip.IsIPv6Available)
+	ip.IsIPv6Available = true
+	NewTransport(RuntimeTransport{IPMode: ipModeIPv4Only})
+	if !ip.IsIPv6Available {
+		t.Fatal("expected NewTransport to leave the process-wide IPv6 switch alone")
+	}
+	SetProcessIPMode(ipModeIPv4Only)
+	if ip.IsIPv6Available {
+		t.Fatal("expected SetProcessIPMode to disable IPv6 for ipv4-only")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Closing every connection makes each request dial again.
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		lookups[host]++
+		mu.Unlock()
+		if host == "broken.test" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	defer func() { lookupUpstream = prev }()
+
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	cfg.LogLevel = "error"
+	cfg.Transport.DNSCacheTTL = "1h"
+	cfg.Routes = []RouteConfig{
+		{Name: "registry", PublicPrefix: "/registry", Upstream: "http://registry.test:" + port},
+		{Name: "broken", PublicPrefix: "/broken", Upstream: "http://broken.test:" + port},
+	}
+	m := newTestMirrorInstance(t, cfg)
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 3; i++ {
+		if status := get("/registry/v2/"); status != http.StatusOK {
+			t.Fatalf("expected 200, got %d", status)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if status := get("/broken/v2/"); status != http.StatusBadGateway {
+			t.Fatalf("expected 502 for an unresolvable upstream, got %d", status)
+		}
+	}
+	mu.Lock()
+	if lookups["registry.test"] != 1 || lookups["broken.test"] != 1 {
+		t.Fatalf("expected one lookup per host, got %v", lookups)
+	}
+	mu.Unlock()
+	for result, want := range map[string]float64{dnsCacheMiss: 2, dnsCacheHit: 2, dnsCacheNegativeHit: 1} {
+		if got := metricValue(t, m.metrics, "rmirror_dns_cache_lookups_total", map[string]string{"result": result}); got != want {
+			t.Fatalf("expected %v %s lookups, got %v", want, result, got)
+		}
+	}
+
+	cache := newDNSCache(time.Minute)
+	now := time.Now()
+	cache.set("registry.test", nil, errors.New("timeout"), now)
+	if _, ok := cache.get("registry.test", now.Add(dnsNegativeCacheTTL)); ok {
+		t.Fatal("expected a failed lookup to expire after the negative TTL")
+	}
+	cache.set("registry.test", []string{"127.0.0.1"}, nil, now)
+	if _, ok := cache.get("registry.test", now.Add(time.Minute-time.Second)); !ok {
+		t.Fatal("expected a resolved lookup to last for the TTL")
+	}
+	if _, ok := cache.get("registry.test", now.Add(time.Minute)); ok {
+		t.Fatal("expected a resolved lookup to expire after the TTL")
+	}
+
+	cfg = DefaultConfig()
+	cfg.Transport.DNSCacheTTL = "-1s"
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "dns_cache_ttl") {
+		t.Fatalf("expected a negative dns_cache_ttl to be rejected, got %v", err)
+	}
+}
+
+func TestDNSServers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	queries := make(chan string, 16)
+	live := startDNSServer(t, netip.MustParseAddr("127.0.0.1"), queries)
+	// Nothing listens on a closed port, so the first server fails at once.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := closed.LocalAddr().String()
+	closed.Close()
+
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		t.Errorf("terasu resolver used for %s", host)
+		return nil, errors.New("unexpected lookup")
+	}
+	defer func() { lookupUpstream = prev }()
+
+	cfg := DefaultConfig()
+	cfg.DNS = &DNSConfig{Servers: []string{dead, live}, Protocol: "udp", Timeout: "500ms"}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	resp, err := (&http.Client{Transport: NewTransport(runtime.Transport)}).Get("http://registry.test:" + port + "/")
+	if err != nil {
+		t.Fatalf("expected the upstream to be reached through the configured servers: %v", err)
+	}
+	resp.Body.Close()
+	if got := <-queries; got != "registry.test." {
+		t.Fatalf("expected a query for registry.test., got %q", got)
+	}
+
+	// Without dns.protocol the servers are queried over TLS, and the
+	// plaintext server is never asked.
+	dotQueries := make(chan string, 16)
+	dot, caFile := startDoTServer(t, netip.MustParseAddr("127.0.0.1"), dotQueries)
+	for _, server := range []string{dot, "example.com@" + dot} {
+		cfg = DefaultConfig()
+		cfg.Transport.FirstFragmentLen = 3
+		cfg.DNS = &DNSConfig{Servers: []string{server}, CAFile: caFile, Timeout: "500ms"}
+		runtime, err = cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		resp, err = (&http.Client{Transport: NewTransport(runtime.Transport)}).Get("http://dot.test:" + port + "/")
+		if err != nil {
+			t.Fatalf("%s: expected the upstream to be reached over DoT: %v", server, err)
+		}
+		resp.Body.Close()
+		if got := <-dotQueries; got != "dot.test." {
+			t.Fatalf("%s: expected a query for dot.test., got %q", server, got)
+		}
+	}
+	// A server whose certificate does not match its name is not trusted.
+	cfg = DefaultConfig()
+	cfg.DNS = &DNSConfig{Servers: []string{"dns.test@" + dot}, CAFile: caFile, Timeout: "500ms"}
+	runtime, err = cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	if resp, err := (&http.Client{Transport: NewTransport(runtime.Transport)}).Get("http://mismatch.test:" + port + "/"); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a DoT server with the wrong certificate name to be rejected")
+	}
+	select {
+	case got := <-queries:
+		t.Fatalf("expected no plaintext queries, got %q", got)
+	default:
+	}
+
+	for _, tc := range []struct {
+		dns  DNSConfig
+		want string
+	}{
+		{DNSConfig{Servers: []string{"8.8.8.8"}}, "dns.servers[0]"},
+		{DNSConfig{Servers: []string{"1.1.1.1:53", ":53"}}, "dns.servers[1]: missing host"},
+		{DNSConfig{Servers: []string{"1.1.1.1:dns"}}, `dns.servers[0]: invalid port "dns"`},
+		{DNSConfig{Servers: []string{"1.1.1.1:53"}, Timeout: "0s"}, "dns.timeout must be > 0"},
+		{DNSConfig{Servers: []string{"@1.1.1.1:853"}}, "dns.servers[0]: empty server name"},
+		{DNSConfig{Servers: []string{"1.1.1.1:853"}, Protocol: "https"}, `dns.protocol: unknown protocol "https"`},
+		{DNSConfig{Servers: []string{"1.1.1.1:853"}, CAFile: "/nonexistent/ca.pem"}, "dns.ca_file"},
+	} {
+		cfg := DefaultConfig()
+		cfg.DNS = &tc.dns
+		if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%+v: expected %q, got %v", tc.dns, tc.want, err)
+		}
+	}
+}
+
+// startDNSServer answers every A query with addr and every other query with
+// an empty answer, sending the queried names to queries.
+func startDNSServer(t *testing.T, addr netip.Addr, queries chan<- string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen dns: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if out := answerDNSQuery(buf[:n], addr, queries); out != nil {
+				conn.WriteTo(out, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startDoTServer is startDNSServer over TLS with the httptest certificate,
+// which is valid for 127.0.0.1 and example.com. It returns the address and a
+// CA file trusting the certificate.
+func startDoTServer(t *testing.T, addr netip.Addr, queries chan<- string) (string, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.StartTLS()
+	certificates := srv.TLS.Certificates
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	srv.Close()
+	caFile := filepath.Join(t.TempDir(), "dns-ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certificates})
+	if err != nil {
+		t.Fatalf("listen dot: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size [2]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					out := answerDNSQuery(buf, addr, queries)
+					if out == nil {
+						return
+					}
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), caFile
+}
+
+func answerDNSQuery(query []byte, addr netip.Addr, queries chan<- string) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true, RecursionDesired: msg.RecursionDesired},
+		Questions: msg.Questions,
+	}
+	if q.Type == dnsmessage.TypeA {
+		select {
+		case queries <- q.Name.String():
+		default:
+		}
+		reply.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: addr.As4()},
+		}}
+	}
+	out, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func TestTransportBufferSizes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Transport.FirstFragmentLen = 3
+	cfg.Transport.ReadBufferSize = 64 << 10
+	cfg.Transport.WriteBufferSize = 16 << 10
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	rt := NewTransport(runtime.Transport).(*fallbackRoundTripper)
+	transports := []http.RoundTripper{rt.primary}
+	transports = append(transports, rt.fallbacks...)
+	if len(transports) < 2 {
+		t.Fatalf("expected fallback transports, got %d transports", len(transports))
+	}
+	for i, tr := range transports {
+		base := tr.(*http.Transport)
+		if base.ReadBufferSize != 64<<10 || base.WriteBufferSize != 16<<10 {
+			t.Fatalf("transport %d: got read=%d write=%d", i, base.ReadBufferSize, base.WriteBufferSize)
+		}
+	}
+
+	cfg.Transport.ReadBufferSize = 100
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "read_buffer_size") {
+		t.Fatalf("expected read_buffer_size bound error, got %v", err)
+	}
+}
+
+func BenchmarkTransportBufferSizes(b *testing.B) {
+	payload := make([]byte, 8<<20)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	for _, size := range []int{0, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("read=%d", size), func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.Transport.ReadBufferSize = size
+			runtime, err := cfg.Runtime()
+			if err != nil {
+				b.Fatalf("runtime config: %v", err)
+			}
+			client := &http.Client{Transport: NewTransport(runtime.Transport)}
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(upstream.URL)
+				if err != nil {
+					b.Fatalf("get: %v", err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+// rejectFragmentedHello forwards connections to target unless the first TLS
+// record is shorter than any real ClientHello, as a censoring middlebox that
+// cannot reassemble fragments would.
+func rejectFragmentedHello(t *testing.T, target string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(client, header); err != nil {
+					return
+				}
+				if int(header[3])<<8|int(header[4]) < 64 {
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				upstream.Write(header)
+				go io.Copy(upstream, client)
+				io.Copy(client, upstream)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestHandshakePathPlainFallback(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	ln := rejectFragmentedHello(t, upstream.Listener.Addr().String())
+	defer ln.Close()
+
+	cfg := DefaultConfig()
+	cfg.Transport.FirstFragmentLen = 3
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	m := newMetrics(nil)
+	var logs syncBuffer
+	observer := &dialObserver{metrics: m, logger: newStructuredLoggerTo(&logs, levelDebug)}
+	transport := newBaseTransport(runtime.Transport, nil, observer)
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+	transport.TLSClientConfig.RootCAs = pool
+
+	// Only the pooled connection counts as closed by a sweep, not the
+	// rejected fragmented attempt before it.
+	closedBefore := metricValue(t, m, "rmirror_idle_connections_closed_total", nil)
+	observer.sweeping.Add(1)
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	transport.CloseIdleConnections()
+	observer.sweeping.Add(-1)
+	if got := metricValue(t, m, "rmirror_idle_connections_closed_total", nil) - closedBefore; got != 1 {
+		t.Fatalf("expected one closed idle connection, got %v", got)
+	}
+
+	if got := metricValue(t, m, "rmirror_tls_handshake_path_total", map[string]string{"path": "plain_fallback"}); got != 1 {
+		t.Fatalf("expected one plain_fallback handshake, got %v", got)
+	}
+	found := false
+	for _, entry := range logs.entries(t) {
+		if entry["msg"] == "tls handshake" && entry["path"] == "plain_fallback" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a tls handshake debug log for the plain fallback")
+	}
+}
+
+func TestTLSVersionRange(t *testing.T) {
+	newUpstream := func(min, max uint16) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		srv.TLS = &tls.Config{MinVersion: min, MaxVersion: max}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	legacy := newUpstream(tls.VersionTLS10, tls.VersionTLS11)
+	modern := newUpstream(tls.VersionTLS13, tls.VersionTLS13)
+	get := func(minVersion, maxVersion string, upstream *httptest.Server) error {
+		cfg := DefaultConfig()
+		cfg.Transport.TLSMinVersion = minVersion
+		cfg.Transport.TLSMaxVersion = maxVersion
+		cfg.Transport.InsecureSkipVerify = true
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		resp, err := (&http.Client{Transport: NewTransport(runtime.Transport)}).Get(upstream.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get("", "", legacy); err == nil {
+		t.Fatalf("expected the default minimum of 1.2 to reject a TLS 1.1 upstream")
+	}
+	if err := get("1.0", "", legacy); err != nil {
+		t.Fatalf("expected tls_min_version 1.0 to reach a TLS 1.1 upstream, got %v", err)
+	}
+	if err := get("1.3", "", modern); err != nil {
+		t.Fatalf("expected tls_min_version 1.3 to reach a TLS 1.3 upstream, got %v", err)
+	}
+	if err := get("1.3", "", legacy); err == nil {
+		t.Fatalf("expected tls_min_version 1.3 to reject a TLS 1.1 upstream")
+	}
+	if err := get("", "1.2", modern); err == nil {
+		t.Fatalf("expected tls_max_version 1.2 to reject a TLS 1.3-only upstream")
+	}
+
+	for _, tc := range []struct{ min, max, want string }{
+		{"1.4", "", `tls_min_version: unknown version "1.4"`},
+		{"", "TLS1.3", `tls_max_version: unknown version "TLS1.3"`},
+		{"1.3", "1.2", "tls_min_version 1.3 is above tls_max_version 1.2"},
+	} {
+		cfg := DefaultConfig()
+		cfg.Transport.TLSMinVersion = tc.min
+		cfg.Transport.TLSMaxVersion = tc.max
+		if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("min %q max %q: expected %q, got %v", tc.min, tc.max, tc.want, err)
+		}
+	}
+}
+
+func TestRouteSNIOverride(t *testing.T) {
+	serverNames := make(chan string, 4)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	upstream.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}}
+	upstream.StartTLS()
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+
+	var lookedUp []string
+	prev := lookupUpstream
+	lookupUpstream = func(ctx context.Context, host string) ([]string, error) {
+		lookedUp = append(lookedUp, host)
+		return []string{"127.0.0.1"}, nil
+	}
+	defer func() { lookupUpstream = prev }()
+
+	get := func(sni string) error {
+		cfg := DefaultConfig()
+		cfg.Routes = []RouteConfig{{Name: "cdn", PublicPrefix: "/", Upstream: "https://cdn.test:" + port, Transport: &RouteTransportConfig{CAFile: caFile, SNI: sni}}}
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		rt, _, err := runtime.routeTransport(cfg.Routes[0])
+		if err != nil {
+			t.Fatalf("route transport: %v", err)
+		}
+		resp, err := (&http.Client{Transport: NewTransport(rt)}).Get("https://cdn.test:" + port + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The test certificate is issued for example.com, so verification only
+	// passes when the override is also the name the certificate is checked
+	// against.
+	if err := get("example.com"); err != nil {
+		t.Fatalf("expected the SNI override to reach the upstream, got %v", err)
+	}
+	if got := <-serverNames; got != "example.com" {
+		t.Fatalf("expected handshake ServerName example.com, got %q", got)
+	}
+	if len(lookedUp) != 1 || lookedUp[0] != "cdn.test" {
+		t.Fatalf("expected DNS to stay keyed on the upstream host, got %v", lookedUp)
+	}
+
+	if err := get(""); err == nil {
+		t.Fatalf("expected the upstream host to fail verification without the override")
+	}
+	if got := <-serverNames; got != "cdn.test" {
+		t.Fatalf("expected handshake ServerName cdn.test without override, got %q", got)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Routes = []RouteConfig{{Name: "cdn", PublicPrefix: "/", Upstream: "https://cdn.test", Transport: &RouteTransportConfig{SNI: "example.com:443"}}}
+	if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "routes[0].transport.sni") {
+		t.Fatalf("expected sni with a port to be rejected, got %v", err)
+	}
+}
+
+func TestCAFileAndInsecureSkipVerify(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	get := func(rt http.RoundTripper) error {
+		resp, err := (&http.Client{Transport: rt}).Get(upstream.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	cfg := DefaultConfig()
+	insecure := true
+	cfg.Routes = []RouteConfig{
+		{Name: "private", PublicPrefix: "/private", Upstream: upstream.URL, Transport: &RouteTransportConfig{CAFile: caFile}},
+		{Name: "staging", PublicPrefix: "/staging", Upstream: upstream.URL, Transport: &RouteTransportConfig{InsecureSkipVerify: &insecure}},
+		{Name: "public", PublicPrefix: "/", Upstream: upstream.URL},
+	}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	var unknown x509.UnknownAuthorityError
+	if err := get(NewTransport(runtime.Transport)); !errors.As(err, &unknown) {
+		t.Fatalf("expected the private CA to be untrusted by default, got %v", err)
+	}
+	for _, route := range cfg.Routes[:2] {
+		rt, _, err := runtime.routeTransport(route)
+		if err != nil {
+			t.Fatalf("%s: route transport: %v", route.Name, err)
+		}
+		if err := get(NewTransport(rt)); err != nil {
+			t.Fatalf("%s: expected the override to reach the upstream, got %v", route.Name, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := newMirror(runtime, NewTransport(runtime.Transport), nil, &out); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"msg":"upstream TLS certificate verification is disabled`)) || !bytes.Contains(out.Bytes(), []byte(`"route":"staging"`)) {
+		t.Fatalf("expected an insecure_skip_verify warning for the staging route, got %s", out.Bytes())
+	}
+
+	for _, bad := range []string{filepath.Join(t.TempDir(), "missing.pem"), writeConfigFile(t, "empty.pem", "not a certificate")} {
+		cfg := DefaultConfig()
+		cfg.Transport.CAFile = bad
+		if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "ca_file") {
+			t.Fatalf("%s: expected ca_file error, got %v", bad, err)
+		}
+	}
+}
+
+// startConnectProxy runs a minimal http proxy that tunnels CONNECT requests
+// and answers plain requests itself, recording what it was asked for.
+func startConnectProxy(t *testing.T, requests chan<- *http.Request) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requests <- req
+				if req.Method != http.MethodConnect {
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nX-Proxied: 1\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startSocks5Proxy runs a minimal no-auth SOCKS5 proxy, recording the host
+// each CONNECT asked for.
+func startSocks5Proxy(t *testing.T, hosts chan<- string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				hosts <- host
+				target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestUpstreamHostPolicyThroughHTTPProxy(t *testing.T) {
+	requests := make(chan *http.Request, 4)
+	proxy := startConnectProxy(t, requests)
+	defer proxy.Close()
+
+	cfg := DefaultConfig()
+	cfg.Transport.ProxyURL = "http://" + proxy.Addr().String()
+	cfg.DeniedUpstreamHosts = []string{"denied.example"}
+	runtime, err := cfg.Runtime()
+	if err != nil {
+		t.Fatalf("runtime config: %v", err)
+	}
+	m := newMetrics(nil)
+	client := &http.Client{Transport: newBaseTransport(runtime.Transport, nil, &dialObserver{metrics: m})}
+
+	for url, reason := range map[string]string{
+		"http://denied.example/v2/":         blockedDenied,
+		"http://169.254.169.254/latest/":    blockedLinkLocal,
+		"http://sub.denied.example.com/v2/": "",
+	} {
+		resp, err := client.Get(url)
+		if reason == "" {
+			if err != nil {
+				t.Fatalf("%s: expected the proxy to be used, got %v", url, err)
+			}
+			resp.Body.Close()
+			<-requests
+			continue
+		}
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("%s: expected the request to be blocked", url)
+		}
+		if !isBlockedUpstream(err) {
+			t.Fatalf("%s: expected a blocked upstream error, got %v", url, err)
+		}
+		if got := metricValue(t, m, "rmirror_blocked_dials_total", map[string]string{"reason": reason}); got != 1 {
+			t.Fatalf("%s: expected one blocked dial for %s, got %v", url, reason, got)
+		}
+	}
+	select {
+	case req := <-requests:
+		t.Fatalf("expected blocked upstreams to never reach the proxy, got %s %s", req.Method, req.RequestURI)
+	default:
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "tls")
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	newTransport := func(proxyURL string) (*http.Transport, *metrics) {
+		cfg := DefaultConfig()
+		cfg.Transport.FirstFragmentLen = 3
+		cfg.Transport.ProxyURL = proxyURL
+		runtime, err := cfg.Runtime()
+		if err != nil {
+			t.Fatalf("runtime config: %v", err)
+		}
+		m := newMetrics(nil)
+		transport := newBaseTransport(runtime.Transport, nil, &dialObserver{metrics: m})
+		pool := x509.NewCertPool()
+		pool.AddCert(upstream.Certificate())
+		transport.TLSClientConfig.RootCAs = pool
+		return transport, m
+	}
+	get := func(transport *http.Transport, url string) *http.Response {
+		t.Helper()
+		resp, err := (&http.Client{Transport: transport}).Get(url)
+		if err != nil {
+			t.Fatalf("get %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	requests := make(chan *http.Request, 4)
+	httpProxy := startConnectProxy(t, requests)
+	defer httpProxy.Close()
+	transport, m := newTransport("http://user:secret@" + httpProxy.Addr().String())
+	if resp := get(transport, "https://"+upstreamHost+"/v2/"); resp.Header.Get("X-Upstream") != "tls" {
+		t.Fatalf("expected the upstream response through the tunnel, got %v", resp.Header)
+	}
+	connect := <-requests
+	if connect.Method != http.MethodConnect || connect.Host != upstreamHost {
+		t.Fatalf("expected CONNECT %s, got %s %s", upstreamHost, connect.Method, connect.Host)
+	}
+	if got := connect.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Fatalf("unexpected Proxy-Authorization %q", got)
+	}
+	if got := metricValue(t, m, "rmirror_tls_handshake_path_total", map[string]string{"path": "fragmented"}); got != 1 {
+		t.Fatalf("expected the tunneled handshake to be fragmented, got %v", got)
+	}
+	if resp := get(transport, "http://plain.example/v2/"); resp.Header.Get("X-Proxied") != "1" {
+		t.Fatalf("expected a plain http upstream to be sent to the proxy, got %v", resp.Header)
+	}
+	if plain := <-requests; plain.Method != http.MethodGet || plain.RequestURI != "http://plain.example/v2/" {
+		t.Fatalf("expected an absolute-form GET, got %s %s", plain.Method, plain.RequestURI)
+	}
+
+	hosts := make(chan string, 4)
+	socks := startSocks5Proxy(t, hosts)
+	defer socks.Close()
+	transport, _ = newTransport("socks5h://" + socks.Addr().String())
+	if resp := get(transport, "https://"+upstreamHost+"/v2/"); resp.Header.Get("X-Upstream") != "tls" {
+		t.Fatalf("expected the upstream response through socks5, got %v", resp.Header)
+	}
+	if host := <-hosts; host != "127.0.0.1" {
+		t.Fatalf("unexpected socks5 target %q", host)
+	}
+
+	for _, raw := range []string{"https://proxy.example", "ftp://proxy.example", "http://"} {
+		cfg := DefaultConfig()
+		cfg.Transport.ProxyURL = raw
+		if _, err := cfg.Runtime(); err == nil || !strings.Contains(err.Error(), "proxy_url") {
+			t.Fatalf("%q: expected proxy_url error, got %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// upstreamTarget is one upstream host together with the transport its
+// routes send through.
+type upstreamTarget struct {
+	scheme    string
+	host      string
+	transport http.RoundTripper
+}
+
+// upstreamTargets lists each unique upstream host and transport pair across
+// the routes.
+func (m *Mirror) upstreamTargets() []upstreamTarget {
+	seen := make(map[upstreamTarget]struct{})
+	var targets []upstreamTarget
+	for _, r := range m.routes {
+		transport := m.transport
+		if r.transport != nil {
+			transport = r.transport
+		}
+		target := upstreamTarget{scheme: r.upstream.Scheme, host: r.upstream.Host, transport: transport}
+		if _, ok := seen[target]; ok {
+			continue
+		}
+		seen[target] = struct{}{}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Warmup opens one pooled connection per unique upstream host.
+func (m *Mirror) Warmup(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range m.upstreamTargets() {
+		wg.Add(1)
+		go func(target upstreamTarget) {
+			defer wg.Done()
+			err := warmupHost(ctx, target.transport, target.scheme+"://"+target.host)
+			m.metrics.observeWarmup(target.host, err)
+			if m.logger == nil {
+				return
+			}
+			if err != nil {
+				m.logger.Error("warmup failed", map[string]any{"upstream": target.host, "error": err.Error()})
+				return
+			}
+			m.logger.Info("warmup ok", map[string]any{"upstream": target.host})
+		}(target)
+	}
+	wg.Wait()
+}
+
+func warmupHost(ctx context.Context, transport http.RoundTripper, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}